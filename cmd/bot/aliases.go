@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/sound"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Failed lookups of the same name before moderators are offered an alias
+	ALIAS_SUGGEST_THRESHOLD = 3
+
+	// Most missed names `!alias suggest` lists
+	ALIAS_SUGGESTIONS = 5
+)
+
+func aliasKey(coll, name string) string {
+	return coll + ":" + name
+}
+
+func missesKey(gid string) string {
+	return fmt.Sprintf("airhorn:guild:%s:misses", gid)
+}
+
+// Returns the sound called name in the collection, following this guild's aliases
+func resolveSound(gs *GuildSettings, coll *sound.Collection, name string) *sound.Sound {
+	if s := coll.Find(name); s != nil {
+		return s
+	}
+
+	if target, exists := gs.Aliases[aliasKey(coll.Prefix, name)]; exists {
+		return coll.Find(target)
+	}
+	return nil
+}
+
+// Counts a lookup of a sound that doesn't exist. Once a name has been missed
+// ALIAS_SUGGEST_THRESHOLD times, guilds with a moderation channel are offered
+// a button aliasing it to the closest sound.
+func recordFailedLookup(guild *discordgo.Guild, coll *sound.Collection, name string) {
+	// Names with a colon can't be put in a button's custom id
+	if rcli == nil || strings.Contains(name, ":") {
+		return
+	}
+
+	count, err := rcli.ZIncrBy(missesKey(guild.ID), 1, aliasKey(coll.Prefix, name)).Result()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"error": err,
+		}).Warning("Failed to track failed sound lookup")
+		return
+	}
+
+	modChannel := getGuildSettings(guild.ID).ModChannel
+	if int(count) != ALIAS_SUGGEST_THRESHOLD || modChannel == "" {
+		return
+	}
+
+	target := closestSound(coll, name)
+	if target == nil {
+		return
+	}
+
+	sendModerationNotice(modChannel, "Alias suggestion",
+		fmt.Sprintf("`!%s %s` was tried %d times but there is no such sound, did they mean **%s**?", coll.Prefix, name, int(count), target.Name),
+		aliasComponents([]*aliasSuggestion{{coll.Prefix, name, target.Name}}))
+}
+
+// A missed name and the sound it probably meant
+type aliasSuggestion struct {
+	Collection string
+	Alias      string
+	Sound      string
+}
+
+// Returns a button creating each suggested alias
+func aliasComponents(suggestions []*aliasSuggestion) []discordgo.MessageComponent {
+	buttons := make([]discordgo.MessageComponent, len(suggestions))
+	for i, sg := range suggestions {
+		buttons[i] = discordgo.Button{
+			Label:    fmt.Sprintf("Alias %s to %s", sg.Alias, sg.Sound),
+			Style:    discordgo.PrimaryButton,
+			CustomID: componentID("alias", sg.Collection, sg.Alias, sg.Sound),
+		}
+	}
+
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{Components: buttons},
+	}
+}
+
+// Returns the sound in the collection that looks most like name, preferring a
+// long shared prefix and then the smallest edit distance. nil is returned if
+// nothing is close.
+func closestSound(coll *sound.Collection, name string) *sound.Sound {
+	var (
+		best               *sound.Sound
+		bestPrefix, bestED int
+	)
+
+	for _, s := range coll.Sounds {
+		prefix := commonPrefix(s.Name, name)
+		ed := editDistance(s.Name, name)
+		if prefix < 3 && ed > 2 {
+			continue
+		}
+
+		if best == nil || prefix > bestPrefix || (prefix == bestPrefix && ed < bestED) {
+			best, bestPrefix, bestED = s, prefix, ed
+		}
+	}
+	return best
+}
+
+func commonPrefix(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// Returns the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// Handles `!alias list`, `!alias suggest`, `!alias add <collection> <alias> <sound>`
+// and `!alias remove <collection> <alias>`
+func handleAliasCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, parts []string, dryRun bool) {
+	if len(parts) < 2 || parts[1] == "list" {
+		displayAliases(m.ChannelID, getGuildSettings(guild.ID))
+		return
+	}
+
+	if parts[1] == "suggest" {
+		suggestAliases(m.ChannelID, guild)
+		return
+	}
+
+	var update func(gs *GuildSettings)
+	switch {
+	case parts[1] == "add" && len(parts) == 5:
+		coll := findCollection(parts[2])
+		if coll == nil {
+			discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("There is no collection %s", parts[2]))
+			return
+		}
+
+		if coll.Find(parts[4]) == nil {
+			discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("There is no sound %s in %s", parts[4], coll.Prefix))
+			return
+		}
+
+		if coll.Find(parts[3]) != nil {
+			discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("%s is already a sound in %s", parts[3], coll.Prefix))
+			return
+		}
+
+		update = func(gs *GuildSettings) {
+			setAlias(gs, coll.Prefix, parts[3], parts[4])
+		}
+	case parts[1] == "remove" && len(parts) == 4:
+		update = func(gs *GuildSettings) {
+			delete(gs.Aliases, aliasKey(parts[2], parts[3]))
+		}
+	default:
+		discord.ChannelMessageSend(m.ChannelID, "Usage: `!alias [list|suggest]`, `!alias add <collection> <alias> <sound>` or `!alias remove <collection> <alias>`")
+		return
+	}
+
+	if dryRun {
+		if changes, err := settingsChanges(guild.ID, update); err == nil {
+			reportDryRun(m.ChannelID, changes)
+		}
+		return
+	}
+
+	if _, err := updateGuildSettings(guild.ID, update); err != nil {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"error": err,
+		}).Error("Failed to save sound alias")
+		return
+	}
+	discord.ChannelMessageSend(m.ChannelID, ":ok_hand:")
+}
+
+func setAlias(gs *GuildSettings, coll, alias, target string) {
+	if gs.Aliases == nil {
+		gs.Aliases = make(map[string]string)
+	}
+	gs.Aliases[aliasKey(coll, alias)] = target
+}
+
+func displayAliases(cid string, gs *GuildSettings) {
+	if len(gs.Aliases) == 0 {
+		discord.ChannelMessageSend(cid, "There are no aliases, add one with `!alias add <collection> <alias> <sound>` or see what people are looking for with `!alias suggest`")
+		return
+	}
+
+	keys := make([]string, 0, len(gs.Aliases))
+	for key := range gs.Aliases {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	lines := make([]string, len(keys))
+	for i, key := range keys {
+		parts := strings.SplitN(key, ":", 2)
+		lines[i] = fmt.Sprintf("`!%s %s` plays **%s**", parts[0], parts[1], gs.Aliases[key])
+	}
+	discord.ChannelMessageSend(cid, strings.Join(lines, "\n"))
+}
+
+// Lists the most missed sound names, with a button aliasing each to the
+// closest sound where there is one
+func suggestAliases(cid string, guild *discordgo.Guild) {
+	if rcli == nil {
+		discord.ChannelMessageSend(cid, "Alias suggestions require a redis connection")
+		return
+	}
+
+	misses, err := rcli.ZRevRangeWithScores(missesKey(guild.ID), 0, ALIAS_SUGGESTIONS-1).Result()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"error": err,
+		}).Warning("Failed to fetch failed sound lookups")
+		return
+	}
+
+	if len(misses) == 0 {
+		discord.ChannelMessageSend(cid, "Nobody has tried to play a sound that doesn't exist")
+		return
+	}
+
+	lines := make([]string, 0, len(misses))
+	suggestions := make([]*aliasSuggestion, 0)
+	for _, miss := range misses {
+		member, _ := miss.Member.(string)
+		parts := strings.SplitN(member, ":", 2)
+		if len(parts) < 2 {
+			continue
+		}
+		prefix, name := parts[0], parts[1]
+
+		line := fmt.Sprintf("`!%s %s` - tried %d times", prefix, name, int(miss.Score))
+		if coll := findCollection(prefix); coll != nil {
+			if target := closestSound(coll, name); target != nil {
+				line += fmt.Sprintf(", probably **%s**", target.Name)
+				suggestions = append(suggestions, &aliasSuggestion{prefix, name, target.Name})
+			}
+		}
+		lines = append(lines, line)
+	}
+
+	var components []discordgo.MessageComponent
+	if len(suggestions) > 0 {
+		components = aliasComponents(suggestions)
+	}
+	sendModerationNotice(cid, "Sounds people looked for", strings.Join(lines, "\n"), components)
+}
+
+// Handles the create alias buttons, args are the collection, alias and sound
+func handleAliasClick(s *discordgo.Session, i *discordgo.InteractionCreate, args []string) {
+	if len(args) < 3 || i.GuildID == "" {
+		return
+	}
+
+	guild, _ := discord.State.Guild(i.GuildID)
+	if guild == nil {
+		return
+	}
+
+	user := interactionUser(i)
+	if !isGuildAdmin(guild, user.ID, i.ChannelID) {
+		respondEphemeral(s, i, "Only server admins can create aliases")
+		return
+	}
+
+	coll := findCollection(args[0])
+	if coll == nil || coll.Find(args[2]) == nil {
+		respondEphemeral(s, i, "That sound no longer exists")
+		return
+	}
+
+	_, err := updateGuildSettings(guild.ID, func(gs *GuildSettings) {
+		setAlias(gs, args[0], args[1], args[2])
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"error": err,
+		}).Error("Failed to save sound alias")
+		respondEphemeral(s, i, "Failed to save the alias, try again later")
+		return
+	}
+
+	// The name works now, so it shouldn't be suggested again
+	if rcli != nil {
+		rcli.ZRem(missesKey(guild.ID), aliasKey(args[0], args[1]))
+	}
+
+	log.WithFields(log.Fields{
+		"guild": guild.ID,
+		"alias": aliasKey(args[0], args[1]),
+		"sound": args[2],
+		"admin": user.ID,
+	}).Info("Created sound alias")
+
+	resolveModerationNotice(s, i, fmt.Sprintf("`!%s %s` now plays **%s**, added by <@%s>", args[0], args[1], args[2], user.ID))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Closed to stop whatever is playing in a guild, keyed by guild id
+	playbackStops     map[string]chan struct{} = make(map[string]chan struct{})
+	playbackStopsLock sync.Mutex
+)
+
+// Returns the channel that is closed when the guild's playback should stop
+func playbackStop(gid string) <-chan struct{} {
+	playbackStopsLock.Lock()
+	defer playbackStopsLock.Unlock()
+
+	stop, exists := playbackStops[gid]
+	if !exists {
+		stop = make(chan struct{})
+		playbackStops[gid] = stop
+	}
+	return stop
+}
+
+// Stops the sound playing in a guild, playSound then drops the queue and leaves
+func stopPlayback(gid string) {
+	playbackStopsLock.Lock()
+	defer playbackStopsLock.Unlock()
+
+	if stop, exists := playbackStops[gid]; exists {
+		close(stop)
+		delete(playbackStops, gid)
+	}
+}
+
+// Returns the number of people (not bots) in a voice channel
+func listeners(guild *discordgo.Guild, cid string) int {
+	count := 0
+	for _, vs := range guild.VoiceStates {
+		if vs.ChannelID != cid {
+			continue
+		}
+
+		if member := getMember(guild, vs.UserID); member != nil && member.User != nil && member.User.Bot {
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// Stops playing once everyone has left the bot's voice channel, rather than
+// horning through the rest of the queue into an empty room
+func onVoiceStateLeave(s *discordgo.Session, vs *discordgo.VoiceStateUpdate) {
+	if vs.BeforeUpdate == nil || vs.BeforeUpdate.ChannelID == "" || vs.BeforeUpdate.ChannelID == vs.ChannelID {
+		return
+	}
+
+	s.RLock()
+	vc := s.VoiceConnections[vs.GuildID]
+	s.RUnlock()
+	if vc == nil || vc.ChannelID != vs.BeforeUpdate.ChannelID {
+		return
+	}
+
+	guild, _ := s.State.Guild(vs.GuildID)
+	if guild == nil || listeners(guild, vc.ChannelID) > 0 {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"guild":   vs.GuildID,
+		"channel": vc.ChannelID,
+		"queued":  queues.Len(vs.GuildID),
+	}).Info("Everyone left the voice channel, stopping playback")
+
+	queues.Remove(vs.GuildID)
+	stopBomb(vs.GuildID)
+	stopPlayback(vs.GuildID)
+	dropIdleVoice(vs.GuildID)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/noisemaster/airhornbot/pkg/sound"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Number of sound files fetched from the asset server at once
+	ASSET_FETCH_WORKERS = 8
+)
+
+var (
+	// Base url missing sound files are fetched from, empty disables fetching.
+	// Files are requested as <ASSET_URL>/<file>.dca, so this can be another
+	// instance serving its assets or an object store bucket.
+	ASSET_URL string
+
+	assetClient = &http.Client{Timeout: time.Minute}
+)
+
+// Serves the DCA files in the audio directory over http for other instances to fetch
+func serveAssets(addr string) {
+	files := http.FileServer(http.Dir("audio"))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, ".dca") {
+			http.NotFound(w, r)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+
+	log.WithFields(log.Fields{
+		"addr": addr,
+	}).Info("Serving sound assets")
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.WithFields(log.Fields{
+			"addr":  addr,
+			"error": err,
+		}).Error("Failed to serve sound assets")
+	}
+}
+
+// Downloads a single file from the asset server, writing it to path once it
+// has been fully received
+func fetchAsset(path string) error {
+	resp, err := assetClient.Get(strings.TrimSuffix(ASSET_URL, "/") + "/" + filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("asset server returned %s", resp.Status)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a failed download never leaves a partial sound behind
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".fetch")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, resp.Body)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Fetches every sound file in the collections that isn't on disk from ASSET_URL
+func fetchMissingAssets(colls []*sound.Collection) {
+	if ASSET_URL == "" {
+		return
+	}
+
+	missing := make(chan string)
+	var wg sync.WaitGroup
+
+	for i := 0; i < ASSET_FETCH_WORKERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range missing {
+				if err := fetchAsset(path); err != nil {
+					log.WithFields(log.Fields{
+						"path":  path,
+						"error": err,
+					}).Warning("Failed to fetch sound from the asset server")
+				}
+			}
+		}()
+	}
+
+	count := 0
+	for _, coll := range colls {
+		for _, s := range coll.Sounds {
+			path := coll.SoundPath(s)
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				missing <- path
+				count++
+			}
+		}
+	}
+	close(missing)
+	wg.Wait()
+
+	if count > 0 {
+		log.WithFields(log.Fields{
+			"sounds": count,
+		}).Info("Finished fetching missing sounds from the asset server")
+	}
+}
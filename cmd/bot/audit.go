@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How often queued audit log lines are sent, every guild gets at most one
+	// message per interval
+	AUDIT_FLUSH_INTERVAL = time.Second * 10
+
+	// Longest audit log message, discord rejects anything over 2000 characters
+	AUDIT_MAX_MESSAGE = 1900
+)
+
+var (
+	// Audit log lines waiting to be sent, keyed by audit channel
+	auditLines     map[string][]string = make(map[string][]string)
+	auditLinesLock sync.Mutex
+)
+
+// Play hook queueing an audit log line for guilds that have an audit channel
+func auditPlay(play *queue.Play) {
+	cid := getGuildSettings(play.GuildID).AuditChannel
+	if cid == "" {
+		return
+	}
+
+	line := fmt.Sprintf("<@%s> played %s:%s in <#%s> (%s, `%s`)", play.UserID, play.Collection, play.Sound.Name, play.ChannelID, play.Source, play.ID)
+
+	auditLinesLock.Lock()
+	auditLines[cid] = append(auditLines[cid], line)
+	auditLinesLock.Unlock()
+}
+
+// Sends the queued audit log lines every AUDIT_FLUSH_INTERVAL, batching them
+// into as few messages as possible to stay clear of rate limits
+func flushAuditLog() {
+	for {
+		time.Sleep(AUDIT_FLUSH_INTERVAL)
+
+		auditLinesLock.Lock()
+		pending := auditLines
+		auditLines = make(map[string][]string)
+		auditLinesLock.Unlock()
+
+		for cid, lines := range pending {
+			for _, message := range batchLines(lines, AUDIT_MAX_MESSAGE) {
+				_, err := discord.ChannelMessageSendComplex(cid, &discordgo.MessageSend{
+					Content: message,
+
+					// Log lines mention users without pinging them
+					AllowedMentions: &discordgo.MessageAllowedMentions{},
+				})
+				if err != nil {
+					log.WithFields(log.Fields{
+						"channel": cid,
+						"error":   err,
+					}).Warning("Failed to send audit log")
+					break
+				}
+			}
+		}
+	}
+}
+
+// Joins lines into messages of at most max characters
+func batchLines(lines []string, max int) []string {
+	messages := make([]string, 0)
+	current := ""
+	for _, line := range lines {
+		if current != "" && len(current)+len(line)+1 > max {
+			messages = append(messages, current)
+			current = ""
+		}
+
+		if current != "" {
+			current += "\n"
+		}
+		current += line
+	}
+
+	if current != "" {
+		messages = append(messages, current)
+	}
+	return messages
+}
+
+// Handles `!auditlog [#channel|off]`, showing or changing where plays are logged
+func handleAuditLogCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, parts []string, dryRun bool) {
+	if len(parts) < 2 {
+		current := "off"
+		if cid := getGuildSettings(guild.ID).AuditChannel; cid != "" {
+			current = "<#" + cid + ">"
+		}
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Plays are logged to %s, change it with `!auditlog #channel` or `!auditlog off`", current))
+		return
+	}
+
+	handleSettingsCommand(m, guild, append([]string{"!settings", "set", "auditlog"}, parts[1:]...), dryRun)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// Redis sets of the users and guilds the bot ignores
+const (
+	BLOCKED_USERS_KEY  = "airhorn:blocked:users"
+	BLOCKED_GUILDS_KEY = "airhorn:blocked:guilds"
+)
+
+var (
+	// Blocked users and guilds when there is no redis to remember them in,
+	// keyed by the redis set they'd be in
+	localBlocks     map[string]map[string]bool = make(map[string]map[string]bool)
+	localBlocksLock sync.Mutex
+)
+
+// Returns true if the user or guild was blocked by the owner. Either can be
+// empty, eg. for direct messages. The owner is never blocked.
+func blocked(uid, gid string) bool {
+	if uid == OWNER {
+		return false
+	}
+
+	if rcli == nil {
+		localBlocksLock.Lock()
+		defer localBlocksLock.Unlock()
+		return localBlocks[BLOCKED_USERS_KEY][uid] || localBlocks[BLOCKED_GUILDS_KEY][gid]
+	}
+
+	var user, guild *redis.BoolCmd
+	_, err := rcli.Pipelined(func(pipe *redis.Pipeline) error {
+		user = pipe.SIsMember(BLOCKED_USERS_KEY, uid)
+		guild = pipe.SIsMember(BLOCKED_GUILDS_KEY, gid)
+		return nil
+	})
+	if err != nil {
+		// The blocklist is for the odd abuser, it shouldn't take everyone down with redis
+		log.WithFields(log.Fields{
+			"user":  uid,
+			"guild": gid,
+			"error": err,
+		}).Warning("Failed to check the blocklist")
+		return false
+	}
+	return user.Val() || guild.Val()
+}
+
+func setBlocked(key, id string, block bool) error {
+	if rcli == nil {
+		localBlocksLock.Lock()
+		defer localBlocksLock.Unlock()
+
+		if localBlocks[key] == nil {
+			localBlocks[key] = make(map[string]bool)
+		}
+		if block {
+			localBlocks[key][id] = true
+		} else {
+			delete(localBlocks[key], id)
+		}
+		return nil
+	}
+
+	if block {
+		return rcli.SAdd(key, id).Err()
+	}
+	return rcli.SRem(key, id).Err()
+}
+
+func listBlocked(key string) ([]string, error) {
+	if rcli == nil {
+		localBlocksLock.Lock()
+		defer localBlocksLock.Unlock()
+
+		ids := make([]string, 0, len(localBlocks[key]))
+		for id := range localBlocks[key] {
+			ids = append(ids, id)
+		}
+		return ids, nil
+	}
+	return rcli.SMembers(key).Result()
+}
+
+// Handles `!block user|guild <id>`, `!unblock user|guild <id>` and `!block list`
+func handleBlockCommand(m *discordgo.MessageCreate, parts []string) {
+	if len(parts) == 2 && parts[1] == "list" {
+		displayBlocklist(m.ChannelID)
+		return
+	}
+
+	if len(parts) != 3 || (parts[1] != "user" && parts[1] != "guild") {
+		discord.ChannelMessageSend(m.ChannelID, "Usage: `!block user|guild <id>`, `!unblock user|guild <id>` or `!block list`")
+		return
+	}
+
+	// Mentions work as well as raw ids
+	id := strings.Trim(parts[2], "<@!>")
+	key := BLOCKED_USERS_KEY
+	if parts[1] == "guild" {
+		key = BLOCKED_GUILDS_KEY
+	}
+
+	block := parts[0] == "!block"
+	if err := setBlocked(key, id, block); err != nil {
+		log.WithFields(log.Fields{
+			"id":    id,
+			"error": err,
+		}).Error("Failed to save the blocklist")
+		discord.ChannelMessageSend(m.ChannelID, "Failed to save the blocklist")
+		return
+	}
+
+	action := "unblock"
+	if block {
+		action = "block"
+	}
+	auditOwnerAction(action, parts[1]+" "+id, "ok")
+	discord.ChannelMessageSend(m.ChannelID, ":ok_hand:")
+}
+
+func displayBlocklist(cid string) {
+	users, err := listBlocked(BLOCKED_USERS_KEY)
+	if err != nil {
+		discord.ChannelMessageSend(cid, "Failed to load the blocklist")
+		return
+	}
+
+	guilds, err := listBlocked(BLOCKED_GUILDS_KEY)
+	if err != nil {
+		discord.ChannelMessageSend(cid, "Failed to load the blocklist")
+		return
+	}
+
+	if len(users) == 0 && len(guilds) == 0 {
+		discord.ChannelMessageSend(cid, "Nobody is blocked")
+		return
+	}
+
+	sort.Strings(users)
+	sort.Strings(guilds)
+	discord.ChannelMessageSend(cid, fmt.Sprintf("**users** - %s\n**guilds** - %s", formatIDs(users), formatIDs(guilds)))
+}
+
+func formatIDs(ids []string) string {
+	if len(ids) == 0 {
+		return "none"
+	}
+	return "`" + strings.Join(ids, "`, `") + "`"
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	log "github.com/sirupsen/logrus"
+)
+
+// A bomb going off in a guild
+type bomb struct {
+	stop      chan struct{}
+	remaining int32
+}
+
+var (
+	// The bomb going off in each guild, keyed by guild id
+	bombs     map[string]*bomb = make(map[string]*bomb)
+	bombsLock sync.Mutex
+)
+
+// Returns true if the user may set off bombs. Unlike collections the bomb is
+// closed by default, only admins and roles granted it with `!perms grant @role bomb` can use it.
+func canBomb(guild *discordgo.Guild, uid, cid string) bool {
+	if isGuildAdmin(guild, uid, cid) {
+		return true
+	}
+
+	roles := getGuildSettings(guild.ID).RolePerms[PERM_BOMB]
+	if len(roles) == 0 {
+		return false
+	}
+
+	member := getMember(guild, uid)
+	return member != nil && hasRole(member, roles)
+}
+
+// Handles `!bomb <count> [@user]` and `!bomb stop`
+func handleBombCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, parts []string) {
+	if !canBomb(guild, m.Author.ID, m.ChannelID) {
+		discord.ChannelMessageSend(m.ChannelID, "Only moderators can set off bombs")
+		return
+	}
+
+	if len(parts) < 2 {
+		discord.ChannelMessageSend(m.ChannelID, "Usage: `!bomb <count> [@user]` or `!bomb stop`")
+		return
+	}
+
+	if parts[1] == "stop" {
+		if stopBomb(guild.ID) {
+			discord.ChannelMessageSend(m.ChannelID, ":ok_hand: defused")
+		} else {
+			discord.ChannelMessageSend(m.ChannelID, "There is no bomb going off")
+		}
+		return
+	}
+
+	target := m.Author
+	if len(m.Mentions) > 0 {
+		target = m.Mentions[0]
+	}
+	startBomb(m.ChannelID, guild, target, parts[1])
+}
+
+// Queues count random airhorns in the target's voice channel as a single
+// chain, so the bomb waits its turn in the guild queue and plays in one go.
+// Bombs have a low priority, plays with a higher one queued while a bomb goes
+// off play between its airhorns.
+func startBomb(cid string, guild *discordgo.Guild, target *discordgo.User, cs string) {
+	count, err := strconv.Atoi(cs)
+	max := getGuildSettings(guild.ID).MaxBombSize
+	if err != nil || count < 1 || count > max {
+		discord.ChannelMessageSend(cid, fmt.Sprintf("Bombs on this server can be between 1 and %d airhorns", max))
+		return
+	}
+
+	channel := getCurrentVoiceChannel(target, guild)
+	if channel == nil {
+		discord.ChannelMessageSend(cid, fmt.Sprintf("<@%s> isn't in a voice channel", target.ID))
+		return
+	}
+
+	if eventQuiet(guild.ID, channel.ID) {
+		return
+	}
+
+	b := &bomb{stop: make(chan struct{}), remaining: int32(count)}
+	bombsLock.Lock()
+	if bombs[guild.ID] != nil {
+		bombsLock.Unlock()
+		discord.ChannelMessageSend(cid, "A bomb is already going off, stop it with `!bomb stop`")
+		return
+	}
+	bombs[guild.ID] = b
+	bombsLock.Unlock()
+
+	// A stopped bomb skips the rest of its airhorns
+	skip := func() bool {
+		select {
+		case <-b.stop:
+			return true
+		default:
+		}
+		return false
+	}
+
+	// Every airhorn counts down the bomb once it's over, played or dropped
+	// (full queue, quiet hours, failed voice join), the last one clears it
+	done := func() {
+		if atomic.AddInt32(&b.remaining, -1) == 0 {
+			bombsLock.Lock()
+			if bombs[guild.ID] == b {
+				delete(bombs, guild.ID)
+			}
+			bombsLock.Unlock()
+		}
+	}
+
+	// Resolve the loaded collection, AIRHORN is only the definition
+	airhorn := findCollection(AIRHORN.Prefix)
+	play := newPlay(guild, channel.ID, target.ID, airhorn, nil, queue.SOURCE_BOMB)
+	play.TextChannelID = cid
+	play.Skip = skip
+	play.Done = done
+
+	tail := play
+	for i := 1; i < count; i++ {
+		tail.Next = newPlay(guild, channel.ID, target.ID, airhorn, nil, queue.SOURCE_BOMB)
+		tail = tail.Next
+		tail.TextChannelID = cid
+		tail.Skip = skip
+		tail.Done = done
+	}
+
+	log.WithFields(log.Fields{
+		"guild":  guild.ID,
+		"target": target.ID,
+		"count":  count,
+	}).Info("Bomb queued")
+
+	discord.ChannelMessageSend(cid, ":ok_hand:"+strings.Repeat(":trumpet:", count))
+	go queuePlay(play)
+}
+
+// Stops the bomb going off in a guild, returning false if there isn't one
+func stopBomb(gid string) bool {
+	bombsLock.Lock()
+	defer bombsLock.Unlock()
+
+	b := bombs[gid]
+	if b == nil {
+		return false
+	}
+	close(b.stop)
+	delete(bombs, gid)
+	return true
+}
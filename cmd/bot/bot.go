@@ -2,10 +2,9 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"expvar"
 	"flag"
 	"fmt"
-	"io"
 	"math/rand"
 	"os"
 	"os/signal"
@@ -15,10 +14,13 @@ import (
 	"text/tabwriter"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/bwmarrin/discordgo"
 	"github.com/dustin/go-humanize"
-	redis "gopkg.in/redis.v3"
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	"github.com/noisemaster/airhornbot/pkg/redis"
+	"github.com/noisemaster/airhornbot/pkg/sound"
+	"github.com/noisemaster/airhornbot/pkg/stats"
+	log "github.com/sirupsen/logrus"
 )
 
 var (
@@ -28,413 +30,401 @@ var (
 	// Redis client connection (used for stats)
 	rcli *redis.Client
 
-	// Map of Guild id's to *Play channels, used for queuing and rate-limiting guilds
-	queues map[string]chan *Play = make(map[string]chan *Play)
+	// Records plays in redis, nil unless redis is the stats backend
+	tracker *stats.Tracker
 
-	// Sound encoding settings
-	BITRATE        = 128
-	MAX_QUEUE_SIZE = 6
-
-	// Owner
-	OWNER string
-)
+	// Where plays are recorded, picked with -stats
+	statsSink stats.Sink = stats.NopSink{}
 
-// Play represents an individual use of the !airhorn command
-type Play struct {
-	GuildID   string
-	ChannelID string
-	UserID    string
-	Sound     *Sound
+	// Guild play queues, used for queuing and rate-limiting guilds
+	queues = queue.NewManager(MAX_QUEUE_SIZE)
 
-	// The next play to occur after this, only used for chaining sounds like anotha
-	Next *Play
+	// Id of the last play that started, exported with the other metrics
+	lastPlayID = expvar.NewString("last_play")
 
-	// If true, this was a forced play using a specific airhorn sound name
-	Forced bool
-}
-
-type SoundCollection struct {
-	Prefix    string
-	Commands  []string
-	Sounds    []*Sound
-	ChainWith *SoundCollection
-
-	soundRange int
-}
+	// Default bitrate (in kbps) sounds are encoded at on the fly
+	BITRATE        = 128
+	MAX_QUEUE_SIZE = 6
 
-// Sound represents a sound clip
-type Sound struct {
-	Name string
+	// Times a play is restarted after its voice connection dies
+	VOICE_MAX_RETRIES = 3
 
-	// Weight adjust how likely it is this song will play, higher = more likely
-	Weight int
+	// Functions run as every sound starts playing, and after it finished
+	playStartHooks []func(play *queue.Play)
+	playHooks      []func(play *queue.Play)
 
-	// Delay (in milliseconds) for the bot to wait before sending the disconnect request
-	PartDelay int
+	// Owner
+	OWNER string
+)
 
-	// Buffer to store encoded PCM packets
-	buffer [][]byte
-}
+// Gateway events the bot subscribes to
+const BOT_INTENTS = discordgo.IntentsGuilds |
+	discordgo.IntentsGuildMessages |
+	discordgo.IntentsGuildVoiceStates |
+	discordgo.IntentsDirectMessages |
+	discordgo.IntentsMessageContent |
+	discordgo.IntentsGuildScheduledEvents |
+	discordgo.IntentAutoModerationExecution
 
 // Array of all the sounds we have
-var AIRHORN *SoundCollection = &SoundCollection{
+var AIRHORN *sound.Collection = &sound.Collection{
 	Prefix: "airhorn",
 	Commands: []string{
 		"!airhorn",
 	},
-	Sounds: []*Sound{
-		createSound("default", 1000, 250),
-		createSound("reverb", 800, 250),
-		createSound("spam", 800, 0),
-		createSound("tripletap", 800, 250),
-		createSound("fourtap", 800, 250),
-		createSound("distant", 500, 250),
-		createSound("echo", 500, 250),
-		createSound("clownfull", 250, 250),
-		createSound("clownshort", 250, 250),
-		createSound("clownspam", 250, 0),
-		createSound("highfartlong", 200, 250),
-		createSound("highfartshort", 200, 250),
-		createSound("midshort", 100, 250),
-		createSound("truck", 10, 250),
+	Sounds: []*sound.Sound{
+		sound.New("default", 1000, 250),
+		sound.New("reverb", 800, 250),
+		sound.New("spam", 800, 0),
+		sound.New("tripletap", 800, 250),
+		sound.New("fourtap", 800, 250),
+		sound.New("distant", 500, 250),
+		sound.New("echo", 500, 250),
+		sound.New("clownfull", 250, 250),
+		sound.New("clownshort", 250, 250),
+		sound.New("clownspam", 250, 0),
+		sound.New("highfartlong", 200, 250),
+		sound.New("highfartshort", 200, 250),
+		sound.New("midshort", 100, 250),
+		sound.New("truck", 10, 250).WithCelebration(":truck: :trumpet: :truck: :trumpet: :truck:"),
 	},
 }
-var OVERWATCH *SoundCollection = &SoundCollection{
+var OVERWATCH *sound.Collection = &sound.Collection{
 	Prefix: "owult",
 	Commands: []string{
 		"!overwatch",
 		"!owult",
 	},
-	Sounds: []*Sound{
+	Sounds: []*sound.Sound{
 		//looking for sounds on
 		//http://rpboyer15.github.io/sounds-of-overwatch/
-		createSound("bastion", 1000, 250),
-		createSound("dva_enemy", 1000, 250),
-		createSound("dva_friendly", 1000, 250),
-		createSound("genji_enemy", 1000, 250),
-		createSound("genji_friendly", 1000, 250),
-		createSound("hanzo_enemy", 1000, 250),
-		createSound("hanzo_friendly", 1000, 250),
-		createSound("junkrat_enemy", 1000, 250),
-		createSound("junkrat_friendly", 1000, 250),
-		createSound("lucio_friendly", 1000, 250),
-		createSound("lucio_enemy", 1000, 250),
-		createSound("mccree_enemy", 1000, 250),
-		createSound("mccree_friendly", 1000, 250),
-		createSound("mei_friendly", 1000, 250),
+		sound.New("bastion", 1000, 250),
+		sound.New("dva_enemy", 1000, 250),
+		sound.New("dva_friendly", 1000, 250),
+		sound.New("genji_enemy", 1000, 250),
+		sound.New("genji_friendly", 1000, 250),
+		sound.New("hanzo_enemy", 1000, 250),
+		sound.New("hanzo_friendly", 1000, 250),
+		sound.New("junkrat_enemy", 1000, 250),
+		sound.New("junkrat_friendly", 1000, 250),
+		sound.New("lucio_friendly", 1000, 250),
+		sound.New("lucio_enemy", 1000, 250),
+		sound.New("mccree_enemy", 1000, 250),
+		sound.New("mccree_friendly", 1000, 250),
+		sound.New("mei_friendly", 1000, 250),
 		// //there may be multiple mei friendly ult lines
 		// //from this: https://www.reddit.com/r/Overwatch/comments/4fdw0z/is_that_ultimate_friendly_or_hostile/
-		createSound("mei_enemy", 1000, 250),
-		createSound("mercy_friendly", 1000, 250),
-		createSound("mercy_friendly_devil", 1000, 250),
-		createSound("mercy_friendly_valkyrie", 1000, 250),
-		createSound("mercy_enemy", 1000, 250),
-		createSound("orisa_enemy", 1000, 250),
-		createSound("orisa_friendly", 1000, 250),
-		createSound("pharah_enemy", 1000, 250),
-		createSound("pharah_friendly", 1000, 250),
-		createSound("reaper_enemy", 1000, 250),
-		createSound("reaper_friendly", 1000, 250),
-		createSound("reinhardt", 1000, 250),
-		createSound("roadhog_enemy", 1000, 250),
-		createSound("roadhog_friendly", 1000, 250),
-		createSound("76_enemy", 1000, 250),
-		createSound("76_friendly", 1000, 250),
-		createSound("sombra_enemy", 1000, 250),
-		createSound("sombra_friendly", 1000, 250),
-		createSound("symmetra_teleporter", 1000, 250),
-		createSound("symmetra_shield", 1000, 250),
-		createSound("torbjorn", 1000, 250),
-		createSound("tracer_enemy", 1000, 250),    //enemy line has variations. variations are an argument for splitting it up to be !owtracer, putting them in separate sound collections
-		createSound("tracer_friendly", 1000, 250), //doesn't exist?
-		createSound("widow_enemy", 1000, 250),     //consider shortening to widow?
-		createSound("widow_friendly", 1000, 250),  //same as above
-		createSound("zarya_enemy", 1000, 250),
-		createSound("zarya_friendly", 1000, 250),
-		createSound("zenyatta_enemy", 1000, 250),
-		createSound("zenyatta_friendly", 1000, 250),
-
-		createSound("dva_;)", 1000, 250), //should be in its own sound repository
-		createSound("anyong", 1000, 250),
+		sound.New("mei_enemy", 1000, 250),
+		sound.New("mercy_friendly", 1000, 250),
+		sound.New("mercy_friendly_devil", 1000, 250),
+		sound.New("mercy_friendly_valkyrie", 1000, 250),
+		sound.New("mercy_enemy", 1000, 250),
+		sound.New("orisa_enemy", 1000, 250),
+		sound.New("orisa_friendly", 1000, 250),
+		sound.New("pharah_enemy", 1000, 250),
+		sound.New("pharah_friendly", 1000, 250),
+		sound.New("reaper_enemy", 1000, 250),
+		sound.New("reaper_friendly", 1000, 250),
+		sound.New("reinhardt", 1000, 250),
+		sound.New("roadhog_enemy", 1000, 250),
+		sound.New("roadhog_friendly", 1000, 250),
+		sound.New("76_enemy", 1000, 250),
+		sound.New("76_friendly", 1000, 250),
+		sound.New("sombra_enemy", 1000, 250),
+		sound.New("sombra_friendly", 1000, 250),
+		sound.New("symmetra_teleporter", 1000, 250),
+		sound.New("symmetra_shield", 1000, 250),
+		sound.New("torbjorn", 1000, 250),
+		sound.New("tracer_enemy", 1000, 250),    //enemy line has variations. variations are an argument for splitting it up to be !owtracer, putting them in separate sound collections
+		sound.New("tracer_friendly", 1000, 250), //doesn't exist?
+		sound.New("widow_enemy", 1000, 250),     //consider shortening to widow?
+		sound.New("widow_friendly", 1000, 250),  //same as above
+		sound.New("zarya_enemy", 1000, 250),
+		sound.New("zarya_friendly", 1000, 250),
+		sound.New("zenyatta_enemy", 1000, 250),
+		sound.New("zenyatta_friendly", 1000, 250),
+
+		sound.New("dva_;)", 1000, 250), //should be in its own sound repository
+		sound.New("anyong", 1000, 250),
 	},
 }
 
-var KHALED *SoundCollection = &SoundCollection{
+var KHALED *sound.Collection = &sound.Collection{
 	Prefix:    "another",
 	ChainWith: AIRHORN,
 	Commands: []string{
 		"!anotha",
 		"!anothaone",
 	},
-	Sounds: []*Sound{
-		createSound("one", 1, 250),
-		createSound("one_classic", 1, 250),
-		createSound("one_echo", 1, 250),
+	Sounds: []*sound.Sound{
+		sound.New("one", 1, 250),
+		sound.New("one_classic", 1, 250),
+		sound.New("one_echo", 1, 250),
 	},
 }
 
-var CENA *SoundCollection = &SoundCollection{
+var CENA *sound.Collection = &sound.Collection{
 	Prefix: "jc",
 	Commands: []string{
 		"!johncena",
 		"!cena",
 	},
-	Sounds: []*Sound{
-		createSound("airhorn", 1, 250),
-		createSound("echo", 1, 250),
-		createSound("full", 1, 250),
-		createSound("jc", 1, 250),
-		createSound("nameis", 1, 250),
-		createSound("spam", 1, 250),
+	Sounds: []*sound.Sound{
+		sound.New("airhorn", 1, 250),
+		sound.New("echo", 1, 250),
+		sound.New("full", 1, 250),
+		sound.New("jc", 1, 250),
+		sound.New("nameis", 1, 250),
+		sound.New("spam", 1, 250),
 	},
 }
 
-var COW *SoundCollection = &SoundCollection{
+var COW *sound.Collection = &sound.Collection{
 	Prefix: "cow",
 	Commands: []string{
 		"!stan",
 		"!stanislav",
 	},
-	Sounds: []*Sound{
-		createSound("herd", 10, 250),
-		createSound("moo", 10, 250),
-		createSound("x3", 1, 250),
+	Sounds: []*sound.Sound{
+		sound.New("herd", 10, 250),
+		sound.New("moo", 10, 250),
+		sound.New("x3", 1, 250),
 	},
 }
 
-var BIRTHDAY *SoundCollection = &SoundCollection{
+var BIRTHDAY *sound.Collection = &sound.Collection{
 	Prefix: "birthday",
 	Commands: []string{
 		"!birthday",
 		"!bday",
 	},
-	Sounds: []*Sound{
-		createSound("horn", 50, 250),
-		createSound("horn3", 30, 250),
-		createSound("sadhorn", 25, 250),
-		createSound("weakhorn", 25, 250),
+	Sounds: []*sound.Sound{
+		sound.New("horn", 50, 250).WithCelebration(":tada: :birthday: :tada:"),
+		sound.New("horn3", 30, 250).WithCelebration(":tada: :tada: :tada: :birthday: :confetti_ball:"),
+		sound.New("sadhorn", 25, 250),
+		sound.New("weakhorn", 25, 250),
 	},
 }
 
-var ROODE *SoundCollection = &SoundCollection{
+var ROODE *sound.Collection = &sound.Collection{
 	Prefix: "roode",
 	Commands: []string{
 		"!roode",
 	},
-	Sounds: []*Sound{
-		createSound("glorious", 100, 250),
-		createSound("defend", 5, 250),
-		createSound("victorious_full", 1, 250),
+	Sounds: []*sound.Sound{
+		sound.New("glorious", 100, 250),
+		sound.New("defend", 5, 250),
+		sound.New("victorious_full", 1, 250).WithMinInterval(time.Minute * 10),
 	},
 }
 
-var REVIVAL *SoundCollection = &SoundCollection{
+var REVIVAL *sound.Collection = &sound.Collection{
 	Prefix: "revival",
 	Commands: []string{
 		"!revival",
 	},
-	Sounds: []*Sound{
-		createSound("we_go_hard", 100, 250),
-		createSound("say_yeah", 25, 250),
+	Sounds: []*sound.Sound{
+		sound.New("we_go_hard", 100, 250),
+		sound.New("say_yeah", 25, 250),
 	},
 }
 
-var STYLES *SoundCollection = &SoundCollection{
+var STYLES *sound.Collection = &sound.Collection{
 	Prefix: "styles",
 	Commands: []string{
 		"!styles",
 		"!aj",
 	},
-	Sounds: []*Sound{
-		createSound("gay_community", 100, 250),
+	Sounds: []*sound.Sound{
+		sound.New("gay_community", 100, 250),
 	},
 }
 
-var DUMMY *SoundCollection = &SoundCollection{
+var DUMMY *sound.Collection = &sound.Collection{
 	Prefix: "dummy",
 	Commands: []string{
 		"!dummy",
 	},
-	Sounds: []*Sound{
-		createSound("yeah", 100, 250),
+	Sounds: []*sound.Sound{
+		sound.New("yeah", 100, 250),
 	},
 }
 
-var DOTA *SoundCollection = &SoundCollection{
+var DOTA *sound.Collection = &sound.Collection{
 	Prefix: "dota",
 	Commands: []string{
 		"!dota",
 		"!tobi",
 		"!tobiwan",
 	},
-	Sounds: []*Sound{
-		createSound("alldead", 100, 250),
-		createSound("digitalsports", 100, 250),
-		createSound("dingdingding", 100, 250),
-		createSound("disaster", 100, 250),
-		createSound("liquid", 100, 250),
-		createSound("pudge", 100, 250),
-		createSound("waow", 100, 250),
+	Sounds: []*sound.Sound{
+		sound.New("alldead", 100, 250),
+		sound.New("digitalsports", 100, 250),
+		sound.New("dingdingding", 100, 250),
+		sound.New("disaster", 100, 250),
+		sound.New("liquid", 100, 250),
+		sound.New("pudge", 100, 250),
+		sound.New("waow", 100, 250),
 	},
 }
 
-var JONES *SoundCollection = &SoundCollection{
+var JONES *sound.Collection = &sound.Collection{
 	Prefix: "jones",
 	Commands: []string{
 		"!jones",
 		"!alexjones",
 	},
-	Sounds: []*Sound{
-		createSound("kissing_goblins", 100, 250),
-		createSound("kissing_goblins_full", 100, 250),
-		createSound("in_bed_goblin", 100, 250),
-		createSound("charging_goblins", 100, 250),
-		createSound("pepsi_taste_test", 100, 250),
-		createSound("1776", 100, 250),
-		createSound("human", 100, 250),
-		createSound("destroy_everything", 100, 250),
-		createSound("hot_blood", 100, 250),
-		createSound("have_children", 100, 250),
-		createSound("gang_of_mustaches", 100, 250),
-		createSound("sick_of_it", 100, 250),
-		createSound("what_is_that_joke", 100, 250),
-		createSound("what_is_venezuela", 100, 250),
-		createSound("the_gay_bomb", 100, 250),
-		createSound("punches", 100, 250),
-		createSound("its_a_gay_bomb", 100, 250),
-		createSound("gay_frogs", 100, 250),
-		createSound("fight_for_your_life", 100, 250),
+	Sounds: []*sound.Sound{
+		sound.New("kissing_goblins", 100, 250),
+		sound.New("kissing_goblins_full", 100, 250),
+		sound.New("in_bed_goblin", 100, 250),
+		sound.New("charging_goblins", 100, 250),
+		sound.New("pepsi_taste_test", 100, 250),
+		sound.New("1776", 100, 250),
+		sound.New("human", 100, 250),
+		sound.New("destroy_everything", 100, 250),
+		sound.New("hot_blood", 100, 250),
+		sound.New("have_children", 100, 250),
+		sound.New("gang_of_mustaches", 100, 250),
+		sound.New("sick_of_it", 100, 250),
+		sound.New("what_is_that_joke", 100, 250),
+		sound.New("what_is_venezuela", 100, 250),
+		sound.New("the_gay_bomb", 100, 250),
+		sound.New("punches", 100, 250),
+		sound.New("its_a_gay_bomb", 100, 250),
+		sound.New("gay_frogs", 100, 250),
+		sound.New("fight_for_your_life", 100, 250),
 	},
 }
 
-var MUMMY *SoundCollection = &SoundCollection{
+var MUMMY *sound.Collection = &sound.Collection{
 	Prefix: "mummy",
 	Commands: []string{
 		"!mummy",
 	},
-	Sounds: []*Sound{
-		createSound("1", 100, 250),
-		createSound("2", 100, 250),
-		createSound("3", 100, 250),
-		createSound("4", 100, 250),
-		createSound("5", 100, 250),
-		createSound("6", 100, 250),
-		createSound("7", 100, 250),
-		createSound("8", 100, 250),
+	Sounds: []*sound.Sound{
+		sound.New("1", 100, 250),
+		sound.New("2", 100, 250),
+		sound.New("3", 100, 250),
+		sound.New("4", 100, 250),
+		sound.New("5", 100, 250),
+		sound.New("6", 100, 250),
+		sound.New("7", 100, 250),
+		sound.New("8", 100, 250),
 	},
 }
 
-var IMHERE *SoundCollection = &SoundCollection{
+var IMHERE *sound.Collection = &sound.Collection{
 	Prefix: "imhere",
 	Commands: []string{
 		"!im_here",
 		"!imhere",
 	},
-	Sounds: []*Sound{
-		createSound("find_me", 100, 250),
+	Sounds: []*sound.Sound{
+		sound.New("find_me", 100, 250),
 	},
 }
 
-var NEWSREEL *SoundCollection = &SoundCollection{
+var NEWSREEL *sound.Collection = &sound.Collection{
 	Prefix: "newsreel",
 	Commands: []string{
 		"!newsreel",
 	},
-	Sounds: []*Sound{
-		createSound("ooh_swish", 100, 250),
+	Sounds: []*sound.Sound{
+		sound.New("ooh_swish", 100, 250),
 	},
 }
 
-var LOGAN *SoundCollection = &SoundCollection{
+var LOGAN *sound.Collection = &sound.Collection{
 	Prefix: "logan",
 	Commands: []string{
 		"!logan",
 	},
-	Sounds: []*Sound{
-		createSound("1", 100, 250),
-		createSound("2", 100, 250),
-		createSound("3", 100, 250),
-		createSound("4", 100, 250),
+	Sounds: []*sound.Sound{
+		sound.New("1", 100, 250),
+		sound.New("2", 100, 250),
+		sound.New("3", 100, 250),
+		sound.New("4", 100, 250),
 	},
 }
 
-var FOXY *SoundCollection = &SoundCollection{
+var FOXY *sound.Collection = &sound.Collection{
 	Prefix: "foxy",
 	Commands: []string{
 		"!foxy",
 	},
-	Sounds: []*Sound{
-		createSound("trying", 100, 250),
+	Sounds: []*sound.Sound{
+		sound.New("trying", 100, 250),
 	},
 }
 
-var ENZO *SoundCollection = &SoundCollection{
+var ENZO *sound.Collection = &sound.Collection{
 	Prefix: "enzo",
 	Commands: []string{
 		"!enzo",
 	},
-	Sounds: []*Sound{
-		createSound("sawft_arena", 100, 250),
+	Sounds: []*sound.Sound{
+		sound.New("sawft_arena", 100, 250),
 	},
 }
 
-var MONEY *SoundCollection = &SoundCollection{
+var MONEY *sound.Collection = &sound.Collection{
 	Prefix: "money",
 	Commands: []string{
 		"!money",
 	},
-	Sounds: []*Sound{
-		createSound("lodsofemone", 100, 250),
-		createSound("lodsofemone_full", 100, 250),
-		createSound("wopitout", 100, 250),
+	Sounds: []*sound.Sound{
+		sound.New("lodsofemone", 100, 250),
+		sound.New("lodsofemone_full", 100, 250),
+		sound.New("wopitout", 100, 250),
 	},
 }
 
-var GW2 *SoundCollection = &SoundCollection{
+var GW2 *sound.Collection = &sound.Collection{
 	Prefix: "gw2",
 	Commands: []string{
 		"!gw2",
 	},
-	Sounds: []*Sound{
-		createSound("rose", 100, 250),
+	Sounds: []*sound.Sound{
+		sound.New("rose", 100, 250),
 	},
 }
 
-var WEED *SoundCollection = &SoundCollection{
+var WEED *sound.Collection = &sound.Collection{
 	Prefix: "theweed",
 	Commands: []string{
 		"!theweed",
 		"!weed",
 	},
-	Sounds: []*Sound{
-		createSound("all", 100, 250),
+	Sounds: []*sound.Sound{
+		sound.New("all", 100, 250),
 	},
 }
 
-var TF2 *SoundCollection = &SoundCollection{
+var TF2 *sound.Collection = &sound.Collection{
 	Prefix: "tf2",
 	Commands: []string{
 		"!tf2",
 	},
-	Sounds: []*Sound{
-		createSound("overtime1", 100, 250),
-		createSound("overtime2", 100, 250),
-		createSound("overtime3", 100, 250),
-		createSound("overtime4", 100, 250),
+	Sounds: []*sound.Sound{
+		sound.New("overtime1", 100, 250),
+		sound.New("overtime2", 100, 250),
+		sound.New("overtime3", 100, 250),
+		sound.New("overtime4", 100, 250),
 	},
 }
 
-var ASSBLAST *SoundCollection = &SoundCollection{
+var ASSBLAST *sound.Collection = &sound.Collection{
 	Prefix: "assblastusa",
 	Commands: []string{
 		"!assblastusa",
 	},
-	Sounds: []*Sound{
-		createSound("full", 100, 250),
+	Sounds: []*sound.Sound{
+		sound.New("full", 100, 250),
 	},
 }
 
-var COLLECTIONS []*SoundCollection = []*SoundCollection{
+var COLLECTIONS []*sound.Collection = []*sound.Collection{
 	AIRHORN,
 	KHALED,
 	CENA,
@@ -460,95 +450,6 @@ var COLLECTIONS []*SoundCollection = []*SoundCollection{
 	ASSBLAST,
 }
 
-// Create a Sound struct
-func createSound(Name string, Weight int, PartDelay int) *Sound {
-	return &Sound{
-		Name:      Name,
-		Weight:    Weight,
-		PartDelay: PartDelay,
-		buffer:    make([][]byte, 0),
-	}
-}
-
-func (sc *SoundCollection) Load() {
-	for _, sound := range sc.Sounds {
-		sc.soundRange += sound.Weight
-		sound.Load(sc)
-	}
-}
-
-func (s *SoundCollection) Random() *Sound {
-	var (
-		i      int
-		number int = randomRange(0, s.soundRange)
-	)
-
-	for _, sound := range s.Sounds {
-		i += sound.Weight
-
-		if number < i {
-			return sound
-		}
-	}
-	return nil
-}
-
-// Load attempts to load an encoded sound file from disk
-// DCA files are pre-computed sound files that are easy to send to Discord.
-// If you would like to create your own DCA files, please use:
-// https://github.com/nstafie/dca-rs
-// eg: dca-rs --raw -i <input wav file> > <output file>
-func (s *Sound) Load(c *SoundCollection) error {
-	path := fmt.Sprintf("audio/%v_%v.dca", c.Prefix, s.Name)
-
-	file, err := os.Open(path)
-
-	if err != nil {
-		fmt.Println("error opening dca file :", err)
-		return err
-	}
-
-	var opuslen int16
-
-	for {
-		// read opus frame length from dca file
-		err = binary.Read(file, binary.LittleEndian, &opuslen)
-
-		// If this is the end of the file, just return
-		if err == io.EOF || err == io.ErrUnexpectedEOF {
-			return nil
-		}
-
-		if err != nil {
-			fmt.Println("error reading from dca file :", err)
-			return err
-		}
-
-		// read encoded pcm from dca file
-		InBuf := make([]byte, opuslen)
-		err = binary.Read(file, binary.LittleEndian, &InBuf)
-
-		// Should not be any end of file errors
-		if err != nil {
-			fmt.Println("error reading from dca file :", err)
-			return err
-		}
-
-		// append encoded pcm data to the buffer
-		s.buffer = append(s.buffer, InBuf)
-	}
-}
-
-// Plays this sound over the specified VoiceConnection
-func (s *Sound) Play(vc *discordgo.VoiceConnection) {
-	vc.Speaking(true)
-	defer vc.Speaking(false)
-
-	for _, buff := range s.buffer {
-		vc.OpusSend <- buff
-	}
-}
-
 // Attempts to find the current users voice channel inside a given guild
 func getCurrentVoiceChannel(user *discordgo.User, guild *discordgo.Guild) *discordgo.Channel {
 	for _, vs := range guild.VoiceStates {
@@ -562,12 +463,11 @@ func getCurrentVoiceChannel(user *discordgo.User, guild *discordgo.Guild) *disco
 
 // Returns a random integer between min and max
 func randomRange(min, max int) int {
-	rand.Seed(time.Now().UTC().UnixNano())
 	return rand.Intn(max-min) + min
 }
 
 // Prepares a play
-func createPlay(user *discordgo.User, guild *discordgo.Guild, coll *SoundCollection, sound *Sound) *Play {
+func createPlay(user *discordgo.User, guild *discordgo.Guild, coll *sound.Collection, sound *sound.Sound, source string) *queue.Play {
 	// Grab the users voice channel
 	channel := getCurrentVoiceChannel(user, guild)
 	if channel == nil {
@@ -578,29 +478,49 @@ func createPlay(user *discordgo.User, guild *discordgo.Guild, coll *SoundCollect
 		return nil
 	}
 
-	// Create the play
-	play := &Play{
-		GuildID:   guild.ID,
-		ChannelID: channel.ID,
-		UserID:    user.ID,
-		Sound:     sound,
-		Forced:    true,
+	return newPlay(guild, channel.ID, user.ID, coll, sound, source)
+}
+
+// Prepares a play in a specific voice channel, on behalf of the user uid
+func newPlay(guild *discordgo.Guild, channelID, uid string, coll *sound.Collection, sound *sound.Sound, source string) *queue.Play {
+	play := &queue.Play{
+		ID:         queue.NewID(),
+		GuildID:    guild.ID,
+		ChannelID:  channelID,
+		UserID:     uid,
+		Sound:      sound,
+		Collection: coll.Prefix,
+		Forced:     true,
+		Source:     source,
+		Priority:   playPriority(guild, uid),
+	}
+
+	// Bombs are the least important thing the bot can play
+	if source == queue.SOURCE_BOMB {
+		play.Priority = queue.PRIORITY_LOW
 	}
 
 	// If we didn't get passed a manual sound, generate a random one
 	if play.Sound == nil {
-		play.Sound = coll.Random()
+		play.Sound = randomSound(guild.ID, coll)
 		play.Forced = false
 	}
 
+	// Swap in an experiment variant if this guild is bucketed into one
+	applyExperiments(play, coll)
+
 	// If the collection is a chained one, set the next sound
 	if coll.ChainWith != nil {
-		play.Next = &Play{
-			GuildID:   play.GuildID,
-			ChannelID: play.ChannelID,
-			UserID:    play.UserID,
-			Sound:     coll.ChainWith.Random(),
-			Forced:    play.Forced,
+		play.Next = &queue.Play{
+			ID:         queue.NewID(),
+			GuildID:    play.GuildID,
+			ChannelID:  play.ChannelID,
+			UserID:     play.UserID,
+			Sound:      coll.ChainWith.Random(),
+			Collection: coll.ChainWith.Prefix,
+			Forced:     play.Forced,
+			Source:     play.Source,
+			Priority:   play.Priority,
 		}
 	}
 
@@ -608,142 +528,308 @@ func createPlay(user *discordgo.User, guild *discordgo.Guild, coll *SoundCollect
 }
 
 // Prepares and enqueues a play into the ratelimit/buffer guild queue
-func enqueuePlay(user *discordgo.User, guild *discordgo.Guild, coll *SoundCollection, sound *Sound) {
-	play := createPlay(user, guild, coll, sound)
+func enqueuePlay(user *discordgo.User, guild *discordgo.Guild, cid string, coll *sound.Collection, sound *sound.Sound, source string) {
+	// Collections can be restricted to some roles with !perms
+	if blocked(user.ID, guild.ID) || !canUse(guild, user.ID, coll.Prefix) || onCooldown(guild.ID, user.ID) {
+		return
+	}
+
+	play := createPlay(user, guild, coll, sound, source)
 	if play == nil {
 		return
 	}
 
-	// Check if we already have a connection to this guild
-	//   yes, this isn't threadsafe, but its "OK" 99% of the time
-	_, exists := queues[guild.ID]
+	if remaining := claimCollection(guild.ID, coll); remaining > 0 {
+		if cid != "" {
+			discord.ChannelMessageSend(cid, localize(guild.ID, "cooldown.collection", map[string]interface{}{
+				"Collection": coll.Prefix,
+				"Remaining":  remaining.Round(time.Second),
+			}))
+		}
+		return
+	}
+
+	// Random picks avoid sounds that are still in their minimum interval
+	remaining := claimSound(guild.ID, coll.Prefix, play.Sound)
+	for attempt := 0; remaining > 0 && !play.Forced && attempt < 3; attempt++ {
+		play.Sound = randomSound(guild.ID, coll)
+		remaining = claimSound(guild.ID, coll.Prefix, play.Sound)
+	}
 
-	if exists {
-		if len(queues[guild.ID]) < MAX_QUEUE_SIZE {
-			queues[guild.ID] <- play
+	if remaining > 0 {
+		if cid != "" {
+			discord.ChannelMessageSend(cid, localize(guild.ID, "interval.locked", map[string]interface{}{
+				"Sound":     play.Sound.Name,
+				"Remaining": remaining.Round(time.Second),
+			}))
 		}
-	} else {
-		queues[guild.ID] = make(chan *Play, MAX_QUEUE_SIZE)
-		playSound(play, nil)
+		return
+	}
+	play.TextChannelID = cid
+	if play.Next != nil {
+		play.Next.TextChannelID = cid
 	}
+	queuePlay(play)
 }
 
-func trackSoundStats(play *Play) {
-	if rcli == nil {
+// Enqueues a prepared play, playing it straight away if the guild is idle
+func queuePlay(play *queue.Play) {
+	if eventQuiet(play.GuildID, play.ChannelID) {
+		log.WithFields(log.Fields{
+			"play":    play.ID,
+			"guild":   play.GuildID,
+			"channel": play.ChannelID,
+		}).Info("Dropping play in the channel of a live event")
+		play.Drop()
+		return
+	}
+
+	if !claimGuild(play.GuildID) {
+		log.WithFields(log.Fields{
+			"play":  play.ID,
+			"guild": play.GuildID,
+		}).Debug("Dropping play for a guild another instance is serving")
+		play.Drop()
 		return
 	}
 
-	_, err := rcli.Pipelined(func(pipe *redis.Pipeline) error {
-		var baseChar string
+	if quietHoursBlock(play) {
+		return
+	}
 
-		if play.Forced {
-			baseChar = "f"
-		} else {
-			baseChar = "a"
+	// Only start playing if this guild wasn't already, otherwise it waits in the queue
+	if queues.Enqueue(play) {
+		playGuildQueue(play)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"play":   play.ID,
+		"guild":  play.GuildID,
+		"queued": queues.Len(play.GuildID),
+	}).Debug("Guild is already playing, play handed to its queue")
+}
+
+// Handles !random, playing a random sound from a random collection the user can play
+func handleRandomCommand(m *discordgo.MessageCreate, guild *discordgo.Guild) {
+	settings := getGuildSettings(guild.ID)
+
+	colls := make([]*sound.Collection, 0)
+	for _, coll := range getCollections() {
+		if settings.CollectionEnabled(coll) && canUse(guild, m.Author.ID, coll.Prefix) {
+			colls = append(colls, coll)
 		}
+	}
 
-		base := fmt.Sprintf("airhorn:%s", baseChar)
-		pipe.Incr("airhorn:total")
-		pipe.Incr(fmt.Sprintf("%s:total", base))
-		pipe.Incr(fmt.Sprintf("%s:sound:%s", base, play.Sound.Name))
-		pipe.Incr(fmt.Sprintf("%s:user:%s:sound:%s", base, play.UserID, play.Sound.Name))
-		pipe.Incr(fmt.Sprintf("%s:guild:%s:sound:%s", base, play.GuildID, play.Sound.Name))
-		pipe.Incr(fmt.Sprintf("%s:guild:%s:chan:%s:sound:%s", base, play.GuildID, play.ChannelID, play.Sound.Name))
-		pipe.SAdd(fmt.Sprintf("%s:users", base), play.UserID)
-		pipe.SAdd(fmt.Sprintf("%s:guilds", base), play.GuildID)
-		pipe.SAdd(fmt.Sprintf("%s:channels", base), play.ChannelID)
-		return nil
+	// Collections that are in season are favored
+	coll := sound.RandomCollectionWeighted(colls, func(coll *sound.Collection) float64 {
+		return seasonBoost(guild.ID, coll)
 	})
+	if coll == nil {
+		return
+	}
+	enqueuePlay(m.Author, guild, m.ChannelID, coll, nil, queue.SOURCE_COMMAND)
+}
 
-	if err != nil {
+// Plays through a guild's queue starting with play. A panic while playing only
+// takes down this guild's queue, which is dropped along with its voice
+// connection so the next play starts from scratch.
+func playGuildQueue(play *queue.Play) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		reportPanic(r, log.Fields{
+			"play":       play.ID,
+			"guild":      play.GuildID,
+			"collection": play.Collection,
+		})
+
+		if playing := queues.Playing(play.GuildID); playing != nil {
+			playing.Drop()
+		}
+		queues.Remove(play.GuildID)
+		stopListening(play.GuildID)
+
+		discord.RLock()
+		vc := discord.VoiceConnections[play.GuildID]
+		discord.RUnlock()
+		if vc != nil {
+			vc.Disconnect()
+		}
+	}()
+
+	playSound(play, takeIdleVoice(play.GuildID))
+}
+
+func trackSoundStats(play *queue.Play) {
+	// Users who opted out still count towards the totals, just not as themselves
+	if optedOut(play.UserID) {
+		anonymous := *play
+		anonymous.UserID = ""
+		play = &anonymous
+	}
+
+	if err := statsSink.TrackPlay(play); err != nil {
 		log.WithFields(log.Fields{
+			"play":  play.ID,
 			"error": err,
-		}).Warning("Failed to track stats in redis")
+		}).Warning("Failed to track stats")
+	}
+}
+
+// Plays through the guild's queue starting with play, on vc if the bot is
+// still in voice from a previous play
+func playSound(play *queue.Play, vc *discordgo.VoiceConnection) error {
+	err := queues.Drain(play, func(play *queue.Play) (err error) {
+		vc, err = playOne(play, vc)
+		return err
+	})
+
+	if vc != nil {
+		leaveVoice(vc)
 	}
+	return err
 }
 
-// Play a sound
-func playSound(play *Play, vc *discordgo.VoiceConnection) (err error) {
+// Play a sound, joining its voice channel first if needed. Returns the
+// connection the next sound can be played on, nil if it was dropped.
+func playOne(play *queue.Play, vc *discordgo.VoiceConnection) (*discordgo.VoiceConnection, error) {
 	log.WithFields(log.Fields{
-		"play": play,
+		"play":    play.ID,
+		"guild":   play.GuildID,
+		"channel": play.ChannelID,
+		"user":    play.UserID,
+		"sound":   play.Sound.Name,
+		"forced":  play.Forced,
+		"source":  play.Source,
 	}).Info("Playing sound")
+	lastPlayID.Set(play.ID)
 
 	if vc == nil {
+		var err error
 		vc, err = discord.ChannelVoiceJoin(play.GuildID, play.ChannelID, false, false)
 		// vc.Receive = false
 		if err != nil {
 			log.WithFields(log.Fields{
+				"play":  play.ID,
 				"error": err,
 			}).Error("Failed to play sound")
-			delete(queues, play.GuildID)
-			return err
+			go trackError("voice")
+			queues.Remove(play.GuildID)
+			return nil, err
 		}
 	}
 
 	// If we need to change channels, do that now
 	if vc.ChannelID != play.ChannelID {
+		log.WithFields(log.Fields{
+			"play":  play.ID,
+			"guild": play.GuildID,
+			"from":  vc.ChannelID,
+			"to":    play.ChannelID,
+		}).Debug("Changing voice channel")
 		vc.ChangeChannel(play.ChannelID, false, false)
 		time.Sleep(time.Millisecond * 125)
 	}
 
-	// Track stats for this play in redis
-	go trackSoundStats(play)
-
 	// Sleep for a specified amount of time before playing the sound
 	time.Sleep(time.Millisecond * 32)
 
-	// Play the sound
-	play.Sound.Play(vc)
+	// Synchronized plays wait for every guild to be ready
+	if wait := time.Until(play.StartAt); wait > 0 {
+		time.Sleep(wait)
+	}
 
-	// If this is chained, play the chained sound
-	if play.Next != nil {
-		playSound(play.Next, vc)
+	for _, hook := range playStartHooks {
+		hook(play)
 	}
 
-	// If there is another song in the queue, recurse and play that
-	if len(queues[play.GuildID]) > 0 {
-		play := <-queues[play.GuildID]
-		playSound(play, vc)
-		return nil
+	// Play the sound, rejoining and starting it over if the voice connection died
+	for attempt := 1; ; attempt++ {
+		err := play.Sound.PlayUntil(vc, playbackStop(play.GuildID))
+		if err == nil {
+			// Only plays that made it to the end count in the stats
+			go trackSoundStats(play)
+
+			for _, hook := range playHooks {
+				hook(play)
+			}
+			return vc, nil
+		}
+
+		// Stopped plays (everyone left) take the rest of the chain with them,
+		// the queue has already been dropped
+		if err == sound.ErrStopped {
+			vc.Disconnect()
+			return nil, err
+		}
+
+		// A sound missing from disk or corrupt isn't the connection's fault,
+		// the rest of the queue plays on it
+		if _, ok := err.(*sound.FileError); ok {
+			log.WithFields(log.Fields{
+				"play":  play.ID,
+				"guild": play.GuildID,
+				"sound": play.Sound.Name,
+				"error": err,
+			}).Error("Failed to read sound")
+			go trackError("sound_file")
+			return vc, err
+		}
+
+		log.WithFields(log.Fields{
+			"play":    play.ID,
+			"guild":   play.GuildID,
+			"sound":   play.Sound.Name,
+			"attempt": attempt,
+			"error":   err,
+		}).Warning("Sound playback stalled")
+		go trackError("playback")
+
+		// A sound that is slow as a whole isn't retried, the watchdog gives up on
+		// it and the rest of the queue gets a fresh connection
+		if err == sound.ErrPlayTimeout || attempt > VOICE_MAX_RETRIES {
+			vc.Disconnect()
+			return nil, err
+		}
+
+		vc, err = rejoinVoice(play, vc, attempt)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"play":  play.ID,
+				"guild": play.GuildID,
+				"error": err,
+			}).Error("Failed to rejoin voice, dropping the queue")
+			queues.Remove(play.GuildID)
+			return nil, err
+		}
 	}
+}
 
-	// If the queue is empty, delete it
-	time.Sleep(time.Millisecond * time.Duration(play.Sound.PartDelay))
-	delete(queues, play.GuildID)
+// Drops a dead voice connection and joins the play's channel again, waiting a
+// little longer on every attempt
+func rejoinVoice(play *queue.Play, vc *discordgo.VoiceConnection, attempt int) (*discordgo.VoiceConnection, error) {
 	vc.Disconnect()
-	return nil
+	time.Sleep(time.Second * time.Duration(attempt))
+	return discord.ChannelVoiceJoin(play.GuildID, play.ChannelID, false, false)
 }
 
 func onReady(s *discordgo.Session, event *discordgo.Ready) {
 	log.Info("Recieved READY payload")
-	status := 0 //A good line
-
-	// A work around to get to GameType "2" (Listening to ...)
-	dup := discordgo.UpdateStatusData{
-		Status:    "online",
-		IdleSince: &status,
-		Game: &discordgo.Game{
-			Name: "airhorn.wav",
-			Type: discordgo.GameType(2),
-			URL:  "",
-		},
-	}
-	err := s.UpdateStatusComplex(dup)
-	if err != nil {
-		log.Println(err)
-	}
+	updatePresence(s)
 }
 
 func onGuildCreate(s *discordgo.Session, event *discordgo.GuildCreate) {
+	// Scheduled events aren't part of the guild payload
 	if !event.Guild.Unavailable {
-		return
+		go syncScheduledEvents(event.Guild.ID)
 	}
 
-	for _, channel := range event.Guild.Channels {
-		if channel.ID == event.Guild.ID {
-			s.ChannelMessageSend(channel.ID, "**AIRHORN BOT READY FOR HORNING. TYPE `!AIRHORN` WHILE IN A VOICE CHANNEL TO ACTIVATE**")
-			return
-		}
+	if newlyJoined(event.Guild) && claimGuild(event.Guild.ID) {
+		go startOnboarding(event.Guild)
 	}
 }
 
@@ -756,23 +842,48 @@ func scontains(key string, options ...string) bool {
 	return false
 }
 
-func calculateAirhornsPerSecond(cid string) {
-	current, _ := strconv.Atoi(rcli.Get("airhorn:a:total").Val())
-	time.Sleep(time.Second * 10)
-	latest, _ := strconv.Atoi(rcli.Get("airhorn:a:total").Val())
+func displayAirhornsPerSecond(cid string) {
+	if tracker == nil {
+		return
+	}
+
+	rates, err := tracker.Rates()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to fetch play rates")
+		return
+	}
 
-	discord.ChannelMessageSend(cid, fmt.Sprintf("Current APS: %v", (float64(latest-current))/10.0))
+	sendReplyText(cid, fmt.Sprintf("Current APS: %.2f (%d in the last minute, %d in the last hour, %d in the last day, %d today)",
+		rates.APS, rates.LastMinute, rates.LastHour, rates.LastDay, rates.Today), REPLY_LOW)
 }
 
 func displayBotStats(cid string) {
 	stats := runtime.MemStats{}
 	runtime.ReadMemStats(&stats)
 
+	servers := len(discord.State.Ready.Guilds)
 	users := 0
 	for _, guild := range discord.State.Ready.Guilds {
 		users += len(guild.Members)
 	}
 
+	// With redis every shard publishes its counts, so the totals cover all of them
+	var shards []*ShardStats
+	if rcli != nil {
+		shards, _ = getShardStats()
+		if len(shards) > 0 {
+			total := sumShardStats(shards)
+			servers, users = total.Guilds, total.Users
+		}
+	}
+
+	discord.RLock()
+	voiceConnections := len(discord.VoiceConnections)
+	discord.RUnlock()
+	playing, waiting := queues.Totals()
+
 	w := &tabwriter.Writer{}
 	buf := &bytes.Buffer{}
 
@@ -781,51 +892,63 @@ func displayBotStats(cid string) {
 	fmt.Fprintf(w, "Discordgo: \t%s\n", discordgo.VERSION)
 	fmt.Fprintf(w, "Go: \t%s\n", runtime.Version())
 	fmt.Fprintf(w, "Memory: \t%s / %s (%s total allocated)\n", humanize.Bytes(stats.Alloc), humanize.Bytes(stats.Sys), humanize.Bytes(stats.TotalAlloc))
-	fmt.Fprintf(w, "Tasks: \t%d\n", runtime.NumGoroutine())
-	fmt.Fprintf(w, "Servers: \t%d\n", len(discord.State.Ready.Guilds))
-	fmt.Fprintf(w, "Users: \t%d\n", users)
+	fmt.Fprintf(w, "Tasks: \t%s\n", humanize.Comma(int64(runtime.NumGoroutine())))
+	fmt.Fprintf(w, "Uptime: \t%s (since %s)\n", time.Since(startTime).Round(time.Second), startTime.UTC().Format("Jan 2 15:04 MST"))
+	fmt.Fprintf(w, "Shard: \t%d of %d\n", discord.ShardID, discord.ShardCount)
+	fmt.Fprintf(w, "Servers: \t%s\n", humanize.Comma(int64(servers)))
+	fmt.Fprintf(w, "Users: \t%s\n", humanize.Comma(int64(users)))
+	fmt.Fprintf(w, "Voice: \t%s connected, %s idle\n", humanize.Comma(int64(voiceConnections)), humanize.Comma(int64(idleVoiceCount())))
+	fmt.Fprintf(w, "Queues: \t%s playing, %s waiting\n", humanize.Comma(int64(playing)), humanize.Comma(int64(waiting)))
+	fmt.Fprintf(w, "Redis: \t%s\n", redisDiagnostics())
+	if len(shards) > 0 {
+		fmt.Fprintf(w, "Shards: \t%d of %d reporting\n", len(shards), discord.ShardCount)
+		for _, ss := range shards {
+			fmt.Fprintf(w, "  Shard %d: \t%s latency, up %s on %s\n", ss.Shard, ss.Latency.Round(time.Millisecond), time.Since(ss.Started).Round(time.Second), ss.Instance)
+		}
+	}
+	fmt.Fprintf(w, "Sounds: \t%s pinned (%s), %s streamed\n", humanize.Comma(getMetric(sound.Metrics, "pinned")), humanize.Bytes(uint64(getMetric(sound.Metrics, "pinned_bytes"))), humanize.Comma(getMetric(sound.Metrics, "streamed")))
+	if soundCache != nil {
+		fmt.Fprintf(w, "Sound cache: \t%s / %s, %.1f%% hit rate, %s evictions\n", humanize.Bytes(uint64(soundCache.Size())), humanize.Bytes(uint64(soundCache.Budget())), cacheHitRate(), humanize.Comma(getMetric(sound.Metrics, "cache_evictions")))
+	}
+	fmt.Fprintf(w, "Plays: \t%s from memory, %s from disk\n", humanize.Comma(getMetric(sound.Metrics, "plays_from_memory")), humanize.Comma(getMetric(sound.Metrics, "plays_from_disk")))
+	fmt.Fprintf(w, "Frames: \t%s sent, %s\n", humanize.Comma(getMetric(sound.Metrics, "frames_sent")), formatFrameJitter())
+	fmt.Fprintf(w, "Last play: \t%s\n", lastPlayID.Value())
+	fmt.Fprintf(w, "Replies: \t%s dropped to busy channels\n", humanize.Comma(repliesDropped.Value()))
+	if counts, err := statsSink.Counts(); err == nil {
+		fmt.Fprintf(w, "Stats: \t%s plays, errors: %s\n", humanize.Comma(int64(counts.Total)), formatErrorCounts(counts))
+	}
+	if tracker != nil {
+		fmt.Fprintf(w, "Sources: \t%s commands, %s soundboard\n", humanize.Comma(int64(tracker.SourceTotal(queue.SOURCE_COMMAND))), humanize.Comma(int64(tracker.SourceTotal(queue.SOURCE_SOUNDBOARD))))
+	}
 	fmt.Fprintf(w, "```\n")
 	w.Flush()
-	discord.ChannelMessageSend(cid, buf.String())
+	sendReplyText(cid, buf.String(), REPLY_NORMAL)
 }
 
-func utilSumRedisKeys(keys []string) int {
-	results := make([]*redis.StringCmd, 0)
-
-	rcli.Pipelined(func(pipe *redis.Pipeline) error {
-		for _, key := range keys {
-			results = append(results, pipe.Get(key))
-		}
-		return nil
-	})
-
-	var total int
-	for _, i := range results {
-		t, _ := strconv.Atoi(i.Val())
-		total += t
+func displayUserStats(cid, gid, uid string) {
+	if tracker == nil {
+		return
 	}
 
-	return total
-}
-
-func displayUserStats(cid, uid string) {
-	keys, err := rcli.Keys(fmt.Sprintf("airhorn:*:user:%s:sound:*", uid)).Result()
+	totalAirhorns, err := tracker.UserTotal(uid)
 	if err != nil {
 		return
 	}
 
-	totalAirhorns := utilSumRedisKeys(keys)
-	discord.ChannelMessageSend(cid, fmt.Sprintf("Total Airhorns: %v", totalAirhorns))
+	sendReplyText(cid, localize(gid, "stats.total", map[string]interface{}{"Total": totalAirhorns}), REPLY_NORMAL)
 }
 
 func displayServerStats(cid, sid string) {
-	keys, err := rcli.Keys(fmt.Sprintf("airhorn:*:guild:%s:sound:*", sid)).Result()
+	if tracker == nil {
+		return
+	}
+
+	totalAirhorns, err := tracker.GuildTotal(sid)
 	if err != nil {
 		return
 	}
 
-	totalAirhorns := utilSumRedisKeys(keys)
-	discord.ChannelMessageSend(cid, fmt.Sprintf("Total Airhorns: %v", totalAirhorns))
+	sendReplyText(cid, localize(sid, "stats.total", map[string]interface{}{"Total": totalAirhorns}), REPLY_NORMAL)
 }
 
 func utilGetMentioned(s *discordgo.Session, m *discordgo.MessageCreate) *discordgo.User {
@@ -837,55 +960,73 @@ func utilGetMentioned(s *discordgo.Session, m *discordgo.MessageCreate) *discord
 	return nil
 }
 
-func airhornBomb(cid string, guild *discordgo.Guild, user *discordgo.User, cs string) {
-	count, _ := strconv.Atoi(cs)
-	discord.ChannelMessageSend(cid, ":ok_hand:"+strings.Repeat(":trumpet:", count))
-
-	// Cap it at something
-	if count > 100 {
-		return
-	}
-
-	play := createPlay(user, guild, AIRHORN, nil)
-	vc, err := discord.ChannelVoiceJoin(play.GuildID, play.ChannelID, true, true)
-	if err != nil {
+// Handles bot operator messages, should be refactored (lmao)
+func handleBotControlMessages(s *discordgo.Session, m *discordgo.MessageCreate, parts []string, g *discordgo.Guild) {
+	if len(parts) < 2 {
 		return
 	}
 
-	for i := 0; i < count; i++ {
-		AIRHORN.Random().Play(vc)
-	}
-
-	vc.Disconnect()
-}
-
-// Handles bot operator messages, should be refactored (lmao)
-func handleBotControlMessages(s *discordgo.Session, m *discordgo.MessageCreate, parts []string, g *discordgo.Guild) {
 	if scontains(parts[1], "status") {
 		displayBotStats(m.ChannelID)
 	} else if scontains(parts[1], "stats") {
 		if len(m.Mentions) >= 2 {
-			displayUserStats(m.ChannelID, utilGetMentioned(s, m).ID)
+			displayUserStats(m.ChannelID, g.ID, utilGetMentioned(s, m).ID)
 		} else if len(parts) >= 3 {
-			displayUserStats(m.ChannelID, parts[2])
+			displayUserStats(m.ChannelID, g.ID, parts[2])
 		} else {
 			displayServerStats(m.ChannelID, g.ID)
 		}
 	} else if scontains(parts[1], "bomb") && len(parts) >= 4 {
-		airhornBomb(m.ChannelID, g, utilGetMentioned(s, m), parts[3])
+		if target := utilGetMentioned(s, m); target != nil {
+			startBomb(m.ChannelID, g, target, parts[3])
+		}
 	} else if scontains(parts[1], "aps") {
-		s.ChannelMessageSend(m.ChannelID, ":ok_hand: give me a sec m8")
-		go calculateAirhornsPerSecond(m.ChannelID)
+		displayAirhornsPerSecond(m.ChannelID)
+	} else if scontains(parts[1], "experiment") {
+		handleExperimentCommand(m.ChannelID, parts[2:])
+	} else if scontains(parts[1], "gallery") {
+		handleGalleryModeration(m.ChannelID, parts[2:])
+	} else if scontains(parts[1], "syncplay") {
+		handleSyncPlayCommand(m.ChannelID, parts[2:])
+	} else if scontains(parts[1], "incident") {
+		handleIncidentCommand(m.ChannelID, m.Content)
+	} else if scontains(parts[1], "shards") {
+		displayShardStats(m.ChannelID)
+	} else if scontains(parts[1], "reload", "reloadsounds") {
+		if err := reloadSounds(); err != nil {
+			auditOwnerAction("reloadsounds", "", "failed: "+err.Error())
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Reload failed, keeping the current sounds: %s", err))
+			return
+		}
+		auditOwnerAction("reloadsounds", "", "ok")
+		s.ChannelMessageSend(m.ChannelID, ":ok_hand: reloaded")
+	} else if scontains(parts[1], "guilds") {
+		displayOwnerGuilds(m.ChannelID, parts[2:])
+	} else if scontains(parts[1], "leave") {
+		ownerLeaveGuild(m.ChannelID, parts[2:])
+	} else if scontains(parts[1], "broadcast") {
+		ownerBroadcast(m.ChannelID, ownerCommandArgs(m.Content, "broadcast"))
+	} else if scontains(parts[1], "setstatus") {
+		ownerSetStatus(m.ChannelID, ownerCommandArgs(m.Content, "setstatus"))
+	} else if scontains(parts[1], "shutdown") {
+		ownerShutdown(m.ChannelID)
+	} else if scontains(parts[1], "audit") {
+		displayOwnerAudit(m.ChannelID)
 	}
 }
 
 func onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
-	if len(m.Content) <= 0 || (m.Content[0] != '!' && len(m.Mentions) < 1) {
+	if len(m.Content) <= 0 {
 		return
 	}
 
-	msg := strings.Replace(m.ContentWithMentionsReplaced(), s.State.Ready.User.Username, "username", 1)
-	parts := strings.Split(strings.ToLower(msg), " ")
+	// Direct messages have no guild, skip our own replies so they never loop
+	if m.GuildID == "" {
+		if !m.Author.Bot && !blocked(m.Author.ID, "") {
+			handleDirectMessage(m)
+		}
+		return
+	}
 
 	channel, _ := discord.State.Channel(m.ChannelID)
 	if channel == nil {
@@ -906,41 +1047,37 @@ func onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 		return
 	}
 
-	if strings.HasPrefix(strings.ToLower(m.Content), "!help") {
-		messageLower := strings.ToLower(m.Content)
-		helpCommand := strings.Split(messageLower, " ")
-		if messageLower == "!help" || len(helpCommand) == 1 {
-			var em = discordgo.MessageEmbed{
-				Title:       "Airhorn Basics",
-				Color:       0xE5343A,
-				Description: "Here are a list of sounds categories this bot has\n",
-			}
-			for _, sound := range COLLECTIONS {
-				em.Description += "**" + sound.Prefix + "** - " + strings.Join(sound.Commands, ", ") + "\n"
-			}
-			em.Description += "For more information about any of these commands, preform\n**!help {Any of those above prefixes}**"
-			_, err := s.ChannelMessageSendEmbed(m.ChannelID, &em)
-			if err != nil {
-				log.Error(err)
-			}
-		} else {
-			for _, sound := range COLLECTIONS {
-				if helpCommand[1] == sound.Prefix {
-					var em = discordgo.MessageEmbed{
-						Title:       sound.Prefix,
-						Color:       0xE5343A,
-						Description: "Here are a list of sounds that can be used with this prefix\nTo use these use " + strings.Join(sound.Commands, ", ") + " {any of the below}\n",
-					}
-					for _, v := range sound.Sounds {
-						em.Description += v.Name + "\n"
-					}
-					_, err := s.ChannelMessageSendEmbed(m.ChannelID, &em)
-					if err != nil {
-						log.Error(err)
-					}
-				}
-			}
-		}
+	// Guilds with a custom prefix get it swapped for ! so the rest of the command handling is the same
+	settings := getGuildSettings(guild.ID)
+	if settings.Prefix != "!" && strings.HasPrefix(m.Content, settings.Prefix) {
+		m.Content = "!" + strings.TrimPrefix(m.Content, settings.Prefix)
+	}
+
+	if m.Content[0] != '!' && len(m.Mentions) < 1 {
+		return
+	}
+
+	if blocked(m.Author.ID, guild.ID) {
+		return
+	}
+
+	// Another instance is serving this guild
+	if !claimGuild(guild.ID) {
+		return
+	}
+
+	msg := strings.Replace(m.ContentWithMentionsReplaced(), s.State.Ready.User.Username, "username", 1)
+	parts := strings.Split(strings.ToLower(msg), " ")
+
+	if checkSpam(m, guild, settings, parts) {
+		return
+	}
+
+	if routeCommand(m, guild, settings, parts) {
+		return
+	}
+
+	if !settings.ChannelAllowed(m.ChannelID) && m.Author.ID != OWNER {
 		return
 	}
 
@@ -961,24 +1098,9 @@ func onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 	}
 
 	// Find the collection for the command we got
-	for _, coll := range COLLECTIONS {
+	for _, coll := range getCollections() {
 		if scontains(parts[0], coll.Commands...) {
-
-			// If they passed a specific sound effect, find and select that (otherwise play nothing)
-			var sound *Sound
-			if len(parts) > 1 {
-				for _, s := range coll.Sounds {
-					if parts[1] == s.Name {
-						sound = s
-					}
-				}
-
-				if sound == nil {
-					return
-				}
-			}
-
-			go enqueuePlay(m.Author, guild, coll, sound)
+			routeCollectionCommand(m, guild, settings, parts, coll)
 			return
 		}
 	}
@@ -986,23 +1108,164 @@ func onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 
 func main() {
 	var (
-		Token      = flag.String("t", "", "Discord Authentication Token")
-		Redis      = flag.String("r", "", "Redis Connection String")
-		Shard      = flag.String("s", "", "Shard ID")
-		ShardCount = flag.String("c", "", "Number of shards")
-		Owner      = flag.String("o", "", "Owner ID")
-		err        error
+		Token          = flag.String("t", "", "Discord Authentication Token")
+		Redis          = flag.String("r", "", "Redis Connection String")
+		Stats          = flag.String("stats", "redis", "Where stats are recorded: redis, none or driver:dsn for a SQL database (eg. sqlite3:airhorn.db)")
+		Shard          = flag.String("s", "", "Shard ID")
+		ShardCount     = flag.String("c", "", "Number of shards")
+		Manage         = flag.Bool("manage", false, "Run a bot process for every shard instead of connecting to discord directly")
+		ShardCheck     = flag.Duration("shardcheck", time.Hour*6, "How often the shard manager checks for a new recommended shard count")
+		Owner          = flag.String("o", "", "Owner ID")
+		TTS            = flag.String("tts", "", "Text-to-speech backend for !say (espeak, espeak:<voice> or a http url)")
+		Encoder        = flag.String("dca", "dca-rs", "Path to the dca-rs binary used to encode sounds on the fly")
+		Assets         = flag.String("assets", "", "Base url to fetch sound files missing from the audio directory from")
+		ServeAssets    = flag.String("serveassets", "", "Address to serve the audio directory on for other instances to fetch")
+		Bitrate        = flag.Int("bitrate", 128, "Default bitrate (in kbps) sounds are encoded at on the fly")
+		Control        = flag.String("control", "", "Unix socket to serve the local control api on, for playing sounds from other programs")
+		RemoteSecret   = flag.String("remotesecret", "", "Key shared with the webserver to sign web soundboard plays, they're ignored without one")
+		Originals      = flag.String("originals", "", "Directory of original sound files (<collection>_<sound>.mp3 or .ogg) sent by !preview instead of the encoded sound")
+		Silence        = flag.Int("silence", 5, "Frames of silence sent after every sound so clients don't clip the end")
+		PaceLead       = flag.Int("pacelead", 2, "Frames sent ahead of the 20ms playback schedule, more smooths over slow links at the cost of latency")
+		PinPercent     = flag.Int("pin", 100, "Percentage of the most played sounds to keep in memory, the rest are streamed from disk")
+		Warmup         = flag.Duration("warmup", time.Hour*24*7, "Only load sounds played within this long on startup, loading the rest when first played (0 loads everything)")
+		MaxSoundMem    = flag.String("maxsoundmem", "", "Memory budget for sounds (eg. 256MB), loading them when first played and evicting the least recently played")
+		RetierInterval = flag.Duration("retier", time.Hour, "How often to recalculate which sounds are kept in memory")
+		URLCacheSize   = flag.Int("urlcache", 100, "Number of sounds downloaded by !play to keep cached on disk")
+		STT            = flag.String("stt", "", "Speech-to-text backend used to screen uploads (exec:<command> or a http url)")
+		ScreenWords    = flag.String("screenwords", "screenwords.txt", "File of words and phrases that hold an upload for review")
+		Health         = flag.String("health", "", "Address to serve the /healthz and /readyz probes and the /status page on, for a single shard (ignored with -manage)")
+		Presence       = flag.String("presence", "", "File of presences to rotate through, one \"<playing|listening|watching|competing> <template>\" per line")
+		PackIndex      = flag.String("packindex", "", "HTTPS url of the JSON soundpack index !packs browses and installs from")
+		Seasons        = flag.String("seasons", "", "JSON file of seasons collections are played in, eg. a spooky collection only in October")
+		VoiceIdle      = flag.Duration("voiceidle", 0, "How long to stay in voice after the queue is done, so the next play doesn't have to join again (0 leaves straight away)")
+		PresenceEvery  = flag.Duration("presenceinterval", time.Minute*5, "How often to move on to the next presence")
+		Check          = flag.Bool("check", false, "Check every sound file in the audio directory and exit")
+		LogLevel       = flag.String("loglevel", "info", "Lowest level logged: debug, info, warning or error")
+		LogFormat      = flag.String("logformat", "text", "Log format: text or json")
+		LogFile        = flag.String("logfile", "", "Also write logs to this file, shards append their id to the name")
+		LogMaxSize     = flag.String("logmaxsize", "100MB", "Size the log file is rotated at")
+		LogKeep        = flag.Int("logkeep", 5, "Number of rotated log files kept")
+		ErrorWebhook   = flag.String("errorwebhook", "", "Discord webhook URL errors are reported to")
+		SentryDSN      = flag.String("sentry", "", "Sentry DSN errors are reported to")
+		Strict         = flag.Bool("strict", false, "Refuse to start if any sound file is broken instead of disabling those sounds (with -check, orphaned files fail too)")
+		err            error
 	)
 	flag.Parse()
 
+	// Seeded once, seeding on every pick made picks in the same nanosecond repeat
+	rand.Seed(time.Now().UTC().UnixNano())
+
+	logPath := *LogFile
+	if logPath != "" && *Shard != "" {
+		logPath += "." + *Shard
+	}
+	logMaxSize, err := humanize.ParseBytes(*LogMaxSize)
+	if err == nil {
+		err = setupLogging(*LogLevel, *LogFormat, logPath, int64(logMaxSize), *LogKeep)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Fatal("Invalid logging options")
+		return
+	}
+
+	if *ErrorWebhook != "" || *SentryDSN != "" {
+		reporter, err := newErrorReporter(*ErrorWebhook, *SentryDSN)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Fatal("Invalid error reporting options")
+			return
+		}
+		log.AddHook(reporter)
+		go reporter.run()
+	}
+
+	if err := loadInstalledPacks(); err != nil {
+		log.WithFields(log.Fields{
+			"path":  PACKS_FILE,
+			"error": err,
+		}).Fatal("Failed to load installed soundpacks")
+		return
+	}
+
+	if *Check {
+		report := checkAudio(COLLECTIONS)
+		report.print(os.Stdout)
+		if len(report.Broken) > 0 || (*Strict && len(report.Orphans) > 0) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	URL_CACHE_SIZE = *URLCacheSize
+
 	if *Owner != "" {
 		OWNER = *Owner
 	}
 
-	// Preload all the sounds
-	log.Info("Preloading sounds...")
-	for _, coll := range COLLECTIONS {
-		coll.Load()
+	DCA_ENCODER = *Encoder
+	ASSET_URL = *Assets
+	BITRATE = *Bitrate
+	sound.SilenceFrames = *Silence
+	queues.Fair = func(gid string) bool {
+		return getGuildSettings(gid).FairChannels
+	}
+	REMOTE_PLAY_SECRET = *RemoteSecret
+	ORIGINALS_DIR = *Originals
+	VOICE_IDLE = *VoiceIdle
+	PACK_INDEX_URL = *PackIndex
+	if PACK_INDEX_URL != "" && !strings.HasPrefix(PACK_INDEX_URL, "https://") {
+		log.WithFields(log.Fields{
+			"url": PACK_INDEX_URL,
+		}).Fatal("The soundpack index has to be served over https")
+		return
+	}
+	sound.PaceLead = *PaceLead
+
+	if *TTS != "" {
+		tts = newTTSBackend(*TTS)
+		if tts == nil {
+			log.WithFields(log.Fields{
+				"backend": *TTS,
+			}).Fatal("Unknown text-to-speech backend")
+			return
+		}
+	}
+
+	if *STT != "" {
+		stt = newSTTBackend(*STT)
+		if stt == nil {
+			log.WithFields(log.Fields{
+				"backend": *STT,
+			}).Fatal("Unknown speech-to-text backend")
+			return
+		}
+
+		err = loadScreenWords(*ScreenWords)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"path":  *ScreenWords,
+				"error": err,
+			}).Fatal("Failed to load screened words")
+			return
+		}
+	}
+
+	PIN_PERCENT = *PinPercent
+	WARMUP_WINDOW = *Warmup
+
+	if *MaxSoundMem != "" {
+		budget, err := humanize.ParseBytes(*MaxSoundMem)
+		if err != nil || budget == 0 {
+			log.WithFields(log.Fields{
+				"maxsoundmem": *MaxSoundMem,
+				"error":       err,
+			}).Fatal("Invalid sound memory budget")
+			return
+		}
+		soundCache = sound.NewCache(int64(budget))
 	}
 
 	// If we got passed a redis server, try to connect
@@ -1019,6 +1282,93 @@ func main() {
 		}
 	}
 
+	statsSink, err = openStatsSink(*Stats)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"stats": *Stats,
+			"error": err,
+		}).Fatal("Failed to open stats backend")
+		return
+	}
+
+	// Only one process serves the assets, the manager if there is one
+	if *ServeAssets != "" {
+		go serveAssets(*ServeAssets)
+	}
+
+	// The manager only supervises the shard processes, which do everything else
+	if *Manage {
+		count, _ := strconv.Atoi(*ShardCount)
+		sm := &ShardManager{
+			Token:      *Token,
+			FixedCount: count,
+			Args:       shardArgs(),
+		}
+
+		if err := sm.Run(*ShardCheck); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Fatal("Failed to run shards")
+		}
+		return
+	}
+
+	// Broken sounds are left out unless that should stop the bot altogether
+	fetchMissingAssets(COLLECTIONS)
+	report := checkAudio(COLLECTIONS)
+	report.log()
+	if len(report.Broken) > 0 {
+		if *Strict {
+			log.WithFields(log.Fields{
+				"broken": len(report.Broken),
+			}).Fatal("Refusing to start with broken sound files")
+			return
+		}
+		COLLECTIONS = withoutBrokenSounds(COLLECTIONS, report.Broken)
+	}
+
+	// Preload all the sounds
+	log.Info("Preloading sounds...")
+	loadSounds()
+	go retierLoop(*RetierInterval)
+	go reloadOnSignal()
+
+	loadExperiments()
+
+	if err := loadLocales(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Fatal("Failed to load message catalogs")
+		return
+	}
+
+	if *Presence != "" {
+		if err := loadPresences(*Presence); err != nil {
+			log.WithFields(log.Fields{
+				"path":  *Presence,
+				"error": err,
+			}).Fatal("Failed to load presences")
+			return
+		}
+	}
+
+	if *Seasons != "" {
+		SEASONS_FILE = *Seasons
+		if err := loadSeasons(SEASONS_FILE); err != nil {
+			log.WithFields(log.Fields{
+				"path":  SEASONS_FILE,
+				"error": err,
+			}).Fatal("Failed to load seasons")
+			return
+		}
+	}
+
+	registerCommands()
+	playHooks = append(playHooks, auditPlay, trackRecentPlay)
+	playStartHooks = append(playStartHooks, celebratePlay, recordHistory)
+	go expireCommandUsage()
+	go expireSpamTrackers()
+
 	// Create a discord session
 	log.Info("Starting discord session...")
 	discord, err = discordgo.New(*Token)
@@ -1029,6 +1379,11 @@ func main() {
 		return
 	}
 
+	// Message content is a privileged intent and has to be enabled for the
+	// application in the developer portal, commands are read from it
+	discord.Identify.Intents = BOT_INTENTS
+	discord.ShouldReconnectOnError = true
+
 	// Set sharding info
 	discord.ShardID, _ = strconv.Atoi(*Shard)
 	discord.ShardCount, _ = strconv.Atoi(*ShardCount)
@@ -1039,7 +1394,27 @@ func main() {
 
 	discord.AddHandler(onReady)
 	discord.AddHandler(onGuildCreate)
+	discord.AddHandler(trackBotGuild)
+	discord.AddHandler(untrackBotGuild)
 	discord.AddHandler(onMessageCreate)
+	discord.AddHandler(onInteractionCreate)
+	discord.AddHandler(onVoiceStateUpdate)
+	discord.AddHandler(onVoiceStateLeave)
+	discord.AddHandler(onAutoModerationAction)
+	discord.AddHandler(onScheduledEventCreate)
+	discord.AddHandler(onScheduledEventUpdate)
+	discord.AddHandler(onScheduledEventDelete)
+	discord.AddHandler(onConnect)
+	discord.AddHandler(onDisconnect)
+	discord.AddHandler(onResumed)
+	discord.AddHandler(onBotVoiceStateUpdate)
+	discord.AddHandler(onVoiceChannelDelete)
+	discord.AddHandler(onIdleGuildDelete)
+
+	// Probes are answered while the gateway is still connecting
+	if *Health != "" {
+		go serveHealth(*Health)
+	}
 
 	err = discord.Open()
 	if err != nil {
@@ -1049,11 +1424,35 @@ func main() {
 		return
 	}
 
+	go publishShardStats()
+	go renewGuildLeases()
+	go runScheduler()
+	go flushAuditLog()
+	go expireFollows()
+	go rotatePresence(discord, *PresenceEvery)
+	if rcli != nil {
+		go listenSyncPlays()
+		publishCatalog()
+	}
+	if rcli != nil && REMOTE_PLAY_SECRET != "" {
+		go listenRemotePlays()
+	}
+	if *Control != "" {
+		go serveControl(*Control)
+	}
+
 	// We're running!
 	log.Info("AIRHORNBOT is ready to horn it up.")
 
 	// Wait for a signal to quit
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill)
-	<-c
+	select {
+	case <-c:
+	case <-shutdownRequested:
+		log.Info("Shutting down on the owner's request")
+	}
+
+	releaseGuildLeases()
+	dropAllIdleVoice()
 }
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"github.com/noisemaster/airhornbot/pkg/queue"
+)
+
+// Play start hook posting the sound's celebration in the channel it was
+// requested from, for guilds that turned celebrations on
+func celebratePlay(play *queue.Play) {
+	if play.Sound.Celebration == "" || play.TextChannelID == "" {
+		return
+	}
+
+	if !getGuildSettings(play.GuildID).Celebrations {
+		return
+	}
+	go discord.ChannelMessageSend(play.TextChannelID, play.Sound.Celebration)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	"github.com/noisemaster/airhornbot/pkg/sound"
+)
+
+const (
+	// Longest chain a guild can allow with `!settings set maxchain`
+	MAX_CHAIN_LENGTH = 10
+)
+
+// A sound picked for one link of a chain
+type chainLink struct {
+	Collection *sound.Collection
+	Sound      *sound.Sound
+}
+
+// Handles `!chain <collection[:sound]> ...`, playing the sounds back to back as
+// a single chain so nothing else in the queue gets between them. Links without
+// a sound play a random one from their collection.
+func handleChainCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, parts []string) {
+	gs := getGuildSettings(guild.ID)
+	if len(parts) < 2 {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Usage: `!chain <collection[:sound]> ...` with up to %d sounds, eg. `!chain airhorn:default jc:nameis airhorn:truck`", gs.MaxChainLength))
+		return
+	}
+
+	links, err := parseChain(guild, gs, m.Author.ID, parts[1:])
+	if err != nil {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Can't play that chain, %s", err))
+		return
+	}
+	playChain(m, guild, links)
+}
+
+// Parses the links of a chain, which has to fit the guild's max chain length
+func parseChain(guild *discordgo.Guild, gs *GuildSettings, uid string, args []string) ([]*chainLink, error) {
+	if len(args) > gs.MaxChainLength {
+		return nil, fmt.Errorf("chains on this server can be at most %d sounds long", gs.MaxChainLength)
+	}
+
+	links := make([]*chainLink, 0, len(args))
+	for _, arg := range args {
+		link, err := parseChainLink(guild, gs, uid, arg)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// Queues the links as a single chain in the author's voice channel
+func playChain(m *discordgo.MessageCreate, guild *discordgo.Guild, links []*chainLink) {
+	if onCooldown(guild.ID, m.Author.ID) {
+		return
+	}
+
+	channel := getCurrentVoiceChannel(m.Author, guild)
+	if channel == nil {
+		return
+	}
+
+	if !claimChain(guild.ID, m.ChannelID, links) {
+		return
+	}
+
+	// Links can bring their own chain (like !anotha), so each is added at the tail
+	var head, tail *queue.Play
+	for _, link := range links {
+		play := newPlay(guild, channel.ID, m.Author.ID, link.Collection, link.Sound, queue.SOURCE_COMMAND)
+		if head == nil {
+			head = play
+		} else {
+			tail.Next = play
+		}
+
+		for tail = play; ; tail = tail.Next {
+			tail.TextChannelID = m.ChannelID
+			if tail.Next == nil {
+				break
+			}
+		}
+	}
+
+	queuePlay(head)
+}
+
+// Parses `collection` or `collection:sound` into a link the user may play
+func parseChainLink(guild *discordgo.Guild, gs *GuildSettings, uid, arg string) (*chainLink, error) {
+	parts := strings.SplitN(arg, ":", 2)
+
+	var coll *sound.Collection
+	for _, c := range getCollections() {
+		if c.Prefix == parts[0] || scontains("!"+parts[0], c.Commands...) {
+			coll = c
+			break
+		}
+	}
+
+	if coll == nil || !gs.CollectionEnabled(coll) || !canUse(guild, uid, coll.Prefix) {
+		return nil, fmt.Errorf("there is no collection %s you can play", parts[0])
+	}
+
+	if len(parts) < 2 || parts[1] == "" {
+		return &chainLink{coll, randomSound(guild.ID, coll)}, nil
+	}
+
+	s := resolveSound(gs, coll, parts[1])
+	if s == nil {
+		return nil, fmt.Errorf("there is no sound %s in %s", parts[1], coll.Prefix)
+	}
+	return &chainLink{coll, s}, nil
+}
+
+// Claims the collection cooldowns and sound intervals of every link, only
+// once each so a chain can repeat a collection or sound. Returns false (after
+// telling the channel) if one of them isn't free.
+func claimChain(gid, cid string, links []*chainLink) bool {
+	claimed := make(map[string]bool)
+	for _, link := range links {
+		if !claimed[link.Collection.Prefix] {
+			claimed[link.Collection.Prefix] = true
+			if remaining := claimCollection(gid, link.Collection); remaining > 0 {
+				discord.ChannelMessageSend(cid, localize(gid, "cooldown.collection", map[string]interface{}{
+					"Collection": link.Collection.Prefix,
+					"Remaining":  remaining.Round(time.Second),
+				}))
+				return false
+			}
+		}
+
+		key := link.Collection.Prefix + ":" + link.Sound.Name
+		if !claimed[key] {
+			claimed[key] = true
+			if remaining := claimSound(gid, link.Collection.Prefix, link.Sound); remaining > 0 {
+				discord.ChannelMessageSend(cid, localize(gid, "interval.locked", map[string]interface{}{
+					"Sound":     link.Sound.Name,
+					"Remaining": remaining.Round(time.Second),
+				}))
+				return false
+			}
+		}
+	}
+	return true
+}
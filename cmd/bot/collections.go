@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How long the reply to a disabled collection's command stays up
+	DISABLED_REPLY_LIFETIME = time.Second * 10
+)
+
+// Handles `!collections [list]`, `!collections disable <collection...>` and
+// `!collections enable <collection...>`. Everyone can list the collections,
+// only admins can turn them on and off.
+func handleCollectionsCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, parts []string, dryRun bool) {
+	if len(parts) < 2 || parts[1] == "list" {
+		displayCollections(m.ChannelID, getGuildSettings(guild.ID))
+		return
+	}
+
+	if (parts[1] != "disable" && parts[1] != "enable") || len(parts) < 3 {
+		discord.ChannelMessageSend(m.ChannelID, "Usage: `!collections [list]` or `!collections disable|enable <collection...>`")
+		return
+	}
+
+	if !isGuildAdmin(guild, m.Author.ID, m.ChannelID) {
+		discord.ChannelMessageSend(m.ChannelID, "Only server admins can turn collections on and off")
+		return
+	}
+
+	// Collections can be given by prefix or command, with or without the !
+	names := make([]string, len(parts)-2)
+	for i, name := range parts[2:] {
+		names[i] = strings.TrimPrefix(name, "!")
+	}
+
+	prefixes, err := parseCollections(names)
+	if err != nil {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Can't %s that, %s", parts[1], err))
+		return
+	}
+
+	disable := parts[1] == "disable"
+	update := func(gs *GuildSettings) {
+		for _, prefix := range prefixes {
+			gs.DisabledCollections = sremove(prefix, gs.DisabledCollections)
+			if disable {
+				gs.DisabledCollections = append(gs.DisabledCollections, prefix)
+			}
+		}
+	}
+
+	if dryRun {
+		if changes, err := settingsChanges(guild.ID, update); err == nil {
+			reportDryRun(m.ChannelID, changes)
+		}
+		return
+	}
+
+	if _, err := updateGuildSettings(guild.ID, update); err != nil {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"error": err,
+		}).Error("Failed to save guild settings")
+		return
+	}
+	discord.ChannelMessageSend(m.ChannelID, ":ok_hand:")
+}
+
+func displayCollections(cid string, gs *GuildSettings) {
+	enabled := make([]string, 0)
+	disabled := make([]string, 0)
+	for _, coll := range getCollections() {
+		if gs.CollectionEnabled(coll) {
+			enabled = append(enabled, coll.Prefix)
+		} else {
+			disabled = append(disabled, coll.Prefix)
+		}
+	}
+
+	discord.ChannelMessageSendEmbed(cid, &discordgo.MessageEmbed{
+		Title:       "Collections",
+		Color:       0xE5343A,
+		Description: fmt.Sprintf("**enabled** - %s\n**disabled** - %s", orNone(strings.Join(enabled, ", ")), orNone(strings.Join(disabled, ", "))),
+	})
+}
+
+// Tells the channel a collection is disabled here, removing the reply after a
+// while so it doesn't clutter the channel
+func replyCollectionDisabled(cid, gid, prefix string) {
+	key := "collection.disabled"
+	if outOfSeason(prefix, time.Now()) {
+		key = "collection.outofseason"
+	}
+
+	msg, err := discord.ChannelMessageSend(cid, localize(gid, key, map[string]string{
+		"Collection": prefix,
+	}))
+	if err != nil {
+		return
+	}
+
+	time.AfterFunc(DISABLED_REPLY_LIFETIME, func() {
+		discord.ChannelMessageDelete(cid, msg.ID)
+	})
+}
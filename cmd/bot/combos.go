@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Most combos a guild can save
+	MAX_COMBOS = 25
+)
+
+// Combo names are used as a single word in commands
+var comboNameRegex = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// Handles `!combo list`, `!combo play <name>`, `!combo save <name> <collection[:sound]> ...`
+// and `!combo remove <name>`. Everyone can list and play combos, only admins
+// can change them.
+func handleComboCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, parts []string, dryRun bool) {
+	gs := getGuildSettings(guild.ID)
+	if len(parts) < 2 || parts[1] == "list" {
+		displayCombos(m.ChannelID, gs)
+		return
+	}
+
+	if parts[1] == "play" && len(parts) == 3 {
+		links, exists := gs.Combos[parts[2]]
+		if !exists {
+			discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("There is no combo %s, see them with `!combo list`", parts[2]))
+			return
+		}
+
+		// Combos are parsed again on every play, the sounds in them could have
+		// been disabled or removed since they were saved
+		chain, err := parseChain(guild, gs, m.Author.ID, links)
+		if err != nil {
+			discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Can't play %s, %s", parts[2], err))
+			return
+		}
+		playChain(m, guild, chain)
+		return
+	}
+
+	if parts[1] != "save" && parts[1] != "remove" {
+		discord.ChannelMessageSend(m.ChannelID, "Usage: `!combo [list]`, `!combo play <name>`, `!combo save <name> <collection[:sound]> ...` or `!combo remove <name>`")
+		return
+	}
+
+	if !isGuildAdmin(guild, m.Author.ID, m.ChannelID) {
+		discord.ChannelMessageSend(m.ChannelID, "Only server admins can change combos")
+		return
+	}
+
+	var update func(gs *GuildSettings)
+	switch {
+	case parts[1] == "save" && len(parts) >= 4:
+		name := parts[2]
+		if !comboNameRegex.MatchString(name) {
+			discord.ChannelMessageSend(m.ChannelID, "Combo names can only use letters, numbers, - and _")
+			return
+		}
+
+		if _, exists := gs.Combos[name]; !exists && len(gs.Combos) >= MAX_COMBOS {
+			discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("This server already has %d combos, remove one first", MAX_COMBOS))
+			return
+		}
+
+		links := parts[3:]
+		if _, err := parseChain(guild, gs, m.Author.ID, links); err != nil {
+			discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Can't save %s, %s", name, err))
+			return
+		}
+
+		update = func(gs *GuildSettings) {
+			if gs.Combos == nil {
+				gs.Combos = make(map[string][]string)
+			}
+			gs.Combos[name] = links
+		}
+	case parts[1] == "remove" && len(parts) == 3:
+		update = func(gs *GuildSettings) {
+			delete(gs.Combos, parts[2])
+		}
+	default:
+		discord.ChannelMessageSend(m.ChannelID, "Usage: `!combo save <name> <collection[:sound]> ...` or `!combo remove <name>`")
+		return
+	}
+
+	if dryRun {
+		if changes, err := settingsChanges(guild.ID, update); err == nil {
+			reportDryRun(m.ChannelID, changes)
+		}
+		return
+	}
+
+	if _, err := updateGuildSettings(guild.ID, update); err != nil {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"error": err,
+		}).Error("Failed to save combo")
+		return
+	}
+	discord.ChannelMessageSend(m.ChannelID, ":ok_hand:")
+}
+
+func displayCombos(cid string, gs *GuildSettings) {
+	if len(gs.Combos) == 0 {
+		discord.ChannelMessageSend(cid, "There are no combos, admins can add one with `!combo save <name> <collection[:sound]> ...`")
+		return
+	}
+
+	names := make([]string, 0, len(gs.Combos))
+	for name := range gs.Combos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = fmt.Sprintf("**%s** - %s", name, strings.Join(gs.Combos[name], " "))
+	}
+	discord.ChannelMessageSend(cid, strings.Join(lines, "\n")+"\nPlay one with `!combo play <name>`")
+}
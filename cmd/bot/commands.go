@@ -0,0 +1,581 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	"github.com/noisemaster/airhornbot/pkg/sound"
+	log "github.com/sirupsen/logrus"
+)
+
+// Who is allowed to run a command
+type Permission int
+
+const (
+	PERM_EVERYONE Permission = iota
+	PERM_ADMIN
+	PERM_OWNER
+)
+
+const (
+	// Flag that makes destructive commands report their changes instead of making them
+	DRY_RUN_FLAG = "--dry-run"
+
+	// Most sounds listed by !find
+	FIND_MAX_RESULTS = 25
+
+	// Commands a single user can run within COMMAND_RATE_WINDOW
+	COMMAND_RATE_LIMIT  = 5
+	COMMAND_RATE_WINDOW = time.Second * 10
+)
+
+var (
+	// Registered text commands, keyed by their name (including the !)
+	commands map[string]*Command = make(map[string]*Command)
+
+	// Middleware every command runs through, outermost first
+	commandMiddleware []CommandMiddleware
+
+	// Commands run by each user in the current rate limit window
+	commandUsage     map[string]*commandWindow = make(map[string]*commandWindow)
+	commandUsageLock sync.Mutex
+)
+
+// CommandContext is everything a command handler gets about the message that invoked it
+type CommandContext struct {
+	Message  *discordgo.MessageCreate
+	Guild    *discordgo.Guild
+	Settings *GuildSettings
+
+	// The lowercased message split on spaces, with mentions replaced by names
+	Parts []string
+
+	// If true the command should only report what it would change
+	DryRun bool
+}
+
+// Renders a message in the language of the guild (or DM) the command was run in
+func (c *CommandContext) translate(key string, data interface{}) string {
+	return translate(c.Settings.Language, key, data)
+}
+
+// Returns the lowercased message split on any whitespace, with mentions left intact
+func (c *CommandContext) Fields() []string {
+	return stripDryRun(strings.Fields(strings.ToLower(c.Message.Content)))
+}
+
+type CommandHandler func(c *CommandContext)
+
+// CommandMiddleware wraps a handler, returning a handler that runs before (or
+// instead of) it
+type CommandMiddleware func(cmd *Command, next CommandHandler) CommandHandler
+
+type Command struct {
+	Name       string
+	Permission Permission
+
+	// Usage shown by !help, commands without one aren't listed
+	Help string
+
+	// If true the command is accepted in channels commands are disabled in
+	AnyChannel bool
+
+	// If true the command understands --dry-run, other commands refuse to run with it
+	DryRun bool
+
+	// If true the command can also be run in direct messages, where the
+	// context has no Guild and the default settings
+	DM bool
+
+	handler CommandHandler
+}
+
+type commandWindow struct {
+	start time.Time
+	count int
+}
+
+// Adds a command to the router, returning it so callers can adjust its options
+func registerCommand(name string, handler CommandHandler, perm Permission, help string) *Command {
+	cmd := &Command{
+		Name:       name,
+		Permission: perm,
+		Help:       help,
+		handler:    handler,
+	}
+	commands[name] = cmd
+	return cmd
+}
+
+// Returns true if the user is allowed to run the command in the channel
+func (cmd *Command) allowed(guild *discordgo.Guild, uid, cid string) bool {
+	if guild == nil {
+		return cmd.DM && cmd.Permission == PERM_EVERYONE
+	}
+
+	switch cmd.Permission {
+	case PERM_ADMIN:
+		return isGuildAdmin(guild, uid, cid)
+	case PERM_OWNER:
+		return uid == OWNER
+	}
+	return true
+}
+
+// Returns the command a message runs, nil if there is none. Commands can be
+// registered under two words (like `!airhorn optout`), which win over the
+// first word alone.
+func lookupCommand(parts []string) *Command {
+	if len(parts) > 1 {
+		if cmd, exists := commands[parts[0]+" "+parts[1]]; exists {
+			return cmd
+		}
+	}
+	return commands[parts[0]]
+}
+
+// Runs the command through every middleware
+func (cmd *Command) run(c *CommandContext) {
+	handler := cmd.handler
+	for i := len(commandMiddleware) - 1; i >= 0; i-- {
+		handler = commandMiddleware[i](cmd, handler)
+	}
+	handler(c)
+}
+
+// Logs every command that is run
+func logCommand(cmd *Command, next CommandHandler) CommandHandler {
+	return func(c *CommandContext) {
+		gid := ""
+		if c.Guild != nil {
+			gid = c.Guild.ID
+		}
+
+		log.WithFields(log.Fields{
+			"command": cmd.Name,
+			"guild":   gid,
+			"user":    c.Message.Author.ID,
+		}).Debug("Running command")
+		next(c)
+	}
+}
+
+// Drops commands from users that have run more than COMMAND_RATE_LIMIT commands
+// within COMMAND_RATE_WINDOW
+func rateLimitCommand(cmd *Command, next CommandHandler) CommandHandler {
+	return func(c *CommandContext) {
+		uid := c.Message.Author.ID
+		if uid == OWNER {
+			next(c)
+			return
+		}
+
+		commandUsageLock.Lock()
+		window, exists := commandUsage[uid]
+		if !exists || time.Since(window.start) > COMMAND_RATE_WINDOW {
+			window = &commandWindow{start: time.Now()}
+			commandUsage[uid] = window
+		}
+		window.count++
+		limited := window.count > COMMAND_RATE_LIMIT
+		commandUsageLock.Unlock()
+
+		if limited {
+			log.WithFields(log.Fields{
+				"command": cmd.Name,
+				"user":    uid,
+			}).Info("Dropping rate limited command")
+			return
+		}
+		next(c)
+	}
+}
+
+// Ignores commands the user isn't allowed to run
+func checkCommandPermission(cmd *Command, next CommandHandler) CommandHandler {
+	return func(c *CommandContext) {
+		if !cmd.allowed(c.Guild, c.Message.Author.ID, c.Message.ChannelID) {
+			return
+		}
+		next(c)
+	}
+}
+
+// Refuses to run commands that don't support dry runs with --dry-run, so it
+// can never be mistaken for a no-op
+func checkDryRun(cmd *Command, next CommandHandler) CommandHandler {
+	return func(c *CommandContext) {
+		if c.DryRun && !cmd.DryRun {
+			discord.ChannelMessageSend(c.Message.ChannelID, fmt.Sprintf("`%s` doesn't support %s", cmd.Name, DRY_RUN_FLAG))
+			return
+		}
+		next(c)
+	}
+}
+
+// Returns parts without the dry run flag
+func stripDryRun(parts []string) []string {
+	return sremove(DRY_RUN_FLAG, parts)
+}
+
+// Reports the changes a dry run of a command would have made
+func reportDryRun(cid string, changes []string) {
+	if len(changes) == 0 {
+		discord.ChannelMessageSend(cid, "Dry run: nothing would change")
+		return
+	}
+
+	discord.ChannelMessageSendEmbed(cid, &discordgo.MessageEmbed{
+		Title:       "Dry run",
+		Color:       0xE5343A,
+		Description: "Nothing was changed, running this without " + DRY_RUN_FLAG + " would:\n- " + strings.Join(changes, "\n- "),
+	})
+}
+
+// Removes rate limit windows that have expired
+func expireCommandUsage() {
+	for {
+		time.Sleep(COMMAND_RATE_WINDOW * 6)
+
+		commandUsageLock.Lock()
+		for uid, window := range commandUsage {
+			if time.Since(window.start) > COMMAND_RATE_WINDOW {
+				delete(commandUsage, uid)
+			}
+		}
+		commandUsageLock.Unlock()
+	}
+}
+
+// Registers all of the text commands and the middleware they run through
+func registerCommands() {
+	commandMiddleware = []CommandMiddleware{logCommand, rateLimitCommand, checkCooldown, checkCommandPermission, checkDryRun}
+
+	registerCommand("!help", handleHelpCommand, PERM_EVERYONE, "").DM = true
+
+	settings := registerCommand("!settings", func(c *CommandContext) {
+		handleSettingsCommand(c.Message, c.Guild, c.Fields(), c.DryRun)
+	}, PERM_ADMIN, "show or change this server's settings")
+	settings.AnyChannel = true
+	settings.DryRun = true
+
+	channels := registerCommand("!airhornchannel", func(c *CommandContext) {
+		handleAirhornChannelCommand(c.Message, c.Guild, c.Fields(), c.DryRun)
+	}, PERM_ADMIN, "allow or deny commands in channels")
+	channels.AnyChannel = true
+	channels.DryRun = true
+
+	config := registerCommand("!airhornconfig", func(c *CommandContext) {
+		handleConfigCommand(c.Message, c.Guild, c.DryRun)
+	}, PERM_ADMIN, "change settings for many collections at once")
+	config.AnyChannel = true
+	config.DryRun = true
+
+	registerCommand("!ping", func(c *CommandContext) {
+		handlePingCommand(c.Message, c.Guild)
+	}, PERM_EVERYONE, "check whether the bot or discord is slow")
+
+	registerCommand("!queue", func(c *CommandContext) {
+		handleQueueCommand(c.Message, c.Guild, c.Fields())
+	}, PERM_EVERYONE, "see what is playing and queued, admins can clear the queue")
+
+	registerCommand("!listen", func(c *CommandContext) {
+		handleListenCommand(c.Message, c.Guild, c.Fields())
+	}, PERM_EVERYONE, "listen in voice and horn back at claps and yells (experimental)")
+
+	registerCommand("!bomb", func(c *CommandContext) {
+		handleBombCommand(c.Message, c.Guild, c.Fields())
+	}, PERM_EVERYONE, "set off (or stop) a bomb of airhorns, for moderators")
+
+	registerCommand("!collections", func(c *CommandContext) {
+		handleCollectionsCommand(c.Message, c.Guild, c.Fields(), c.DryRun)
+	}, PERM_EVERYONE, "list the collections, or for admins turn them on and off").DryRun = true
+
+	registerCommand("!weights", func(c *CommandContext) {
+		handleWeightsCommand(c.Message, c.Guild, c.Fields(), c.DryRun)
+	}, PERM_EVERYONE, "see how likely sounds are to be picked, or for admins favor variety").DryRun = true
+
+	registerCommand("!events", func(c *CommandContext) {
+		handleEventsCommand(c.Message.ChannelID, c.Guild)
+	}, PERM_EVERYONE, "see which seasonal collections are on and coming up")
+
+	registerCommand("!quiethours", func(c *CommandContext) {
+		handleQuietHoursCommand(c.Message, c.Guild, c.DryRun)
+	}, PERM_ADMIN, "stop sounds from playing at night").DryRun = true
+
+	registerCommand("!chain", func(c *CommandContext) {
+		handleChainCommand(c.Message, c.Guild, c.Fields())
+	}, PERM_EVERYONE, "play several sounds back to back")
+
+	registerCommand("!last", func(c *CommandContext) {
+		handleLastCommand(c.Message.ChannelID, c.Guild)
+	}, PERM_EVERYONE, "see who played what recently")
+
+	registerCommand("!again", func(c *CommandContext) {
+		handleAgainCommand(c.Message, c.Guild)
+	}, PERM_EVERYONE, "play the last sound again")
+
+	registerCommand("!fav", func(c *CommandContext) {
+		handleFavoriteCommand(c.Message, c.Guild, c.Fields())
+	}, PERM_EVERYONE, "play one of your favorite sounds, or add and list them")
+
+	registerCommand("!combo", func(c *CommandContext) {
+		handleComboCommand(c.Message, c.Guild, c.Fields(), c.DryRun)
+	}, PERM_EVERYONE, "play (or for admins, save) named sets of sounds").DryRun = true
+
+	registerCommand("!rent", func(c *CommandContext) {
+		handleRentCommand(c.Message, c.Guild, c.Fields(), c.DryRun)
+	}, PERM_ADMIN, "enable a disabled collection for a while").DryRun = true
+
+	registerCommand("!alias", func(c *CommandContext) {
+		handleAliasCommand(c.Message, c.Guild, c.Fields(), c.DryRun)
+	}, PERM_ADMIN, "play sounds by another name").DryRun = true
+
+	registerCommand("!auditlog", func(c *CommandContext) {
+		handleAuditLogCommand(c.Message, c.Guild, c.Fields(), c.DryRun)
+	}, PERM_ADMIN, "log every play to a channel").DryRun = true
+
+	registerCommand("!perms", func(c *CommandContext) {
+		handlePermsCommand(c.Message, c.Guild, c.Fields(), c.DryRun)
+	}, PERM_ADMIN, "limit collections to roles").DryRun = true
+
+	registerCommand("!custom", func(c *CommandContext) {
+		handleCustomCommand(c.Message, c.Guild, c.Parts, c.DryRun)
+	}, PERM_EVERYONE, "play and manage this server's own sounds").DryRun = true
+
+	registerCommand("!share", func(c *CommandContext) {
+		handleShareCommand(c.Message, c.Guild, c.Parts)
+	}, PERM_ADMIN, "share a custom sound with another server")
+
+	registerCommand("!import", func(c *CommandContext) {
+		handleImportCommand(c.Message, c.Guild, c.Parts)
+	}, PERM_ADMIN, "import a sound shared by another server")
+
+	registerCommand("!gallery", func(c *CommandContext) {
+		handleGalleryCommand(c.Message, c.Guild, c.Parts)
+	}, PERM_EVERYONE, "browse sounds published by other servers")
+
+	registerCommand("!report", func(c *CommandContext) {
+		handleReportCommand(c.Message, c.Guild, c.Parts)
+	}, PERM_EVERYONE, "report a custom sound to the moderators")
+
+	registerCommand("!play", func(c *CommandContext) {
+		handlePlayCommand(c.Message, c.Guild, c.Parts)
+	}, PERM_EVERYONE, "play a sound from a link")
+
+	registerCommand("!packs", func(c *CommandContext) {
+		handlePacksCommand(c.Message, c.Fields())
+	}, PERM_EVERYONE, "browse community soundpacks, which the owner can install")
+
+	registerCommand("!soundboard", func(c *CommandContext) {
+		handleSoundboardCommand(c.Message.ChannelID, c.Guild, c.Parts)
+	}, PERM_EVERYONE, "show buttons for a collection's sounds")
+
+	registerCommand("!say", func(c *CommandContext) {
+		handleSay(c.Message, c.Guild, c.Message.Content[len("!say"):])
+	}, PERM_EVERYONE, "speak some text")
+
+	registerCommand("!schedule", func(c *CommandContext) {
+		handleScheduleCommand(c.Message, c.Guild, c.DryRun)
+	}, PERM_ADMIN, "play a sound at recurring times").DryRun = true
+
+	registerCommand("!language", func(c *CommandContext) {
+		handleLanguageCommand(c.Message.ChannelID, c.Guild.ID, c.Parts)
+	}, PERM_ADMIN, "change the language responses are sent in").AnyChannel = true
+
+	follow := func(c *CommandContext) {
+		handleFollowCommand(c.Message, c.Guild, c.Fields())
+	}
+	registerCommand("!follow", follow, PERM_ADMIN, "play a sound every time someone moves voice channels")
+	registerCommand("!unfollow", follow, PERM_ADMIN, "")
+
+	registerCommand("!find", func(c *CommandContext) {
+		handleFindCommand(c.Message.ChannelID, c.Guild, c.Settings, c.Parts)
+	}, PERM_EVERYONE, "search every collection for a sound").DM = true
+
+	registerCommand("!mystats", func(c *CommandContext) {
+		handleMyStatsCommand(c.Message.ChannelID, c.Message.Author.ID, c.Settings)
+	}, PERM_EVERYONE, "show how many sounds you've played").DM = true
+
+	registerCommand("!aps", func(c *CommandContext) {
+		displayAirhornsPerSecond(c.Message.ChannelID)
+	}, PERM_EVERYONE, "show how many airhorns are being played right now")
+
+	registerCommand("!stats", handleStatsCommand, PERM_EVERYONE, "show how often a sound gets played")
+
+	registerCommand("!airhorn optout", func(c *CommandContext) {
+		handleOptOutCommand(c.Message, true)
+	}, PERM_EVERYONE, "stop tracking your plays").DM = true
+
+	registerCommand("!airhorn optin", func(c *CommandContext) {
+		handleOptOutCommand(c.Message, false)
+	}, PERM_EVERYONE, "").DM = true
+
+	registerCommand("!forgetme", func(c *CommandContext) {
+		handleForgetMeCommand(c.Message)
+	}, PERM_EVERYONE, "delete your stats and stop tracking your plays").DM = true
+
+	block := func(c *CommandContext) {
+		handleBlockCommand(c.Message, c.Fields())
+	}
+	registerCommand("!block", block, PERM_OWNER, "stop the bot answering an abusive user or guild").AnyChannel = true
+	registerCommand("!unblock", block, PERM_OWNER, "").AnyChannel = true
+
+	debug := registerCommand("!debug", func(c *CommandContext) {
+		handleDebugCommand(c.Message, c.Fields())
+	}, PERM_OWNER, "log everything about a guild for a while")
+	debug.AnyChannel = true
+
+	registerCommand("!preview", func(c *CommandContext) {
+		handlePreviewCommand(c.Message, c.Guild, c.Settings, c.Parts)
+	}, PERM_EVERYONE, "get a sound sent to you as a file, to hear it without playing it in voice").DM = true
+
+	random := func(c *CommandContext) {
+		handleRandomCommand(c.Message, c.Guild)
+	}
+	registerCommand("!random", random, PERM_EVERYONE, "play any sound from any collection")
+	registerCommand("!surprise", random, PERM_EVERYONE, "")
+
+	registerCommand("!rate", func(c *CommandContext) {
+		if len(c.Parts) > 1 {
+			rateExperimentPlay(c.Message.ChannelID, c.Guild.ID, c.Message.Author.ID, c.Parts[1])
+		}
+	}, PERM_EVERYONE, "")
+}
+
+// Handles `!find <term>`, listing every sound whose name contains the term
+// along with the command that plays it. Without a guild (in direct messages)
+// custom sounds aren't searched.
+func handleFindCommand(cid string, guild *discordgo.Guild, settings *GuildSettings, parts []string) {
+	if len(parts) < 2 || parts[1] == "" {
+		discord.ChannelMessageSend(cid, translate(settings.Language, "find.usage", nil))
+		return
+	}
+	term := strings.Join(parts[1:], "_")
+
+	matches := make([]string, 0)
+	for _, coll := range getCollections() {
+		if !settings.CollectionEnabled(coll) {
+			continue
+		}
+
+		// Searching for a collection's command lists all of its sounds
+		matchesCollection := strings.Contains(coll.Prefix, term) || scontains("!"+term, coll.Commands...)
+		for _, s := range coll.Sounds {
+			if matchesCollection || strings.Contains(s.Name, term) {
+				matches = append(matches, fmt.Sprintf("`%s %s`", coll.Commands[0], s.Name))
+			}
+		}
+	}
+
+	if rcli != nil && guild != nil {
+		for _, cs := range listCustomSounds(guild.ID) {
+			if cs.Playable() && strings.Contains(cs.Name, term) {
+				matches = append(matches, fmt.Sprintf("`!custom %s`", cs.Name))
+			}
+		}
+	}
+
+	if len(matches) == 0 {
+		discord.ChannelMessageSend(cid, translate(settings.Language, "find.none", map[string]string{"Term": term}))
+		return
+	}
+
+	description := ""
+	if len(matches) > FIND_MAX_RESULTS {
+		description = translate(settings.Language, "find.truncated", map[string]int{"Shown": FIND_MAX_RESULTS, "Total": len(matches)}) + "\n"
+		matches = matches[:FIND_MAX_RESULTS]
+	}
+
+	discord.ChannelMessageSendEmbed(cid, &discordgo.MessageEmbed{
+		Title:       translate(settings.Language, "find.title", map[string]string{"Term": term}),
+		Color:       0xE5343A,
+		Description: description + strings.Join(matches, "\n"),
+	})
+}
+
+// Finds and runs the registered command for a message, returning false if
+// there isn't one
+func routeCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, settings *GuildSettings, parts []string) bool {
+	cmd := lookupCommand(parts)
+	if cmd == nil {
+		return false
+	}
+
+	if !cmd.AnyChannel && !settings.ChannelAllowed(m.ChannelID) && m.Author.ID != OWNER {
+		return true
+	}
+
+	go cmd.run(newCommandContext(m, guild, settings, parts))
+	return true
+}
+
+// Runs a collection's command (like `!airhorn`) for a message. Collections
+// aren't in the registry since packs add them at runtime, their commands are
+// built on the fly but go through the same middleware.
+func routeCollectionCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, settings *GuildSettings, parts []string, coll *sound.Collection) {
+	cmd := &Command{
+		Name:       parts[0],
+		Permission: PERM_EVERYONE,
+		handler: func(c *CommandContext) {
+			playCollectionCommand(c, coll)
+		},
+	}
+	go cmd.run(newCommandContext(m, guild, settings, parts))
+}
+
+func newCommandContext(m *discordgo.MessageCreate, guild *discordgo.Guild, settings *GuildSettings, parts []string) *CommandContext {
+	return &CommandContext{
+		Message:  m,
+		Guild:    guild,
+		Settings: settings,
+		Parts:    stripDryRun(parts),
+		DryRun:   scontains(DRY_RUN_FLAG, parts...),
+	}
+}
+
+// Plays the sound given to a collection's command, or a random one from it
+func playCollectionCommand(c *CommandContext, coll *sound.Collection) {
+	if !c.Settings.CollectionEnabled(coll) {
+		replyCollectionDisabled(c.Message.ChannelID, c.Guild.ID, coll.Prefix)
+		return
+	}
+
+	// If they passed a specific sound effect, find and select that (otherwise play nothing)
+	var s *sound.Sound
+	if len(c.Parts) > 1 {
+		s = resolveSound(c.Settings, coll, c.Parts[1])
+		if s == nil {
+			recordFailedLookup(c.Guild, coll, c.Parts[1])
+			return
+		}
+	}
+
+	enqueuePlay(c.Message.Author, c.Guild, c.Message.ChannelID, coll, s, queue.SOURCE_COMMAND)
+}
+
+// Returns the length and source of a sound for !help listings, empty if
+// neither is known
+func describeSound(s *sound.Sound) string {
+	details := make([]string, 0, 2)
+	if d := s.Duration(); d > 0 {
+		details = append(details, fmt.Sprintf("%.1fs", d.Seconds()))
+	}
+
+	if meta := s.Metadata(); meta != nil {
+		if meta.Info.Title != "" {
+			details = append(details, meta.Info.Title)
+		} else if meta.Origin.URL != "" {
+			details = append(details, meta.Origin.URL)
+		}
+	}
+
+	if len(details) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(details, ", ") + ")"
+}
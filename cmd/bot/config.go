@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Longest cooldown a collection can be given
+	MAX_COLLECTION_COOLDOWN = time.Hour
+)
+
+// Handles `!airhornconfig <operation>[; <operation>...]`, applying every
+// operation to the guild's settings at once. Operations are `disable collection
+// <targets>`, `enable collection <targets>` and `cooldown <targets> <duration|off>`,
+// where targets is a comma separated list of collection prefixes and globs
+// (eg. `*` or `ow*`).
+func handleConfigCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, dryRun bool) {
+	content := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(m.Content, "!airhornconfig")))
+	content = strings.TrimSpace(strings.Replace(content, DRY_RUN_FLAG, "", -1))
+	if content == "" {
+		discord.ChannelMessageSend(m.ChannelID, "Usage: `!airhornconfig disable|enable collection <targets>` or `!airhornconfig cooldown <targets> <duration|off>`, "+
+			"targets can be globs like `*` and operations can be joined with `;`")
+		return
+	}
+
+	updates := make([]func(gs *GuildSettings), 0)
+	for _, op := range strings.Split(content, ";") {
+		update, err := parseConfigOperation(strings.Fields(op))
+		if err != nil {
+			discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Can't apply `%s`: %s", strings.TrimSpace(op), err))
+			return
+		}
+		updates = append(updates, update)
+	}
+
+	update := func(gs *GuildSettings) {
+		for _, u := range updates {
+			u(gs)
+		}
+	}
+
+	if dryRun {
+		if changes, err := settingsChanges(guild.ID, update); err == nil {
+			reportDryRun(m.ChannelID, changes)
+		}
+		return
+	}
+
+	if _, err := updateGuildSettings(guild.ID, update); err != nil {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"error": err,
+		}).Error("Failed to save guild settings")
+		return
+	}
+	discord.ChannelMessageSend(m.ChannelID, ":ok_hand:")
+}
+
+// Parses a single operation into a settings update. Everything is validated
+// here, so the updates themselves can't fail part way through.
+func parseConfigOperation(args []string) (func(gs *GuildSettings), error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty operation")
+	}
+
+	switch args[0] {
+	case "disable", "enable":
+		if len(args) != 3 || args[1] != "collection" {
+			return nil, fmt.Errorf("expected `%s collection <targets>`", args[0])
+		}
+
+		prefixes, err := matchCollections(args[2])
+		if err != nil {
+			return nil, err
+		}
+
+		disable := args[0] == "disable"
+		return func(gs *GuildSettings) {
+			for _, prefix := range prefixes {
+				gs.DisabledCollections = sremove(prefix, gs.DisabledCollections)
+				if disable {
+					gs.DisabledCollections = append(gs.DisabledCollections, prefix)
+				}
+			}
+		}, nil
+	case "cooldown":
+		if len(args) != 3 {
+			return nil, fmt.Errorf("expected `cooldown <targets> <duration|off>`")
+		}
+
+		prefixes, err := matchCollections(args[1])
+		if err != nil {
+			return nil, err
+		}
+
+		var cooldown time.Duration
+		if args[2] != "off" {
+			cooldown, err = time.ParseDuration(args[2])
+			if err != nil || cooldown < time.Second || cooldown > MAX_COLLECTION_COOLDOWN {
+				return nil, fmt.Errorf("cooldowns must be between 1s and 1h, or off")
+			}
+		}
+
+		return func(gs *GuildSettings) {
+			for _, prefix := range prefixes {
+				setCollectionCooldown(gs, prefix, cooldown)
+			}
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown operation %s", args[0])
+}
+
+// Expands a comma separated list of collection prefixes and globs into the
+// prefixes they match. Every item has to match at least one collection.
+func matchCollections(targets string) ([]string, error) {
+	seen := make(map[string]bool)
+	prefixes := make([]string, 0)
+
+	for _, target := range strings.Split(targets, ",") {
+		if target == "" {
+			continue
+		}
+
+		matched := false
+		for _, coll := range getCollections() {
+			ok, err := path.Match(target, coll.Prefix)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %s", target)
+			}
+
+			if ok {
+				matched = true
+				if !seen[coll.Prefix] {
+					seen[coll.Prefix] = true
+					prefixes = append(prefixes, coll.Prefix)
+				}
+			}
+		}
+
+		if !matched {
+			return nil, fmt.Errorf("%s doesn't match any collection", target)
+		}
+	}
+
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("no collections given")
+	}
+	return prefixes, nil
+}
+
+func setCollectionCooldown(gs *GuildSettings, prefix string, cooldown time.Duration) {
+	if cooldown <= 0 {
+		delete(gs.CollectionCooldowns, prefix)
+		return
+	}
+
+	if gs.CollectionCooldowns == nil {
+		gs.CollectionCooldowns = make(map[string]int)
+	}
+	gs.CollectionCooldowns[prefix] = int(cooldown / time.Second)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	"github.com/noisemaster/airhornbot/pkg/sound"
+	"github.com/noisemaster/airhornbot/pkg/stats"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How long the Idempotency-Key of a POST /play is remembered, retries
+	// within it get the original play back instead of playing again
+	CONTROL_IDEMPOTENCY_TTL = time.Minute * 10
+
+	// Longest idempotency key accepted
+	CONTROL_IDEMPOTENCY_MAX_LENGTH = 255
+)
+
+var (
+	// Idempotency keys used without redis to remember them in, keyed by the
+	// idempotency key
+	localIdempotency     map[string]*idempotentPlay = make(map[string]*idempotentPlay)
+	localIdempotencyLock sync.Mutex
+)
+
+// The response to the first POST /play with an idempotency key
+type idempotentPlay struct {
+	response *ControlPlayResponse
+	expires  time.Time
+}
+
+// Body of POST /play on the control socket
+type ControlPlayRequest struct {
+	GuildID string `json:"guild_id"`
+
+	// Voice channel to play in, the busiest one in the guild if empty
+	ChannelID string `json:"channel_id,omitempty"`
+
+	Collection string `json:"collection"`
+
+	// Sound to play, a random one from the collection if empty
+	Sound string `json:"sound,omitempty"`
+
+	// User the play is credited to, if any
+	UserID string `json:"user_id,omitempty"`
+
+	// Identifies the request so retrying it doesn't play twice, the
+	// Idempotency-Key header does the same
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+// Response of POST /play
+type ControlPlayResponse struct {
+	PlayID    string `json:"play_id"`
+	ChannelID string `json:"channel_id"`
+	Sound     string `json:"sound"`
+}
+
+// Response of GET /stats
+type ControlStats struct {
+	*stats.Counts
+	Rates *stats.Rates `json:"rates,omitempty"`
+}
+
+// Serves the control api on a unix socket, letting local programs (stream
+// decks, twitch bots, home automation) play sounds without going through
+// discord. Anything that can open the socket can use it, so access is down
+// to the socket's file permissions.
+func serveControl(path string) {
+	// A socket left behind by a previous run would make listening fail
+	os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path":  path,
+			"error": err,
+		}).Error("Failed to open the control socket")
+		return
+	}
+	os.Chmod(path, 0660)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/play", handleControlPlay)
+	mux.HandleFunc("/sounds", handleControlSounds)
+	mux.HandleFunc("/stats", handleControlStats)
+
+	log.WithFields(log.Fields{
+		"path": path,
+	}).Info("Serving the control api")
+
+	if err := http.Serve(listener, mux); err != nil {
+		log.WithFields(log.Fields{
+			"path":  path,
+			"error": err,
+		}).Error("Failed to serve the control api")
+	}
+}
+
+func writeControlJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func controlError(w http.ResponseWriter, status int, message string) {
+	writeControlJSON(w, status, map[string]string{"error": message})
+}
+
+func handleControlPlay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		controlError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	req := &ControlPlayRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		controlError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		idempotencyKey = req.IdempotencyKey
+	}
+	if len(idempotencyKey) > CONTROL_IDEMPOTENCY_MAX_LENGTH {
+		controlError(w, http.StatusBadRequest, "idempotency key is too long")
+		return
+	}
+
+	guild, _ := discord.State.Guild(req.GuildID)
+	if guild == nil || blocked(req.UserID, req.GuildID) {
+		controlError(w, http.StatusNotFound, "the bot isn't in that guild on this shard")
+		return
+	}
+
+	coll := findCollection(req.Collection)
+	if coll == nil {
+		controlError(w, http.StatusNotFound, "no such collection")
+		return
+	}
+
+	var s *sound.Sound
+	if req.Sound != "" {
+		if s = coll.Find(req.Sound); s == nil {
+			controlError(w, http.StatusNotFound, "no such sound")
+			return
+		}
+	}
+
+	channelID := req.ChannelID
+	if channelID == "" {
+		channelID = busiestVoiceChannel(guild)
+	}
+	if channelID == "" {
+		controlError(w, http.StatusConflict, "nobody is in a voice channel")
+		return
+	}
+
+	play := newPlay(guild, channelID, req.UserID, coll, s, queue.SOURCE_API)
+	resp := &ControlPlayResponse{
+		PlayID:    play.ID,
+		ChannelID: channelID,
+		Sound:     play.Sound.Name,
+	}
+
+	if idempotencyKey != "" {
+		previous, err := claimIdempotencyKey(idempotencyKey, resp)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warning("Failed to check the idempotency key of a control play")
+			controlError(w, http.StatusServiceUnavailable, "failed to check the idempotency key, try again")
+			return
+		}
+
+		if previous != nil {
+			writeControlJSON(w, http.StatusOK, previous)
+			return
+		}
+	}
+
+	go queuePlay(play)
+	writeControlJSON(w, http.StatusAccepted, resp)
+}
+
+func idempotencyRedisKey(key string) string {
+	return "airhorn:control:idempotency:" + key
+}
+
+// Remembers resp as the response for the idempotency key. If the key was
+// already used the response to its first use is returned instead, and the
+// play shouldn't be queued.
+func claimIdempotencyKey(key string, resp *ControlPlayResponse) (*ControlPlayResponse, error) {
+	if rcli == nil {
+		localIdempotencyLock.Lock()
+		defer localIdempotencyLock.Unlock()
+
+		now := time.Now()
+		for k, ip := range localIdempotency {
+			if now.After(ip.expires) {
+				delete(localIdempotency, k)
+			}
+		}
+
+		if ip := localIdempotency[key]; ip != nil {
+			return ip.response, nil
+		}
+		localIdempotency[key] = &idempotentPlay{response: resp, expires: now.Add(CONTROL_IDEMPOTENCY_TTL)}
+		return nil, nil
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	claimed, err := rcli.SetNX(idempotencyRedisKey(key), string(data), CONTROL_IDEMPOTENCY_TTL).Result()
+	if err != nil {
+		return nil, err
+	}
+	if claimed {
+		return nil, nil
+	}
+
+	raw, err := rcli.Get(idempotencyRedisKey(key)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	previous := &ControlPlayResponse{}
+	if err := json.Unmarshal([]byte(raw), previous); err != nil {
+		return nil, err
+	}
+	return previous, nil
+}
+
+func handleControlSounds(w http.ResponseWriter, r *http.Request) {
+	writeControlJSON(w, http.StatusOK, soundCatalog())
+}
+
+func handleControlStats(w http.ResponseWriter, r *http.Request) {
+	counts, err := statsSink.Counts()
+	if err != nil {
+		controlError(w, http.StatusInternalServerError, "failed to load stats")
+		return
+	}
+
+	body := &ControlStats{Counts: counts}
+	if tracker != nil {
+		if rates, err := tracker.Rates(); err == nil {
+			body.Rates = rates
+		}
+	}
+	writeControlJSON(w, http.StatusOK, body)
+}
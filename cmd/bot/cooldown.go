@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/sound"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Discord's mention spam trigger, discordgo doesn't name it
+	AUTOMOD_TRIGGER_MENTION_SPAM discordgo.AutoModerationRuleTriggerType = 5
+)
+
+func cooldownKey(gid, uid string) string {
+	return fmt.Sprintf("airhorn:guild:%s:cooldown:%s", gid, uid)
+}
+
+// Stops a user from running commands or playing sounds in a guild for a while
+func setCooldown(gid, uid string, d time.Duration) error {
+	return rcli.Set(cooldownKey(gid, uid), "1", d).Err()
+}
+
+// Returns true if the user is cooling down in the guild
+func onCooldown(gid, uid string) bool {
+	if rcli == nil || uid == OWNER {
+		return false
+	}
+	return rcli.Exists(cooldownKey(gid, uid)).Val() > 0
+}
+
+func soundIntervalKey(gid, coll, name string) string {
+	return fmt.Sprintf("airhorn:guild:%s:interval:%s:%s", gid, coll, name)
+}
+
+func collectionCooldownKey(gid, coll string) string {
+	return fmt.Sprintf("airhorn:guild:%s:collcooldown:%s", gid, coll)
+}
+
+// Starts the minimum interval of a sound that is about to be played in a
+// guild, returning how long is left instead if it's still in the last one
+func claimSound(gid, coll string, s *sound.Sound) time.Duration {
+	return claimInterval(soundIntervalKey(gid, coll, s.Name), s.MinInterval)
+}
+
+// Starts the guild's cooldown for a collection that is about to be played,
+// returning how long is left instead if it's still cooling down
+func claimCollection(gid string, coll *sound.Collection) time.Duration {
+	return claimInterval(collectionCooldownKey(gid, coll.Prefix), getGuildSettings(gid).CollectionCooldown(coll))
+}
+
+// Claims key for d, returning how long is left on the existing claim if there
+// is one. Claims go through redis so every shard sees them.
+func claimInterval(key string, d time.Duration) time.Duration {
+	if rcli == nil || d <= 0 {
+		return 0
+	}
+
+	claimed, err := rcli.SetNX(key, "1", d).Result()
+	if err != nil || claimed {
+		return 0
+	}
+
+	remaining, err := rcli.PTTL(key).Result()
+	if err != nil || remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// Drops commands from users that are cooling down
+func checkCooldown(cmd *Command, next CommandHandler) CommandHandler {
+	return func(c *CommandContext) {
+		if c.Guild != nil && onCooldown(c.Guild.ID, c.Message.Author.ID) {
+			return
+		}
+		next(c)
+	}
+}
+
+// Puts users AutoMod flags for spam on a cooldown, in guilds that opted in
+func onAutoModerationAction(s *discordgo.Session, event *discordgo.AutoModerationActionExecution) {
+	if event.RuleTriggerType != discordgo.AutoModerationEventTriggerSpam && event.RuleTriggerType != AUTOMOD_TRIGGER_MENTION_SPAM {
+		return
+	}
+
+	minutes := getGuildSettings(event.GuildID).AutoModCooldown
+	if minutes <= 0 || rcli == nil {
+		return
+	}
+
+	err := setCooldown(event.GuildID, event.UserID, time.Minute*time.Duration(minutes))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": event.GuildID,
+			"user":  event.UserID,
+			"error": err,
+		}).Warning("Failed to apply AutoMod cooldown")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"guild":   event.GuildID,
+		"user":    event.UserID,
+		"rule":    event.RuleID,
+		"minutes": minutes,
+	}).Info("Applied AutoMod cooldown")
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/dca"
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	"github.com/noisemaster/airhornbot/pkg/redis"
+	"github.com/noisemaster/airhornbot/pkg/sound"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Limits for uploaded custom sounds
+	CUSTOM_SOUND_MAX_BYTES  = 1024 * 1024 * 2
+	CUSTOM_SOUND_MAX_FRAMES = 50 * 30
+)
+
+var (
+	// Pseudo collection used for guild custom sounds
+	CUSTOM *sound.Collection = &sound.Collection{
+		Prefix: "custom",
+		Commands: []string{
+			"!custom",
+		},
+	}
+
+	// Names custom sounds are allowed to have
+	customSoundName = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+	// Downloads links and attachments users give the bot, public addresses only
+	httpClient = newPublicHTTPClient(20 * time.Second)
+)
+
+var codeLetters = []rune("ABCDEFGHJKLMNPQRSTUVWXYZ23456789")
+
+// Return a random code of n characters that is easy to read back
+func randomCode(n int) string {
+	b := make([]rune, n)
+	for i := range b {
+		b[i] = codeLetters[randomRange(0, len(codeLetters))]
+	}
+	return string(b)
+}
+
+// CustomSound is the metadata for a sound uploaded to a single guild
+type CustomSound struct {
+	Name     string    `json:"name"`
+	Uploader string    `json:"uploader"`
+	Added    time.Time `json:"added"`
+
+	// The guild and sound this was imported from, if any
+	Origin string `json:"origin,omitempty"`
+
+	// Disabled sounds are kept but can't be played until an admin enables them
+	Disabled bool `json:"disabled,omitempty"`
+
+	// Held sounds were flagged by upload screening and wait for a review
+	Held       bool   `json:"held,omitempty"`
+	HeldReason string `json:"held_reason,omitempty"`
+}
+
+// Returns true if the sound can be played, shared and published
+func (cs *CustomSound) Playable() bool {
+	return !cs.Disabled && !cs.Held
+}
+
+func customSoundPath(gid, name string) string {
+	return fmt.Sprintf("audio/guilds/%s/%s.dca", gid, name)
+}
+
+func customSoundsKey(gid string) string {
+	return fmt.Sprintf("airhorn:guild:%s:sounds", gid)
+}
+
+// Returns the metadata of a custom sound in a guild, or nil if it doesn't exist
+func getCustomSound(gid, name string) *CustomSound {
+	raw, err := rcli.HGet(customSoundsKey(gid), name).Result()
+	if err != nil {
+		return nil
+	}
+
+	cs := &CustomSound{}
+	if err := json.Unmarshal([]byte(raw), cs); err != nil {
+		return nil
+	}
+	return cs
+}
+
+// Returns all custom sounds in a guild
+func listCustomSounds(gid string) []*CustomSound {
+	data, err := rcli.HGetAll(customSoundsKey(gid)).Result()
+	if err != nil {
+		return nil
+	}
+
+	sounds := make([]*CustomSound, 0, len(data))
+	for _, raw := range data {
+		cs := &CustomSound{}
+		if json.Unmarshal([]byte(raw), cs) == nil {
+			sounds = append(sounds, cs)
+		}
+	}
+	return sounds
+}
+
+// Stores the frames and metadata of a custom sound for a guild
+func saveCustomSound(gid string, cs *CustomSound, frames [][]byte) error {
+	if err := dca.WriteFile(customSoundPath(gid, cs.Name), frames); err != nil {
+		return err
+	}
+	return putCustomSound(gid, cs)
+}
+
+// Updates the metadata of a custom sound
+func putCustomSound(gid string, cs *CustomSound) error {
+	data, err := json.Marshal(cs)
+	if err != nil {
+		return err
+	}
+	return rcli.HSet(customSoundsKey(gid), cs.Name, string(data)).Err()
+}
+
+// Marks a custom sound as disabled (or enables it again)
+func setCustomSoundDisabled(gid, name string, disabled bool) error {
+	cs := getCustomSound(gid, name)
+	if cs == nil {
+		return fmt.Errorf("no custom sound called %s", name)
+	}
+
+	// Disabled sounds shouldn't stay in front of other servers either
+	if disabled {
+		unpublishGallerySound(gid, name)
+	}
+
+	cs.Disabled = disabled
+	return putCustomSound(gid, cs)
+}
+
+func deleteCustomSound(gid, name string) {
+	unpublishGallerySound(gid, name)
+	rcli.HDel(customSoundsKey(gid), name)
+	os.Remove(customSoundPath(gid, name))
+}
+
+// Returns what deleteCustomSound would remove
+func customSoundDeleteChanges(gid, name string) []string {
+	changes := make([]string, 0)
+	if getCustomSound(gid, name) == nil {
+		return changes
+	}
+
+	if id := rcli.HGet(galleryGuildKey(gid), name).Val(); id != "" {
+		changes = append(changes, fmt.Sprintf("delete `%s` from airhorn:gallery", id))
+		changes = append(changes, fmt.Sprintf("delete `%s` from %s", name, galleryGuildKey(gid)))
+	}
+
+	changes = append(changes, fmt.Sprintf("delete `%s` from %s", name, customSoundsKey(gid)))
+	if _, err := os.Stat(customSoundPath(gid, name)); err == nil {
+		changes = append(changes, fmt.Sprintf("delete the file %s", customSoundPath(gid, name)))
+	}
+	return changes
+}
+
+// Returns a playable sound for a guild's custom sound, streamed from disk
+func customSoundPlayable(gid string, cs *CustomSound) *sound.Sound {
+	return sound.NewStreamed(cs.Name, customSoundPath(gid, cs.Name))
+}
+
+// Downloads a file over HTTP, refusing anything larger than maxBytes or not
+// on the public internet
+func downloadLimited(rawurl string, maxBytes int64) ([]byte, *http.Response, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkPublicURL(u); err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := httpClient.Get(u.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp, fmt.Errorf("download returned %s", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, resp, err
+	}
+
+	if int64(len(data)) > maxBytes {
+		return nil, resp, fmt.Errorf("file is larger than %d bytes", maxBytes)
+	}
+	return data, resp, nil
+}
+
+// Returns true if the user is allowed to manage the bot in the channel's guild
+func isGuildAdmin(guild *discordgo.Guild, uid, cid string) bool {
+	if guild.OwnerID == uid || uid == OWNER {
+		return true
+	}
+
+	perms, err := discord.State.UserChannelPermissions(uid, cid)
+	if err != nil {
+		return false
+	}
+	return perms&(discordgo.PermissionAdministrator|discordgo.PermissionManageServer) != 0
+}
+
+// Handles `!custom add <name>` with an attached audio file
+func addCustomSound(m *discordgo.MessageCreate, guild *discordgo.Guild, name string) {
+	if !customSoundName.MatchString(name) {
+		discord.ChannelMessageSend(m.ChannelID, "Sound names can only contain letters, numbers and underscores")
+		return
+	}
+
+	if len(m.Attachments) < 1 {
+		discord.ChannelMessageSend(m.ChannelID, "Attach the audio file to the `!custom add` message")
+		return
+	}
+
+	if getCustomSound(guild.ID, name) != nil {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("There is already a sound called %s", name))
+		return
+	}
+
+	data, _, err := downloadLimited(m.Attachments[0].URL, CUSTOM_SOUND_MAX_BYTES)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"error": err,
+		}).Info("Failed to download custom sound")
+		discord.ChannelMessageSend(m.ChannelID, "Failed to download that file")
+		return
+	}
+
+	// Custom sounds are played in any channel, so they're only limited by the guild
+	frames, err := encodeDCABytes(data, getGuildSettings(guild.ID).Volume, encodeBitrate(guild, nil))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"error": err,
+		}).Warning("Failed to encode custom sound")
+		discord.ChannelMessageSend(m.ChannelID, "I couldn't read that audio file")
+		return
+	}
+
+	if len(frames) > CUSTOM_SOUND_MAX_FRAMES {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Sounds can be at most %d seconds long", CUSTOM_SOUND_MAX_FRAMES/50))
+		return
+	}
+
+	cs := &CustomSound{
+		Name:     name,
+		Uploader: m.Author.ID,
+		Added:    time.Now(),
+	}
+
+	// Flagged uploads are stored but held until someone reviews them
+	if reason := screenUpload(guild.ID, data); reason != "" {
+		cs.Held = true
+		cs.HeldReason = reason
+	}
+
+	if err := saveCustomSound(guild.ID, cs, frames); err != nil {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"error": err,
+		}).Error("Failed to save custom sound")
+		return
+	}
+
+	if cs.Held {
+		log.WithFields(log.Fields{
+			"guild":  guild.ID,
+			"sound":  name,
+			"reason": cs.HeldReason,
+		}).Info("Held custom sound for review")
+		requestUploadReview(guild, cs)
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("%s was added but needs to be reviewed before it can be played", name))
+		return
+	}
+
+	discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf(":ok_hand: added %s, play it with `!custom %s`", name, name))
+}
+
+// Handles the !custom command group
+func handleCustomCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, parts []string, dryRun bool) {
+	if rcli == nil {
+		return
+	}
+
+	if len(parts) < 2 || parts[1] == "list" {
+		names := make([]string, 0)
+		for _, cs := range listCustomSounds(guild.ID) {
+			if cs.Held {
+				names = append(names, cs.Name+" (waiting for review)")
+			} else if cs.Disabled {
+				names = append(names, cs.Name+" (disabled)")
+			} else {
+				names = append(names, cs.Name)
+			}
+		}
+
+		if len(names) == 0 {
+			discord.ChannelMessageSend(m.ChannelID, "This server has no custom sounds yet, an admin can add one with `!custom add <name>`")
+			return
+		}
+
+		discord.ChannelMessageSendEmbed(m.ChannelID, &discordgo.MessageEmbed{
+			Title:       "custom",
+			Color:       0xE5343A,
+			Description: "Here are the custom sounds for this server\nTo use these use !custom {any of the below}\n" + strings.Join(names, "\n"),
+		})
+		return
+	}
+
+	switch parts[1] {
+	case "add", "remove", "enable", "disable":
+		if !isGuildAdmin(guild, m.Author.ID, m.ChannelID) {
+			return
+		}
+
+		if len(parts) < 3 {
+			discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Usage: `!custom %s <name>`", parts[1]))
+			return
+		}
+
+		if dryRun && parts[1] != "remove" {
+			discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("`!custom %s` doesn't support %s", parts[1], DRY_RUN_FLAG))
+			return
+		}
+
+		switch parts[1] {
+		case "add":
+			addCustomSound(m, guild, parts[2])
+			return
+		case "remove":
+			if dryRun {
+				reportDryRun(m.ChannelID, customSoundDeleteChanges(guild.ID, parts[2]))
+				return
+			}
+			deleteCustomSound(guild.ID, parts[2])
+		default:
+			if err := setCustomSoundDisabled(guild.ID, parts[2], parts[1] == "disable"); err != nil {
+				discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("There is %s", err))
+				return
+			}
+		}
+		discord.ChannelMessageSend(m.ChannelID, ":ok_hand:")
+		return
+	}
+
+	if dryRun {
+		return
+	}
+
+	cs := getCustomSound(guild.ID, parts[1])
+	if cs == nil || !cs.Playable() {
+		return
+	}
+
+	enqueuePlay(m.Author, guild, m.ChannelID, CUSTOM, customSoundPlayable(guild.ID, cs), queue.SOURCE_COMMAND)
+}
+
+// Handles `!share sound <name>`, creating a code another guild can import the sound with
+func handleShareCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, parts []string) {
+	if rcli == nil {
+		return
+	}
+
+	if len(parts) < 3 || parts[1] != "sound" {
+		discord.ChannelMessageSend(m.ChannelID, "Usage: `!share sound <name>`")
+		return
+	}
+
+	cs := getCustomSound(guild.ID, parts[2])
+	if cs == nil {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("There is no custom sound called %s", parts[2]))
+		return
+	}
+
+	if !cs.Playable() {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("%s is disabled or waiting for review and can't be shared", cs.Name))
+		return
+	}
+
+	code := randomCode(6)
+	err := rcli.Set(fmt.Sprintf("airhorn:share:%s", code), guild.ID+":"+cs.Name, time.Hour*24).Err()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to store share code")
+		return
+	}
+
+	discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf(
+		"Share code for **%s**: `%s`\nAn admin of the other server can import it with `!import code %s` within the next 24 hours",
+		cs.Name, code, code))
+}
+
+// Handles `!import code <code> [name]`, copying a shared sound into this guild
+func handleImportCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, parts []string) {
+	if rcli == nil {
+		return
+	}
+
+	if len(parts) < 3 || parts[1] != "code" {
+		discord.ChannelMessageSend(m.ChannelID, "Usage: `!import code <code> [name]`")
+		return
+	}
+
+	source, err := rcli.Get(fmt.Sprintf("airhorn:share:%s", strings.ToUpper(parts[2]))).Result()
+	if err == redis.Nil {
+		discord.ChannelMessageSend(m.ChannelID, "That share code is invalid or has expired")
+		return
+	} else if err != nil {
+		return
+	}
+
+	split := strings.SplitN(source, ":", 2)
+	if len(split) != 2 {
+		return
+	}
+	sourceGuild, sourceName := split[0], split[1]
+
+	name := sourceName
+	if len(parts) > 3 {
+		name = parts[3]
+	}
+
+	if !customSoundName.MatchString(name) {
+		discord.ChannelMessageSend(m.ChannelID, "Sound names can only contain letters, numbers and underscores")
+		return
+	}
+
+	if getCustomSound(guild.ID, name) != nil {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("There is already a sound called %s, pass a new name with `!import code %s <name>`", name, parts[2]))
+		return
+	}
+
+	cs := getCustomSound(sourceGuild, sourceName)
+	if cs == nil || !cs.Playable() {
+		discord.ChannelMessageSend(m.ChannelID, "The shared sound no longer exists")
+		return
+	}
+
+	if err := importCustomSound(sourceGuild, cs, guild.ID, name, m.Author.ID); err != nil {
+		log.WithFields(log.Fields{
+			"source": sourceGuild,
+			"guild":  guild.ID,
+			"error":  err,
+		}).Error("Failed to import shared sound")
+		return
+	}
+
+	discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf(":ok_hand: imported %s, play it with `!custom %s`", name, name))
+}
+
+// Copies a custom sound from one guild into another under a new name
+func importCustomSound(sourceGuild string, cs *CustomSound, gid, name, uid string) error {
+	file, err := os.Open(customSoundPath(sourceGuild, cs.Name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	frames, err := dca.Read(file)
+	if err != nil {
+		return err
+	}
+
+	return saveCustomSound(gid, &CustomSound{
+		Name:     name,
+		Uploader: uid,
+		Added:    time.Now(),
+		Origin:   sourceGuild + ":" + cs.Name,
+	}, frames)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	"github.com/noisemaster/airhornbot/pkg/sound"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Most sounds listed by !mystats
+	MYSTATS_TOP_SOUNDS = 5
+)
+
+var (
+	// Directory of original sound files sent as previews, if empty previews
+	// are made from the stored opus frames
+	ORIGINALS_DIR string
+
+	// Answers direct messages that aren't a command, rate limited like any other command
+	dmFallback = &Command{
+		Name: "dm",
+		DM:   true,
+		handler: func(c *CommandContext) {
+			discord.ChannelMessageSend(c.Message.ChannelID, c.translate("dm.unknown", nil))
+		},
+	}
+
+	// Plays a sound in one of the user's servers, eg. `airhorn <server name>`
+	dmSoundRequest = &Command{
+		Name:    "dm sound",
+		DM:      true,
+		handler: handleDMSoundRequest,
+	}
+)
+
+// Runs commands sent to the bot in a direct message, which can be sent with
+// or without the ! in front. Only commands marked DM are accepted.
+func handleDirectMessage(m *discordgo.MessageCreate) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(m.Content)), " ")
+	if !strings.HasPrefix(parts[0], "!") {
+		parts[0] = "!" + parts[0]
+	}
+
+	cmd := lookupCommand(parts)
+	if cmd == nil || !cmd.DM {
+		cmd = dmFallback
+		if dmCollection(parts[0]) != nil {
+			cmd = dmSoundRequest
+		}
+	}
+
+	go cmd.run(&CommandContext{
+		Message:  m,
+		Settings: defaultGuildSettings(),
+		Parts:    stripDryRun(parts),
+		DryRun:   scontains(DRY_RUN_FLAG, parts...),
+	})
+}
+
+// Returns the collection a direct message command like !airhorn plays
+func dmCollection(command string) *sound.Collection {
+	for _, coll := range getCollections() {
+		if scontains(command, coll.Commands...) {
+			return coll
+		}
+	}
+	return nil
+}
+
+// Handles `<collection> [server name]` in direct messages, playing a random
+// sound from the collection in the voice channel the user is in. The server can
+// be left out when the user is only in voice in one of them.
+func handleDMSoundRequest(c *CommandContext) {
+	cid := c.Message.ChannelID
+	coll := dmCollection(c.Parts[0])
+	if coll == nil {
+		return
+	}
+
+	// Guild names keep their case and spaces, so they're taken from the message
+	fields := strings.Fields(c.Message.Content)
+	name := ""
+	if len(fields) > 1 {
+		name = strings.Join(fields[1:], " ")
+	}
+
+	guild, reason := dmTargetGuild(c.Message.Author, name)
+	if reason != "" {
+		discord.ChannelMessageSend(cid, c.translate(reason, map[string]interface{}{
+			"Guild":   name,
+			"Command": strings.TrimPrefix(c.Parts[0], "!"),
+		}))
+		return
+	}
+
+	// From here on the guild's own settings apply, as if it was sent there
+	settings := getGuildSettings(guild.ID)
+	data := map[string]interface{}{
+		"Guild":      guild.Name,
+		"Collection": coll.Prefix,
+	}
+
+	if !settings.CollectionEnabled(coll) || !canUse(guild, c.Message.Author.ID, coll.Prefix) {
+		discord.ChannelMessageSend(cid, translate(settings.Language, "dm.request.disabled", data))
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"user":       c.Message.Author.ID,
+		"guild":      guild.ID,
+		"collection": coll.Prefix,
+	}).Info("Playing sound requested in a direct message")
+
+	discord.ChannelMessageSend(cid, translate(settings.Language, "dm.request.playing", data))
+	enqueuePlay(c.Message.Author, guild, cid, coll, nil, queue.SOURCE_DM)
+}
+
+// Picks the mutual guild a direct message request is for, returning the
+// message key explaining why there isn't one otherwise. Names are matched
+// case insensitively, first exactly and then by prefix.
+func dmTargetGuild(user *discordgo.User, name string) (*discordgo.Guild, string) {
+	guilds := mutualGuilds(user.ID)
+	if len(guilds) == 0 {
+		return nil, "dm.request.noguilds"
+	}
+
+	if name == "" {
+		var inVoice []*discordgo.Guild
+		for _, guild := range guilds {
+			if getCurrentVoiceChannel(user, guild) != nil {
+				inVoice = append(inVoice, guild)
+			}
+		}
+
+		switch len(inVoice) {
+		case 0:
+			return nil, "dm.request.novoice"
+		case 1:
+			return inVoice[0], ""
+		}
+		return nil, "dm.request.which"
+	}
+
+	var matches []*discordgo.Guild
+	for _, guild := range guilds {
+		if strings.EqualFold(guild.Name, name) {
+			matches = append(matches, guild)
+		}
+	}
+	if len(matches) == 0 {
+		for _, guild := range guilds {
+			if strings.HasPrefix(strings.ToLower(guild.Name), strings.ToLower(name)) {
+				matches = append(matches, guild)
+			}
+		}
+	}
+
+	switch {
+	case len(matches) == 0:
+		return nil, "dm.request.unknown"
+	case len(matches) > 1:
+		return nil, "dm.request.ambiguous"
+	case getCurrentVoiceChannel(user, matches[0]) == nil:
+		return nil, "dm.request.notinvoice"
+	}
+	return matches[0], ""
+}
+
+// Returns the guilds on this shard the user is a member of
+func mutualGuilds(uid string) []*discordgo.Guild {
+	// State.Member takes the state lock itself, so the guilds are copied first
+	discord.State.RLock()
+	all := make([]*discordgo.Guild, len(discord.State.Guilds))
+	copy(all, discord.State.Guilds)
+	discord.State.RUnlock()
+
+	guilds := make([]*discordgo.Guild, 0)
+	for _, guild := range all {
+		if member, _ := discord.State.Member(guild.ID, uid); member != nil {
+			guilds = append(guilds, guild)
+		}
+	}
+	return guilds
+}
+
+// Handles `!mystats`, showing a user's plays across every guild and the guilds
+// they share with the bot
+func handleMyStatsCommand(cid, uid string, settings *GuildSettings) {
+	if tracker == nil {
+		return
+	}
+
+	counts, err := tracker.UserSounds(uid)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"user":  uid,
+			"error": err,
+		}).Warning("Failed to fetch user stats")
+		return
+	}
+
+	total := 0
+	names := make([]string, 0, len(counts))
+	for name, count := range counts {
+		total += count
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return counts[names[i]] > counts[names[j]]
+	})
+	if len(names) > MYSTATS_TOP_SOUNDS {
+		names = names[:MYSTATS_TOP_SOUNDS]
+	}
+
+	favorites := make([]string, 0, len(names))
+	for _, name := range names {
+		favorites = append(favorites, fmt.Sprintf("%s (%d)", name, counts[name]))
+	}
+
+	guilds := make([]string, 0)
+	for _, guild := range mutualGuilds(uid) {
+		guilds = append(guilds, guild.Name)
+	}
+	sort.Strings(guilds)
+
+	sendReplyEmbed(cid, &discordgo.MessageEmbed{
+		Title: translate(settings.Language, "mystats.title", nil),
+		Color: 0xE5343A,
+		Description: translate(settings.Language, "mystats.body", map[string]interface{}{
+			"Total":     total,
+			"Favorites": orNone(strings.Join(favorites, ", ")),
+			"Guilds":    orNone(strings.Join(guilds, ", ")),
+		}),
+	}, REPLY_NORMAL)
+}
+
+// Handles `!preview <collection> <sound>`, sending the sound to the user as a
+// file. Previews run in a server are sent in a direct message so they stay out
+// of busy channels.
+func handlePreviewCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, settings *GuildSettings, parts []string) {
+	cid := m.ChannelID
+	if len(parts) < 3 {
+		discord.ChannelMessageSend(cid, translate(settings.Language, "preview.usage", nil))
+		return
+	}
+
+	var (
+		s      *sound.Sound
+		prefix string
+	)
+	for _, coll := range getCollections() {
+		if coll.Prefix == parts[1] || scontains("!"+parts[1], coll.Commands...) {
+			s = coll.Find(parts[2])
+			prefix = coll.Prefix
+			break
+		}
+	}
+	if s == nil {
+		discord.ChannelMessageSend(cid, translate(settings.Language, "preview.unknown", map[string]string{
+			"Sound": strings.Join(parts[1:], " "),
+		}))
+		return
+	}
+
+	file, err := previewFile(prefix, s)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sound": s.Name,
+			"error": err,
+		}).Warning("Failed to read sound for a preview")
+		return
+	}
+
+	// The reply points the user at their direct messages instead
+	if guild != nil {
+		dm, err := discord.UserChannelCreate(m.Author.ID)
+		if err != nil {
+			discord.ChannelMessageSend(cid, translate(settings.Language, "preview.closed", nil))
+			return
+		}
+		cid = dm.ID
+	}
+
+	_, err = discord.ChannelMessageSendComplex(cid, &discordgo.MessageSend{
+		Files: []*discordgo.File{file},
+	})
+	if guild == nil {
+		return
+	}
+
+	if err != nil {
+		discord.ChannelMessageSend(m.ChannelID, translate(settings.Language, "preview.closed", nil))
+		return
+	}
+	discord.ChannelMessageSend(m.ChannelID, translate(settings.Language, "preview.sent", map[string]string{
+		"User": "<@" + m.Author.ID + ">",
+	}))
+}
+
+// Returns the sound as a file to attach. The original recording is sent if
+// there is one in ORIGINALS_DIR (as <collection>_<sound>.mp3 or .ogg),
+// otherwise the stored opus frames are put in an ogg container.
+func previewFile(prefix string, s *sound.Sound) (*discordgo.File, error) {
+	if ORIGINALS_DIR != "" {
+		for ext, contentType := range map[string]string{".ogg": "audio/ogg", ".mp3": "audio/mpeg"} {
+			name := prefix + "_" + s.Name + ext
+			if data, err := ioutil.ReadFile(filepath.Join(ORIGINALS_DIR, name)); err == nil {
+				return &discordgo.File{Name: name, ContentType: contentType, Reader: bytes.NewReader(data)}, nil
+			}
+		}
+	}
+
+	frames, err := s.Frames()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	if err := sound.WriteOgg(buf, frames); err != nil {
+		return nil, err
+	}
+	return &discordgo.File{Name: prefix + "_" + s.Name + ".ogg", ContentType: "audio/ogg", Reader: buf}, nil
+}
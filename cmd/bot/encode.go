@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/dca"
+)
+
+var (
+	// Path to the dca-rs binary used for encoding sounds on the fly
+	DCA_ENCODER = "dca-rs"
+)
+
+// Encodes an audio file on disk into DCA opus frames using dca-rs, volume is
+// a percentage of the original loudness and bitrate is in kbps
+func encodeDCA(input string, volume, bitrate int) ([][]byte, error) {
+	// dca uses 256 as the unchanged volume
+	cmd := exec.Command(DCA_ENCODER, "--raw", "--vol", strconv.Itoa(volume*256/100),
+		"--bitrate", strconv.Itoa(bitrate), "-i", input)
+
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	frames, err := dca.Read(stdout)
+	if err != nil {
+		cmd.Wait()
+		return nil, err
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("%s: %s", err, stderr.String())
+	}
+
+	return frames, nil
+}
+
+// Encodes raw audio data (any format the encoder understands) into DCA opus frames
+func encodeDCABytes(data []byte, volume, bitrate int) ([][]byte, error) {
+	tmp, err := ioutil.TempFile("", "airhorn")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeDCA(tmp.Name(), volume, bitrate)
+}
+
+// Returns the highest bitrate (in kbps) a guild's voice channels can be set to
+func maxGuildBitrate(guild *discordgo.Guild) int {
+	switch guild.PremiumTier {
+	case discordgo.PremiumTier1:
+		return 128
+	case discordgo.PremiumTier2:
+		return 256
+	case discordgo.PremiumTier3:
+		return 384
+	}
+	return 96
+}
+
+// Returns the bitrate (in kbps) to encode sounds for a guild at. Sounds are never
+// encoded above what the voice channel they'll be played in can carry, channel
+// may be nil if the sound isn't played right away.
+func encodeBitrate(guild *discordgo.Guild, channel *discordgo.Channel) int {
+	bitrate := getGuildSettings(guild.ID).Bitrate
+	if bitrate == 0 {
+		bitrate = BITRATE
+	}
+
+	if max := maxGuildBitrate(guild); bitrate > max {
+		bitrate = max
+	}
+
+	if channel != nil && channel.Bitrate > 0 && bitrate > channel.Bitrate/1000 {
+		bitrate = channel.Bitrate / 1000
+	}
+	return bitrate
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How often batched errors are sent
+	ERROR_REPORT_INTERVAL = time.Minute
+
+	// Most distinct errors kept per batch, the rest are only counted
+	ERROR_REPORT_MAX = 25
+
+	// Most of a panic's stack trace that is reported, embeds can't fit more
+	PANIC_STACK_MAX = 1500
+)
+
+// An error logged one or more times since the last report
+type reportedError struct {
+	Message string
+	Level   log.Level
+	Count   int
+	First   time.Time
+	Last    time.Time
+
+	// Fields of the last time it was logged
+	Fields log.Fields
+}
+
+// Sends errors to a discord webhook and/or sentry. It's a logrus hook, so
+// anything logged at error level or above is reported, batched by message so
+// an error logged in a loop is sent once with a count.
+type errorReporter struct {
+	webhook string
+	sentry  *url.URL
+	client  *http.Client
+
+	sync.Mutex
+	batch   map[string]*reportedError
+	dropped int
+}
+
+func newErrorReporter(webhook, dsn string) (*errorReporter, error) {
+	er := &errorReporter{
+		webhook: webhook,
+		client:  &http.Client{Timeout: time.Second * 10},
+		batch:   make(map[string]*reportedError),
+	}
+
+	if dsn != "" {
+		u, err := url.Parse(dsn)
+		if err != nil || u.User == nil || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+			return nil, fmt.Errorf("invalid sentry dsn, expected https://<key>@<host>/<project>")
+		}
+		er.sentry = u
+	}
+	return er, nil
+}
+
+func (er *errorReporter) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel}
+}
+
+func (er *errorReporter) Fire(entry *log.Entry) error {
+	fields := make(log.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		fields[k] = v
+	}
+
+	er.Lock()
+	re, exists := er.batch[entry.Message]
+	if !exists {
+		if len(er.batch) >= ERROR_REPORT_MAX {
+			er.dropped++
+			er.Unlock()
+			return nil
+		}
+		re = &reportedError{Message: entry.Message, Level: entry.Level, First: entry.Time}
+		er.batch[entry.Message] = re
+	}
+	re.Count++
+	re.Last = entry.Time
+	re.Fields = fields
+	er.Unlock()
+
+	// The process is about to die, so this can't wait for the next batch
+	if entry.Level <= log.FatalLevel {
+		er.flush()
+	}
+	return nil
+}
+
+// Sends the batch every ERROR_REPORT_INTERVAL
+func (er *errorReporter) run() {
+	for {
+		time.Sleep(ERROR_REPORT_INTERVAL)
+		er.flush()
+	}
+}
+
+func (er *errorReporter) flush() {
+	er.Lock()
+	batch := make([]*reportedError, 0, len(er.batch))
+	for _, re := range er.batch {
+		batch = append(batch, re)
+	}
+	dropped := er.dropped
+	er.batch = make(map[string]*reportedError)
+	er.dropped = 0
+	er.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+
+	sort.Slice(batch, func(i, j int) bool {
+		return batch[i].Count > batch[j].Count
+	})
+
+	// Failures are logged as warnings, so they aren't reported themselves
+	if er.webhook != "" {
+		if err := er.sendWebhook(batch, dropped); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warning("Failed to report errors to the webhook")
+		}
+	}
+
+	if er.sentry != nil {
+		for _, re := range batch {
+			if err := er.sendSentry(re); err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Warning("Failed to report error to sentry")
+				break
+			}
+		}
+	}
+}
+
+// Logs a recovered panic with the stack trace of where it happened, which
+// sends it to the error reporter like any other error
+func reportPanic(recovered interface{}, fields log.Fields) {
+	stack := string(debug.Stack())
+	if len(stack) > PANIC_STACK_MAX {
+		stack = stack[:PANIC_STACK_MAX] + "..."
+	}
+
+	fields["panic"] = fmt.Sprint(recovered)
+	fields["stack"] = "```" + stack + "```"
+	log.WithFields(fields).Error("Recovered from a panic")
+	go trackError("panic")
+}
+
+// Shard and instance the errors came from, added to every report
+func reportContext() log.Fields {
+	fields := log.Fields{"instance": instanceName}
+	if discord != nil {
+		fields["shard"] = fmt.Sprintf("%d/%d", discord.ShardID, discord.ShardCount)
+	}
+	return fields
+}
+
+func formatFields(fields log.Fields) string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	lines := make([]string, len(keys))
+	for i, k := range keys {
+		lines[i] = fmt.Sprintf("**%s**: %v", k, fields[k])
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (er *errorReporter) sendWebhook(batch []*reportedError, dropped int) error {
+	context := reportContext()
+	embeds := make([]*discordgo.MessageEmbed, 0, len(batch))
+	for _, re := range batch {
+		embeds = append(embeds, &discordgo.MessageEmbed{
+			Title:       fmt.Sprintf("[%s] %s", strings.ToUpper(re.Level.String()), re.Message),
+			Color:       0xE5343A,
+			Description: fmt.Sprintf("%d times since %s\n%s", re.Count, re.First.Format(time.RFC3339), formatFields(re.Fields)),
+			Footer:      &discordgo.MessageEmbedFooter{Text: fmt.Sprintf("shard %v on %v", context["shard"], context["instance"])},
+		})
+	}
+
+	content := ""
+	if dropped > 0 {
+		content = fmt.Sprintf("%d more errors weren't included", dropped)
+	}
+
+	// Webhook messages can only carry 10 embeds
+	for len(embeds) > 0 {
+		n := len(embeds)
+		if n > 10 {
+			n = 10
+		}
+
+		body, _ := json.Marshal(map[string]interface{}{
+			"username": "Airhorn errors",
+			"content":  content,
+			"embeds":   embeds[:n],
+		})
+		if err := er.post(er.webhook, body, nil); err != nil {
+			return err
+		}
+		embeds, content = embeds[n:], ""
+	}
+	return nil
+}
+
+// Sends an error to sentry's store endpoint
+func (er *errorReporter) sendSentry(re *reportedError) error {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	tags := map[string]string{}
+	for k, v := range reportContext() {
+		tags[k] = fmt.Sprint(v)
+	}
+	if gid, ok := re.Fields["guild"].(string); ok {
+		tags["guild"] = gid
+	}
+
+	level := re.Level.String()
+	if re.Level == log.PanicLevel {
+		level = "fatal"
+	}
+
+	extra := map[string]interface{}{"count": re.Count, "first": re.First}
+	for k, v := range re.Fields {
+		extra[k] = v
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"event_id":  hex.EncodeToString(id),
+		"timestamp": re.Last.UTC().Format("2006-01-02T15:04:05"),
+		"level":     level,
+		"logger":    "airhornbot",
+		"platform":  "go",
+		"message":   re.Message,
+		"tags":      tags,
+		"extra":     extra,
+	})
+
+	key := er.sentry.User.Username()
+	project := strings.Trim(er.sentry.Path, "/")
+	endpoint := fmt.Sprintf("%s://%s/api/%s/store/", er.sentry.Scheme, er.sentry.Host, project)
+	return er.post(endpoint, body, map[string]string{
+		"X-Sentry-Auth": fmt.Sprintf("Sentry sentry_version=7, sentry_key=%s, sentry_client=airhornbot/1.0", key),
+	})
+}
+
+func (er *errorReporter) post(endpoint string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := er.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Voice channels of scheduled events that are live, keyed by event id
+	liveEvents     map[string]string = make(map[string]string)
+	liveEventsLock sync.RWMutex
+)
+
+// Tracks whether a scheduled event is live in a voice channel
+func updateScheduledEvent(event *discordgo.GuildScheduledEvent) {
+	live := event.Status == discordgo.GuildScheduledEventStatusActive && event.ChannelID != ""
+
+	liveEventsLock.Lock()
+	_, wasLive := liveEvents[event.ID]
+	if live {
+		liveEvents[event.ID] = event.ChannelID
+	} else {
+		delete(liveEvents, event.ID)
+	}
+	liveEventsLock.Unlock()
+
+	if live != wasLive {
+		log.WithFields(log.Fields{
+			"guild":   event.GuildID,
+			"channel": event.ChannelID,
+			"event":   event.ID,
+			"live":    live,
+		}).Info("Scheduled event changed quiet mode")
+	}
+}
+
+// Returns true if sounds shouldn't be played in a voice channel because a
+// scheduled event is live in it
+func eventQuiet(gid, cid string) bool {
+	if !getGuildSettings(gid).EventQuiet {
+		return false
+	}
+
+	liveEventsLock.RLock()
+	defer liveEventsLock.RUnlock()
+	for _, channel := range liveEvents {
+		if channel == cid {
+			return true
+		}
+	}
+	return false
+}
+
+// Picks up events that went live while the bot was offline
+func syncScheduledEvents(gid string) {
+	if !getGuildSettings(gid).EventQuiet {
+		return
+	}
+
+	events, err := discord.GuildScheduledEvents(gid, false)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": gid,
+			"error": err,
+		}).Warning("Failed to fetch scheduled events")
+		return
+	}
+
+	for _, event := range events {
+		updateScheduledEvent(event)
+	}
+}
+
+func onScheduledEventCreate(s *discordgo.Session, event *discordgo.GuildScheduledEventCreate) {
+	updateScheduledEvent(event.GuildScheduledEvent)
+}
+
+func onScheduledEventUpdate(s *discordgo.Session, event *discordgo.GuildScheduledEventUpdate) {
+	updateScheduledEvent(event.GuildScheduledEvent)
+}
+
+func onScheduledEventDelete(s *discordgo.Session, event *discordgo.GuildScheduledEventDelete) {
+	liveEventsLock.Lock()
+	delete(liveEvents, event.ID)
+	liveEventsLock.Unlock()
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	"github.com/noisemaster/airhornbot/pkg/redis"
+	"github.com/noisemaster/airhornbot/pkg/sound"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Variant name used for the sound as it exists in the normal collection
+	EXPERIMENT_CONTROL = "control"
+
+	// How long after a play a rating is still attributed to it
+	EXPERIMENT_RATING_WINDOW = time.Minute * 5
+)
+
+var (
+	// All known experiments, keyed by name
+	experiments     map[string]*Experiment = make(map[string]*Experiment)
+	experimentsLock sync.RWMutex
+
+	// The last experiment play in each guild, used to attribute !rate votes
+	lastExperimentPlays     map[string]*experimentPlay = make(map[string]*experimentPlay)
+	lastExperimentPlaysLock sync.Mutex
+)
+
+// Experiment buckets guilds between alternate encodings of a single sound so
+// that play and rating data can be compared per variant
+type Experiment struct {
+	Name       string   `json:"name"`
+	Collection string   `json:"collection"`
+	Sound      string   `json:"sound"`
+	Variants   []string `json:"variants"`
+	Running    bool     `json:"running"`
+
+	// Loaded sounds for each variant, the control variant is the original sound
+	sounds map[string]*sound.Sound
+}
+
+type experimentPlay struct {
+	Experiment string
+	Variant    string
+	At         time.Time
+}
+
+// Loads the audio for every variant of this experiment. Variant files live in
+// audio/experiments/<prefix>_<sound>_<variant>.dca
+func (e *Experiment) Load() error {
+	coll := findCollection(e.Collection)
+	if coll == nil {
+		return fmt.Errorf("unknown collection %s", e.Collection)
+	}
+
+	original := coll.Find(e.Sound)
+	if original == nil {
+		return fmt.Errorf("unknown sound %s in collection %s", e.Sound, e.Collection)
+	}
+
+	e.sounds = make(map[string]*sound.Sound)
+	for _, variant := range e.Variants {
+		if variant == EXPERIMENT_CONTROL {
+			e.sounds[variant] = original
+			continue
+		}
+
+		s := sound.New(original.Name, original.Weight, original.PartDelay)
+		err := s.LoadFile(fmt.Sprintf("audio/experiments/%s_%s_%s.dca", coll.Prefix, original.Name, variant))
+		if err != nil {
+			return err
+		}
+		e.sounds[variant] = s
+	}
+
+	return nil
+}
+
+// Returns the variant a guild is bucketed into for this experiment
+func (e *Experiment) Bucket(guildID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(e.Name + ":" + guildID))
+	return e.Variants[h.Sum32()%uint32(len(e.Variants))]
+}
+
+func (e *Experiment) save() error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return rcli.HSet("airhorn:experiments", e.Name, string(data)).Err()
+}
+
+// Returns the collection with the given prefix
+func findCollection(prefix string) *sound.Collection {
+	for _, coll := range getCollections() {
+		if coll.Prefix == prefix {
+			return coll
+		}
+	}
+	return nil
+}
+
+// Loads all experiments stored in redis
+func loadExperiments() {
+	if rcli == nil {
+		return
+	}
+
+	data, err := rcli.HGetAll("airhorn:experiments").Result()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to load experiments from redis")
+		return
+	}
+
+	experimentsLock.Lock()
+	defer experimentsLock.Unlock()
+
+	for name, raw := range data {
+		exp := &Experiment{}
+		if err := json.Unmarshal([]byte(raw), exp); err != nil {
+			log.WithFields(log.Fields{
+				"experiment": name,
+				"error":      err,
+			}).Warning("Failed to decode experiment")
+			continue
+		}
+
+		if err := exp.Load(); err != nil {
+			log.WithFields(log.Fields{
+				"experiment": name,
+				"error":      err,
+			}).Warning("Failed to load experiment sounds")
+			continue
+		}
+
+		experiments[name] = exp
+	}
+}
+
+// Swaps the sound for a play with the variant its guild is bucketed into, if
+// the sound is part of a running experiment
+func applyExperiments(play *queue.Play, coll *sound.Collection) {
+	experimentsLock.RLock()
+	defer experimentsLock.RUnlock()
+
+	for _, exp := range experiments {
+		if !exp.Running || exp.Collection != coll.Prefix || exp.Sound != play.Sound.Name {
+			continue
+		}
+
+		play.Experiment = exp.Name
+		play.Variant = exp.Bucket(play.GuildID)
+		play.Sound = exp.sounds[play.Variant]
+
+		lastExperimentPlaysLock.Lock()
+		lastExperimentPlays[play.GuildID] = &experimentPlay{
+			Experiment: play.Experiment,
+			Variant:    play.Variant,
+			At:         time.Now(),
+		}
+		lastExperimentPlaysLock.Unlock()
+		return
+	}
+}
+
+// Records the experiment variant of a play into a stats pipeline
+func trackExperimentStats(pipe *redis.Pipeline, play *queue.Play) {
+	if play.Experiment == "" {
+		return
+	}
+
+	base := fmt.Sprintf("airhorn:exp:%s:%s", play.Experiment, play.Variant)
+	pipe.Incr(fmt.Sprintf("%s:plays", base))
+	pipe.SAdd(fmt.Sprintf("%s:guilds", base), play.GuildID)
+	if play.UserID != "" {
+		pipe.SAdd(fmt.Sprintf("%s:users", base), play.UserID)
+	}
+}
+
+// Handles a !rate command, attributing the vote to the last experiment play in the guild
+func rateExperimentPlay(cid, gid, uid, vote string) {
+	if rcli == nil {
+		return
+	}
+
+	if vote != "up" && vote != "down" {
+		discord.ChannelMessageSend(cid, "Usage: `!rate up` or `!rate down`")
+		return
+	}
+
+	lastExperimentPlaysLock.Lock()
+	last := lastExperimentPlays[gid]
+	lastExperimentPlaysLock.Unlock()
+
+	if last == nil || time.Since(last.At) > EXPERIMENT_RATING_WINDOW {
+		discord.ChannelMessageSend(cid, "There is nothing to rate right now")
+		return
+	}
+
+	// Only count a single vote per user for each variant
+	base := fmt.Sprintf("airhorn:exp:%s:%s", last.Experiment, last.Variant)
+	added, err := rcli.SAdd(fmt.Sprintf("%s:raters", base), uid).Result()
+	if err != nil || added == 0 {
+		return
+	}
+
+	rcli.Incr(fmt.Sprintf("%s:%s", base, vote))
+	discord.ChannelMessageSend(cid, ":ok_hand: thanks for the feedback")
+}
+
+// Removes the user from the players and raters of every experiment variant,
+// including experiments that were deleted since
+func forgetExperimentUser(uid string) error {
+	keys, err := rcli.ScanKeys("airhorn:exp:*")
+	if err != nil {
+		return err
+	}
+
+	_, err = rcli.Pipelined(func(pipe *redis.Pipeline) error {
+		for _, key := range keys {
+			if strings.HasSuffix(key, ":users") || strings.HasSuffix(key, ":raters") {
+				pipe.SRem(key, uid)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+func displayExperimentResults(cid string, exp *Experiment) {
+	type variantCmds struct {
+		plays, up, down *redis.StringCmd
+		guilds          *redis.IntCmd
+	}
+
+	results := make([]variantCmds, len(exp.Variants))
+	rcli.Pipelined(func(pipe *redis.Pipeline) error {
+		for i, variant := range exp.Variants {
+			base := fmt.Sprintf("airhorn:exp:%s:%s", exp.Name, variant)
+			results[i] = variantCmds{
+				plays:  pipe.Get(fmt.Sprintf("%s:plays", base)),
+				up:     pipe.Get(fmt.Sprintf("%s:up", base)),
+				down:   pipe.Get(fmt.Sprintf("%s:down", base)),
+				guilds: pipe.SCard(fmt.Sprintf("%s:guilds", base)),
+			}
+		}
+		return nil
+	})
+
+	w := &tabwriter.Writer{}
+	buf := &bytes.Buffer{}
+
+	w.Init(buf, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(w, "```\n")
+	fmt.Fprintf(w, "%s (%s:%s, running: %v)\n", exp.Name, exp.Collection, exp.Sound, exp.Running)
+	fmt.Fprintf(w, "Variant\tPlays\tGuilds\tUp\tDown\n")
+	for i, variant := range exp.Variants {
+		r := results[i]
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", variant, orZero(r.plays.Val()), r.guilds.Val(), orZero(r.up.Val()), orZero(r.down.Val()))
+	}
+	fmt.Fprintf(w, "```\n")
+	w.Flush()
+	discord.ChannelMessageSend(cid, buf.String())
+}
+
+func orZero(val string) string {
+	if val == "" {
+		return "0"
+	}
+	return val
+}
+
+// Handles the owner `experiment` control commands:
+//
+//	experiment create <name> <collection> <sound> <variant> [variant...]
+//	experiment start|stop|results|delete <name>
+//	experiment list
+func handleExperimentCommand(cid string, parts []string) {
+	if rcli == nil {
+		discord.ChannelMessageSend(cid, "Experiments require a redis connection")
+		return
+	}
+
+	if len(parts) < 1 || parts[0] == "list" {
+		experimentsLock.RLock()
+		names := make([]string, 0, len(experiments))
+		for name, exp := range experiments {
+			names = append(names, fmt.Sprintf("%s (%s:%s, running: %v)", name, exp.Collection, exp.Sound, exp.Running))
+		}
+		experimentsLock.RUnlock()
+
+		if len(names) == 0 {
+			discord.ChannelMessageSend(cid, "No experiments")
+			return
+		}
+		discord.ChannelMessageSend(cid, "```\n"+strings.Join(names, "\n")+"\n```")
+		return
+	}
+
+	if len(parts) < 2 {
+		return
+	}
+
+	if parts[0] == "create" {
+		if len(parts) < 5 {
+			discord.ChannelMessageSend(cid, "Usage: `experiment create <name> <collection> <sound> <variant> [variant...]`")
+			return
+		}
+
+		exp := &Experiment{
+			Name:       parts[1],
+			Collection: parts[2],
+			Sound:      parts[3],
+			Variants:   append([]string{EXPERIMENT_CONTROL}, parts[4:]...),
+		}
+
+		if err := exp.Load(); err != nil {
+			discord.ChannelMessageSend(cid, fmt.Sprintf("Failed to load experiment: %s", err))
+			return
+		}
+
+		if err := exp.save(); err != nil {
+			discord.ChannelMessageSend(cid, fmt.Sprintf("Failed to save experiment: %s", err))
+			return
+		}
+
+		experimentsLock.Lock()
+		experiments[exp.Name] = exp
+		experimentsLock.Unlock()
+
+		discord.ChannelMessageSend(cid, fmt.Sprintf(":ok_hand: created experiment %s with variants %s", exp.Name, strings.Join(exp.Variants, ", ")))
+		return
+	}
+
+	experimentsLock.Lock()
+	exp, exists := experiments[parts[1]]
+	if exists {
+		switch parts[0] {
+		case "start":
+			exp.Running = true
+			exp.save()
+		case "stop":
+			exp.Running = false
+			exp.save()
+		case "delete":
+			delete(experiments, exp.Name)
+			rcli.HDel("airhorn:experiments", exp.Name)
+		}
+	}
+	experimentsLock.Unlock()
+
+	if !exists {
+		discord.ChannelMessageSend(cid, fmt.Sprintf("Unknown experiment %s", parts[1]))
+		return
+	}
+
+	if parts[0] == "results" {
+		displayExperimentResults(cid, exp)
+		return
+	}
+
+	discord.ChannelMessageSend(cid, ":ok_hand:")
+}
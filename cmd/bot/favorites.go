@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Most sounds a user can favorite
+	MAX_FAVORITES = 25
+)
+
+// Redis set of a user's favorite sounds as `collection:sound`, shared by every
+// guild they play in
+func favoritesKey(uid string) string {
+	return fmt.Sprintf("airhorn:user:%s:favorites", uid)
+}
+
+func getFavorites(uid string) ([]string, error) {
+	favorites, err := rcli.SMembers(favoritesKey(uid)).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(favorites)
+	return favorites, nil
+}
+
+// Handles `!fav` (play a random favorite), `!fav add <collection:sound>`,
+// `!fav remove <collection:sound>` and `!fav list`
+func handleFavoriteCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, parts []string) {
+	if rcli == nil {
+		discord.ChannelMessageSend(m.ChannelID, "Favorites require a redis connection")
+		return
+	}
+
+	if len(parts) < 2 {
+		playFavorite(m, guild)
+		return
+	}
+
+	switch parts[1] {
+	case "list":
+		displayFavorites(m.ChannelID, m.Author.ID)
+	case "add":
+		if len(parts) != 3 {
+			discord.ChannelMessageSend(m.ChannelID, "Usage: `!fav add <collection:sound>`, eg. `!fav add airhorn:truck`")
+			return
+		}
+		addFavorite(m, guild, parts[2])
+	case "remove":
+		if len(parts) != 3 {
+			discord.ChannelMessageSend(m.ChannelID, "Usage: `!fav remove <collection:sound>`")
+			return
+		}
+
+		removed, err := rcli.SRem(favoritesKey(m.Author.ID), parts[2]).Result()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"user":  m.Author.ID,
+				"error": err,
+			}).Error("Failed to remove favorite")
+			discord.ChannelMessageSend(m.ChannelID, "Something went wrong, try again later")
+			return
+		}
+		if removed == 0 {
+			discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("%s isn't one of your favorites, see them with `!fav list`", parts[2]))
+			return
+		}
+		discord.ChannelMessageSend(m.ChannelID, ":ok_hand:")
+	default:
+		discord.ChannelMessageSend(m.ChannelID, "Usage: `!fav`, `!fav add <collection:sound>`, `!fav remove <collection:sound>` or `!fav list`")
+	}
+}
+
+// Saves a sound to the user's favorites, it has to be one they can play here
+func addFavorite(m *discordgo.MessageCreate, guild *discordgo.Guild, arg string) {
+	if !strings.Contains(arg, ":") {
+		discord.ChannelMessageSend(m.ChannelID, "Favorites are single sounds, eg. `!fav add airhorn:truck`")
+		return
+	}
+
+	link, err := parseChainLink(guild, getGuildSettings(guild.ID), m.Author.ID, arg)
+	if err != nil {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Can't favorite that, %s", err))
+		return
+	}
+
+	// Favorites are saved under the sound's real name, not an alias
+	favorite := link.Collection.Prefix + ":" + link.Sound.Name
+	key := favoritesKey(m.Author.ID)
+	if count := rcli.SCard(key).Val(); count >= MAX_FAVORITES && !rcli.SIsMember(key, favorite).Val() {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("You already have %d favorites, remove one first", MAX_FAVORITES))
+		return
+	}
+
+	if err := rcli.SAdd(key, favorite).Err(); err != nil {
+		log.WithFields(log.Fields{
+			"user":  m.Author.ID,
+			"error": err,
+		}).Error("Failed to save favorite")
+		discord.ChannelMessageSend(m.ChannelID, "Something went wrong, try again later")
+		return
+	}
+	discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf(":ok_hand: added %s to your favorites, play one with `!fav`", favorite))
+}
+
+// Plays one of the user's favorites, picked from the ones this guild lets
+// them play
+func playFavorite(m *discordgo.MessageCreate, guild *discordgo.Guild) {
+	favorites, err := getFavorites(m.Author.ID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"user":  m.Author.ID,
+			"error": err,
+		}).Error("Failed to get favorites")
+		return
+	}
+
+	if len(favorites) == 0 {
+		discord.ChannelMessageSend(m.ChannelID, "You don't have any favorites yet, add one with `!fav add airhorn:truck`")
+		return
+	}
+
+	// Favorites are checked on every play, they can be disabled in this guild
+	// or have been removed since they were added
+	gs := getGuildSettings(guild.ID)
+	playable := make([]*chainLink, 0, len(favorites))
+	for _, favorite := range favorites {
+		if link, err := parseChainLink(guild, gs, m.Author.ID, favorite); err == nil {
+			playable = append(playable, link)
+		}
+	}
+
+	if len(playable) == 0 {
+		discord.ChannelMessageSend(m.ChannelID, "None of your favorites can be played on this server")
+		return
+	}
+
+	link := playable[rand.Intn(len(playable))]
+	enqueuePlay(m.Author, guild, m.ChannelID, link.Collection, link.Sound, queue.SOURCE_COMMAND)
+}
+
+func displayFavorites(cid, uid string) {
+	favorites, err := getFavorites(uid)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"user":  uid,
+			"error": err,
+		}).Error("Failed to get favorites")
+		return
+	}
+
+	if len(favorites) == 0 {
+		discord.ChannelMessageSend(cid, "You don't have any favorites yet, add one with `!fav add airhorn:truck`")
+		return
+	}
+
+	discord.ChannelMessageSendEmbed(cid, &discordgo.MessageEmbed{
+		Title:       "Your favorites",
+		Color:       0xE5343A,
+		Description: strings.Join(favorites, "\n"),
+		Footer: &discordgo.MessageEmbedFooter{
+			Text: fmt.Sprintf("%d/%d, play a random one with !fav", len(favorites), MAX_FAVORITES),
+		},
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	"github.com/noisemaster/airhornbot/pkg/sound"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Follows end once the followed user hasn't moved for this long
+	FOLLOW_TIMEOUT = time.Minute * 30
+)
+
+// A user the bot plays a stinger for every time they join or move voice channels
+type follow struct {
+	UserID string
+
+	// Sound played on every move, a random one from the collection if Sound is nil
+	Collection *sound.Collection
+	Sound      *sound.Sound
+
+	// Text channel !follow was run in, told when the follow times out
+	ChannelID string
+
+	LastMove time.Time
+}
+
+var (
+	// The user being followed in each guild, keyed by guild id
+	follows     map[string]*follow = make(map[string]*follow)
+	followsLock sync.Mutex
+)
+
+// Handles `!follow @user [collection] [sound]` and `!unfollow`
+func handleFollowCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, parts []string) {
+	if parts[0] == "!unfollow" {
+		followsLock.Lock()
+		delete(follows, guild.ID)
+		followsLock.Unlock()
+		discord.ChannelMessageSend(m.ChannelID, ":ok_hand:")
+		return
+	}
+
+	if len(m.Mentions) != 1 {
+		discord.ChannelMessageSend(m.ChannelID, "Usage: `!follow @user [collection] [sound]`")
+		return
+	}
+
+	// The mention is the second part, anything after it picks the stinger
+	f := &follow{
+		UserID:     m.Mentions[0].ID,
+		Collection: findCollection(AIRHORN.Prefix),
+		ChannelID:  m.ChannelID,
+		LastMove:   time.Now(),
+	}
+
+	if len(parts) > 2 {
+		f.Collection = nil
+		for _, coll := range getCollections() {
+			if coll.Prefix == parts[2] || scontains("!"+parts[2], coll.Commands...) {
+				f.Collection = coll
+				break
+			}
+		}
+
+		if f.Collection == nil || !getGuildSettings(guild.ID).CollectionEnabled(f.Collection) {
+			discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("There is no collection %s", parts[2]))
+			return
+		}
+	}
+
+	if len(parts) > 3 {
+		f.Sound = f.Collection.Find(parts[3])
+		if f.Sound == nil {
+			discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("There is no sound %s in %s", parts[3], f.Collection.Prefix))
+			return
+		}
+	}
+
+	followsLock.Lock()
+	follows[guild.ID] = f
+	followsLock.Unlock()
+
+	discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf(":ok_hand: following <@%s>, stop with `!unfollow`", f.UserID))
+}
+
+// Plays the stinger when the followed user joins or moves to a voice channel
+func onVoiceStateUpdate(s *discordgo.Session, vs *discordgo.VoiceStateUpdate) {
+	if vs.ChannelID == "" || (vs.BeforeUpdate != nil && vs.BeforeUpdate.ChannelID == vs.ChannelID) {
+		return
+	}
+
+	followsLock.Lock()
+	f := follows[vs.GuildID]
+	if f != nil && f.UserID == vs.UserID {
+		f.LastMove = time.Now()
+	} else {
+		f = nil
+	}
+	followsLock.Unlock()
+
+	if f == nil {
+		return
+	}
+
+	guild, _ := discord.State.Guild(vs.GuildID)
+	if guild == nil {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"guild":   vs.GuildID,
+		"user":    vs.UserID,
+		"channel": vs.ChannelID,
+	}).Info("Following user to a new channel")
+	go queuePlay(newPlay(guild, vs.ChannelID, vs.UserID, f.Collection, f.Sound, queue.SOURCE_FOLLOW))
+}
+
+// Ends follows whose user hasn't moved within FOLLOW_TIMEOUT
+func expireFollows() {
+	for {
+		time.Sleep(time.Minute)
+
+		expired := make([]*follow, 0)
+		followsLock.Lock()
+		for gid, f := range follows {
+			if time.Since(f.LastMove) > FOLLOW_TIMEOUT {
+				delete(follows, gid)
+				expired = append(expired, f)
+			}
+		}
+		followsLock.Unlock()
+
+		for _, f := range expired {
+			discord.ChannelMessageSend(f.ChannelID, fmt.Sprintf("Stopped following <@%s>, they haven't moved in a while", f.UserID))
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Number of gallery entries listed per page of !gallery browse
+	GALLERY_PAGE_SIZE = 15
+)
+
+// GalleryEntry is a custom sound a guild has published to the public gallery.
+// The web server reads these from the same redis hash.
+type GalleryEntry struct {
+	ID        string    `json:"id"`
+	GuildID   string    `json:"guild_id"`
+	GuildName string    `json:"guild_name"`
+	Name      string    `json:"name"`
+	Publisher string    `json:"publisher"`
+	Published time.Time `json:"published"`
+	Imports   int       `json:"imports"`
+}
+
+func galleryGuildKey(gid string) string {
+	return fmt.Sprintf("airhorn:gallery:guild:%s", gid)
+}
+
+func getGalleryEntry(id string) *GalleryEntry {
+	raw, err := rcli.HGet("airhorn:gallery", id).Result()
+	if err != nil {
+		return nil
+	}
+
+	entry := &GalleryEntry{}
+	if json.Unmarshal([]byte(raw), entry) != nil {
+		return nil
+	}
+	return entry
+}
+
+func putGalleryEntry(entry *GalleryEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return rcli.HSet("airhorn:gallery", entry.ID, string(data)).Err()
+}
+
+// Returns every gallery entry, newest first
+func listGalleryEntries() []*GalleryEntry {
+	data, err := rcli.HGetAll("airhorn:gallery").Result()
+	if err != nil {
+		return nil
+	}
+
+	entries := make([]*GalleryEntry, 0, len(data))
+	for _, raw := range data {
+		entry := &GalleryEntry{}
+		if json.Unmarshal([]byte(raw), entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Published.After(entries[j].Published)
+	})
+	return entries
+}
+
+// Removes a guild's sound from the gallery, if it was published
+func unpublishGallerySound(gid, name string) {
+	id := rcli.HGet(galleryGuildKey(gid), name).Val()
+	if id == "" {
+		return
+	}
+
+	rcli.HDel("airhorn:gallery", id)
+	rcli.HDel(galleryGuildKey(gid), name)
+}
+
+// Removes a gallery entry by id, used by owner moderation
+func removeGalleryEntry(id string) *GalleryEntry {
+	entry := getGalleryEntry(id)
+	if entry == nil {
+		return nil
+	}
+
+	rcli.HDel("airhorn:gallery", id)
+	rcli.HDel(galleryGuildKey(entry.GuildID), entry.Name)
+	return entry
+}
+
+func publishGallerySound(m *discordgo.MessageCreate, guild *discordgo.Guild, name string) {
+	if !getGuildSettings(guild.ID).GalleryOptIn {
+		discord.ChannelMessageSend(m.ChannelID, "This server hasn't opted in to the public gallery, enable it with `!settings set gallery on`")
+		return
+	}
+
+	if rcli.SIsMember("airhorn:gallery:banned", guild.ID).Val() {
+		discord.ChannelMessageSend(m.ChannelID, "This server can no longer publish to the gallery")
+		return
+	}
+
+	cs := getCustomSound(guild.ID, name)
+	if cs == nil {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("There is no custom sound called %s", name))
+		return
+	}
+
+	if !cs.Playable() {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("%s is disabled or waiting for review and can't be published", name))
+		return
+	}
+
+	if rcli.HGet(galleryGuildKey(guild.ID), name).Val() != "" {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("%s is already in the gallery", name))
+		return
+	}
+
+	entry := &GalleryEntry{
+		ID:        strings.ToLower(randomCode(8)),
+		GuildID:   guild.ID,
+		GuildName: guild.Name,
+		Name:      cs.Name,
+		Publisher: m.Author.ID,
+		Published: time.Now(),
+	}
+
+	if err := putGalleryEntry(entry); err != nil {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"error": err,
+		}).Error("Failed to publish gallery sound")
+		return
+	}
+	rcli.HSet(galleryGuildKey(guild.ID), cs.Name, entry.ID)
+
+	log.WithFields(log.Fields{
+		"guild": guild.ID,
+		"sound": cs.Name,
+		"id":    entry.ID,
+	}).Info("Published sound to the gallery")
+	discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf(":ok_hand: published %s to the gallery as `%s`", cs.Name, entry.ID))
+}
+
+func importGallerySound(m *discordgo.MessageCreate, guild *discordgo.Guild, parts []string) {
+	entry := getGalleryEntry(parts[2])
+	if entry == nil {
+		discord.ChannelMessageSend(m.ChannelID, "There is no gallery sound with that id")
+		return
+	}
+
+	name := entry.Name
+	if len(parts) > 3 {
+		name = parts[3]
+	}
+
+	if !customSoundName.MatchString(name) {
+		discord.ChannelMessageSend(m.ChannelID, "Sound names can only contain letters, numbers and underscores")
+		return
+	}
+
+	if getCustomSound(guild.ID, name) != nil {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("There is already a sound called %s, pass a new name with `!gallery import %s <name>`", name, entry.ID))
+		return
+	}
+
+	cs := getCustomSound(entry.GuildID, entry.Name)
+	if cs == nil {
+		removeGalleryEntry(entry.ID)
+		discord.ChannelMessageSend(m.ChannelID, "That sound no longer exists")
+		return
+	}
+
+	if err := importCustomSound(entry.GuildID, cs, guild.ID, name, m.Author.ID); err != nil {
+		log.WithFields(log.Fields{
+			"id":    entry.ID,
+			"guild": guild.ID,
+			"error": err,
+		}).Error("Failed to import gallery sound")
+		return
+	}
+
+	entry.Imports++
+	putGalleryEntry(entry)
+	discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf(":ok_hand: imported %s, play it with `!custom %s`", name, name))
+}
+
+func displayGallery(cid string, page int) {
+	entries := listGalleryEntries()
+	if len(entries) == 0 {
+		discord.ChannelMessageSend(cid, "The gallery is empty")
+		return
+	}
+
+	pages := (len(entries) + GALLERY_PAGE_SIZE - 1) / GALLERY_PAGE_SIZE
+	if page < 1 || page > pages {
+		page = 1
+	}
+
+	em := &discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("Sound Gallery (page %d of %d)", page, pages),
+		Color:       0xE5343A,
+		Description: "Import any of these with **!gallery import {id}**\n",
+	}
+
+	for _, entry := range entries[(page-1)*GALLERY_PAGE_SIZE : minInt(page*GALLERY_PAGE_SIZE, len(entries))] {
+		em.Description += fmt.Sprintf("`%s` **%s** from %s (%d imports)\n", entry.ID, entry.Name, entry.GuildName, entry.Imports)
+	}
+
+	discord.ChannelMessageSendEmbed(cid, em)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Handles the !gallery command group
+func handleGalleryCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, parts []string) {
+	if rcli == nil {
+		return
+	}
+
+	if len(parts) < 2 || parts[1] == "browse" {
+		page := 1
+		if len(parts) > 2 {
+			fmt.Sscanf(parts[2], "%d", &page)
+		}
+		displayGallery(m.ChannelID, page)
+		return
+	}
+
+	if !isGuildAdmin(guild, m.Author.ID, m.ChannelID) {
+		return
+	}
+
+	if len(parts) < 3 {
+		discord.ChannelMessageSend(m.ChannelID, "Usage: `!gallery [browse|publish <name>|unpublish <name>|import <id> [name]]`")
+		return
+	}
+
+	switch parts[1] {
+	case "publish":
+		publishGallerySound(m, guild, parts[2])
+	case "unpublish":
+		unpublishGallerySound(guild.ID, parts[2])
+		discord.ChannelMessageSend(m.ChannelID, ":ok_hand:")
+	case "import":
+		importGallerySound(m, guild, parts)
+	}
+}
+
+// Handles the owner gallery moderation commands:
+//
+//	gallery remove <id>
+//	gallery ban|unban <guild id>
+func handleGalleryModeration(cid string, parts []string) {
+	if rcli == nil || len(parts) < 2 {
+		return
+	}
+
+	switch parts[0] {
+	case "remove":
+		entry := removeGalleryEntry(parts[1])
+		if entry == nil {
+			discord.ChannelMessageSend(cid, "No gallery entry with that id")
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"id":    entry.ID,
+			"guild": entry.GuildID,
+			"sound": entry.Name,
+		}).Info("Removed sound from the gallery")
+	case "ban":
+		rcli.SAdd("airhorn:gallery:banned", parts[1])
+		for _, entry := range listGalleryEntries() {
+			if entry.GuildID == parts[1] {
+				removeGalleryEntry(entry.ID)
+			}
+		}
+	case "unban":
+		rcli.SRem("airhorn:gallery:banned", parts[1])
+	default:
+		return
+	}
+
+	discord.ChannelMessageSend(cid, ":ok_hand:")
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How long the gateway can stay disconnected before /healthz reports the
+	// bot as dead, discordgo normally reconnects well within this
+	HEALTH_GATEWAY_GRACE = time.Minute * 5
+)
+
+var (
+	// When the gateway connection was lost, zero while connected
+	gatewayDownSince     time.Time
+	gatewayDownSinceLock sync.Mutex
+)
+
+// The body of /healthz and /readyz
+type HealthStatus struct {
+	OK bool `json:"ok"`
+
+	Gateway      string `json:"gateway"`
+	Redis        string `json:"redis"`
+	Sounds       int    `json:"sounds"`
+	Shard        int    `json:"shard"`
+	Uptime       string `json:"uptime"`
+	GatewayError string `json:"gateway_error,omitempty"`
+	RedisError   string `json:"redis_error,omitempty"`
+}
+
+func onConnect(s *discordgo.Session, event *discordgo.Connect) {
+	gatewayDownSinceLock.Lock()
+	gatewayDownSince = time.Time{}
+	gatewayDownSinceLock.Unlock()
+}
+
+func onDisconnect(s *discordgo.Session, event *discordgo.Disconnect) {
+	gatewayDownSinceLock.Lock()
+	if gatewayDownSince.IsZero() {
+		gatewayDownSince = time.Now()
+	}
+	gatewayDownSinceLock.Unlock()
+}
+
+// Discord resumes the session after short drops instead of sending ready
+// again, replaying the events the bot missed, so state and voice
+// connections carry on as they were
+func onResumed(s *discordgo.Session, event *discordgo.Resumed) {
+	gatewayDownSinceLock.Lock()
+	downSince := gatewayDownSince
+	gatewayDownSince = time.Time{}
+	gatewayDownSinceLock.Unlock()
+
+	fields := log.Fields{"shard": s.ShardID}
+	if !downSince.IsZero() {
+		fields["downtime"] = time.Since(downSince)
+	}
+	log.WithFields(fields).Info("Resumed gateway session")
+}
+
+// Collects the current health of the bot, along with how long the gateway has
+// been down. The gateway is "connected" once the ready event arrived,
+// "connecting" before that and "disconnected" if it was lost and discordgo is
+// still trying to reconnect.
+func healthStatus() (*HealthStatus, time.Duration) {
+	status := &HealthStatus{
+		Gateway: "connecting",
+		Redis:   "disabled",
+		Shard:   discord.ShardID,
+		Uptime:  time.Since(startTime).Round(time.Second).String(),
+	}
+
+	gatewayDownSinceLock.Lock()
+	downSince := gatewayDownSince
+	gatewayDownSinceLock.Unlock()
+
+	var downFor time.Duration
+	if !downSince.IsZero() {
+		downFor = time.Since(downSince)
+		status.Gateway = "disconnected"
+		status.GatewayError = "disconnected for " + downFor.Round(time.Second).String()
+	} else {
+		discord.RLock()
+		if discord.DataReady {
+			status.Gateway = "connected"
+		}
+		discord.RUnlock()
+	}
+
+	if rcli != nil {
+		status.Redis = "connected"
+		if err := rcli.Ping().Err(); err != nil {
+			status.Redis = "unreachable"
+			status.RedisError = err.Error()
+		}
+	}
+
+	for _, coll := range getCollections() {
+		status.Sounds += len(coll.Sounds)
+	}
+	return status, downFor
+}
+
+// Serves /healthz for liveness probes, which only fails once the gateway has
+// been down for longer than HEALTH_GATEWAY_GRACE, and /readyz for readiness
+// probes, which fails whenever the bot can't play sounds. The public status
+// page is served on /status.
+func serveHealth(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", serveStatusPage)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		status, downFor := healthStatus()
+		status.OK = downFor < HEALTH_GATEWAY_GRACE
+		writeHealth(w, status)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		status, _ := healthStatus()
+		status.OK = status.Gateway == "connected" && status.Redis != "unreachable" && status.Sounds > 0
+		writeHealth(w, status)
+	})
+
+	log.WithFields(log.Fields{
+		"addr": addr,
+	}).Info("Serving health checks")
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.WithFields(log.Fields{
+			"addr":  addr,
+			"error": err,
+		}).Error("Failed to serve health checks")
+	}
+}
+
+func writeHealth(w http.ResponseWriter, status *HealthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	if !status.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
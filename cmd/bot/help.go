@@ -0,0 +1,223 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Lines shown on each page of !help
+	HELP_PAGE_LINES = 15
+)
+
+// Categories the !help select menu switches between, in menu order. Anything
+// else is taken as a collection prefix, listing its sounds.
+var helpCategories = []string{"collections", "commands", "admin", "owner"}
+
+// Permission the commands listed in a help category need
+var helpCategoryPerms = map[string]Permission{
+	"commands": PERM_EVERYONE,
+	"admin":    PERM_ADMIN,
+	"owner":    PERM_OWNER,
+}
+
+// Returns the help lines for the commands with the given permission the user
+// can run, sorted by name
+func commandHelp(guild *discordgo.Guild, uid, cid string, perm Permission) []string {
+	lines := make([]string, 0, len(commands))
+	for _, cmd := range commands {
+		if cmd.Help == "" || cmd.Permission != perm || !cmd.allowed(guild, uid, cid) {
+			continue
+		}
+		lines = append(lines, "**"+cmd.Name+"** - "+cmd.Help)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// Returns the categories the user has something to see in
+func availableHelpCategories(guild *discordgo.Guild, uid, cid string) []string {
+	available := make([]string, 0, len(helpCategories))
+	for _, category := range helpCategories {
+		if perm, ok := helpCategoryPerms[category]; ok && len(commandHelp(guild, uid, cid, perm)) == 0 {
+			continue
+		}
+		available = append(available, category)
+	}
+	return available
+}
+
+// Renders a page of a help category for the user, along with the buttons and
+// category menu to move around it. Returns nil if there is no such category.
+func helpPage(guild *discordgo.Guild, settings *GuildSettings, uid, cid, category string, page int) (*discordgo.MessageEmbed, []discordgo.MessageComponent) {
+	em := &discordgo.MessageEmbed{Color: 0xE5343A}
+	var lines []string
+
+	if perm, ok := helpCategoryPerms[category]; ok {
+		em.Title = translate(settings.Language, "help.category."+category, nil)
+		lines = commandHelp(guild, uid, cid, perm)
+	} else if category == "collections" {
+		em.Title = translate(settings.Language, "help.title", nil)
+		em.Description = translate(settings.Language, "help.collections", nil) + "\n"
+		for _, coll := range getCollections() {
+			if settings.CollectionEnabled(coll) {
+				lines = append(lines, "**"+coll.Prefix+"** - "+strings.Join(coll.Commands, ", "))
+			}
+		}
+	} else {
+		coll := findCollection(category)
+		if coll == nil || coll.Prefix != category || !settings.CollectionEnabled(coll) {
+			return nil, nil
+		}
+
+		em.Title = coll.Prefix
+		em.Description = translate(settings.Language, "help.sounds", map[string]string{"Commands": strings.Join(coll.Commands, ", ")}) + "\n"
+		for _, s := range coll.Sounds {
+			lines = append(lines, s.Name+describeSound(s))
+		}
+	}
+
+	pages := (len(lines) + HELP_PAGE_LINES - 1) / HELP_PAGE_LINES
+	if pages < 1 {
+		pages = 1
+	}
+	if page >= pages {
+		page = pages - 1
+	}
+	if page < 0 {
+		page = 0
+	}
+
+	end := (page + 1) * HELP_PAGE_LINES
+	if end > len(lines) {
+		end = len(lines)
+	}
+	em.Description += strings.Join(lines[page*HELP_PAGE_LINES:end], "\n")
+	if category == "collections" {
+		em.Description += "\n\n" + translate(settings.Language, "help.more", nil)
+	}
+	em.Footer = &discordgo.MessageEmbedFooter{
+		Text: translate(settings.Language, "help.page", map[string]int{"Page": page + 1, "Pages": pages}),
+	}
+
+	components := []discordgo.MessageComponent{
+		discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.Button{
+				Emoji:    &discordgo.ComponentEmoji{Name: "◀"},
+				Style:    discordgo.SecondaryButton,
+				CustomID: componentID("help", uid, category, strconv.Itoa(page-1)),
+				Disabled: page == 0,
+			},
+			discordgo.Button{
+				Emoji:    &discordgo.ComponentEmoji{Name: "▶"},
+				Style:    discordgo.SecondaryButton,
+				CustomID: componentID("help", uid, category, strconv.Itoa(page+1)),
+				Disabled: page >= pages-1,
+			},
+		}},
+	}
+
+	options := make([]discordgo.SelectMenuOption, 0, len(helpCategories))
+	for _, available := range availableHelpCategories(guild, uid, cid) {
+		options = append(options, discordgo.SelectMenuOption{
+			Label:   translate(settings.Language, "help.category."+available, nil),
+			Value:   available,
+			Default: available == category,
+		})
+	}
+	if len(options) > 1 {
+		components = append(components, discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.SelectMenu{
+				MenuType:    discordgo.StringSelectMenu,
+				CustomID:    componentID("help", uid, "select"),
+				Placeholder: translate(settings.Language, "help.choose", nil),
+				Options:     options,
+			},
+		}})
+	}
+	return em, components
+}
+
+// Handles !help, showing the collections (or the sounds in one) with buttons
+// to page through them and a menu to switch to the other commands
+func handleHelpCommand(c *CommandContext) {
+	category := "collections"
+	if len(c.Parts) > 1 {
+		category = c.Parts[1]
+	}
+
+	em, components := helpPage(c.Guild, c.Settings, c.Message.Author.ID, c.Message.ChannelID, category, 0)
+	if em == nil {
+		return
+	}
+
+	sendReply(c.Message.ChannelID, &discordgo.MessageSend{
+		Embeds:     []*discordgo.MessageEmbed{em},
+		Components: components,
+	}, REPLY_NORMAL)
+}
+
+// Handles the !help buttons and category menu, args are the user the help was
+// for and either the category and page to show or select
+func handleHelpClick(s *discordgo.Session, i *discordgo.InteractionCreate, args []string) {
+	if len(args) < 2 {
+		return
+	}
+
+	// Help sent in a direct message has no guild and the default settings
+	var guild *discordgo.Guild
+	settings := defaultGuildSettings()
+	if i.GuildID != "" {
+		guild, _ = discord.State.Guild(i.GuildID)
+		settings = getGuildSettings(i.GuildID)
+	}
+
+	if interactionUser(i).ID != args[0] {
+		respondEphemeral(s, i, translate(settings.Language, "help.own", nil))
+		return
+	}
+
+	category, page := args[1], 0
+	if category == "select" {
+		values := i.MessageComponentData().Values
+		if len(values) == 0 {
+			respondAcknowledge(s, i)
+			return
+		}
+		category = values[0]
+	} else if len(args) > 2 {
+		page, _ = strconv.Atoi(args[2])
+	}
+
+	// Categories are checked again, the user may have lost a role since
+	if perm, ok := helpCategoryPerms[category]; ok && len(commandHelp(guild, args[0], i.ChannelID, perm)) == 0 {
+		respondAcknowledge(s, i)
+		return
+	}
+
+	em, components := helpPage(guild, settings, args[0], i.ChannelID, category, page)
+	if em == nil {
+		respondAcknowledge(s, i)
+		return
+	}
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Embeds:     []*discordgo.MessageEmbed{em},
+			Components: components,
+		},
+	})
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"category": category,
+			"page":     page,
+			"error":    err,
+		}).Warning("Failed to update help")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dustin/go-humanize"
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	"github.com/noisemaster/airhornbot/pkg/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Plays remembered per guild for !last and !again
+	HISTORY_SIZE = 10
+)
+
+// A play as remembered in a guild's history
+type HistoryEntry struct {
+	UserID     string    `json:"user_id"`
+	Collection string    `json:"collection"`
+	Sound      string    `json:"sound"`
+	Source     string    `json:"source"`
+	Played     time.Time `json:"played"`
+}
+
+var (
+	// Guild histories when there is no redis to keep them in, newest first
+	localHistory     map[string][]*HistoryEntry = make(map[string][]*HistoryEntry)
+	localHistoryLock sync.Mutex
+)
+
+func historyKey(gid string) string {
+	return fmt.Sprintf("airhorn:guild:%s:history", gid)
+}
+
+// Adds the play to its guild's history as it starts. Users who opted out of
+// stats are remembered without their id.
+func recordHistory(play *queue.Play) {
+	if play.Sound == nil {
+		return
+	}
+
+	entry := &HistoryEntry{
+		Collection: play.Collection,
+		Sound:      play.Sound.Name,
+		Source:     play.Source,
+		Played:     time.Now(),
+	}
+	if !optedOut(play.UserID) {
+		entry.UserID = play.UserID
+	}
+
+	if rcli == nil {
+		localHistoryLock.Lock()
+		history := append([]*HistoryEntry{entry}, localHistory[play.GuildID]...)
+		if len(history) > HISTORY_SIZE {
+			history = history[:HISTORY_SIZE]
+		}
+		localHistory[play.GuildID] = history
+		localHistoryLock.Unlock()
+		return
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	key := historyKey(play.GuildID)
+	_, err = rcli.Pipelined(func(pipe *redis.Pipeline) error {
+		pipe.LPush(key, string(data))
+		pipe.LTrim(key, 0, HISTORY_SIZE-1)
+		return nil
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"play":  play.ID,
+			"guild": play.GuildID,
+			"error": err,
+		}).Warning("Failed to record play history")
+	}
+}
+
+// Returns the guild's recent plays, newest first
+func guildHistory(gid string) []*HistoryEntry {
+	if rcli == nil {
+		localHistoryLock.Lock()
+		defer localHistoryLock.Unlock()
+		return append([]*HistoryEntry(nil), localHistory[gid]...)
+	}
+
+	raw, err := rcli.LRange(historyKey(gid), 0, HISTORY_SIZE-1).Result()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": gid,
+			"error": err,
+		}).Warning("Failed to fetch play history")
+		return nil
+	}
+
+	history := make([]*HistoryEntry, 0, len(raw))
+	for _, data := range raw {
+		entry := &HistoryEntry{}
+		if json.Unmarshal([]byte(data), entry) == nil {
+			history = append(history, entry)
+		}
+	}
+	return history
+}
+
+// Removes the user's plays from every guild's history
+func forgetHistory(uid string) error {
+	if rcli == nil {
+		localHistoryLock.Lock()
+		defer localHistoryLock.Unlock()
+		for gid, history := range localHistory {
+			kept := make([]*HistoryEntry, 0, len(history))
+			for _, entry := range history {
+				if entry.UserID != uid {
+					kept = append(kept, entry)
+				}
+			}
+			localHistory[gid] = kept
+		}
+		return nil
+	}
+
+	keys, err := rcli.ScanKeys(historyKey("*"))
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		raw, err := rcli.LRange(key, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+
+		// Entries are removed by value, so plays recorded in the meantime stay
+		for _, data := range raw {
+			entry := &HistoryEntry{}
+			if json.Unmarshal([]byte(data), entry) != nil || entry.UserID != uid {
+				continue
+			}
+			if err := rcli.LRem(key, 0, data).Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Handles !last, listing who played what recently
+func handleLastCommand(cid string, guild *discordgo.Guild) {
+	history := guildHistory(guild.ID)
+	if len(history) == 0 {
+		discord.ChannelMessageSend(cid, "Nothing has been played here recently")
+		return
+	}
+
+	lines := make([]string, len(history))
+	for i, entry := range history {
+		who := "someone"
+		if entry.UserID != "" {
+			who = "<@" + entry.UserID + ">"
+		}
+		lines[i] = fmt.Sprintf("**%s:%s** by %s, %s (%s)", entry.Collection, entry.Sound, who, humanize.Time(entry.Played), entry.Source)
+	}
+
+	discord.ChannelMessageSendComplex(cid, &discordgo.MessageSend{
+		Embeds: []*discordgo.MessageEmbed{{
+			Title:       "Recently played",
+			Color:       0xE5343A,
+			Description: strings.Join(lines, "\n"),
+		}},
+
+		// The history mentions users without pinging them
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	})
+}
+
+// Handles !again, playing the guild's most recent sound once more for the
+// author. Sounds that aren't in a collection, like links and text to speech,
+// can't be replayed.
+func handleAgainCommand(m *discordgo.MessageCreate, guild *discordgo.Guild) {
+	history := guildHistory(guild.ID)
+	if len(history) == 0 {
+		discord.ChannelMessageSend(m.ChannelID, "Nothing has been played here recently")
+		return
+	}
+
+	last := history[0]
+	link, err := parseChainLink(guild, getGuildSettings(guild.ID), m.Author.ID, last.Collection+":"+last.Sound)
+	if err != nil {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Can't play %s:%s again, %s", last.Collection, last.Sound, err))
+		return
+	}
+	enqueuePlay(m.Author, guild, m.ChannelID, link.Collection, link.Sound, queue.SOURCE_COMMAND)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+
+	"github.com/noisemaster/airhornbot/pkg/dca"
+	"github.com/noisemaster/airhornbot/pkg/sound"
+	log "github.com/sirupsen/logrus"
+)
+
+// The result of checking the audio directory against the collections
+type audioReport struct {
+	// Sounds checked and how many of them are fine
+	Checked int
+	Valid   int
+
+	// Why each broken sound file can't be played, keyed by path
+	Broken map[string]error
+
+	// DCA files in the audio directory no collection references
+	Orphans []string
+}
+
+// Verifies that every sound in the collections has a readable, frame-valid
+// DCA file and looks for files in the audio directory nothing uses. Custom and
+// experiment sounds live in subdirectories and aren't checked.
+func checkAudio(colls []*sound.Collection) *audioReport {
+	report := &audioReport{
+		Broken:  make(map[string]error),
+		Orphans: make([]string, 0),
+	}
+
+	referenced := make(map[string]bool)
+	for _, coll := range colls {
+		for _, s := range coll.Sounds {
+			path := coll.SoundPath(s)
+			referenced[path] = true
+
+			report.Checked++
+			if _, err := dca.Verify(path); err != nil {
+				report.Broken[path] = err
+				continue
+			}
+			report.Valid++
+		}
+	}
+
+	files, _ := filepath.Glob("audio/*.dca")
+	for _, path := range files {
+		if !referenced[filepath.ToSlash(path)] {
+			report.Orphans = append(report.Orphans, path)
+		}
+	}
+	sort.Strings(report.Orphans)
+	return report
+}
+
+// Writes a human readable version of the report, used by -check
+func (ar *audioReport) print(w io.Writer) {
+	fmt.Fprintf(w, "%d of %d sounds are valid\n", ar.Valid, ar.Checked)
+
+	broken := make([]string, 0, len(ar.Broken))
+	for path := range ar.Broken {
+		broken = append(broken, path)
+	}
+	sort.Strings(broken)
+
+	for _, path := range broken {
+		fmt.Fprintf(w, "  broken: %s (%s)\n", path, ar.Broken[path])
+	}
+	for _, path := range ar.Orphans {
+		fmt.Fprintf(w, "  orphaned: %s\n", path)
+	}
+}
+
+// Logs the problems in the report
+func (ar *audioReport) log() {
+	for path, err := range ar.Broken {
+		log.WithFields(log.Fields{
+			"path":  path,
+			"error": err,
+		}).Warning("Sound file is broken")
+	}
+
+	if len(ar.Orphans) > 0 {
+		log.WithFields(log.Fields{
+			"files": ar.Orphans,
+		}).Warning("Found sound files no collection uses")
+	}
+
+	log.WithFields(log.Fields{
+		"checked": ar.Checked,
+		"valid":   ar.Valid,
+		"broken":  len(ar.Broken),
+		"orphans": len(ar.Orphans),
+	}).Info("Checked the audio directory")
+}
+
+// Returns the collection definitions without the sounds whose files are
+// broken. Collections left without any sounds are dropped, along with chains
+// into them.
+func withoutBrokenSounds(defs []*sound.Collection, broken map[string]error) []*sound.Collection {
+	if len(broken) == 0 {
+		return defs
+	}
+
+	kept := make([]*sound.Collection, 0, len(defs))
+	dropped := make(map[*sound.Collection]bool)
+	for _, def := range defs {
+		sounds := make([]*sound.Sound, 0, len(def.Sounds))
+		for _, s := range def.Sounds {
+			if _, isBroken := broken[def.SoundPath(s)]; !isBroken {
+				sounds = append(sounds, s)
+			}
+		}
+
+		if len(sounds) == 0 {
+			dropped[def] = true
+			continue
+		}
+		def.Sounds = sounds
+		kept = append(kept, def)
+	}
+
+	for _, def := range kept {
+		if dropped[def.ChainWith] {
+			def.ChainWith = nil
+		}
+	}
+	return kept
+}
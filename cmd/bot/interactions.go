@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// Handles a click on a message component. args are the remaining colon
+// separated parts of the component's custom id.
+type componentHandler func(s *discordgo.Session, i *discordgo.InteractionCreate, args []string)
+
+// Map of custom id prefixes to the handler for those components
+var componentHandlers map[string]componentHandler = map[string]componentHandler{
+	"soundboard": handleSoundboardClick,
+	"report":     handleReportClick,
+	"upload":     handleUploadReviewClick,
+	"alias":      handleAliasClick,
+	"owner":      handleOwnerClick,
+	"help":       handleHelpClick,
+	"onboarding": handleOnboardingClick,
+}
+
+// Builds a component custom id from a handler name and its arguments
+func componentID(handler string, args ...string) string {
+	return strings.Join(append([]string{handler}, args...), ":")
+}
+
+func onInteractionCreate(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionMessageComponent {
+		return
+	}
+
+	parts := strings.Split(i.MessageComponentData().CustomID, ":")
+	handler, exists := componentHandlers[parts[0]]
+	if !exists {
+		log.WithFields(log.Fields{
+			"custom_id": i.MessageComponentData().CustomID,
+		}).Warning("Received interaction for unknown component")
+		return
+	}
+
+	handler(s, i, parts[1:])
+}
+
+// Returns the user that triggered an interaction
+func interactionUser(i *discordgo.InteractionCreate) *discordgo.User {
+	if i.Member != nil {
+		return i.Member.User
+	}
+	return i.User
+}
+
+// Responds to an interaction with a message only the clicking user can see
+func respondEphemeral(s *discordgo.Session, i *discordgo.InteractionCreate, content string) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to respond to interaction")
+	}
+}
+
+// Acknowledges an interaction without sending anything back
+func respondAcknowledge(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredMessageUpdate,
+	})
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to acknowledge interaction")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How long a guild stays with the instance that last served it. Another
+	// instance takes over once the lease runs out without being renewed.
+	GUILD_LEASE_TTL = time.Second * 30
+
+	// How long a lease check is trusted before asking redis again
+	GUILD_LEASE_CACHE = GUILD_LEASE_TTL / 3
+)
+
+// Takes or renews the lease on a guild, only if nobody else holds it
+const claimLeaseScript = `
+local owner = redis.call("GET", KEYS[1])
+if owner == false or owner == ARGV[1] then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+end
+return 0`
+
+// Drops the lease on a guild, only if this instance holds it
+const releaseLeaseScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`
+
+// The last lease check for a guild
+type guildLease struct {
+	Owned   bool
+	Checked time.Time
+}
+
+var (
+	// Recent lease checks, keyed by guild id
+	guildLeases     map[string]*guildLease = make(map[string]*guildLease)
+	guildLeasesLock sync.Mutex
+)
+
+func guildLeaseKey(gid string) string {
+	return fmt.Sprintf("airhorn:guild:%s:lease", gid)
+}
+
+// Returns true if this instance should serve the guild. When two processes
+// receive the same events (eg. while a deploy overlaps) only the one holding
+// the guild's lease in redis answers commands and plays sounds, so nothing is
+// played twice. Without redis every guild is served.
+func claimGuild(gid string) bool {
+	if rcli == nil {
+		return true
+	}
+
+	guildLeasesLock.Lock()
+	lease := guildLeases[gid]
+	guildLeasesLock.Unlock()
+	if lease != nil && time.Since(lease.Checked) < GUILD_LEASE_CACHE {
+		return lease.Owned
+	}
+
+	ttl := strconv.FormatInt(int64(GUILD_LEASE_TTL/time.Millisecond), 10)
+	result, err := rcli.Eval(claimLeaseScript, []string{guildLeaseKey(gid)}, []string{instanceName, ttl}).Result()
+	if err != nil {
+		// Double plays beat not playing at all while redis is down
+		log.WithFields(log.Fields{
+			"guild": gid,
+			"error": err,
+		}).Warning("Failed to claim guild lease")
+		return true
+	}
+
+	owned := result == int64(1)
+	if lease != nil && lease.Owned != owned {
+		log.WithFields(log.Fields{
+			"guild": gid,
+			"owned": owned,
+		}).Info("Guild lease changed hands")
+	}
+
+	guildLeasesLock.Lock()
+	guildLeases[gid] = &guildLease{Owned: owned, Checked: time.Now()}
+	guildLeasesLock.Unlock()
+	return owned
+}
+
+// Keeps the leases of guilds this instance is in voice in from running out,
+// so a long queue isn't picked up by another instance half way through
+func renewGuildLeases() {
+	if rcli == nil {
+		return
+	}
+
+	for {
+		time.Sleep(GUILD_LEASE_CACHE)
+
+		discord.RLock()
+		gids := make([]string, 0, len(discord.VoiceConnections))
+		for gid := range discord.VoiceConnections {
+			gids = append(gids, gid)
+		}
+		discord.RUnlock()
+
+		for _, gid := range gids {
+			guildLeasesLock.Lock()
+			delete(guildLeases, gid)
+			guildLeasesLock.Unlock()
+			claimGuild(gid)
+		}
+	}
+}
+
+// Gives up every lease this instance holds, so the instance replacing it can
+// take the guilds over straight away instead of waiting for them to expire
+func releaseGuildLeases() {
+	if rcli == nil {
+		return
+	}
+
+	guildLeasesLock.Lock()
+	defer guildLeasesLock.Unlock()
+
+	for gid, lease := range guildLeases {
+		if !lease.Owned {
+			continue
+		}
+
+		if err := rcli.Eval(releaseLeaseScript, []string{guildLeaseKey(gid)}, []string{instanceName}).Err(); err != nil {
+			log.WithFields(log.Fields{
+				"guild": gid,
+				"error": err,
+			}).Warning("Failed to release guild lease")
+		}
+	}
+	guildLeases = make(map[string]*guildLease)
+}
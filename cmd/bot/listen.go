@@ -0,0 +1,305 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Listening stops once nothing was triggered for this long
+	LISTEN_TIMEOUT = time.Minute * 15
+
+	// Shortest time between two triggered airhorns in a guild
+	LISTEN_COOLDOWN = time.Second * 30
+
+	// Frames of a speaker that are averaged before peaks are looked for, 50
+	// frames is a second of audio
+	LISTEN_WARMUP_FRAMES = 50
+
+	// A frame is a peak if it is this many times bigger than the speaker's
+	// average and at least LISTEN_MIN_PEAK bytes
+	LISTEN_PEAK_RATIO = 2.5
+	LISTEN_MIN_PEAK   = 120
+
+	// Peak frames in a row that count as a clap or yell
+	LISTEN_PEAK_FRAMES = 3
+
+	// How quickly a speaker's average follows their frames
+	LISTEN_AVERAGE_WEIGHT = 0.05
+)
+
+// Tracks the loudness of a single speaker. Voice isn't decoded, so the size
+// of each opus frame stands in for its energy: the encoder spends more bytes
+// on loud, noisy audio like claps and yells than on speech or silence.
+type peakDetector struct {
+	frames  int
+	average float64
+	streak  int
+}
+
+// Feeds a frame to the detector, returning true when it completes a peak
+func (d *peakDetector) feed(size int) bool {
+	// Discord's silence frames are 3 bytes, they'd drag the average down
+	if size <= 3 {
+		d.streak = 0
+		return false
+	}
+
+	peak := d.frames >= LISTEN_WARMUP_FRAMES && size >= LISTEN_MIN_PEAK && float64(size) >= d.average*LISTEN_PEAK_RATIO
+	if peak {
+		d.streak++
+	} else {
+		d.streak = 0
+	}
+
+	// Peaks aren't averaged in, so a long yell doesn't raise its own bar
+	if !peak {
+		d.frames++
+		if d.frames == 1 {
+			d.average = float64(size)
+		} else {
+			d.average += (float64(size) - d.average) * LISTEN_AVERAGE_WEIGHT
+		}
+	}
+
+	if d.streak >= LISTEN_PEAK_FRAMES {
+		d.streak = 0
+		return true
+	}
+	return false
+}
+
+// The bot listening in a guild's voice channel for loud noises
+type listener struct {
+	GuildID   string
+	ChannelID string
+
+	// Text channel !listen was run in
+	TextChannelID string
+
+	stop chan struct{}
+
+	sync.Mutex
+	users       map[uint32]string
+	detectors   map[uint32]*peakDetector
+	lastTrigger time.Time
+
+	// When the listener started or last triggered, it stops after
+	// LISTEN_TIMEOUT without a trigger
+	lastActive time.Time
+}
+
+var (
+	// The listener in each guild, keyed by guild id
+	voiceListeners     map[string]*listener = make(map[string]*listener)
+	voiceListenersLock sync.Mutex
+)
+
+// Returns true if the bot is listening in the voice channel, so it should
+// stay connected once it is done playing
+func listening(gid, cid string) bool {
+	voiceListenersLock.Lock()
+	defer voiceListenersLock.Unlock()
+
+	l := voiceListeners[gid]
+	return l != nil && l.ChannelID == cid
+}
+
+// Leaves voice once the guild's queue is done (after -voiceidle, if set),
+// unless the bot is listening in the channel
+func leaveVoice(vc *discordgo.VoiceConnection) {
+	if listening(vc.GuildID, vc.ChannelID) {
+		return
+	}
+	keepVoice(vc)
+}
+
+// Handles `!listen` and `!listen stop`
+func handleListenCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, parts []string) {
+	if len(parts) > 1 && parts[1] == "stop" {
+		if stopListening(guild.ID) {
+			discord.ChannelMessageSend(m.ChannelID, ":ok_hand:")
+		} else {
+			discord.ChannelMessageSend(m.ChannelID, "I'm not listening")
+		}
+		return
+	}
+
+	if !getGuildSettings(guild.ID).VoiceTrigger {
+		discord.ChannelMessageSend(m.ChannelID, "Listening is experimental, an admin can enable it with `!settings set voicetrigger on`")
+		return
+	}
+
+	channel := getCurrentVoiceChannel(m.Author, guild)
+	if channel == nil {
+		discord.ChannelMessageSend(m.ChannelID, "Join a voice channel first")
+		return
+	}
+
+	// A connection left open after the last play is taken over, or left if it's
+	// in another channel
+	if idle := takeIdleVoice(guild.ID); idle != nil && idle.ChannelID != channel.ID {
+		idle.Disconnect()
+	}
+
+	discord.RLock()
+	current := discord.VoiceConnections[guild.ID]
+	discord.RUnlock()
+	if current != nil && current.ChannelID != channel.ID {
+		discord.ChannelMessageSend(m.ChannelID, "I'm busy in another voice channel, try again in a bit")
+		return
+	}
+
+	l := &listener{
+		GuildID:       guild.ID,
+		ChannelID:     channel.ID,
+		TextChannelID: m.ChannelID,
+		stop:          make(chan struct{}),
+		users:         make(map[uint32]string),
+		detectors:     make(map[uint32]*peakDetector),
+		lastActive:    time.Now(),
+	}
+
+	voiceListenersLock.Lock()
+	if voiceListeners[guild.ID] != nil {
+		voiceListenersLock.Unlock()
+		discord.ChannelMessageSend(m.ChannelID, "I'm already listening, stop me with `!listen stop`")
+		return
+	}
+	voiceListeners[guild.ID] = l
+	voiceListenersLock.Unlock()
+
+	vc, err := discord.ChannelVoiceJoin(guild.ID, channel.ID, false, false)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild":   guild.ID,
+			"channel": channel.ID,
+			"error":   err,
+		}).Error("Failed to join voice to listen")
+		stopListening(guild.ID)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"guild":   guild.ID,
+		"channel": channel.ID,
+		"user":    m.Author.ID,
+	}).Info("Listening for claps")
+
+	discord.ChannelMessageSend(m.ChannelID, ":ear: clap or yell and I'll horn back, stop me with `!listen stop`")
+	go l.run(vc)
+}
+
+// Stops listening in a guild, returning false if the bot wasn't. If nothing
+// is playing the bot leaves the voice channel.
+func stopListening(gid string) bool {
+	voiceListenersLock.Lock()
+	l := voiceListeners[gid]
+	delete(voiceListeners, gid)
+	voiceListenersLock.Unlock()
+
+	if l == nil {
+		return false
+	}
+	close(l.stop)
+
+	discord.RLock()
+	vc := discord.VoiceConnections[gid]
+	discord.RUnlock()
+	if vc != nil && vc.ChannelID == l.ChannelID && queues.Len(gid) == 0 {
+		vc.Disconnect()
+	}
+	return true
+}
+
+// Reads voice from the connection until listening is stopped, the bot is
+// moved away, everyone leaves or nothing triggers for LISTEN_TIMEOUT
+func (l *listener) run(vc *discordgo.VoiceConnection) {
+	vc.AddHandler(func(vc *discordgo.VoiceConnection, vs *discordgo.VoiceSpeakingUpdate) {
+		l.Lock()
+		l.users[uint32(vs.SSRC)] = vs.UserID
+		l.Unlock()
+	})
+
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			if l.done(vc) {
+				log.WithFields(log.Fields{
+					"guild":   l.GuildID,
+					"channel": l.ChannelID,
+				}).Info("Stopped listening for claps")
+				stopListening(l.GuildID)
+				return
+			}
+		case p := <-vc.OpusRecv:
+			if p != nil {
+				l.handlePacket(p)
+			}
+		}
+	}
+}
+
+// Returns true once there is no reason to keep listening
+func (l *listener) done(vc *discordgo.VoiceConnection) bool {
+	discord.RLock()
+	current := discord.VoiceConnections[l.GuildID]
+	discord.RUnlock()
+	if current != vc || vc.ChannelID != l.ChannelID {
+		return true
+	}
+
+	guild, _ := discord.State.Guild(l.GuildID)
+	if guild == nil || listeners(guild, l.ChannelID) == 0 || !getGuildSettings(l.GuildID).VoiceTrigger {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	return time.Since(l.lastActive) > LISTEN_TIMEOUT
+}
+
+func (l *listener) handlePacket(p *discordgo.Packet) {
+	l.Lock()
+	d, exists := l.detectors[p.SSRC]
+	if !exists {
+		d = &peakDetector{}
+		l.detectors[p.SSRC] = d
+	}
+
+	uid := l.users[p.SSRC]
+	if !d.feed(len(p.Opus)) || uid == "" || time.Since(l.lastTrigger) < LISTEN_COOLDOWN {
+		l.Unlock()
+		return
+	}
+	l.lastTrigger = time.Now()
+	l.lastActive = l.lastTrigger
+	l.Unlock()
+
+	guild, _ := discord.State.Guild(l.GuildID)
+	if guild == nil {
+		return
+	}
+
+	member := getMember(guild, uid)
+	if member == nil || member.User == nil || member.User.Bot {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"guild":   l.GuildID,
+		"channel": l.ChannelID,
+		"user":    uid,
+	}).Debug("Heard a clap")
+
+	go enqueuePlay(member.User, guild, l.TextChannelID, findCollection(AIRHORN.Prefix), nil, queue.SOURCE_VOICE)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Language used for guilds without one and for messages a translation is missing
+	DEFAULT_LANGUAGE = "en"
+)
+
+var (
+	// Message catalogs, one JSON file of templates per language
+	//go:embed locales/*.json
+	localeFiles embed.FS
+
+	// Parsed message templates keyed by language then message key
+	locales map[string]map[string]*template.Template
+)
+
+// Parses every embedded message catalog
+func loadLocales() error {
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		return err
+	}
+
+	locales = make(map[string]map[string]*template.Template, len(files))
+	for _, file := range files {
+		data, err := localeFiles.ReadFile(path.Join("locales", file.Name()))
+		if err != nil {
+			return err
+		}
+
+		messages := make(map[string]string)
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return err
+		}
+
+		lang := strings.TrimSuffix(file.Name(), ".json")
+		locales[lang] = make(map[string]*template.Template, len(messages))
+		for key, message := range messages {
+			tmpl, err := template.New(key).Parse(message)
+			if err != nil {
+				return err
+			}
+			locales[lang][key] = tmpl
+		}
+	}
+	return nil
+}
+
+// Returns the codes of every language with a catalog
+func availableLanguages() []string {
+	langs := make([]string, 0, len(locales))
+	for lang := range locales {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// Renders a message in the given language, falling back to DEFAULT_LANGUAGE
+// when the language doesn't translate it
+func translate(lang, key string, data interface{}) string {
+	tmpl := locales[lang][key]
+	if tmpl == nil {
+		tmpl = locales[DEFAULT_LANGUAGE][key]
+	}
+	if tmpl == nil {
+		log.WithFields(log.Fields{
+			"key": key,
+		}).Warning("Missing message in the default language")
+		return key
+	}
+
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, data); err != nil {
+		log.WithFields(log.Fields{
+			"language": lang,
+			"key":      key,
+			"error":    err,
+		}).Warning("Failed to render message")
+		return key
+	}
+	return buf.String()
+}
+
+// Renders a message in a guild's language
+func localize(gid, key string, data interface{}) string {
+	return translate(getGuildSettings(gid).Language, key, data)
+}
+
+// Handles `!language [code]`, showing or changing the language responses are sent in
+func handleLanguageCommand(cid string, gid string, parts []string) {
+	available := strings.Join(availableLanguages(), ", ")
+	if len(parts) < 2 {
+		lang := getGuildSettings(gid).Language
+		discord.ChannelMessageSend(cid, localize(gid, "language.current", map[string]string{
+			"Name":      translate(lang, "language.name", nil),
+			"Available": available,
+		}))
+		return
+	}
+
+	lang := parts[1]
+	if locales[lang] == nil {
+		discord.ChannelMessageSend(cid, localize(gid, "language.unknown", map[string]string{
+			"Language":  lang,
+			"Available": available,
+		}))
+		return
+	}
+
+	_, err := updateGuildSettings(gid, func(gs *GuildSettings) {
+		gs.Language = lang
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": gid,
+			"error": err,
+		}).Error("Failed to save guild settings")
+		return
+	}
+
+	discord.ChannelMessageSend(cid, localize(gid, "language.set", map[string]string{
+		"Name": translate(lang, "language.name", nil),
+	}))
+}
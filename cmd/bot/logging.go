@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How long `!debug guild <id> on` lasts without a duration
+	GUILD_DEBUG_DURATION = time.Minute * 30
+)
+
+var (
+	// Level set with -loglevel, the logger only goes below it while a guild is debugged
+	baseLogLevel = log.InfoLevel
+
+	// Guilds whose events are logged at debug level, and until when
+	debugGuilds     map[string]time.Time = make(map[string]time.Time)
+	debugGuildsLock sync.Mutex
+)
+
+// Sets up the logger from the -loglevel, -logformat and -logfile flags
+func setupLogging(level, format, path string, maxSize int64, keep int) error {
+	parsed, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	baseLogLevel = parsed
+	log.SetLevel(parsed)
+
+	var formatter log.Formatter
+	switch format {
+	case "text":
+		formatter = &log.TextFormatter{}
+	case "json":
+		formatter = &log.JSONFormatter{}
+	default:
+		return fmt.Errorf("unknown log format %s, expected text or json", format)
+	}
+	log.SetFormatter(&guildDebugFormatter{formatter})
+
+	if path != "" {
+		out, err := openRotatingFile(path, maxSize, keep)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(io.MultiWriter(os.Stdout, out))
+	}
+	return nil
+}
+
+// Drops entries below the base level, unless they're about a guild that is
+// being debugged. The logger itself runs at debug level while any guild is.
+type guildDebugFormatter struct {
+	log.Formatter
+}
+
+func (f *guildDebugFormatter) Format(entry *log.Entry) ([]byte, error) {
+	if entry.Level > baseLogLevel {
+		gid, _ := entry.Data["guild"].(string)
+		if !guildDebugged(gid) {
+			return nil, nil
+		}
+	}
+	return f.Formatter.Format(entry)
+}
+
+func guildDebugged(gid string) bool {
+	if gid == "" {
+		return false
+	}
+
+	debugGuildsLock.Lock()
+	defer debugGuildsLock.Unlock()
+	return time.Now().Before(debugGuilds[gid])
+}
+
+// Debugs a guild for a while, or stops debugging it if d is 0
+func setGuildDebug(gid string, d time.Duration) {
+	debugGuildsLock.Lock()
+	if d > 0 {
+		debugGuilds[gid] = time.Now().Add(d)
+		time.AfterFunc(d, refreshLogLevel)
+	} else {
+		delete(debugGuilds, gid)
+	}
+	debugGuildsLock.Unlock()
+
+	refreshLogLevel()
+}
+
+// Drops expired guild debugging, lowering the logger back to the base level
+// once no guild is debugged
+func refreshLogLevel() {
+	debugGuildsLock.Lock()
+	defer debugGuildsLock.Unlock()
+
+	for gid, until := range debugGuilds {
+		if time.Now().After(until) {
+			delete(debugGuilds, gid)
+		}
+	}
+
+	if len(debugGuilds) > 0 {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(baseLogLevel)
+	}
+}
+
+// Handles the owner `!debug guild <id> on [duration]` and `!debug guild <id> off`
+// commands, and `!debug` listing the guilds being debugged
+func handleDebugCommand(m *discordgo.MessageCreate, parts []string) {
+	if len(parts) < 2 {
+		debugGuildsLock.Lock()
+		lines := make([]string, 0, len(debugGuilds))
+		for gid, until := range debugGuilds {
+			lines = append(lines, fmt.Sprintf("%s until %s", gid, until.Format(time.RFC3339)))
+		}
+		debugGuildsLock.Unlock()
+
+		discord.ChannelMessageSend(m.ChannelID, "Debugging: "+orNone(strings.Join(lines, ", ")))
+		return
+	}
+
+	if len(parts) < 4 || parts[1] != "guild" || (parts[3] != "on" && parts[3] != "off") {
+		discord.ChannelMessageSend(m.ChannelID, "Usage: `!debug guild <id> on [duration]` or `!debug guild <id> off`")
+		return
+	}
+
+	gid := parts[2]
+	if parts[3] == "off" {
+		setGuildDebug(gid, 0)
+		discord.ChannelMessageSend(m.ChannelID, ":ok_hand:")
+		return
+	}
+
+	d := GUILD_DEBUG_DURATION
+	if len(parts) > 4 {
+		var err error
+		d, err = time.ParseDuration(parts[4])
+		if err != nil || d <= 0 {
+			discord.ChannelMessageSend(m.ChannelID, "Invalid duration "+parts[4])
+			return
+		}
+	}
+
+	setGuildDebug(gid, d)
+	log.WithFields(log.Fields{
+		"guild": gid,
+		"for":   d,
+	}).Info("Debugging guild")
+	discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf(":ok_hand: logging everything about %s for %s", gid, d))
+}
+
+// A log file that is rotated once it grows past maxSize, keeping keep old
+// files named <path>.1 (the newest) to <path>.<keep>
+type rotatingFile struct {
+	sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, keep int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, keep: keep}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	rf.file = file
+	rf.size = info.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.Lock()
+	defer rf.Unlock()
+
+	if rf.maxSize > 0 && rf.size+int64(len(p)) > rf.maxSize && rf.size > 0 {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Shifts every old file up by one, dropping the oldest, and starts a new file
+func (rf *rotatingFile) rotate() error {
+	rf.file.Close()
+
+	if rf.keep > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.keep))
+		for i := rf.keep - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		}
+		os.Rename(rf.path, rf.path+".1")
+	} else {
+		os.Remove(rf.path)
+	}
+	return rf.open()
+}
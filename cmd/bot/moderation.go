@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	REPORT_PENDING  = "pending"
+	REPORT_DISABLED = "disabled"
+	REPORT_DELETED  = "deleted"
+	REPORT_IGNORED  = "ignored"
+)
+
+// Report is a user flag raised against a guild's custom sound
+type Report struct {
+	ID        string    `json:"id"`
+	GuildID   string    `json:"guild_id"`
+	ChannelID string    `json:"channel_id"`
+	Sound     string    `json:"sound"`
+	Reporter  string    `json:"reporter"`
+	Reason    string    `json:"reason,omitempty"`
+	Created   time.Time `json:"created"`
+	Status    string    `json:"status"`
+	Moderator string    `json:"moderator,omitempty"`
+}
+
+func getReport(id string) *Report {
+	raw, err := rcli.HGet("airhorn:reports", id).Result()
+	if err != nil {
+		return nil
+	}
+
+	report := &Report{}
+	if json.Unmarshal([]byte(raw), report) != nil {
+		return nil
+	}
+	return report
+}
+
+func putReport(report *Report) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	return rcli.HSet("airhorn:reports", report.ID, string(data)).Err()
+}
+
+// Returns the buttons moderators use to resolve a report
+func reportComponents(report *Report) []discordgo.MessageComponent {
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Disable",
+					Style:    discordgo.PrimaryButton,
+					CustomID: componentID("report", report.ID, REPORT_DISABLED),
+				},
+				discordgo.Button{
+					Label:    "Delete",
+					Style:    discordgo.DangerButton,
+					CustomID: componentID("report", report.ID, REPORT_DELETED),
+				},
+				discordgo.Button{
+					Label:    "Ignore",
+					Style:    discordgo.SecondaryButton,
+					CustomID: componentID("report", report.ID, REPORT_IGNORED),
+				},
+			},
+		},
+	}
+}
+
+func reportDescription(report *Report, guild *discordgo.Guild) string {
+	desc := fmt.Sprintf("<@%s> reported the custom sound **%s** in **%s**", report.Reporter, report.Sound, guild.Name)
+	if report.Reason != "" {
+		desc += fmt.Sprintf("\nReason: %s", report.Reason)
+	}
+	return desc
+}
+
+// Sends a moderation notice to a channel, used for reports and held uploads
+func sendModerationNotice(cid, title, description string, components []discordgo.MessageComponent) {
+	_, err := discord.ChannelMessageSendComplex(cid, &discordgo.MessageSend{
+		Embed: &discordgo.MessageEmbed{
+			Title:       title,
+			Color:       0xE5343A,
+			Description: description,
+		},
+		Components: components,
+	})
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"channel": cid,
+			"error":   err,
+		}).Warning("Failed to send moderation notice")
+	}
+}
+
+// Sends a moderation notice to the guild's moderators and the bot owner.
+// Guilds without a moderation channel get the notice in a DM to the guild owner.
+func notifyModerators(guild *discordgo.Guild, title, description string, components []discordgo.MessageComponent) {
+	targets := make([]string, 0)
+
+	if modChannel := getGuildSettings(guild.ID).ModChannel; modChannel != "" {
+		targets = append(targets, modChannel)
+	} else if dm, err := discord.UserChannelCreate(guild.OwnerID); err == nil {
+		targets = append(targets, dm.ID)
+	}
+
+	if OWNER != "" && OWNER != guild.OwnerID {
+		if dm, err := discord.UserChannelCreate(OWNER); err == nil {
+			targets = append(targets, dm.ID)
+		}
+	}
+
+	for _, cid := range targets {
+		sendModerationNotice(cid, title, description, components)
+	}
+}
+
+// Handles `!report sound <name> [reason]`
+func handleReportCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, parts []string) {
+	if rcli == nil {
+		return
+	}
+
+	if len(parts) < 3 || parts[1] != "sound" {
+		discord.ChannelMessageSend(m.ChannelID, "Usage: `!report sound <name> [reason]`")
+		return
+	}
+
+	cs := getCustomSound(guild.ID, parts[2])
+	if cs == nil {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("There is no custom sound called %s", parts[2]))
+		return
+	}
+
+	// Each user can only report a sound once
+	added, err := rcli.SAdd(fmt.Sprintf("airhorn:guild:%s:reported:%s", guild.ID, cs.Name), m.Author.ID).Result()
+	if err != nil || added == 0 {
+		discord.ChannelMessageSend(m.ChannelID, "You've already reported that sound")
+		return
+	}
+
+	report := &Report{
+		ID:        strings.ToLower(randomCode(10)),
+		GuildID:   guild.ID,
+		ChannelID: m.ChannelID,
+		Sound:     cs.Name,
+		Reporter:  m.Author.ID,
+		Reason:    strings.Join(parts[3:], " "),
+		Created:   time.Now(),
+		Status:    REPORT_PENDING,
+	}
+
+	if err := putReport(report); err != nil {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"error": err,
+		}).Error("Failed to store report")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"guild":  guild.ID,
+		"sound":  cs.Name,
+		"report": report.ID,
+	}).Info("Custom sound reported")
+
+	notifyModerators(guild, "Sound Report", reportDescription(report, guild), reportComponents(report))
+	discord.ChannelMessageSend(m.ChannelID, ":ok_hand: thanks, the moderators have been notified")
+}
+
+// Handles the quick action buttons on a report, args are the report id and action
+func handleReportClick(s *discordgo.Session, i *discordgo.InteractionCreate, args []string) {
+	if len(args) < 2 || rcli == nil {
+		return
+	}
+
+	report := getReport(args[0])
+	if report == nil {
+		respondEphemeral(s, i, "That report no longer exists")
+		return
+	}
+
+	guild, _ := discord.State.Guild(report.GuildID)
+	if guild == nil {
+		respondEphemeral(s, i, "I'm no longer in that server")
+		return
+	}
+
+	user := interactionUser(i)
+	if !isGuildAdmin(guild, user.ID, report.ChannelID) {
+		respondEphemeral(s, i, "Only server admins can resolve reports")
+		return
+	}
+
+	if report.Status != REPORT_PENDING {
+		respondEphemeral(s, i, fmt.Sprintf("That report was already resolved (%s)", report.Status))
+		return
+	}
+
+	switch args[1] {
+	case REPORT_DISABLED:
+		setCustomSoundDisabled(report.GuildID, report.Sound, true)
+	case REPORT_DELETED:
+		deleteCustomSound(report.GuildID, report.Sound)
+	case REPORT_IGNORED:
+	default:
+		return
+	}
+
+	report.Status = args[1]
+	report.Moderator = user.ID
+	putReport(report)
+
+	log.WithFields(log.Fields{
+		"guild":     report.GuildID,
+		"sound":     report.Sound,
+		"report":    report.ID,
+		"status":    report.Status,
+		"moderator": user.ID,
+	}).Info("Resolved sound report")
+
+	resolveModerationNotice(s, i, fmt.Sprintf("%s\n**%s** by <@%s>", reportDescription(report, guild), report.Status, user.ID))
+}
+
+// Replaces a moderation notice with its resolution and removes the buttons
+func resolveModerationNotice(s *discordgo.Session, i *discordgo.InteractionCreate, description string) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Embeds: []*discordgo.MessageEmbed{
+				{
+					Title:       "Resolved",
+					Color:       0x43B581,
+					Description: description,
+				},
+			},
+			Components: []discordgo.MessageComponent{},
+		},
+	})
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to update moderation notice")
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Guilds joined longer ago than this are ones the bot is reconnecting to,
+	// not new ones
+	ONBOARDING_JOIN_WINDOW = time.Minute * 5
+)
+
+// Prefixes the setup message offers, the first is the default
+var onboardingPrefixes = []string{"!", "?", ".", "$", "%"}
+
+func onboardedKey(gid string) string {
+	return fmt.Sprintf("airhorn:guild:%s:onboarded", gid)
+}
+
+// Returns true if a guild admin finished setting the bot up in the guild
+func onboarded(gid string) bool {
+	if rcli == nil {
+		return false
+	}
+	return rcli.Exists(onboardedKey(gid)).Val() > 0
+}
+
+// Returns true if the bot was just added to the guild. GuildCreate is sent for
+// every guild on each connect and the state is updated before handlers run,
+// so the time the bot joined is what tells a new guild apart.
+func newlyJoined(guild *discordgo.Guild) bool {
+	return !guild.Unavailable && !guild.JoinedAt.IsZero() && time.Since(guild.JoinedAt) < ONBOARDING_JOIN_WINDOW
+}
+
+// Returns the channel the setup message is posted in: the system channel if
+// the bot can post there, otherwise the highest text channel it can
+func onboardingChannel(guild *discordgo.Guild) string {
+	const needed = discordgo.PermissionViewChannel | discordgo.PermissionSendMessages | discordgo.PermissionEmbedLinks
+
+	canPost := func(cid string) bool {
+		perms, err := discord.State.UserChannelPermissions(discord.State.Ready.User.ID, cid)
+		return err == nil && perms&needed == needed
+	}
+
+	if guild.SystemChannelID != "" && canPost(guild.SystemChannelID) {
+		return guild.SystemChannelID
+	}
+
+	channels := make([]*discordgo.Channel, 0, len(guild.Channels))
+	for _, channel := range guild.Channels {
+		if channel.Type == discordgo.ChannelTypeGuildText {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Position < channels[j].Position
+	})
+
+	for _, channel := range channels {
+		if canPost(channel.ID) {
+			return channel.ID
+		}
+	}
+	return ""
+}
+
+// Welcomes the bot to a guild it was just added to, with a setup message
+// admins can pick a prefix and the channels commands work in from
+func startOnboarding(guild *discordgo.Guild) {
+	if onboarded(guild.ID) {
+		return
+	}
+
+	cid := onboardingChannel(guild)
+	if cid == "" {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+		}).Info("Joined a guild without a channel to post the setup message in")
+		return
+	}
+
+	prefixes := make([]discordgo.SelectMenuOption, len(onboardingPrefixes))
+	for i, prefix := range onboardingPrefixes {
+		prefixes[i] = discordgo.SelectMenuOption{
+			Label:   prefix,
+			Value:   prefix,
+			Default: i == 0,
+		}
+	}
+
+	noChannels := 0
+	_, err := discord.ChannelMessageSendComplex(cid, &discordgo.MessageSend{
+		Embeds: []*discordgo.MessageEmbed{{
+			Title:       localize(guild.ID, "onboarding.title", nil),
+			Color:       0xE5343A,
+			Description: localize(guild.ID, "onboarding.body", nil),
+		}},
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+				discordgo.SelectMenu{
+					MenuType:    discordgo.StringSelectMenu,
+					CustomID:    componentID("onboarding", "prefix"),
+					Placeholder: localize(guild.ID, "onboarding.prefix", nil),
+					Options:     prefixes,
+				},
+			}},
+			discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+				discordgo.SelectMenu{
+					MenuType:     discordgo.ChannelSelectMenu,
+					CustomID:     componentID("onboarding", "channels"),
+					Placeholder:  localize(guild.ID, "onboarding.channels", nil),
+					ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildText},
+					MinValues:    &noChannels,
+					MaxValues:    25,
+				},
+			}},
+			discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    localize(guild.ID, "onboarding.done", nil),
+					Style:    discordgo.SuccessButton,
+					CustomID: componentID("onboarding", "done"),
+				},
+			}},
+		},
+	})
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild":   guild.ID,
+			"channel": cid,
+			"error":   err,
+		}).Warning("Failed to post the setup message")
+	}
+}
+
+// Handles the setup message's menus and done button, args is which was used
+func handleOnboardingClick(s *discordgo.Session, i *discordgo.InteractionCreate, args []string) {
+	if len(args) < 1 || i.GuildID == "" {
+		return
+	}
+
+	guild, _ := discord.State.Guild(i.GuildID)
+	if guild == nil {
+		return
+	}
+
+	if !isGuildAdmin(guild, interactionUser(i).ID, i.ChannelID) {
+		respondEphemeral(s, i, "Only server admins can set the bot up")
+		return
+	}
+
+	values := i.MessageComponentData().Values
+	var update func(gs *GuildSettings)
+	switch args[0] {
+	case "prefix":
+		if len(values) == 0 || !scontains(values[0], onboardingPrefixes...) {
+			respondAcknowledge(s, i)
+			return
+		}
+		update = func(gs *GuildSettings) {
+			gs.Prefix = values[0]
+		}
+	case "channels":
+		update = func(gs *GuildSettings) {
+			gs.AllowedChannels = append([]string(nil), values...)
+		}
+	case "done":
+		finishOnboarding(s, i, guild)
+		return
+	default:
+		return
+	}
+
+	if _, err := updateGuildSettings(guild.ID, update); err != nil {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"error": err,
+		}).Error("Failed to save guild settings")
+		respondEphemeral(s, i, "Failed to save the setting, try again later")
+		return
+	}
+	respondAcknowledge(s, i)
+}
+
+// Records that the guild is set up and replaces the setup message's menus
+// with how to play a sound
+func finishOnboarding(s *discordgo.Session, i *discordgo.InteractionCreate, guild *discordgo.Guild) {
+	if rcli != nil {
+		if err := rcli.Set(onboardedKey(guild.ID), time.Now().Format(time.RFC3339), 0).Err(); err != nil {
+			log.WithFields(log.Fields{
+				"guild": guild.ID,
+				"error": err,
+			}).Warning("Failed to record onboarding")
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"guild": guild.ID,
+		"user":  interactionUser(i).ID,
+	}).Info("Guild finished onboarding")
+
+	gs := getGuildSettings(guild.ID)
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Embeds: []*discordgo.MessageEmbed{{
+				Title: localize(guild.ID, "onboarding.title", nil),
+				Color: 0xE5343A,
+				Description: localize(guild.ID, "onboarding.finished", map[string]string{
+					"Prefix": gs.Prefix,
+				}),
+			}},
+			Components: []discordgo.MessageComponent{},
+		},
+	})
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"error": err,
+		}).Warning("Failed to update the setup message")
+	}
+}
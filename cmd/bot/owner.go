@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dustin/go-humanize"
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	"github.com/noisemaster/airhornbot/pkg/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Guilds listed per page of `guilds`
+	OWNER_GUILDS_PAGE = 20
+
+	// How long a destructive owner command waits to be confirmed
+	OWNER_CONFIRM_TIMEOUT = time.Minute
+
+	// Owner actions kept in the audit list
+	OWNER_AUDIT_MAX = 100
+
+	OWNER_AUDIT_KEY = "airhorn:owner:audit"
+)
+
+// An owner command waiting for its confirm button to be clicked
+type ownerAction struct {
+	Name      string
+	Arg       string
+	ChannelID string
+	Expires   time.Time
+	run       func() string
+}
+
+// An entry in the owner audit list
+type ownerAuditEntry struct {
+	Action   string    `json:"action"`
+	Arg      string    `json:"arg,omitempty"`
+	Result   string    `json:"result"`
+	Instance string    `json:"instance"`
+	Time     time.Time `json:"time"`
+}
+
+var (
+	// Owner commands waiting for confirmation, keyed by a random id
+	pendingOwnerActions     map[string]*ownerAction = make(map[string]*ownerAction)
+	pendingOwnerActionsLock sync.Mutex
+
+	// Closed by the shutdown owner command to stop the bot
+	shutdownRequested = make(chan struct{})
+	shutdownOnce      sync.Once
+)
+
+// Returns the text following the control command word in the original
+// message, keeping its case
+func ownerCommandArgs(content, command string) string {
+	idx := strings.Index(strings.ToLower(content), command)
+	if idx < 0 {
+		return ""
+	}
+	return strings.TrimSpace(content[idx+len(command):])
+}
+
+// Lists the guilds on this shard, biggest first
+func displayOwnerGuilds(cid string, parts []string) {
+	page := 1
+	if len(parts) > 0 {
+		if n, err := strconv.Atoi(parts[0]); err == nil && n > 0 {
+			page = n
+		}
+	}
+
+	discord.State.RLock()
+	guilds := make([]*discordgo.Guild, len(discord.State.Guilds))
+	copy(guilds, discord.State.Guilds)
+	discord.State.RUnlock()
+
+	sort.Slice(guilds, func(i, j int) bool {
+		return guilds[i].MemberCount > guilds[j].MemberCount
+	})
+
+	pages := (len(guilds) + OWNER_GUILDS_PAGE - 1) / OWNER_GUILDS_PAGE
+	if pages == 0 {
+		discord.ChannelMessageSend(cid, "This shard isn't in any guilds")
+		return
+	}
+	if page > pages {
+		page = pages
+	}
+
+	start := (page - 1) * OWNER_GUILDS_PAGE
+	end := start + OWNER_GUILDS_PAGE
+	if end > len(guilds) {
+		end = len(guilds)
+	}
+
+	lines := make([]string, 0, end-start)
+	for _, guild := range guilds[start:end] {
+		lines = append(lines, fmt.Sprintf("**%s** `%s` - %s members", guild.Name, guild.ID, humanize.Comma(int64(guild.MemberCount))))
+	}
+
+	discord.ChannelMessageSendEmbed(cid, &discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("Guilds on shard %d", discord.ShardID),
+		Color:       0xE5343A,
+		Description: strings.Join(lines, "\n"),
+		Footer: &discordgo.MessageEmbedFooter{
+			Text: fmt.Sprintf("page %d of %d, %d guilds", page, pages, len(guilds)),
+		},
+	})
+}
+
+// Asks the owner to confirm leaving a guild
+func ownerLeaveGuild(cid string, parts []string) {
+	if len(parts) < 1 {
+		discord.ChannelMessageSend(cid, "Usage: `leave <guild id>`")
+		return
+	}
+
+	gid := parts[0]
+	guild, _ := discord.State.Guild(gid)
+	if guild == nil {
+		discord.ChannelMessageSend(cid, fmt.Sprintf("This shard isn't in %s", gid))
+		return
+	}
+
+	confirmOwnerAction(cid, fmt.Sprintf("Leave **%s** (%s members)?", guild.Name, humanize.Comma(int64(guild.MemberCount))), &ownerAction{
+		Name: "leave",
+		Arg:  gid,
+		run: func() string {
+			if err := discord.GuildLeave(gid); err != nil {
+				return "failed: " + err.Error()
+			}
+			return "left " + guild.Name
+		},
+	})
+}
+
+// Asks the owner to confirm sending a message to every guild on this shard.
+// It goes to the guild's moderation channel, or its system channel if it has
+// no moderation channel.
+func ownerBroadcast(cid, message string) {
+	if message == "" {
+		discord.ChannelMessageSend(cid, "Usage: `broadcast <message>`")
+		return
+	}
+
+	discord.State.RLock()
+	count := len(discord.State.Guilds)
+	discord.State.RUnlock()
+
+	confirmOwnerAction(cid, fmt.Sprintf("Send this to %d guilds?\n>>> %s", count, message), &ownerAction{
+		Name: "broadcast",
+		Arg:  message,
+		run: func() string {
+			sent, skipped := broadcast(message)
+			return fmt.Sprintf("sent to %d guilds, %d had nowhere to send it", sent, skipped)
+		},
+	})
+}
+
+func broadcast(message string) (sent, skipped int) {
+	discord.State.RLock()
+	targets := make(map[string]string, len(discord.State.Guilds))
+	for _, guild := range discord.State.Guilds {
+		targets[guild.ID] = guild.SystemChannelID
+	}
+	discord.State.RUnlock()
+
+	for gid, cid := range targets {
+		if modChannel := getGuildSettings(gid).ModChannel; modChannel != "" {
+			cid = modChannel
+		}
+
+		if cid == "" {
+			skipped++
+			continue
+		}
+
+		if _, err := discord.ChannelMessageSend(cid, message); err != nil {
+			log.WithFields(log.Fields{
+				"guild":   gid,
+				"channel": cid,
+				"error":   err,
+			}).Warning("Failed to send broadcast")
+			skipped++
+			continue
+		}
+		sent++
+	}
+	return sent, skipped
+}
+
+// Sets a fixed presence in place of the rotation, or goes back to it with reset
+func ownerSetStatus(cid, text string) {
+	if text == "" {
+		discord.ChannelMessageSend(cid, "Usage: `setstatus <text>` or `setstatus reset`")
+		return
+	}
+
+	if text == "reset" {
+		text = ""
+	}
+	setPresenceOverride(text)
+	updatePresence(discord)
+	auditOwnerAction("setstatus", text, "ok")
+	discord.ChannelMessageSend(cid, ":ok_hand:")
+}
+
+// Asks the owner to confirm stopping this shard's process
+func ownerShutdown(cid string) {
+	confirmOwnerAction(cid, fmt.Sprintf("Shut down shard %d on %s?", discord.ShardID, instanceName), &ownerAction{
+		Name: "shutdown",
+		run: func() string {
+			shutdownOnce.Do(func() {
+				close(shutdownRequested)
+			})
+			return "shutting down"
+		},
+	})
+}
+
+// Posts a confirm and cancel button for a destructive owner command, which is
+// run once confirm is clicked within OWNER_CONFIRM_TIMEOUT
+func confirmOwnerAction(cid, question string, action *ownerAction) {
+	id := queue.NewID()
+	action.ChannelID = cid
+	action.Expires = time.Now().Add(OWNER_CONFIRM_TIMEOUT)
+
+	pendingOwnerActionsLock.Lock()
+	for key, pending := range pendingOwnerActions {
+		if time.Now().After(pending.Expires) {
+			delete(pendingOwnerActions, key)
+		}
+	}
+	pendingOwnerActions[id] = action
+	pendingOwnerActionsLock.Unlock()
+
+	_, err := discord.ChannelMessageSendComplex(cid, &discordgo.MessageSend{
+		Content: question,
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Confirm",
+					Style:    discordgo.DangerButton,
+					CustomID: componentID("owner", id, "confirm"),
+				},
+				discordgo.Button{
+					Label:    "Cancel",
+					Style:    discordgo.SecondaryButton,
+					CustomID: componentID("owner", id, "cancel"),
+				},
+			}},
+		},
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"action": action.Name,
+			"error":  err,
+		}).Warning("Failed to ask for owner confirmation")
+	}
+}
+
+// Handles the owner confirm and cancel buttons, args are the action id and
+// the button clicked
+func handleOwnerClick(s *discordgo.Session, i *discordgo.InteractionCreate, args []string) {
+	if len(args) < 2 {
+		return
+	}
+
+	if interactionUser(i).ID != OWNER {
+		respondEphemeral(s, i, "Only the bot owner can do that")
+		return
+	}
+
+	pendingOwnerActionsLock.Lock()
+	action := pendingOwnerActions[args[0]]
+	delete(pendingOwnerActions, args[0])
+	pendingOwnerActionsLock.Unlock()
+
+	if action == nil || time.Now().After(action.Expires) {
+		resolveOwnerConfirmation(s, i, "This confirmation expired, run the command again")
+		return
+	}
+
+	if args[1] != "confirm" {
+		resolveOwnerConfirmation(s, i, fmt.Sprintf("Cancelled %s", action.Name))
+		return
+	}
+
+	// Broadcasts take a while, so the click is answered first
+	resolveOwnerConfirmation(s, i, fmt.Sprintf("Running %s...", action.Name))
+	go func() {
+		result := action.run()
+		auditOwnerAction(action.Name, action.Arg, result)
+		s.ChannelMessageSend(action.ChannelID, fmt.Sprintf("%s: %s", action.Name, result))
+	}()
+}
+
+// Replaces the confirmation's buttons with what became of it
+func resolveOwnerConfirmation(s *discordgo.Session, i *discordgo.InteractionCreate, content string) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    content,
+			Components: []discordgo.MessageComponent{},
+		},
+	})
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to update owner confirmation")
+	}
+}
+
+// Logs an owner action and keeps it in the redis audit list
+func auditOwnerAction(name, arg, result string) {
+	log.WithFields(log.Fields{
+		"action": name,
+		"arg":    arg,
+		"result": result,
+	}).Info("Owner action")
+
+	if rcli == nil {
+		return
+	}
+
+	data, err := json.Marshal(&ownerAuditEntry{
+		Action:   name,
+		Arg:      arg,
+		Result:   result,
+		Instance: instanceName,
+		Time:     time.Now(),
+	})
+	if err == nil {
+		_, err = rcli.Pipelined(func(pipe *redis.Pipeline) error {
+			pipe.LPush(OWNER_AUDIT_KEY, string(data))
+			pipe.LTrim(OWNER_AUDIT_KEY, 0, OWNER_AUDIT_MAX-1)
+			return nil
+		})
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"action": name,
+			"error":  err,
+		}).Warning("Failed to record owner action")
+	}
+}
+
+// Shows the latest owner actions
+func displayOwnerAudit(cid string) {
+	if rcli == nil {
+		discord.ChannelMessageSend(cid, "The owner audit log requires a redis connection")
+		return
+	}
+
+	entries, err := rcli.LRange(OWNER_AUDIT_KEY, 0, 14).Result()
+	if err != nil || len(entries) == 0 {
+		discord.ChannelMessageSend(cid, "No owner actions were recorded")
+		return
+	}
+
+	lines := make([]string, 0, len(entries))
+	for _, raw := range entries {
+		entry := &ownerAuditEntry{}
+		if json.Unmarshal([]byte(raw), entry) != nil {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s **%s** %s - %s (%s)", humanize.Time(entry.Time), entry.Action, entry.Arg, entry.Result, entry.Instance))
+	}
+	discord.ChannelMessageSend(cid, strings.Join(lines, "\n"))
+}
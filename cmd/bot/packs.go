@@ -0,0 +1,469 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/dca"
+	"github.com/noisemaster/airhornbot/pkg/sound"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// File the installed soundpacks are kept in, so they're loaded again on startup
+	PACKS_FILE = "packs.json"
+
+	// Most sounds a single pack can install
+	PACK_MAX_SOUNDS = 50
+
+	// Largest sound file downloaded for a pack
+	PACK_MAX_SOUND_SIZE = 5 << 20
+)
+
+// Pack names, prefixes and sound names end up in file names and commands
+var packNameRegex = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// Soundpack is a community collection listed in the remote pack index
+type Soundpack struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Author      string `json:"author"`
+	Version     string `json:"version"`
+
+	// Prefix and commands of the collection the pack is installed as
+	Prefix   string   `json:"prefix"`
+	Commands []string `json:"commands"`
+
+	Sounds []*SoundpackSound `json:"sounds"`
+}
+
+// A sound in a soundpack, the DCA file at URL has to match SHA256
+type SoundpackSound struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight,omitempty"`
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+var (
+	// HTTPS url of the JSON list of packs !packs browses, empty disables packs
+	PACK_INDEX_URL string
+
+	packClient = &http.Client{Timeout: time.Minute}
+
+	// Packs installed on this instance, as listed in PACKS_FILE
+	installedPacks     []*Soundpack
+	installedPacksLock sync.Mutex
+
+	// Prefixes of the collections packs were loaded as
+	packPrefixes     map[string]bool = make(map[string]bool)
+	packPrefixesLock sync.Mutex
+)
+
+// Fetches the list of packs from the index
+func fetchPackIndex() ([]*Soundpack, error) {
+	resp, err := packClient.Get(PACK_INDEX_URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("pack index returned %s", resp.Status)
+	}
+
+	packs := make([]*Soundpack, 0)
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&packs); err != nil {
+		return nil, err
+	}
+	return packs, nil
+}
+
+// Builds the collection a pack is installed as
+func (pack *Soundpack) collection() *sound.Collection {
+	coll := &sound.Collection{
+		Prefix:   pack.Prefix,
+		Commands: append([]string(nil), pack.Commands...),
+		Sounds:   make([]*sound.Sound, len(pack.Sounds)),
+	}
+	for i, s := range pack.Sounds {
+		weight := s.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		coll.Sounds[i] = sound.New(s.Name, weight, 250)
+	}
+	return coll
+}
+
+// Checks that a pack is well formed and doesn't take over a collection or
+// command that isn't its own
+func (pack *Soundpack) validate(colls []*sound.Collection) error {
+	if !packNameRegex.MatchString(pack.Name) || !packNameRegex.MatchString(pack.Prefix) {
+		return fmt.Errorf("pack names and prefixes can only use letters, numbers, - and _")
+	}
+
+	if len(pack.Commands) == 0 {
+		return fmt.Errorf("the pack has no commands")
+	}
+	for _, command := range pack.Commands {
+		if !strings.HasPrefix(command, "!") || !packNameRegex.MatchString(command[1:]) {
+			return fmt.Errorf("%s isn't a valid command", command)
+		}
+		if _, exists := commands[command]; exists {
+			return fmt.Errorf("%s is already a bot command", command)
+		}
+	}
+
+	if len(pack.Sounds) == 0 || len(pack.Sounds) > PACK_MAX_SOUNDS {
+		return fmt.Errorf("packs need between 1 and %d sounds", PACK_MAX_SOUNDS)
+	}
+	for _, s := range pack.Sounds {
+		if !packNameRegex.MatchString(s.Name) {
+			return fmt.Errorf("%s isn't a valid sound name", s.Name)
+		}
+		if sum, err := hex.DecodeString(s.SHA256); err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("%s has no valid checksum", s.Name)
+		}
+	}
+
+	// Installing a new version of a pack replaces its own collection
+	installed := installedPack(pack.Name)
+	packPrefixesLock.Lock()
+	own := installed != nil && installed.Prefix == pack.Prefix && packPrefixes[pack.Prefix]
+	packPrefixesLock.Unlock()
+
+	for _, coll := range colls {
+		if coll.Prefix == pack.Prefix {
+			if !own {
+				return fmt.Errorf("there already is a collection %s", pack.Prefix)
+			}
+			continue
+		}
+
+		for _, command := range pack.Commands {
+			if scontains(command, coll.Commands...) {
+				return fmt.Errorf("%s is already used by %s", command, coll.Prefix)
+			}
+		}
+	}
+	return nil
+}
+
+func installedPack(name string) *Soundpack {
+	installedPacksLock.Lock()
+	defer installedPacksLock.Unlock()
+
+	for _, pack := range installedPacks {
+		if pack.Name == name {
+			return pack
+		}
+	}
+	return nil
+}
+
+// Reads the packs installed before and adds their collections to COLLECTIONS,
+// called on startup before the sounds are checked and loaded
+func loadInstalledPacks() error {
+	data, err := ioutil.ReadFile(PACKS_FILE)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	packs := make([]*Soundpack, 0)
+	if err := json.Unmarshal(data, &packs); err != nil {
+		return err
+	}
+
+	installedPacksLock.Lock()
+	installedPacks = packs
+	installedPacksLock.Unlock()
+
+	for _, pack := range packs {
+		if err := pack.validate(COLLECTIONS); err != nil {
+			log.WithFields(log.Fields{
+				"pack":  pack.Name,
+				"error": err,
+			}).Warning("Skipping installed soundpack")
+			continue
+		}
+		COLLECTIONS = append(COLLECTIONS, pack.collection())
+
+		packPrefixesLock.Lock()
+		packPrefixes[pack.Prefix] = true
+		packPrefixesLock.Unlock()
+	}
+
+	log.WithFields(log.Fields{
+		"packs": len(packs),
+	}).Info("Loaded installed soundpacks")
+	return nil
+}
+
+// Saves the installed packs to PACKS_FILE, replacing it in one go
+func saveInstalledPacks(packs []*Soundpack) error {
+	data, err := json.MarshalIndent(packs, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp := PACKS_FILE + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, PACKS_FILE)
+}
+
+// Downloads a pack sound to a temporary file in the audio directory, checking
+// it against its checksum and that it's a playable DCA file
+func downloadPackSound(s *SoundpackSound) (string, error) {
+	resp, err := packClient.Get(s.URL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", s.Name, resp.Status)
+	}
+
+	tmp, err := ioutil.TempFile("audio", ".pack")
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(resp.Body, PACK_MAX_SOUND_SIZE+1))
+	tmp.Close()
+	if err == nil && n > PACK_MAX_SOUND_SIZE {
+		err = fmt.Errorf("%s is larger than %d bytes", s.Name, PACK_MAX_SOUND_SIZE)
+	}
+	if err == nil && !strings.EqualFold(hex.EncodeToString(hash.Sum(nil)), s.SHA256) {
+		err = fmt.Errorf("%s doesn't match its checksum", s.Name)
+	}
+	if err == nil {
+		_, err = dca.Verify(tmp.Name())
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// Downloads every sound in the pack and swaps it into the collections through
+// the same reload SIGHUP triggers. The sound files are only moved into place
+// once all of them downloaded and verified, the files they replace are kept
+// until the reload succeeded and put back if it didn't. The pack is only
+// recorded as installed if the reload succeeded.
+func installPack(pack *Soundpack) error {
+	if err := pack.validate(getCollections()); err != nil {
+		return err
+	}
+
+	coll := pack.collection()
+	downloads := make(map[string]string, len(pack.Sounds))
+	defer func() {
+		for _, tmp := range downloads {
+			os.Remove(tmp)
+		}
+	}()
+
+	for i, s := range pack.Sounds {
+		tmp, err := downloadPackSound(s)
+		if err != nil {
+			return err
+		}
+		downloads[filepath.FromSlash(coll.SoundPath(coll.Sounds[i]))] = tmp
+	}
+
+	// Nothing else may reload or change the collections until the pack is
+	// swapped in or rolled back
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	installed := make([]string, 0, len(downloads))
+	backups := make(map[string]string)
+	restore := func() {
+		for _, path := range installed {
+			os.Remove(path)
+		}
+		for path, backup := range backups {
+			os.Rename(backup, path)
+		}
+	}
+
+	for path, tmp := range downloads {
+		backup := path + ".old"
+		if err := os.Rename(path, backup); err == nil {
+			backups[path] = backup
+		} else if !os.IsNotExist(err) {
+			restore()
+			return err
+		}
+
+		if err := os.Rename(tmp, path); err != nil {
+			restore()
+			return err
+		}
+		installed = append(installed, path)
+		delete(downloads, path)
+	}
+
+	previous := COLLECTIONS
+	replaced := make([]*sound.Collection, 0, len(COLLECTIONS)+1)
+	for _, existing := range COLLECTIONS {
+		if existing.Prefix != pack.Prefix {
+			replaced = append(replaced, existing)
+		}
+	}
+	COLLECTIONS = append(replaced, coll)
+
+	if err := reloadSoundsLocked(); err != nil {
+		COLLECTIONS = previous
+		restore()
+		return err
+	}
+
+	for _, backup := range backups {
+		os.Remove(backup)
+	}
+
+	packPrefixesLock.Lock()
+	packPrefixes[pack.Prefix] = true
+	packPrefixesLock.Unlock()
+
+	installedPacksLock.Lock()
+	defer installedPacksLock.Unlock()
+
+	packs := make([]*Soundpack, 0, len(installedPacks)+1)
+	for _, installed := range installedPacks {
+		if installed.Name != pack.Name {
+			packs = append(packs, installed)
+		}
+	}
+	packs = append(packs, pack)
+	if err := saveInstalledPacks(packs); err != nil {
+		return err
+	}
+	installedPacks = packs
+	return nil
+}
+
+// Handles `!packs [browse]`, listing the packs in the index, and
+// `!packs install <name>`. Packs add a collection for every server, so only
+// the owner can install them.
+func handlePacksCommand(m *discordgo.MessageCreate, parts []string) {
+	if PACK_INDEX_URL == "" {
+		discord.ChannelMessageSend(m.ChannelID, "Soundpacks aren't set up on this bot")
+		return
+	}
+
+	if len(parts) < 2 || parts[1] == "browse" {
+		displayPacks(m.ChannelID)
+		return
+	}
+
+	if parts[1] != "install" || len(parts) != 3 {
+		discord.ChannelMessageSend(m.ChannelID, "Usage: `!packs [browse]` or `!packs install <name>`")
+		return
+	}
+
+	if m.Author.ID != OWNER {
+		discord.ChannelMessageSend(m.ChannelID, "Only the bot owner can install soundpacks, they're added for every server")
+		return
+	}
+
+	packs, err := fetchPackIndex()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to fetch the soundpack index")
+		discord.ChannelMessageSend(m.ChannelID, "Couldn't reach the soundpack index, try again later")
+		return
+	}
+
+	var pack *Soundpack
+	for _, p := range packs {
+		if p.Name == parts[2] {
+			pack = p
+		}
+	}
+	if pack == nil {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("There is no pack %s, see them with `!packs browse`", parts[2]))
+		return
+	}
+
+	discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Installing %s (%d sounds)...", pack.Name, len(pack.Sounds)))
+	if err := installPack(pack); err != nil {
+		log.WithFields(log.Fields{
+			"pack":  pack.Name,
+			"error": err,
+		}).Error("Failed to install soundpack")
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Failed to install %s, %s", pack.Name, err))
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"pack":    pack.Name,
+		"version": pack.Version,
+		"sounds":  len(pack.Sounds),
+	}).Info("Installed soundpack")
+	discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf(":ok_hand: installed %s, play it with %s", pack.Name, strings.Join(pack.Commands, ", ")))
+}
+
+func displayPacks(cid string) {
+	packs, err := fetchPackIndex()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to fetch the soundpack index")
+		discord.ChannelMessageSend(cid, "Couldn't reach the soundpack index, try again later")
+		return
+	}
+
+	if len(packs) == 0 {
+		discord.ChannelMessageSend(cid, "There are no soundpacks yet")
+		return
+	}
+
+	em := &discordgo.MessageEmbed{
+		Title: "Soundpacks",
+		Color: 0xE5343A,
+	}
+	for _, pack := range packs {
+		status := ""
+		if installed := installedPack(pack.Name); installed != nil {
+			status = " (installed)"
+			if installed.Version != pack.Version {
+				status = fmt.Sprintf(" (%s installed)", installed.Version)
+			}
+		}
+
+		// Embeds are limited to 25 fields
+		if len(em.Fields) == 25 {
+			break
+		}
+		em.Fields = append(em.Fields, &discordgo.MessageEmbedField{
+			Name:  fmt.Sprintf("%s %s%s", pack.Name, pack.Version, status),
+			Value: fmt.Sprintf("%s\nby %s, %d sounds, %s", pack.Description, pack.Author, len(pack.Sounds), strings.Join(pack.Commands, ", ")),
+		})
+	}
+	discord.ChannelMessageSendEmbed(cid, em)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Permission key for the airhorn bomb
+	PERM_BOMB = "bomb"
+)
+
+var (
+	// Matches a role mention (<@&id>)
+	roleMention = regexp.MustCompile(`^<@&(\d+)>$`)
+)
+
+// Returns true if the key can be restricted with !perms, either a collection
+// prefix, one of the pseudo collections or the bomb
+func isPermKey(key string) bool {
+	if findCollection(key) != nil {
+		return true
+	}
+	return scontains(key, PERM_BOMB, CUSTOM.Prefix, SAY.Prefix, URL.Prefix)
+}
+
+// Returns true if the user may use the collection (or bomb) with the given key.
+// Keys no role has been granted are open to everyone, admins can always use them.
+func canUse(guild *discordgo.Guild, uid, key string) bool {
+	roles := getGuildSettings(guild.ID).RolePerms[key]
+	if len(roles) == 0 || guild.OwnerID == uid || uid == OWNER {
+		return true
+	}
+
+	member := getMember(guild, uid)
+	if member == nil {
+		return false
+	}
+	return hasRole(member, roles) || isAdminMember(guild, member)
+}
+
+// Returns true if one of the member's roles (or @everyone) grants Administrator
+// or Manage Server. Unlike isGuildAdmin channel overwrites aren't taken into
+// account, plays don't always come from a text channel.
+func isAdminMember(guild *discordgo.Guild, member *discordgo.Member) bool {
+	for _, role := range guild.Roles {
+		if role.ID != guild.ID && !scontains(role.ID, member.Roles...) {
+			continue
+		}
+		if role.Permissions&(discordgo.PermissionAdministrator|discordgo.PermissionManageServer) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a guild member from the state, falling back to the api
+func getMember(guild *discordgo.Guild, uid string) *discordgo.Member {
+	member, err := discord.State.Member(guild.ID, uid)
+	if err != nil {
+		member, err = discord.GuildMember(guild.ID, uid)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"guild": guild.ID,
+				"user":  uid,
+				"error": err,
+			}).Warning("Failed to get member for permission check")
+			return nil
+		}
+	}
+	return member
+}
+
+// Returns true if the member has any of the roles
+func hasRole(member *discordgo.Member, roles []string) bool {
+	for _, role := range member.Roles {
+		if scontains(role, roles...) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the priority a user's plays are queued with. The bot owner jumps
+// every queue, boosters and the guild's priority roles jump normal plays.
+func playPriority(guild *discordgo.Guild, uid string) int {
+	if uid == OWNER {
+		return queue.PRIORITY_OWNER
+	}
+
+	member := getMember(guild, uid)
+	if member == nil {
+		return queue.PRIORITY_NORMAL
+	}
+
+	if member.PremiumSince != nil || hasRole(member, getGuildSettings(guild.ID).PriorityRoles) {
+		return queue.PRIORITY_HIGH
+	}
+	return queue.PRIORITY_NORMAL
+}
+
+func displayPerms(cid string, gs *GuildSettings) {
+	if len(gs.RolePerms) == 0 {
+		discord.ChannelMessageSend(cid, "Everyone can use every sound, restrict one with `!perms grant @role <collection>`")
+		return
+	}
+
+	keys := make([]string, 0, len(gs.RolePerms))
+	for key := range gs.RolePerms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	em := &discordgo.MessageEmbed{
+		Title:       "Airhorn Permissions",
+		Color:       0xE5343A,
+		Description: "These can only be used by the listed roles\n",
+	}
+
+	for _, key := range keys {
+		mentions := make([]string, len(gs.RolePerms[key]))
+		for i, id := range gs.RolePerms[key] {
+			mentions[i] = "<@&" + id + ">"
+		}
+		em.Description += fmt.Sprintf("**%s** - %s\n", key, strings.Join(mentions, ", "))
+	}
+
+	discord.ChannelMessageSendEmbed(cid, em)
+}
+
+// Handles the !perms admin command group:
+//
+//	!perms list
+//	!perms grant|revoke @role <collection|bomb>
+//	!perms clear <collection|bomb>
+func handlePermsCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, parts []string, dryRun bool) {
+	if len(parts) < 2 || parts[1] == "list" {
+		displayPerms(m.ChannelID, getGuildSettings(guild.ID))
+		return
+	}
+
+	var role, key string
+	switch parts[1] {
+	case "grant", "revoke":
+		if len(parts) < 4 {
+			discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Usage: `!perms %s @role <collection|bomb>`", parts[1]))
+			return
+		}
+
+		match := roleMention.FindStringSubmatch(parts[2])
+		if match == nil {
+			discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("%s is not a role", parts[2]))
+			return
+		}
+		role, key = match[1], parts[3]
+	case "clear":
+		if len(parts) < 3 {
+			discord.ChannelMessageSend(m.ChannelID, "Usage: `!perms clear <collection|bomb>`")
+			return
+		}
+		key = parts[2]
+	default:
+		discord.ChannelMessageSend(m.ChannelID, "Usage: `!perms [list|grant|revoke|clear]`")
+		return
+	}
+
+	if !isPermKey(key) {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("There is no collection called %s", key))
+		return
+	}
+
+	update := func(gs *GuildSettings) {
+		roles := sremove(role, gs.RolePerms[key])
+		if parts[1] == "grant" {
+			roles = append(roles, role)
+		} else if parts[1] == "clear" {
+			roles = nil
+		}
+
+		if len(roles) == 0 {
+			delete(gs.RolePerms, key)
+			return
+		}
+
+		if gs.RolePerms == nil {
+			gs.RolePerms = make(map[string][]string)
+		}
+		gs.RolePerms[key] = roles
+	}
+
+	if dryRun {
+		if changes, err := settingsChanges(guild.ID, update); err == nil {
+			reportDryRun(m.ChannelID, changes)
+		}
+		return
+	}
+
+	_, err := updateGuildSettings(guild.ID, update)
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"error": err,
+		}).Error("Failed to save guild settings")
+		return
+	}
+
+	discord.ChannelMessageSend(m.ChannelID, ":ok_hand:")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Handles `!ping`, reporting how long discord, the gateway and redis take to
+// answer, so slowness can be pinned on the bot or on discord
+func handlePingCommand(m *discordgo.MessageCreate, guild *discordgo.Guild) {
+	start := time.Now()
+	reply, err := discord.ChannelMessageSend(m.ChannelID, ":ping_pong: pong")
+	if err != nil {
+		return
+	}
+	roundTrip := time.Since(start)
+
+	lines := []string{
+		fmt.Sprintf("**message round trip** - %s", roundTrip.Round(time.Millisecond)),
+		fmt.Sprintf("**gateway heartbeat** - %s", discord.HeartbeatLatency().Round(time.Millisecond)),
+		fmt.Sprintf("**voice** - %s", voiceDiagnostics(guild.ID)),
+		fmt.Sprintf("**redis** - %s", redisDiagnostics()),
+	}
+
+	// Discord stamps the command when it was received, so this is how long it
+	// took to reach the bot
+	if sent, err := discordgo.SnowflakeTimestamp(m.ID); err == nil {
+		lines = append([]string{fmt.Sprintf("**command delivery** - %s", start.Sub(sent).Round(time.Millisecond))}, lines...)
+	}
+
+	discord.ChannelMessageEdit(m.ChannelID, reply.ID, ":ping_pong: pong\n"+strings.Join(lines, "\n"))
+}
+
+// Describes the guild's voice connection, if the bot has one
+func voiceDiagnostics(gid string) string {
+	discord.RLock()
+	vc := discord.VoiceConnections[gid]
+	discord.RUnlock()
+	if vc == nil {
+		return "not connected"
+	}
+
+	vc.RLock()
+	ready, cid := vc.Ready, vc.ChannelID
+	vc.RUnlock()
+
+	state := "connecting"
+	if ready {
+		state = "connected"
+	}
+
+	if playing := queues.Playing(gid); playing != nil {
+		return fmt.Sprintf("%s to <#%s>, playing %s with %d queued", state, cid, playing.Sound.Name, queues.Len(gid))
+	}
+	return fmt.Sprintf("%s to <#%s>", state, cid)
+}
+
+func redisDiagnostics() string {
+	if rcli == nil {
+		return "disabled"
+	}
+
+	start := time.Now()
+	if err := rcli.Ping().Err(); err != nil {
+		return "unreachable (" + err.Error() + ")"
+	}
+	return time.Since(start).Round(time.Microsecond * 100).String()
+}
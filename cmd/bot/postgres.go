@@ -0,0 +1,7 @@
+//go:build postgres
+// +build postgres
+
+package main
+
+// Built with -tags postgres, allowing -stats postgres:<connection string>
+import _ "github.com/lib/pq"
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dustin/go-humanize"
+	log "github.com/sirupsen/logrus"
+)
+
+// A status message the bot cycles through
+type presence struct {
+	Type     discordgo.ActivityType
+	Template *template.Template
+}
+
+var (
+	// Activity types presence lines can start with
+	presenceTypes = map[string]discordgo.ActivityType{
+		"playing":   discordgo.ActivityTypeGame,
+		"listening": discordgo.ActivityTypeListening,
+		"watching":  discordgo.ActivityTypeWatching,
+		"competing": discordgo.ActivityTypeCompeting,
+	}
+
+	// Functions available to presence templates
+	presenceFuncs = template.FuncMap{
+		"comma": func(n int) string {
+			return humanize.Comma(int64(n))
+		},
+	}
+
+	// The rotated presences, Listening to airhorn.wav unless a file is given
+	presences = []*presence{
+		{
+			Type:     discordgo.ActivityTypeListening,
+			Template: template.Must(template.New("default").Parse("airhorn.wav")),
+		},
+	}
+	presenceIndex int
+	presenceLock  sync.Mutex
+
+	// Set by the owner to show a fixed status in place of the rotation
+	presenceOverride string
+)
+
+// Shows text as the bot's status until it's set back to ""
+func setPresenceOverride(text string) {
+	presenceLock.Lock()
+	presenceOverride = text
+	presenceLock.Unlock()
+}
+
+// Loads presences from a file with one `<playing|listening|watching|competing> <template>`
+// per line, eg. `listening {{comma .Total}} airhorns`. Templates get Total,
+// Servers, Shard, Shards and Uptime.
+func loadPresences(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	loaded := make([]*presence, 0)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(text, " ", 2)
+		activity, exists := presenceTypes[parts[0]]
+		if !exists || len(parts) < 2 {
+			return fmt.Errorf("line %d: expected <playing|listening|watching|competing> <message>", line)
+		}
+
+		tmpl, err := template.New(fmt.Sprintf("line %d", line)).Funcs(presenceFuncs).Parse(parts[1])
+		if err != nil {
+			return err
+		}
+		loaded = append(loaded, &presence{Type: activity, Template: tmpl})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if len(loaded) == 0 {
+		return fmt.Errorf("no presences in %s", path)
+	}
+
+	presenceLock.Lock()
+	presences = loaded
+	presenceIndex = 0
+	presenceLock.Unlock()
+	return nil
+}
+
+// Returns the live stats presence templates are rendered with
+func presenceData(s *discordgo.Session) map[string]interface{} {
+	total := 0
+	if tracker != nil {
+		total = tracker.Total()
+	}
+
+	s.State.RLock()
+	servers := len(s.State.Guilds)
+	s.State.RUnlock()
+
+	return map[string]interface{}{
+		"Total":   total,
+		"Servers": servers,
+		"Shard":   s.ShardID,
+		"Shards":  s.ShardCount,
+		"Uptime":  humanize.RelTime(startTime, time.Now(), "", ""),
+	}
+}
+
+// Sets the presence the rotation is currently on
+func updatePresence(s *discordgo.Session) {
+	presenceLock.Lock()
+	p := presences[presenceIndex%len(presences)]
+	override := presenceOverride
+	presenceLock.Unlock()
+
+	buf := &bytes.Buffer{}
+	if override != "" {
+		p = &presence{Type: discordgo.ActivityTypeGame}
+		buf.WriteString(override)
+	} else if err := p.Template.Execute(buf, presenceData(s)); err != nil {
+		log.WithFields(log.Fields{
+			"presence": p.Template.Name(),
+			"error":    err,
+		}).Warning("Failed to render presence")
+		return
+	}
+
+	status := 0 //A good line
+	err := s.UpdateStatusComplex(discordgo.UpdateStatusData{
+		Status:    "online",
+		IdleSince: &status,
+		Activities: []*discordgo.Activity{
+			{
+				Name: buf.String(),
+				Type: p.Type,
+			},
+		},
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to update presence")
+	}
+}
+
+// Moves on to the next presence every interval. With a single presence it is
+// still refreshed, so live stats in it stay current.
+func rotatePresence(s *discordgo.Session, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	for {
+		time.Sleep(interval)
+
+		presenceLock.Lock()
+		presenceIndex = (presenceIndex + 1) % len(presences)
+		presenceLock.Unlock()
+
+		updatePresence(s)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Redis set of the users who opted out of stats
+	OPTOUT_KEY = "airhorn:optout"
+)
+
+var (
+	// Users who opted out when there is no redis to remember them in
+	localOptOuts     map[string]bool = make(map[string]bool)
+	localOptOutsLock sync.Mutex
+)
+
+// Returns true if the user asked for their plays not to be tracked
+func optedOut(uid string) bool {
+	if rcli == nil {
+		localOptOutsLock.Lock()
+		defer localOptOutsLock.Unlock()
+		return localOptOuts[uid]
+	}
+
+	out, err := rcli.SIsMember(OPTOUT_KEY, uid).Result()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"user":  uid,
+			"error": err,
+		}).Warning("Failed to check stats opt out, leaving the user out")
+		return true
+	}
+	return out
+}
+
+func setOptOut(uid string, out bool) error {
+	if rcli == nil {
+		localOptOutsLock.Lock()
+		localOptOuts[uid] = out
+		localOptOutsLock.Unlock()
+		return nil
+	}
+
+	if out {
+		return rcli.SAdd(OPTOUT_KEY, uid).Err()
+	}
+	return rcli.SRem(OPTOUT_KEY, uid).Err()
+}
+
+// Handles `!airhorn optout` and `!airhorn optin`. Opted out users can still
+// play sounds, their plays just aren't recorded with their id.
+func handleOptOutCommand(m *discordgo.MessageCreate, out bool) {
+	if err := setOptOut(m.Author.ID, out); err != nil {
+		log.WithFields(log.Fields{
+			"user":  m.Author.ID,
+			"error": err,
+		}).Error("Failed to save stats opt out")
+		discord.ChannelMessageSend(m.ChannelID, "Something went wrong, try again later")
+		return
+	}
+
+	if out {
+		discord.ChannelMessageSend(m.ChannelID, ":ok_hand: your plays won't be tracked anymore. Use `!forgetme` to delete what was tracked before, or `!airhorn optin` to undo this")
+		return
+	}
+	discord.ChannelMessageSend(m.ChannelID, ":ok_hand: your plays are tracked again")
+}
+
+// Handles `!forgetme`, deleting the user's stats, favorites and play history
+// and opting them out so nothing new is recorded
+func handleForgetMeCommand(m *discordgo.MessageCreate) {
+	err := setOptOut(m.Author.ID, true)
+	if err == nil {
+		err = statsSink.ForgetUser(m.Author.ID)
+	}
+	if err == nil && rcli != nil {
+		err = rcli.Del(favoritesKey(m.Author.ID)).Err()
+	}
+	if err == nil && rcli != nil {
+		err = forgetExperimentUser(m.Author.ID)
+	}
+	if err == nil {
+		err = forgetHistory(m.Author.ID)
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"user":  m.Author.ID,
+			"error": err,
+		}).Error("Failed to forget user")
+		discord.ChannelMessageSend(m.ChannelID, "Something went wrong, try again later")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"user": m.Author.ID,
+	}).Info("Forgot user")
+	discord.ChannelMessageSend(m.ChannelID, ":ok_hand: your stats, favorites and play history have been deleted and nothing new will be tracked, use `!airhorn optin` if you change your mind")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+const (
+	// Redirects followed when downloading a user supplied link
+	PUBLIC_MAX_REDIRECTS = 5
+)
+
+var (
+	// ErrNotPublic is returned when a user supplied link points at an address
+	// that isn't on the public internet
+	ErrNotPublic = errors.New("address is not public")
+
+	// Ranges the net package doesn't have a check for that still aren't
+	// reachable on the public internet
+	nonPublicNets = mustParseCIDRs(
+		"0.0.0.0/8",
+		"100.64.0.0/10",
+		"192.0.0.0/24",
+		"198.18.0.0/15",
+		"240.0.0.0/4",
+		"64:ff9b::/96",
+	)
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// Returns true if the address is on the public internet, so not loopback,
+// RFC1918, link-local (like the cloud metadata address), an IPv6 ULA or any
+// other reserved range
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks the address a connection is about to be made to. It runs after the
+// host was resolved, so a hostname resolving to an internal address is caught
+// too, and every connection of a redirect chain goes through it.
+func checkPublicDial(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return ErrNotPublic
+	}
+	return nil
+}
+
+// Refuses redirects to anything but public http(s) links
+func checkPublicRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= PUBLIC_MAX_REDIRECTS {
+		return fmt.Errorf("stopped after %d redirects", PUBLIC_MAX_REDIRECTS)
+	}
+	return checkPublicURL(req.URL)
+}
+
+// Refuses links that aren't http(s) or name an address that isn't public.
+// Hostnames are checked once resolved, when the connection is made.
+func checkPublicURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !isPublicIP(ip) {
+		return ErrNotPublic
+	}
+	return nil
+}
+
+// Creates a HTTP client for downloading links users give the bot, which can
+// only connect to public addresses. Proxies from the environment are
+// ignored, they would do the connecting instead.
+func newPublicHTTPClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: checkPublicDial,
+	}
+
+	return &http.Client{
+		Timeout:       timeout,
+		CheckRedirect: checkPublicRedirect,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 10 * time.Second,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       time.Minute,
+		},
+	}
+}
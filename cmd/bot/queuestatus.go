@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Most pending plays !queue lists, the rest are summed up
+	QUEUE_DISPLAY_MAX = 15
+)
+
+// Handles `!queue` and `!queue clear`, the latter for admins
+func handleQueueCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, parts []string) {
+	if len(parts) < 2 {
+		displayQueue(m.ChannelID, guild.ID)
+		return
+	}
+
+	if parts[1] != "clear" {
+		discord.ChannelMessageSend(m.ChannelID, "Usage: `!queue` or `!queue clear`")
+		return
+	}
+
+	if !isGuildAdmin(guild, m.Author.ID, m.ChannelID) {
+		discord.ChannelMessageSend(m.ChannelID, "Only server admins can clear the queue")
+		return
+	}
+
+	dropped := queues.Clear(guild.ID)
+	log.WithFields(log.Fields{
+		"guild":   guild.ID,
+		"admin":   m.Author.ID,
+		"dropped": dropped,
+	}).Info("Cleared guild queue")
+	discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf(":ok_hand: dropped %d queued plays", dropped))
+}
+
+func describePlay(play *queue.Play) string {
+	return fmt.Sprintf("**%s %s** for <@%s>", play.Collection, play.Sound.Name, play.UserID)
+}
+
+func displayQueue(cid, gid string) {
+	playing := queues.Playing(gid)
+	if playing == nil {
+		discord.ChannelMessageSend(cid, "Nothing is playing")
+		return
+	}
+
+	pending := queues.Pending(gid)
+	lines := make([]string, 0, len(pending)+2)
+	lines = append(lines, ":loud_sound: "+describePlay(playing), "")
+
+	if len(pending) == 0 {
+		lines = append(lines, "Nothing is queued")
+	}
+
+	for i, play := range pending {
+		if i == QUEUE_DISPLAY_MAX {
+			lines = append(lines, fmt.Sprintf("and %d more", len(pending)-i))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("%d. %s", i+1, describePlay(play)))
+	}
+
+	discord.ChannelMessageSendEmbed(cid, &discordgo.MessageEmbed{
+		Title:       "Queue",
+		Color:       0xE5343A,
+		Description: strings.Join(lines, "\n"),
+	})
+}
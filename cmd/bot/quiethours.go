@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Most plays held per guild until its quiet hours end, later ones are rejected
+	QUIET_HOURS_MAX_HELD = 10
+)
+
+var (
+	// Time zones quiet hours were set in, keyed by name
+	quietLocations     map[string]*time.Location = make(map[string]*time.Location)
+	quietLocationsLock sync.Mutex
+
+	// Plays waiting for their guild's quiet hours to end, keyed by guild id.
+	// They only live in memory, so a restart drops them.
+	heldPlays     map[string][]*queue.Play = make(map[string][]*queue.Play)
+	heldPlaysLock sync.Mutex
+)
+
+// Returns the time zone with the given IANA name, eg. Europe/Berlin
+func quietLocation(name string) (*time.Location, error) {
+	quietLocationsLock.Lock()
+	defer quietLocationsLock.Unlock()
+
+	if loc, ok := quietLocations[name]; ok {
+		return loc, nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	quietLocations[name] = loc
+	return loc, nil
+}
+
+// Parses a HH:MM time of day into minutes since midnight
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("%s isn't a time like 23:00", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func formatClock(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// Returns true and when they end if the guild is in its quiet hours at now.
+// Quiet hours can wrap around midnight, eg. 23:00-08:00.
+func quietHoursEnd(gs *GuildSettings, now time.Time) (bool, time.Time) {
+	if gs.QuietStart == "" || gs.QuietEnd == "" {
+		return false, time.Time{}
+	}
+
+	start, err := parseClock(gs.QuietStart)
+	if err != nil {
+		return false, time.Time{}
+	}
+	end, err := parseClock(gs.QuietEnd)
+	if err != nil || start == end {
+		return false, time.Time{}
+	}
+
+	loc, err := quietLocation(gs.QuietTimezone)
+	if err != nil {
+		return false, time.Time{}
+	}
+
+	local := now.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+
+	quiet := minute >= start && minute < end
+	if start > end {
+		quiet = minute >= start || minute < end
+	}
+	if !quiet {
+		return false, time.Time{}
+	}
+
+	until := time.Date(local.Year(), local.Month(), local.Day(), end/60, end%60, 0, 0, loc)
+	if !until.After(local) {
+		until = time.Date(local.Year(), local.Month(), local.Day()+1, end/60, end%60, 0, 0, loc)
+	}
+	return true, until
+}
+
+// Describes a guild's quiet hours for !settings and !quiethours
+func describeQuietHours(gs *GuildSettings) string {
+	if gs.QuietStart == "" {
+		return "off"
+	}
+
+	mode := "plays are rejected"
+	if gs.QuietQueue {
+		mode = "plays are held until morning"
+	}
+	return fmt.Sprintf("%s-%s %s, %s", gs.QuietStart, gs.QuietEnd, gs.QuietTimezone, mode)
+}
+
+// Returns true if the play was stopped by the guild's quiet hours, which
+// either rejects it or holds it until they end depending on the guild's setting
+func quietHoursBlock(play *queue.Play) bool {
+	gs := getGuildSettings(play.GuildID)
+	quiet, end := quietHoursEnd(gs, time.Now())
+	if !quiet {
+		return false
+	}
+
+	loc, _ := quietLocation(gs.QuietTimezone)
+	data := map[string]interface{}{
+		"End": end.In(loc).Format("15:04"),
+	}
+
+	if gs.QuietQueue && holdPlay(play, end) {
+		log.WithFields(log.Fields{
+			"play":  play.ID,
+			"guild": play.GuildID,
+			"until": end,
+		}).Info("Holding play until quiet hours end")
+
+		if play.TextChannelID != "" {
+			discord.ChannelMessageSend(play.TextChannelID, localize(play.GuildID, "quiethours.held", data))
+		}
+		return true
+	}
+
+	log.WithFields(log.Fields{
+		"play":  play.ID,
+		"guild": play.GuildID,
+	}).Info("Dropping play during quiet hours")
+	play.Drop()
+
+	if play.TextChannelID != "" {
+		discord.ChannelMessageSend(play.TextChannelID, localize(play.GuildID, "quiethours.rejected", data))
+	}
+	return true
+}
+
+// Keeps a play to be queued once quiet hours end, returning false if the
+// guild already has QUIET_HOURS_MAX_HELD plays waiting
+func holdPlay(play *queue.Play, end time.Time) bool {
+	heldPlaysLock.Lock()
+	defer heldPlaysLock.Unlock()
+
+	held := heldPlays[play.GuildID]
+	if len(held) >= QUIET_HOURS_MAX_HELD {
+		return false
+	}
+
+	// The first held play sets up the release for everything held after it
+	if len(held) == 0 {
+		gid := play.GuildID
+		time.AfterFunc(time.Until(end), func() {
+			releaseHeldPlays(gid)
+		})
+	}
+	heldPlays[play.GuildID] = append(held, play)
+	return true
+}
+
+// Queues the plays held during quiet hours, skipping any whose voice channel
+// emptied out overnight
+func releaseHeldPlays(gid string) {
+	heldPlaysLock.Lock()
+	held := heldPlays[gid]
+	delete(heldPlays, gid)
+	heldPlaysLock.Unlock()
+
+	guild, _ := discord.State.Guild(gid)
+	for _, play := range held {
+		if guild == nil || listeners(guild, play.ChannelID) == 0 {
+			play.Drop()
+			continue
+		}
+		queuePlay(play)
+	}
+}
+
+// Handles !quiethours, showing or setting the hours plays are stopped during
+func handleQuietHoursCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, dryRun bool) {
+	// Time zone names are case sensitive, so the original case is kept
+	parts := stripDryRun(strings.Fields(m.Content))
+	if len(parts) < 2 {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Quiet hours: %s\nSet them with `!quiethours 23:00-08:00 Europe/Berlin [reject|queue]` or turn them off with `!quiethours off`", describeQuietHours(getGuildSettings(guild.ID))))
+		return
+	}
+
+	var update func(gs *GuildSettings)
+	if strings.ToLower(parts[1]) == "off" {
+		update = func(gs *GuildSettings) {
+			gs.QuietStart = ""
+			gs.QuietEnd = ""
+			gs.QuietTimezone = ""
+			gs.QuietQueue = false
+		}
+	} else {
+		hours := strings.SplitN(parts[1], "-", 2)
+		if len(hours) != 2 {
+			discord.ChannelMessageSend(m.ChannelID, "Usage: `!quiethours <start>-<end> [time zone] [reject|queue]`, eg. `!quiethours 23:00-08:00 Europe/Berlin`")
+			return
+		}
+
+		start, err := parseClock(hours[0])
+		end := 0
+		if err == nil {
+			if end, err = parseClock(hours[1]); err == nil && start == end {
+				err = fmt.Errorf("quiet hours can't start and end at the same time")
+			}
+		}
+		if err != nil {
+			discord.ChannelMessageSend(m.ChannelID, err.Error())
+			return
+		}
+
+		timezone := "UTC"
+		queued := false
+		for _, arg := range parts[2:] {
+			switch strings.ToLower(arg) {
+			case "reject":
+				queued = false
+			case "queue":
+				queued = true
+			default:
+				if _, err := quietLocation(arg); err != nil {
+					discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Unknown time zone %s, use a name like Europe/Berlin or America/New_York", arg))
+					return
+				}
+				timezone = arg
+			}
+		}
+
+		update = func(gs *GuildSettings) {
+			gs.QuietStart = formatClock(start)
+			gs.QuietEnd = formatClock(end)
+			gs.QuietTimezone = timezone
+			gs.QuietQueue = queued
+		}
+	}
+
+	if dryRun {
+		if changes, err := settingsChanges(guild.ID, update); err == nil {
+			reportDryRun(m.ChannelID, changes)
+		}
+		return
+	}
+
+	gs, err := updateGuildSettings(guild.ID, update)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"error": err,
+		}).Error("Failed to save guild settings")
+		return
+	}
+	discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf(":ok_hand: quiet hours: %s", describeQuietHours(gs)))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/noisemaster/airhornbot/pkg/sound"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// The live set of loaded collections. Reloads build a complete new set and
+	// swap it in, so plays that already resolved a Sound keep using the old
+	// buffers while new commands see the new library.
+	activeCollections atomic.Value
+
+	// Only one reload runs at a time
+	reloadLock sync.Mutex
+)
+
+// Returns the collections commands should be resolved against
+func getCollections() []*sound.Collection {
+	if colls, ok := activeCollections.Load().([]*sound.Collection); ok {
+		return colls
+	}
+	return COLLECTIONS
+}
+
+// Loads (or indexes, when tiering or the sound cache is enabled) every sound in
+// the collections, returning the first sound that failed to load. With a
+// warm-up window only the recently played sounds are loaded up front.
+func loadCollections(colls []*sound.Collection) error {
+	var firstErr error
+
+	fetchMissingAssets(colls)
+
+	// Tiering and the cache decide what is kept in memory themselves
+	var warmup map[string]bool
+	if !tieringEnabled() && soundCache == nil {
+		warmup = warmupSounds()
+	}
+
+	for _, coll := range colls {
+		var err error
+		if soundCache != nil {
+			coll.LoadCached(soundCache)
+		} else if tieringEnabled() {
+			coll.Index()
+		} else if warmup != nil {
+			err = coll.LoadLazy(func(s *sound.Sound) bool {
+				return warmup[s.Name]
+			})
+		} else {
+			err = coll.Load()
+		}
+
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if tieringEnabled() {
+		retierCollections(colls)
+	}
+	return firstErr
+}
+
+// Reads a new copy of every collection from disk and swaps it in. If any sound
+// fails to load the current collections are kept.
+func reloadSounds() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	return reloadSoundsLocked()
+}
+
+// Reloads the sounds like reloadSounds, for callers already holding reloadLock
+func reloadSoundsLocked() error {
+	colls := sound.CopyAll(COLLECTIONS)
+	if err := loadCollections(colls); err != nil {
+		return err
+	}
+
+	activeCollections.Store(colls)
+	updateTierMetrics()
+
+	if SEASONS_FILE != "" {
+		if err := loadSeasons(SEASONS_FILE); err != nil {
+			log.WithFields(log.Fields{
+				"path":  SEASONS_FILE,
+				"error": err,
+			}).Warning("Failed to reload seasons, keeping the current ones")
+		}
+	}
+	publishCatalog()
+
+	log.WithFields(log.Fields{
+		"collections": len(colls),
+	}).Info("Swapped in reloaded sound collections")
+	return nil
+}
+
+// Reloads the sounds every time the process receives a SIGHUP
+func reloadOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	for range c {
+		if err := reloadSounds(); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Failed to reload sounds, keeping the current collections")
+		}
+	}
+}
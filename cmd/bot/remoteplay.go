@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Redis channel the webserver sends soundboard plays to every shard on
+	REMOTE_PLAY_CHANNEL = "airhorn:remoteplay"
+
+	// Collections and sounds the web soundboard shows, as JSON
+	CATALOG_KEY = "airhorn:catalog"
+
+	// Redis set of every guild the bot is in, so the website can tell which of
+	// a user's guilds it can play in
+	BOT_GUILDS_KEY = "airhorn:bot:guilds"
+
+	// Remote plays older than this are dropped, so a captured one can't be
+	// replayed later
+	REMOTE_PLAY_MAX_AGE = time.Second * 30
+
+	// Signatures of handled remote plays are remembered for as long as a play
+	// with them could still be accepted, on either side of the clock
+	REMOTE_PLAY_SEEN_TTL = REMOTE_PLAY_MAX_AGE * 2
+)
+
+var (
+	// Key remote plays are signed with, shared with the webserver. Remote plays
+	// are ignored without one.
+	REMOTE_PLAY_SECRET string
+)
+
+// A play requested from the web soundboard by a user logged in with discord
+type RemotePlay struct {
+	GuildID    string    `json:"guild_id"`
+	UserID     string    `json:"user_id"`
+	Collection string    `json:"collection"`
+	Sound      string    `json:"sound"`
+	Sent       time.Time `json:"sent"`
+	Signature  string    `json:"signature"`
+}
+
+// A collection as the web soundboard shows it
+type CatalogCollection struct {
+	Prefix string   `json:"prefix"`
+	Sounds []string `json:"sounds"`
+}
+
+// Returns the hex HMAC-SHA256 of the remote play's fields, the webserver signs
+// them the same way
+func remotePlaySignature(secret string, rp *RemotePlay) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s:%s:%s:%s:%d", rp.GuildID, rp.UserID, rp.Collection, rp.Sound, rp.Sent.Unix())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func remotePlaySeenKey(signature string) string {
+	return "airhorn:remoteplay:seen:" + signature
+}
+
+// Returns the names of the sounds in every loaded collection
+func soundCatalog() []*CatalogCollection {
+	colls := getCollections()
+	catalog := make([]*CatalogCollection, 0, len(colls))
+	for _, coll := range colls {
+		cc := &CatalogCollection{Prefix: coll.Prefix, Sounds: make([]string, len(coll.Sounds))}
+		for i, s := range coll.Sounds {
+			cc.Sounds[i] = s.Name
+		}
+		catalog = append(catalog, cc)
+	}
+	return catalog
+}
+
+// Writes the loaded collections to redis for the web soundboard
+func publishCatalog() {
+	if rcli == nil {
+		return
+	}
+
+	data, err := json.Marshal(soundCatalog())
+	if err == nil {
+		err = rcli.Set(CATALOG_KEY, string(data), 0).Err()
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to publish the sound catalog")
+	}
+}
+
+// Keeps BOT_GUILDS_KEY up to date as the bot joins guilds
+func trackBotGuild(s *discordgo.Session, event *discordgo.GuildCreate) {
+	if rcli != nil && !event.Guild.Unavailable {
+		rcli.SAdd(BOT_GUILDS_KEY, event.Guild.ID)
+	}
+}
+
+// Keeps BOT_GUILDS_KEY up to date as the bot is removed from guilds. Guilds
+// going unavailable in an outage are kept.
+func untrackBotGuild(s *discordgo.Session, event *discordgo.GuildDelete) {
+	if rcli != nil && !event.Guild.Unavailable {
+		rcli.SRem(BOT_GUILDS_KEY, event.Guild.ID)
+	}
+}
+
+// Plays the sounds clicked on the web soundboard in guilds on this shard
+func listenRemotePlays() {
+	for {
+		pubsub, err := rcli.Subscribe(REMOTE_PLAY_CHANNEL)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warning("Failed to subscribe to remote plays")
+			time.Sleep(time.Second * 5)
+			continue
+		}
+
+		for {
+			msg, err := pubsub.ReceiveMessage()
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Warning("Lost the remote play subscription")
+				break
+			}
+
+			rp := &RemotePlay{}
+			if err := json.Unmarshal([]byte(msg.Payload), rp); err != nil {
+				continue
+			}
+			go handleRemotePlay(rp)
+		}
+
+		pubsub.Close()
+		time.Sleep(time.Second)
+	}
+}
+
+// Queues a remote play in the user's voice channel, as if they had used the
+// command themselves
+func handleRemotePlay(rp *RemotePlay) {
+	// Other shards play in their own guilds
+	guild, _ := discord.State.Guild(rp.GuildID)
+	if guild == nil {
+		return
+	}
+
+	expected := remotePlaySignature(REMOTE_PLAY_SECRET, rp)
+	if !hmac.Equal([]byte(expected), []byte(rp.Signature)) {
+		log.WithFields(log.Fields{
+			"guild": rp.GuildID,
+			"user":  rp.UserID,
+		}).Warning("Dropping remote play with a bad signature")
+		return
+	}
+
+	if age := time.Since(rp.Sent); age > REMOTE_PLAY_MAX_AGE || age < -REMOTE_PLAY_MAX_AGE {
+		return
+	}
+
+	// Only the instance serving the guild marks the play as seen, another one
+	// getting there first would drop it without playing
+	if !claimGuild(guild.ID) {
+		return
+	}
+
+	// A captured message can be published again while it's still fresh
+	fresh, err := rcli.SetNX(remotePlaySeenKey(rp.Signature), "1", REMOTE_PLAY_SEEN_TTL).Result()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": rp.GuildID,
+			"error": err,
+		}).Warning("Failed to check if a remote play was replayed, dropping it")
+		return
+	}
+	if !fresh {
+		log.WithFields(log.Fields{
+			"guild": rp.GuildID,
+			"user":  rp.UserID,
+		}).Warning("Dropping replayed remote play")
+		return
+	}
+
+	member := getMember(guild, rp.UserID)
+	if member == nil || member.User == nil {
+		return
+	}
+
+	coll := findCollection(rp.Collection)
+	if coll == nil || !getGuildSettings(guild.ID).CollectionEnabled(coll) {
+		return
+	}
+
+	s := coll.Find(rp.Sound)
+	if s == nil {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"guild": guild.ID,
+		"user":  rp.UserID,
+		"sound": coll.Prefix + ":" + s.Name,
+	}).Info("Playing sound from the web soundboard")
+	enqueuePlay(member.User, guild, "", coll, s, queue.SOURCE_WEB)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dustin/go-humanize"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Longest a disabled collection can be rented for
+	MAX_RENTAL = time.Hour * 24 * 7
+)
+
+// A disabled collection that is enabled until a set time
+type Rental struct {
+	Until time.Time `json:"until"`
+
+	// Text channel the rental was started in, told when it ends
+	ChannelID string `json:"channel_id"`
+}
+
+// Handles `!rent`, `!rent <collection> <duration>` and `!rent <collection> off`
+func handleRentCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, parts []string, dryRun bool) {
+	if len(parts) < 2 {
+		displayRentals(m.ChannelID, getGuildSettings(guild.ID))
+		return
+	}
+
+	if len(parts) < 3 {
+		discord.ChannelMessageSend(m.ChannelID, "Usage: `!rent <collection> <duration>`, eg. `!rent birthday 2h`, or `!rent <collection> off`")
+		return
+	}
+
+	prefix := strings.TrimPrefix(parts[1], "!")
+	coll := findCollection(prefix)
+	if coll == nil {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("There is no collection %s", prefix))
+		return
+	}
+
+	var update func(gs *GuildSettings)
+	if parts[2] == "off" {
+		update = func(gs *GuildSettings) {
+			delete(gs.Rentals, prefix)
+		}
+	} else {
+		duration, err := time.ParseDuration(parts[2])
+		if err != nil || duration < time.Minute || duration > MAX_RENTAL {
+			discord.ChannelMessageSend(m.ChannelID, "The duration must be between 1m and 168h, eg. `2h` or `90m`")
+			return
+		}
+
+		if !scontains(prefix, getGuildSettings(guild.ID).DisabledCollections...) {
+			discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("%s isn't disabled on this server, only disabled collections can be rented", prefix))
+			return
+		}
+
+		rental := &Rental{
+			Until:     time.Now().Add(duration).Round(time.Second),
+			ChannelID: m.ChannelID,
+		}
+		update = func(gs *GuildSettings) {
+			if gs.Rentals == nil {
+				gs.Rentals = make(map[string]*Rental)
+			}
+			gs.Rentals[prefix] = rental
+		}
+	}
+
+	if dryRun {
+		if changes, err := settingsChanges(guild.ID, update); err == nil {
+			reportDryRun(m.ChannelID, changes)
+		}
+		return
+	}
+
+	if _, err := updateGuildSettings(guild.ID, update); err != nil {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"error": err,
+		}).Error("Failed to save collection rental")
+		return
+	}
+	discord.ChannelMessageSend(m.ChannelID, ":ok_hand:")
+}
+
+func displayRentals(cid string, gs *GuildSettings) {
+	if len(gs.Rentals) == 0 {
+		discord.ChannelMessageSend(cid, "No collections are rented, enable a disabled one for a while with `!rent <collection> <duration>`")
+		return
+	}
+
+	prefixes := make([]string, 0, len(gs.Rentals))
+	for prefix := range gs.Rentals {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	lines := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		lines[i] = fmt.Sprintf("**%s** - ends %s", prefix, humanize.Time(gs.Rentals[prefix].Until))
+	}
+	discord.ChannelMessageSend(cid, strings.Join(lines, "\n"))
+}
+
+// Removes rentals that have ended in this shard's guilds, telling the channel
+// each was started in. Ended rentals already stop applying on their own, this
+// just tidies up the settings.
+func expireRentals(now time.Time) {
+	discord.State.RLock()
+	guilds := make([]*discordgo.Guild, len(discord.State.Guilds))
+	copy(guilds, discord.State.Guilds)
+	discord.State.RUnlock()
+
+	for _, guild := range guilds {
+		ended := make(map[string]*Rental)
+		for prefix, rental := range getGuildSettings(guild.ID).Rentals {
+			if !now.Before(rental.Until) {
+				ended[prefix] = rental
+			}
+		}
+
+		if len(ended) == 0 {
+			continue
+		}
+
+		_, err := updateGuildSettings(guild.ID, func(gs *GuildSettings) {
+			for prefix := range ended {
+				delete(gs.Rentals, prefix)
+			}
+		})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"guild": guild.ID,
+				"error": err,
+			}).Warning("Failed to remove ended collection rentals")
+			continue
+		}
+
+		for prefix, rental := range ended {
+			discord.ChannelMessageSend(rental.ChannelID, fmt.Sprintf("The %s rental has ended, it's disabled again", prefix))
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Replies that can wait in a channel's queue, more are dropped
+	REPLY_QUEUE_SIZE = 5
+
+	// Replies that waited longer than this are dropped, the conversation has
+	// moved on by then
+	REPLY_MAX_AGE = time.Second * 30
+
+	// Times a reply is sent again after discord failed it
+	REPLY_MAX_RETRIES = 3
+)
+
+// How much a reply matters when a channel has more of them than discord lets through
+const (
+	// Dropped if the channel already has replies waiting, eg. the current APS
+	REPLY_LOW = iota
+
+	// Only dropped once the channel's queue is full or the reply is too old
+	REPLY_NORMAL
+)
+
+type queuedReply struct {
+	message  *discordgo.MessageSend
+	priority int
+	queued   time.Time
+}
+
+// The replies waiting to be sent to a channel, sent one at a time so a burst
+// of commands in one channel doesn't hold up every other channel
+type replyQueue struct {
+	pending []*queuedReply
+	sending bool
+}
+
+var (
+	// Reply queues of the channels that have replies in flight, keyed by channel id
+	replyQueues     map[string]*replyQueue = make(map[string]*replyQueue)
+	replyQueuesLock sync.Mutex
+
+	// Replies dropped because their channel was sending too many
+	repliesDropped = expvar.NewInt("replies_dropped")
+)
+
+// Queues a reply for the channel. Discordgo waits out rate limits itself, so
+// under pressure the queue grows and low priority and stale replies are
+// dropped instead of piling up behind the limit.
+func sendReply(cid string, message *discordgo.MessageSend, priority int) {
+	replyQueuesLock.Lock()
+	defer replyQueuesLock.Unlock()
+
+	q := replyQueues[cid]
+	if q == nil {
+		q = &replyQueue{}
+		replyQueues[cid] = q
+		go q.run(cid)
+	}
+
+	busy := q.sending || len(q.pending) > 0
+	if (priority == REPLY_LOW && busy) || len(q.pending) >= REPLY_QUEUE_SIZE {
+		repliesDropped.Add(1)
+		log.WithFields(log.Fields{
+			"channel":  cid,
+			"priority": priority,
+			"pending":  len(q.pending),
+		}).Debug("Dropping reply to a busy channel")
+		return
+	}
+
+	q.pending = append(q.pending, &queuedReply{
+		message:  message,
+		priority: priority,
+		queued:   time.Now(),
+	})
+}
+
+// Queues a plain text reply
+func sendReplyText(cid, content string, priority int) {
+	sendReply(cid, &discordgo.MessageSend{Content: content}, priority)
+}
+
+// Queues a reply that is a single embed
+func sendReplyEmbed(cid string, em *discordgo.MessageEmbed, priority int) {
+	sendReply(cid, &discordgo.MessageSend{Embeds: []*discordgo.MessageEmbed{em}}, priority)
+}
+
+// Sends the channel's replies until its queue is empty
+func (q *replyQueue) run(cid string) {
+	for {
+		replyQueuesLock.Lock()
+		if len(q.pending) == 0 {
+			delete(replyQueues, cid)
+			replyQueuesLock.Unlock()
+			return
+		}
+		reply := q.pending[0]
+		q.pending = q.pending[1:]
+		q.sending = true
+		replyQueuesLock.Unlock()
+
+		if time.Since(reply.queued) > REPLY_MAX_AGE {
+			repliesDropped.Add(1)
+		} else {
+			deliverReply(cid, reply.message)
+		}
+
+		replyQueuesLock.Lock()
+		q.sending = false
+		replyQueuesLock.Unlock()
+	}
+}
+
+// Sends a reply, retrying with a growing delay while discord is failing
+// requests
+func deliverReply(cid string, message *discordgo.MessageSend) {
+	for attempt := 0; ; attempt++ {
+		_, err := discord.ChannelMessageSendComplex(cid, message)
+		if err == nil {
+			return
+		}
+
+		if !retryableReplyError(err) || attempt >= REPLY_MAX_RETRIES {
+			log.WithFields(log.Fields{
+				"channel":  cid,
+				"attempts": attempt + 1,
+				"error":    err,
+			}).Warning("Failed to send reply")
+			go trackError("reply")
+			return
+		}
+		time.Sleep(time.Millisecond * 500 << uint(attempt))
+	}
+}
+
+// Returns true if sending the reply again could work: it was rate limited,
+// discord had a problem or the request never got an answer. Missing
+// permissions and deleted channels aren't retried.
+func retryableReplyError(err error) bool {
+	rest, ok := err.(*discordgo.RESTError)
+	if !ok || rest.Response == nil {
+		return true
+	}
+	return rest.Response.StatusCode == http.StatusTooManyRequests || rest.Response.StatusCode >= 500
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	"github.com/noisemaster/airhornbot/pkg/redis"
+	"github.com/noisemaster/airhornbot/pkg/sound"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Most schedules a single guild can have
+	MAX_GUILD_SCHEDULES = 10
+
+	// Redis hash of every schedule, keyed by id
+	SCHEDULES_KEY = "airhorn:schedules"
+)
+
+// Schedule is a sound a guild has set to play at recurring times
+type Schedule struct {
+	ID      string `json:"id"`
+	GuildID string `json:"guild_id"`
+
+	// Cron expression (minute hour day-of-month month day-of-week) in UTC
+	Spec string `json:"spec"`
+
+	Collection string `json:"collection"`
+
+	// Sound to play, a random one from the collection if empty
+	Sound string `json:"sound,omitempty"`
+
+	// Voice channel to play in, the most populated one if empty
+	ChannelID string `json:"channel_id,omitempty"`
+
+	CreatedBy string    `json:"created_by"`
+	Created   time.Time `json:"created"`
+
+	cron *cronSpec
+}
+
+// Returns every schedule, parsing their cron expressions
+func getSchedules() []*Schedule {
+	data, err := rcli.HGetAll(SCHEDULES_KEY).Result()
+	if err != nil && err != redis.Nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to load schedules")
+		return nil
+	}
+
+	schedules := make([]*Schedule, 0, len(data))
+	for _, raw := range data {
+		sched := &Schedule{}
+		if json.Unmarshal([]byte(raw), sched) != nil {
+			continue
+		}
+
+		sched.cron, err = parseCron(sched.Spec)
+		if err != nil {
+			continue
+		}
+		schedules = append(schedules, sched)
+	}
+	return schedules
+}
+
+// Returns the schedules belonging to a guild
+func guildSchedules(gid string) []*Schedule {
+	schedules := make([]*Schedule, 0)
+	for _, sched := range getSchedules() {
+		if sched.GuildID == gid {
+			schedules = append(schedules, sched)
+		}
+	}
+	return schedules
+}
+
+func putSchedule(sched *Schedule) error {
+	data, err := json.Marshal(sched)
+	if err != nil {
+		return err
+	}
+	return rcli.HSet(SCHEDULES_KEY, sched.ID, string(data)).Err()
+}
+
+// Runs every schedule for guilds on this shard and ends their collection
+// rentals, checking at the start of every minute
+func runScheduler() {
+	for {
+		now := time.Now().UTC()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+
+		now = time.Now().UTC().Truncate(time.Minute)
+		expireRentals(now)
+		if rcli == nil {
+			continue
+		}
+
+		for _, sched := range getSchedules() {
+			if !sched.cron.matches(now) {
+				continue
+			}
+
+			// Other shards run the schedules of their own guilds
+			guild, _ := discord.State.Guild(sched.GuildID)
+			if guild == nil {
+				continue
+			}
+			go playSchedule(guild, sched)
+		}
+	}
+}
+
+// Plays a scheduled sound, skipping it if nobody is around to hear it
+func playSchedule(guild *discordgo.Guild, sched *Schedule) {
+	coll := findCollection(sched.Collection)
+	if coll == nil || !getGuildSettings(guild.ID).CollectionEnabled(coll) {
+		return
+	}
+
+	var s *sound.Sound
+	if sched.Sound != "" {
+		s = coll.Find(sched.Sound)
+		if s == nil {
+			return
+		}
+	}
+
+	channelID := sched.ChannelID
+	if channelID == "" {
+		channelID = busiestVoiceChannel(guild)
+	}
+	if channelID == "" {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"schedule": sched.ID,
+		"guild":    guild.ID,
+		"channel":  channelID,
+	}).Info("Running scheduled sound")
+	queuePlay(newPlay(guild, channelID, sched.CreatedBy, coll, s, queue.SOURCE_SCHEDULER))
+}
+
+// Returns the voice channel with the most users in it, or an empty string if
+// nobody is in voice
+func busiestVoiceChannel(guild *discordgo.Guild) string {
+	counts := make(map[string]int)
+	best := ""
+	for _, vs := range guild.VoiceStates {
+		if vs.UserID == discord.State.Ready.User.ID {
+			continue
+		}
+
+		counts[vs.ChannelID]++
+		if best == "" || counts[vs.ChannelID] > counts[best] {
+			best = vs.ChannelID
+		}
+	}
+	return best
+}
+
+// Resolves a voice channel from a channel mention or name
+func findVoiceChannel(guild *discordgo.Guild, name string) *discordgo.Channel {
+	id := strings.TrimSuffix(strings.TrimPrefix(name, "<#"), ">")
+	name = strings.TrimPrefix(name, "#")
+
+	for _, channel := range guild.Channels {
+		if channel.Type != discordgo.ChannelTypeGuildVoice {
+			continue
+		}
+
+		if channel.ID == id || strings.EqualFold(channel.Name, name) {
+			return channel
+		}
+	}
+	return nil
+}
+
+// Splits a message on spaces, keeping "quoted text" together
+func splitQuoted(content string) []string {
+	parts := make([]string, 0)
+	for i, chunk := range strings.Split(content, `"`) {
+		if i%2 == 1 {
+			parts = append(parts, chunk)
+			continue
+		}
+		parts = append(parts, strings.Fields(chunk)...)
+	}
+	return parts
+}
+
+// Handles `!schedule`, listing, adding and removing this guild's scheduled sounds
+func handleScheduleCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, dryRun bool) {
+	if rcli == nil {
+		discord.ChannelMessageSend(m.ChannelID, "Schedules require a redis connection")
+		return
+	}
+
+	parts := stripDryRun(splitQuoted(m.Content))
+	if len(parts) < 2 || strings.ToLower(parts[1]) == "list" {
+		displaySchedules(m.ChannelID, guild)
+		return
+	}
+
+	switch strings.ToLower(parts[1]) {
+	case "add":
+		if dryRun {
+			discord.ChannelMessageSend(m.ChannelID, "`!schedule add` doesn't support "+DRY_RUN_FLAG)
+			return
+		}
+		addSchedule(m, guild, parts[2:])
+	case "remove":
+		if len(parts) < 3 {
+			discord.ChannelMessageSend(m.ChannelID, "Usage: `!schedule remove <id>`")
+			return
+		}
+
+		id := strings.ToUpper(parts[2])
+		found := false
+		for _, sched := range guildSchedules(guild.ID) {
+			found = found || sched.ID == id
+		}
+		if !found {
+			discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("There is no schedule %s", id))
+			return
+		}
+
+		if dryRun {
+			reportDryRun(m.ChannelID, []string{"remove schedule " + id})
+			return
+		}
+		rcli.HDel(SCHEDULES_KEY, id)
+		discord.ChannelMessageSend(m.ChannelID, ":ok_hand:")
+	default:
+		discord.ChannelMessageSend(m.ChannelID, "Usage: `!schedule [list|add|remove]`")
+	}
+}
+
+// Handles `!schedule add "<cron>" <collection> [sound] [channel]`
+func addSchedule(m *discordgo.MessageCreate, guild *discordgo.Guild, args []string) {
+	usage := "Usage: `!schedule add \"<minute> <hour> <day> <month> <weekday>\" <collection> [sound] [voice channel]` (times are UTC)"
+	if len(args) < 2 {
+		discord.ChannelMessageSend(m.ChannelID, usage)
+		return
+	}
+
+	cron, err := parseCron(args[0])
+	if err != nil {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Invalid schedule: %s\n%s", err, usage))
+		return
+	}
+
+	if cron.next(time.Now().UTC()).IsZero() {
+		discord.ChannelMessageSend(m.ChannelID, "That schedule never runs")
+		return
+	}
+
+	name := strings.ToLower(args[1])
+	var coll *sound.Collection
+	for _, c := range getCollections() {
+		if c.Prefix == name || scontains("!"+name, c.Commands...) {
+			coll = c
+			break
+		}
+	}
+	if coll == nil {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("There is no collection %s", name))
+		return
+	}
+
+	sched := &Schedule{
+		ID:         randomCode(5),
+		GuildID:    guild.ID,
+		Spec:       args[0],
+		Collection: coll.Prefix,
+		CreatedBy:  m.Author.ID,
+		Created:    time.Now(),
+		cron:       cron,
+	}
+
+	rest := args[2:]
+	if len(rest) > 0 && coll.Find(strings.ToLower(rest[0])) != nil {
+		sched.Sound = strings.ToLower(rest[0])
+		rest = rest[1:]
+	}
+
+	if len(rest) > 0 {
+		channel := findVoiceChannel(guild, strings.Join(rest, " "))
+		if channel == nil {
+			discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("There is no voice channel %s", strings.Join(rest, " ")))
+			return
+		}
+		sched.ChannelID = channel.ID
+	}
+
+	if len(guildSchedules(guild.ID)) >= MAX_GUILD_SCHEDULES {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("This server already has %d schedules, remove one first", MAX_GUILD_SCHEDULES))
+		return
+	}
+
+	if err := putSchedule(sched); err != nil {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"error": err,
+		}).Error("Failed to save schedule")
+		discord.ChannelMessageSend(m.ChannelID, "Failed to save the schedule, try again later")
+		return
+	}
+
+	discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf(":ok_hand: added schedule %s, playing next %s", sched.ID, cron.next(time.Now().UTC()).Format("Mon Jan 2 15:04 MST")))
+}
+
+func displaySchedules(cid string, guild *discordgo.Guild) {
+	schedules := guildSchedules(guild.ID)
+	if len(schedules) == 0 {
+		discord.ChannelMessageSend(cid, "This server has no schedules, an admin can add one with `!schedule add`")
+		return
+	}
+
+	lines := make([]string, 0, len(schedules))
+	for _, sched := range schedules {
+		what := sched.Collection
+		if sched.Sound != "" {
+			what += " " + sched.Sound
+		}
+
+		where := "the busiest voice channel"
+		if sched.ChannelID != "" {
+			where = "<#" + sched.ChannelID + ">"
+		}
+
+		lines = append(lines, fmt.Sprintf("**%s** `%s` %s in %s", sched.ID, sched.Spec, what, where))
+	}
+
+	discord.ChannelMessageSendEmbed(cid, &discordgo.MessageEmbed{
+		Title:       "Schedules",
+		Color:       0xE5343A,
+		Description: "Times are UTC\n" + strings.Join(lines, "\n"),
+	})
+}
+
+// A parsed cron expression, each field holding the values it matches
+type cronSpec struct {
+	minute, hour, dom, month, dow map[int]bool
+
+	// Standard cron runs when either day field matches if both are restricted
+	domAny, dowAny bool
+}
+
+var (
+	cronMonths = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronDays   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// Parses a five field cron expression, supporting lists, ranges, steps and
+// month and weekday names
+func parseCron(spec string) (*cronSpec, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+
+	cs := &cronSpec{
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}
+
+	var err error
+	if cs.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if cs.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if cs.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if cs.month, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, err
+	}
+	if cs.dow, err = parseCronField(fields[4], 0, 7, cronDays); err != nil {
+		return nil, err
+	}
+
+	// Both 0 and 7 are sunday
+	if cs.dow[7] {
+		cs.dow[0] = true
+	}
+	return cs, nil
+}
+
+// Parses a single cron field into the set of values it matches. Names are
+// numbered starting at min.
+func parseCronField(field string, min, max int, names []string) (map[int]bool, error) {
+	value := func(s string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(s, name) {
+				return i + min, nil
+			}
+		}
+
+		v, err := strconv.Atoi(s)
+		if err != nil || v < min || v > max {
+			return 0, fmt.Errorf("%q isn't between %d and %d", s, min, max)
+		}
+		return v, nil
+	}
+
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+
+		start, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+
+			var err error
+			if start, err = value(bounds[0]); err != nil {
+				return nil, err
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = value(bounds[1]); err != nil {
+					return nil, err
+				}
+			} else if step > 1 {
+				end = max
+			}
+
+			if end < start {
+				return nil, fmt.Errorf("invalid range %q", part)
+			}
+		}
+
+		for v := start; v <= end; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// Returns true if the expression runs in the minute t falls in
+func (cs *cronSpec) matches(t time.Time) bool {
+	if !cs.minute[t.Minute()] || !cs.hour[t.Hour()] || !cs.month[int(t.Month())] {
+		return false
+	}
+
+	dom := cs.dom[t.Day()]
+	dow := cs.dow[int(t.Weekday())]
+	switch {
+	case cs.domAny && cs.dowAny:
+		return true
+	case cs.domAny:
+		return dow
+	case cs.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// Returns the next minute after t the expression runs in, or the zero time if
+// it doesn't run within a year
+func (cs *cronSpec) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(1, 0, 0); t.Before(end); t = t.Add(time.Minute) {
+		if cs.matches(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
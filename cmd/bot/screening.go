@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Backend used to transcribe uploads before they're accepted, nil when screening is disabled
+	stt STTBackend
+
+	// Lowercase words and phrases that cause an upload to be held for review
+	screenWords []string
+)
+
+// STTBackend transcribes an uploaded audio file into text
+type STTBackend interface {
+	Transcribe(audio []byte) (string, error)
+}
+
+// Transcribes audio by running a local command, which gets the audio file on
+// stdin and should write the transcript to stdout
+type commandSTTBackend struct {
+	Command string
+}
+
+func (c *commandSTTBackend) Transcribe(audio []byte) (string, error) {
+	cmd := exec.Command("sh", "-c", c.Command)
+	cmd.Stdin = bytes.NewReader(audio)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// Transcribes audio by POSTing the audio file to a HTTP API, which should
+// respond with the transcript as plain text
+type httpSTTBackend struct {
+	URL string
+
+	client *http.Client
+}
+
+func (h *httpSTTBackend) Transcribe(audio []byte) (string, error) {
+	resp, err := h.client.Post(h.URL, "application/octet-stream", bytes.NewReader(audio))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("stt backend returned %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// Creates the STT backend for the given flag value. Either "exec:<command>"
+// or a http(s) URL
+func newSTTBackend(backend string) STTBackend {
+	if strings.HasPrefix(backend, "http://") || strings.HasPrefix(backend, "https://") {
+		return &httpSTTBackend{
+			URL:    backend,
+			client: &http.Client{Timeout: (60 * time.Second)},
+		}
+	}
+
+	if strings.HasPrefix(backend, "exec:") {
+		return &commandSTTBackend{Command: strings.TrimPrefix(backend, "exec:")}
+	}
+
+	return nil
+}
+
+// Loads the screened words from a file with one word or phrase per line,
+// blank lines and lines starting with # are skipped
+func loadScreenWords(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	words := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, normalizeTranscript(line))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	screenWords = words
+	return nil
+}
+
+// Lowercases text and collapses everything that isn't a letter or number into
+// single spaces, so words and phrases can be matched on word boundaries
+func normalizeTranscript(text string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}), " ")
+}
+
+// Returns the screened words found in a transcript
+func matchScreenWords(transcript string) []string {
+	padded := " " + normalizeTranscript(transcript) + " "
+
+	matches := make([]string, 0)
+	for _, word := range screenWords {
+		if strings.Contains(padded, " "+word+" ") {
+			matches = append(matches, word)
+		}
+	}
+	return matches
+}
+
+// Screens an uploaded audio file, returning the reason it should be held for
+// review or an empty string if it's fine. Uploads that can't be transcribed
+// are held as well.
+func screenUpload(gid string, audio []byte) string {
+	if stt == nil {
+		return ""
+	}
+
+	transcript, err := stt.Transcribe(audio)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": gid,
+			"error": err,
+		}).Warning("Failed to transcribe upload")
+		return "screening failed"
+	}
+
+	matches := matchScreenWords(transcript)
+	if len(matches) == 0 {
+		return ""
+	}
+	return "contains " + strings.Join(matches, ", ")
+}
+
+func uploadReviewComponents(gid, name string) []discordgo.MessageComponent {
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Approve",
+					Style:    discordgo.SuccessButton,
+					CustomID: componentID("upload", gid, name, "approve"),
+				},
+				discordgo.Button{
+					Label:    "Delete",
+					Style:    discordgo.DangerButton,
+					CustomID: componentID("upload", gid, name, "delete"),
+				},
+			},
+		},
+	}
+}
+
+// Returns true if the user can review held uploads for a guild. When the bot
+// has an owner only they can, otherwise the guild's admins review uploads.
+func canReviewUploads(guild *discordgo.Guild, uid, cid string) bool {
+	if OWNER != "" {
+		return uid == OWNER
+	}
+	return isGuildAdmin(guild, uid, cid)
+}
+
+// Sends a held upload to whoever reviews uploads for the guild
+func requestUploadReview(guild *discordgo.Guild, cs *CustomSound) {
+	description := fmt.Sprintf("<@%s> uploaded **%s** in **%s**\nHeld because it %s", cs.Uploader, cs.Name, guild.Name, cs.HeldReason)
+	components := uploadReviewComponents(guild.ID, cs.Name)
+
+	if OWNER == "" {
+		notifyModerators(guild, "Upload Review", description, components)
+		return
+	}
+
+	dm, err := discord.UserChannelCreate(OWNER)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to open owner DM for upload review")
+		return
+	}
+	sendModerationNotice(dm.ID, "Upload Review", description, components)
+}
+
+// Handles the review buttons on a held upload, args are the guild id, sound name and action
+func handleUploadReviewClick(s *discordgo.Session, i *discordgo.InteractionCreate, args []string) {
+	if len(args) < 3 || rcli == nil {
+		return
+	}
+
+	gid, name, action := args[0], args[1], args[2]
+
+	guild, _ := discord.State.Guild(gid)
+	if guild == nil {
+		respondEphemeral(s, i, "I'm no longer in that server")
+		return
+	}
+
+	user := interactionUser(i)
+	if !canReviewUploads(guild, user.ID, i.ChannelID) {
+		respondEphemeral(s, i, "You can't review uploads for that server")
+		return
+	}
+
+	cs := getCustomSound(gid, name)
+	if cs == nil || !cs.Held {
+		respondEphemeral(s, i, "That upload was already reviewed")
+		return
+	}
+
+	switch action {
+	case "approve":
+		cs.Held = false
+		cs.HeldReason = ""
+		putCustomSound(gid, cs)
+	case "delete":
+		deleteCustomSound(gid, name)
+	default:
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"guild":    gid,
+		"sound":    name,
+		"action":   action,
+		"reviewer": user.ID,
+	}).Info("Reviewed held upload")
+
+	resolveModerationNotice(s, i, fmt.Sprintf("**%s** in **%s**: %s by <@%s>", name, guild.Name, action, user.ID))
+}
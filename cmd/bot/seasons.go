@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/sound"
+	log "github.com/sirupsen/logrus"
+)
+
+// Season is a stretch of the year some collections are played in, loaded from
+// the -seasons file. Collections in a date range season can only be played
+// while it's on. Anniversary seasons differ from guild to guild, so they only
+// make their collections more likely.
+type Season struct {
+	Name string `json:"name"`
+
+	// Prefixes of the collections the season is for
+	Collections []string `json:"collections"`
+
+	// Days (MM-DD, in UTC) the season runs from and to, both included. A
+	// season can run over new year, eg. 12-20 to 01-06.
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+
+	// If true the season runs for Days days from the day each guild was created
+	Anniversary bool `json:"anniversary,omitempty"`
+	Days        int  `json:"days,omitempty"`
+
+	// How many times more likely !random picks the collections while the
+	// season is on, 1 if unset
+	Boost float64 `json:"boost,omitempty"`
+
+	start, end time.Time
+}
+
+var (
+	// Seasons loaded from the -seasons file
+	seasons     []*Season
+	seasonsLock sync.RWMutex
+
+	// File seasons are loaded (and reloaded along with the sounds) from
+	SEASONS_FILE string
+)
+
+// Loads seasons from a JSON file holding a list of them
+func loadSeasons(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	loaded := make([]*Season, 0)
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return err
+	}
+
+	for _, season := range loaded {
+		if season.Name == "" || len(season.Collections) == 0 {
+			return fmt.Errorf("every season needs a name and collections")
+		}
+
+		if season.Anniversary {
+			if season.Days < 1 {
+				season.Days = 1
+			}
+		} else {
+			if season.start, err = time.Parse("01-02", season.Start); err != nil {
+				return fmt.Errorf("season %s: start must be MM-DD", season.Name)
+			}
+			if season.end, err = time.Parse("01-02", season.End); err != nil {
+				return fmt.Errorf("season %s: end must be MM-DD", season.Name)
+			}
+		}
+
+		if season.Boost <= 0 {
+			season.Boost = 1
+		}
+	}
+
+	seasonsLock.Lock()
+	seasons = loaded
+	seasonsLock.Unlock()
+
+	log.WithFields(log.Fields{
+		"path":    path,
+		"seasons": len(loaded),
+	}).Info("Loaded seasons")
+	return nil
+}
+
+func getSeasons() []*Season {
+	seasonsLock.RLock()
+	defer seasonsLock.RUnlock()
+	return seasons
+}
+
+// Returns when the season last started and when it ends if it's on at now,
+// for anniversary seasons in the guild gid
+func (season *Season) activeAt(gid string, now time.Time) (bool, time.Time, time.Time) {
+	now = now.UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	if season.Anniversary {
+		created, err := discordgo.SnowflakeTimestamp(gid)
+		if gid == "" || err != nil {
+			return false, time.Time{}, time.Time{}
+		}
+
+		// Checking last year as well catches anniversaries that run over new year
+		for _, year := range []int{now.Year(), now.Year() - 1} {
+			start := time.Date(year, created.Month(), created.Day(), 0, 0, 0, 0, time.UTC)
+			end := start.AddDate(0, 0, season.Days)
+			if !today.Before(start) && today.Before(end) {
+				return true, start, end
+			}
+		}
+		return false, time.Time{}, time.Time{}
+	}
+
+	start := time.Date(now.Year(), season.start.Month(), season.start.Day(), 0, 0, 0, 0, time.UTC)
+	end := time.Date(now.Year(), season.end.Month(), season.end.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1)
+	if !end.After(start) {
+		// Over new year, so it's either the end of one that started last year or
+		// the start of one that ends next year
+		if today.Before(end) {
+			start = start.AddDate(-1, 0, 0)
+		} else {
+			end = end.AddDate(1, 0, 0)
+		}
+	}
+	return !today.Before(start) && today.Before(end), start, end
+}
+
+// Returns true if the collection is out of season everywhere. Collections in
+// date range seasons are only played while one of their seasons is on.
+func outOfSeason(prefix string, now time.Time) bool {
+	seasonal := false
+	for _, season := range getSeasons() {
+		if season.Anniversary || !scontains(prefix, season.Collections...) {
+			continue
+		}
+
+		seasonal = true
+		if active, _, _ := season.activeAt("", now); active {
+			return false
+		}
+	}
+	return seasonal
+}
+
+// Returns how much more likely the collection is to be picked in the guild
+// right now, the boosts of every season on for it multiplied together
+func seasonBoost(gid string, coll *sound.Collection) float64 {
+	boost := 1.0
+	now := time.Now()
+	for _, season := range getSeasons() {
+		if !scontains(coll.Prefix, season.Collections...) {
+			continue
+		}
+
+		if active, _, _ := season.activeAt(gid, now); active {
+			boost *= season.Boost
+		}
+	}
+	return boost
+}
+
+// Handles !events, listing the seasons that are on in the guild and the next
+// ones coming up
+func handleEventsCommand(cid string, guild *discordgo.Guild) {
+	all := getSeasons()
+	if len(all) == 0 {
+		discord.ChannelMessageSend(cid, "There are no seasonal events")
+		return
+	}
+
+	now := time.Now()
+	active := make([]string, 0)
+	upcoming := make([]string, 0)
+	for _, season := range all {
+		on, _, end := season.activeAt(guild.ID, now)
+		if on {
+			active = append(active, fmt.Sprintf("**%s** - %s until %s%s", season.Name, strings.Join(season.Collections, ", "), end.AddDate(0, 0, -1).Format("Jan 2"), describeBoost(season)))
+			continue
+		}
+
+		// The next start is found by looking ahead a day at a time, seasons only
+		// change at midnight
+		for days := 1; days <= 366; days++ {
+			if on, start, _ := season.activeAt(guild.ID, now.AddDate(0, 0, days)); on {
+				upcoming = append(upcoming, fmt.Sprintf("**%s** - %s from %s%s", season.Name, strings.Join(season.Collections, ", "), start.Format("Jan 2"), describeBoost(season)))
+				break
+			}
+		}
+	}
+	sort.Strings(active)
+	sort.Strings(upcoming)
+
+	em := &discordgo.MessageEmbed{
+		Title: "Seasonal events",
+		Color: 0xE5343A,
+	}
+	if len(active) > 0 {
+		em.Fields = append(em.Fields, &discordgo.MessageEmbedField{Name: "On now", Value: strings.Join(active, "\n")})
+	}
+	if len(upcoming) > 0 {
+		em.Fields = append(em.Fields, &discordgo.MessageEmbedField{Name: "Coming up", Value: strings.Join(upcoming, "\n")})
+	}
+	discord.ChannelMessageSendEmbed(cid, em)
+}
+
+func describeBoost(season *Season) string {
+	if season.Boost == 1 {
+		return ""
+	}
+	return fmt.Sprintf(" (%gx as likely in !random)", season.Boost)
+}
@@ -0,0 +1,804 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/redis"
+	"github.com/noisemaster/airhornbot/pkg/sound"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Cache of loaded guild settings, keyed by guild id
+	settingsCache     map[string]*GuildSettings = make(map[string]*GuildSettings)
+	settingsCacheLock sync.RWMutex
+
+	// Held by updates of a guild's settings from reading them until the
+	// result is saved, so concurrent updates don't undo each other
+	settingsUpdateLocks     map[string]*sync.Mutex = make(map[string]*sync.Mutex)
+	settingsUpdateLocksLock sync.Mutex
+
+	// Matches a channel mention (<#id>)
+	channelMention = regexp.MustCompile(`^<#(\d+)>$`)
+)
+
+// GuildSettings is the per-guild configuration set by guild admins. Settings
+// are never modified in place, updates replace the cached copy.
+type GuildSettings struct {
+	// Text channels commands are accepted in, empty allows every channel
+	AllowedChannels []string `json:"allowed_channels,omitempty"`
+
+	// Text channels commands are ignored in
+	DeniedChannels []string `json:"denied_channels,omitempty"`
+
+	// Collection prefixes that can't be played in this guild
+	DisabledCollections []string `json:"disabled_collections,omitempty"`
+
+	// Seconds between plays of a collection, keyed by collection prefix
+	CollectionCooldowns map[string]int `json:"collection_cooldowns,omitempty"`
+
+	// Sounds that can be played by another name, keyed by `<collection>:<alias>`
+	Aliases map[string]string `json:"aliases,omitempty"`
+
+	// Sounds saved with !combo save to be played back to back, keyed by combo
+	// name. Each link is `<collection>` or `<collection>:<sound>` like in !chain.
+	Combos map[string][]string `json:"combos,omitempty"`
+
+	// Disabled collections enabled for a while with !rent, keyed by collection prefix
+	Rentals map[string]*Rental `json:"rentals,omitempty"`
+
+	// If true, !listen can be used to horn back at claps and yells heard in voice
+	VoiceTrigger bool `json:"voice_trigger,omitempty"`
+
+	// Local times of day (HH:MM) between which no sounds are played, quiet
+	// hours are off if empty
+	QuietStart string `json:"quiet_start,omitempty"`
+	QuietEnd   string `json:"quiet_end,omitempty"`
+
+	// IANA time zone quiet hours are in
+	QuietTimezone string `json:"quiet_timezone,omitempty"`
+
+	// If true, plays during quiet hours are held until they end instead of rejected
+	QuietQueue bool `json:"quiet_queue,omitempty"`
+
+	// If true, plays take turns between voice channels instead of all going in
+	// the order they were requested
+	FairChannels bool `json:"fair_channels,omitempty"`
+
+	// If true, recently played sounds are picked less often by random plays
+	DynamicWeights bool `json:"dynamic_weights,omitempty"`
+
+	// How random plays pick a collection's sound, SELECTION_RANDOM when empty
+	SelectionMode string `json:"selection_mode,omitempty"`
+
+	// Identical commands within SpamWindow seconds that get a user muted for
+	// SpamMute seconds, doubling every time. 0 turns spam detection off.
+	SpamRepeats int `json:"spam_repeats"`
+	SpamWindow  int `json:"spam_window"`
+	SpamMute    int `json:"spam_mute"`
+
+	// Largest bomb that can be requested
+	MaxBombSize int `json:"max_bomb_size"`
+
+	// Most sounds a single !chain can play
+	MaxChainLength int `json:"max_chain_length"`
+
+	// Volume (in percent) used when encoding sounds on the fly
+	Volume int `json:"volume"`
+
+	// Bitrate (in kbps) used when encoding sounds on the fly, 0 uses BITRATE
+	Bitrate int `json:"bitrate,omitempty"`
+
+	// Prefix used for commands instead of !
+	Prefix string `json:"prefix"`
+
+	// Language bot responses are sent in
+	Language string `json:"language"`
+
+	// If true, sounds can be played from links with !play
+	AllowURLPlay bool `json:"allow_url_play"`
+
+	// If true, admins can publish custom sounds to the public gallery
+	GalleryOptIn bool `json:"gallery_opt_in"`
+
+	// If true, sounds with a celebration post it in the channel they were requested from
+	Celebrations bool `json:"celebrations"`
+
+	// Minutes users AutoMod flags for spam can't use the bot for, 0 disables
+	AutoModCooldown int `json:"automod_cooldown,omitempty"`
+
+	// If true, no sounds are played in the voice channel of a live scheduled event
+	EventQuiet bool `json:"event_quiet"`
+
+	// Channel reports and other moderation notices are sent to, if empty they
+	// are sent to the guild owner
+	ModChannel string `json:"mod_channel,omitempty"`
+
+	// Channel every play is logged to, empty disables the audit log
+	AuditChannel string `json:"audit_channel,omitempty"`
+
+	// Roles whose plays jump ahead of everyone else's in the queue
+	PriorityRoles []string `json:"priority_roles,omitempty"`
+
+	// Roles allowed to use a collection (or the bomb), keyed by collection prefix.
+	// Collections without an entry can be used by everyone.
+	RolePerms map[string][]string `json:"role_perms,omitempty"`
+}
+
+// Returns the settings a guild starts out with
+func defaultGuildSettings() *GuildSettings {
+	return &GuildSettings{
+		MaxBombSize:    100,
+		MaxChainLength: 5,
+		Volume:         100,
+		Prefix:         "!",
+		Language:       "en",
+		EventQuiet:     true,
+		SpamRepeats:    5,
+		SpamWindow:     3,
+		SpamMute:       30,
+	}
+}
+
+func (gs *GuildSettings) clone() *GuildSettings {
+	c := *gs
+	c.AllowedChannels = append([]string(nil), gs.AllowedChannels...)
+	c.DeniedChannels = append([]string(nil), gs.DeniedChannels...)
+	c.DisabledCollections = append([]string(nil), gs.DisabledCollections...)
+	c.PriorityRoles = append([]string(nil), gs.PriorityRoles...)
+
+	if gs.CollectionCooldowns != nil {
+		c.CollectionCooldowns = make(map[string]int, len(gs.CollectionCooldowns))
+		for prefix, seconds := range gs.CollectionCooldowns {
+			c.CollectionCooldowns[prefix] = seconds
+		}
+	}
+
+	if gs.Aliases != nil {
+		c.Aliases = make(map[string]string, len(gs.Aliases))
+		for key, target := range gs.Aliases {
+			c.Aliases[key] = target
+		}
+	}
+
+	if gs.Combos != nil {
+		c.Combos = make(map[string][]string, len(gs.Combos))
+		for name, links := range gs.Combos {
+			c.Combos[name] = append([]string(nil), links...)
+		}
+	}
+
+	if gs.Rentals != nil {
+		c.Rentals = make(map[string]*Rental, len(gs.Rentals))
+		for prefix, rental := range gs.Rentals {
+			c.Rentals[prefix] = rental
+		}
+	}
+
+	if gs.RolePerms != nil {
+		c.RolePerms = make(map[string][]string, len(gs.RolePerms))
+		for key, roles := range gs.RolePerms {
+			c.RolePerms[key] = append([]string(nil), roles...)
+		}
+	}
+	return &c
+}
+
+// Returns true if commands are accepted in the given channel
+func (gs *GuildSettings) ChannelAllowed(cid string) bool {
+	if scontains(cid, gs.DeniedChannels...) {
+		return false
+	}
+	return len(gs.AllowedChannels) == 0 || scontains(cid, gs.AllowedChannels...)
+}
+
+// Returns true if the collection can be played in this guild, either because
+// it isn't disabled or because it's currently rented. Collections that are
+// out of season can't be played anywhere.
+func (gs *GuildSettings) CollectionEnabled(coll *sound.Collection) bool {
+	if outOfSeason(coll.Prefix, time.Now()) {
+		return false
+	}
+
+	if rental, rented := gs.Rentals[coll.Prefix]; rented && time.Now().Before(rental.Until) {
+		return true
+	}
+	return !scontains(coll.Prefix, gs.DisabledCollections...)
+}
+
+// Returns how long the guild has to wait between plays of the collection
+func (gs *GuildSettings) CollectionCooldown(coll *sound.Collection) time.Duration {
+	return time.Duration(gs.CollectionCooldowns[coll.Prefix]) * time.Second
+}
+
+func guildSettingsKey(gid string) string {
+	return fmt.Sprintf("airhorn:guild:%s:settings", gid)
+}
+
+// Returns the settings for a guild, loading them from redis the first time
+// they are requested
+func getGuildSettings(gid string) *GuildSettings {
+	settingsCacheLock.RLock()
+	gs, exists := settingsCache[gid]
+	settingsCacheLock.RUnlock()
+
+	if exists {
+		return gs
+	}
+
+	gs = defaultGuildSettings()
+	if rcli != nil {
+		raw, err := rcli.Get(guildSettingsKey(gid)).Result()
+		if err == nil {
+			if err := json.Unmarshal([]byte(raw), gs); err != nil {
+				log.WithFields(log.Fields{
+					"guild": gid,
+					"error": err,
+				}).Warning("Failed to decode guild settings")
+			}
+		} else if err != redis.Nil {
+			// Don't cache the defaults if redis is having problems, try again next time
+			return gs
+		}
+	}
+
+	// An update may have cached newer settings while these were loading
+	settingsCacheLock.Lock()
+	if cached, exists := settingsCache[gid]; exists {
+		gs = cached
+	} else {
+		settingsCache[gid] = gs
+	}
+	settingsCacheLock.Unlock()
+	return gs
+}
+
+func settingsUpdateLock(gid string) *sync.Mutex {
+	settingsUpdateLocksLock.Lock()
+	defer settingsUpdateLocksLock.Unlock()
+
+	lock, exists := settingsUpdateLocks[gid]
+	if !exists {
+		lock = &sync.Mutex{}
+		settingsUpdateLocks[gid] = lock
+	}
+	return lock
+}
+
+// Applies a change to a guild's settings and persists the result
+func updateGuildSettings(gid string, update func(gs *GuildSettings)) (*GuildSettings, error) {
+	lock := settingsUpdateLock(gid)
+	lock.Lock()
+	defer lock.Unlock()
+
+	gs := getGuildSettings(gid).clone()
+	update(gs)
+
+	if rcli != nil {
+		data, err := json.Marshal(gs)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := rcli.Set(guildSettingsKey(gid), string(data), 0).Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	settingsCacheLock.Lock()
+	settingsCache[gid] = gs
+	settingsCacheLock.Unlock()
+	return gs, nil
+}
+
+// Returns what applying update to a guild's settings would change, without
+// saving anything
+func settingsChanges(gid string, update func(gs *GuildSettings)) ([]string, error) {
+	current := getGuildSettings(gid)
+	updated := current.clone()
+	update(updated)
+
+	before, err := settingsFields(current)
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := settingsFields(updated)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0)
+	for key := range before {
+		keys = append(keys, key)
+	}
+	for key := range after {
+		if _, exists := before[key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	changes := make([]string, 0)
+	for _, key := range keys {
+		if before[key] != after[key] {
+			changes = append(changes, fmt.Sprintf("change `%s` in %s from `%s` to `%s`", key, guildSettingsKey(gid), orNone(before[key]), orNone(after[key])))
+		}
+	}
+	return changes, nil
+}
+
+// Returns the stored JSON of every settings field, keyed by field name
+func settingsFields(gs *GuildSettings) (map[string]string, error) {
+	data, err := json.Marshal(gs)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]string, len(raw))
+	for key, value := range raw {
+		fields[key] = string(value)
+	}
+	return fields, nil
+}
+
+func orNone(val string) string {
+	if val == "" {
+		return "none"
+	}
+	return val
+}
+
+// Parses a comma or space separated list of channel mentions into channel ids
+func parseChannelMentions(values []string) ([]string, error) {
+	ids := make([]string, 0)
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item == "" {
+				continue
+			}
+
+			match := channelMention.FindStringSubmatch(item)
+			if match == nil {
+				return nil, fmt.Errorf("%s is not a channel", item)
+			}
+			ids = append(ids, match[1])
+		}
+	}
+	return ids, nil
+}
+
+// Parses a comma or space separated list of role mentions into role ids
+func parseRoleMentions(values []string) ([]string, error) {
+	ids := make([]string, 0)
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item == "" {
+				continue
+			}
+
+			match := roleMention.FindStringSubmatch(item)
+			if match == nil {
+				return nil, fmt.Errorf("%s is not a role", item)
+			}
+			ids = append(ids, match[1])
+		}
+	}
+	return ids, nil
+}
+
+// Parses a comma or space separated list of collection prefixes
+func parseCollections(values []string) ([]string, error) {
+	prefixes := make([]string, 0)
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item == "" {
+				continue
+			}
+
+			if findCollection(item) == nil {
+				return nil, fmt.Errorf("there is no collection called %s", item)
+			}
+			prefixes = append(prefixes, item)
+		}
+	}
+	return prefixes, nil
+}
+
+func parseToggle(value string) bool {
+	return value == "on" || value == "true" || value == "yes"
+}
+
+// Applies `!settings set <key> <values...>` to the given settings
+func setGuildSetting(guild *discordgo.Guild, gs *GuildSettings, key string, values []string) error {
+	if len(values) == 0 && key != "channels" && key != "denied" && key != "disabled" && key != "priority" {
+		return fmt.Errorf("missing a value for %s", key)
+	}
+
+	switch key {
+	case "channels":
+		channels, err := parseChannelMentions(values)
+		if err != nil {
+			return err
+		}
+		gs.AllowedChannels = channels
+	case "denied":
+		channels, err := parseChannelMentions(values)
+		if err != nil {
+			return err
+		}
+		gs.DeniedChannels = channels
+	case "priority":
+		roles, err := parseRoleMentions(values)
+		if err != nil {
+			return err
+		}
+		gs.PriorityRoles = roles
+	case "disabled":
+		prefixes, err := parseCollections(values)
+		if err != nil {
+			return err
+		}
+		gs.DisabledCollections = prefixes
+	case "maxbomb":
+		size, err := strconv.Atoi(values[0])
+		if err != nil || size < 0 || size > 100 {
+			return fmt.Errorf("maxbomb must be a number between 0 and 100")
+		}
+		gs.MaxBombSize = size
+	case "maxchain":
+		length, err := strconv.Atoi(values[0])
+		if err != nil || length < 1 || length > MAX_CHAIN_LENGTH {
+			return fmt.Errorf("maxchain must be a number between 1 and %d", MAX_CHAIN_LENGTH)
+		}
+		gs.MaxChainLength = length
+	case "volume":
+		volume, err := strconv.Atoi(strings.TrimSuffix(values[0], "%"))
+		if err != nil || volume < 0 || volume > 200 {
+			return fmt.Errorf("volume must be a percentage between 0 and 200")
+		}
+		gs.Volume = volume
+	case "bitrate":
+		if values[0] == "default" {
+			gs.Bitrate = 0
+			break
+		}
+
+		max := maxGuildBitrate(guild)
+		bitrate, err := strconv.Atoi(strings.TrimSuffix(values[0], "kbps"))
+		if err != nil || bitrate < 8 || bitrate > max {
+			return fmt.Errorf("bitrate must be between 8 and %dkbps on this server", max)
+		}
+		gs.Bitrate = bitrate
+	case "prefix":
+		if len(values[0]) > 3 {
+			return fmt.Errorf("prefix can be at most 3 characters")
+		}
+		gs.Prefix = values[0]
+	case "language":
+		if locales[values[0]] == nil {
+			return fmt.Errorf("there is no %s translation, pick one of %s", values[0], strings.Join(availableLanguages(), ", "))
+		}
+		gs.Language = values[0]
+	case "urlplay":
+		gs.AllowURLPlay = parseToggle(values[0])
+	case "gallery":
+		gs.GalleryOptIn = parseToggle(values[0])
+	case "automod":
+		if values[0] == "off" {
+			gs.AutoModCooldown = 0
+			break
+		}
+
+		minutes, err := strconv.Atoi(values[0])
+		if err != nil || minutes < 0 || minutes > 24*60 {
+			return fmt.Errorf("automod must be a number of minutes up to a day, or off")
+		}
+		gs.AutoModCooldown = minutes
+	case "spam":
+		if values[0] == "off" {
+			gs.SpamRepeats = 0
+			break
+		}
+
+		if len(values) < 2 {
+			return fmt.Errorf("spam takes the number of repeats, the seconds they're sent within and optionally the seconds to mute for, or off")
+		}
+
+		repeats, err := strconv.Atoi(values[0])
+		if err != nil || repeats < 2 || repeats > 50 {
+			return fmt.Errorf("spam repeats must be a number from 2 to 50")
+		}
+
+		window, err := strconv.Atoi(values[1])
+		if err != nil || window < 1 || window > 60 {
+			return fmt.Errorf("spam window must be a number of seconds up to a minute")
+		}
+
+		mute := gs.SpamMute
+		if len(values) > 2 {
+			mute, err = strconv.Atoi(values[2])
+			if err != nil || mute < 1 || mute > int(SPAM_MUTE_MAX/time.Second) {
+				return fmt.Errorf("spam mute must be a number of seconds up to an hour")
+			}
+		}
+
+		gs.SpamRepeats = repeats
+		gs.SpamWindow = window
+		gs.SpamMute = mute
+	case "celebrations":
+		gs.Celebrations = parseToggle(values[0])
+	case "eventquiet":
+		gs.EventQuiet = parseToggle(values[0])
+	case "voicetrigger":
+		gs.VoiceTrigger = parseToggle(values[0])
+	case "fairchannels":
+		gs.FairChannels = parseToggle(values[0])
+	case "selection":
+		if values[0] != SELECTION_RANDOM && values[0] != SELECTION_SHUFFLE {
+			return fmt.Errorf("selection must be %s or %s", SELECTION_RANDOM, SELECTION_SHUFFLE)
+		}
+		gs.SelectionMode = values[0]
+		if values[0] == SELECTION_RANDOM {
+			gs.SelectionMode = ""
+		}
+	case "auditlog":
+		if values[0] == "off" || values[0] == "none" {
+			gs.AuditChannel = ""
+			break
+		}
+
+		channels, err := parseChannelMentions(values[:1])
+		if err != nil {
+			return err
+		} else if len(channels) != 1 {
+			return fmt.Errorf("auditlog must be a single channel")
+		}
+		gs.AuditChannel = channels[0]
+	case "modchannel":
+		if values[0] == "none" {
+			gs.ModChannel = ""
+			break
+		}
+
+		channels, err := parseChannelMentions(values[:1])
+		if err != nil {
+			return err
+		} else if len(channels) != 1 {
+			return fmt.Errorf("modchannel must be a single channel")
+		}
+		gs.ModChannel = channels[0]
+	default:
+		return fmt.Errorf("unknown setting %s", key)
+	}
+	return nil
+}
+
+// Formats a list of channel ids as mentions, or returns fallback if it's empty
+func channelMentions(ids []string, fallback string) string {
+	if len(ids) == 0 {
+		return fallback
+	}
+
+	mentions := make([]string, len(ids))
+	for i, id := range ids {
+		mentions[i] = "<#" + id + ">"
+	}
+	return strings.Join(mentions, ", ")
+}
+
+// Returns list without any occurrences of s
+func sremove(s string, list []string) []string {
+	result := make([]string, 0, len(list))
+	for _, item := range list {
+		if item != s {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func displayGuildSettings(cid string, gs *GuildSettings) {
+	channels := channelMentions(gs.AllowedChannels, "all")
+	denied := channelMentions(gs.DeniedChannels, "none")
+
+	disabled := "none"
+	if len(gs.DisabledCollections) > 0 {
+		prefixes := make([]string, len(gs.DisabledCollections))
+		for i, prefix := range gs.DisabledCollections {
+			prefixes[i] = prefix
+			if rental, rented := gs.Rentals[prefix]; rented && time.Now().Before(rental.Until) {
+				prefixes[i] += " (rented until " + rental.Until.UTC().Format("15:04 MST") + ")"
+			}
+		}
+		disabled = strings.Join(prefixes, ", ")
+	}
+
+	bitrate := fmt.Sprintf("default (%dkbps)", BITRATE)
+	if gs.Bitrate != 0 {
+		bitrate = fmt.Sprintf("%dkbps", gs.Bitrate)
+	}
+
+	priority := "boosters"
+	if len(gs.PriorityRoles) > 0 {
+		mentions := make([]string, len(gs.PriorityRoles))
+		for i, id := range gs.PriorityRoles {
+			mentions[i] = "<@&" + id + ">"
+		}
+		priority = "boosters, " + strings.Join(mentions, ", ")
+	}
+
+	modChannel := "server owner"
+	if gs.ModChannel != "" {
+		modChannel = "<#" + gs.ModChannel + ">"
+	}
+
+	autoMod := "off"
+	if gs.AutoModCooldown > 0 {
+		autoMod = fmt.Sprintf("%d minute cooldown", gs.AutoModCooldown)
+	}
+
+	cooldowns := "none"
+	if len(gs.CollectionCooldowns) > 0 {
+		items := make([]string, 0, len(gs.CollectionCooldowns))
+		for prefix, seconds := range gs.CollectionCooldowns {
+			items = append(items, fmt.Sprintf("%s %s", prefix, time.Duration(seconds)*time.Second))
+		}
+		sort.Strings(items)
+		cooldowns = strings.Join(items, ", ")
+	}
+
+	spam := "off"
+	if gs.SpamRepeats > 0 {
+		spam = fmt.Sprintf("%d repeats in %ds mutes for %ds", gs.SpamRepeats, gs.SpamWindow, gs.SpamMute)
+	}
+
+	auditLog := "off"
+	if gs.AuditChannel != "" {
+		auditLog = "<#" + gs.AuditChannel + ">"
+	}
+
+	discord.ChannelMessageSendEmbed(cid, &discordgo.MessageEmbed{
+		Title: "Airhorn Settings",
+		Color: 0xE5343A,
+		Description: fmt.Sprintf(
+			"**channels** - %s\n**denied** - %s\n**disabled** - %s\n**maxbomb** - %d\n**maxchain** - %d\n**volume** - %d%%\n**bitrate** - %s\n**prefix** - %s\n**language** - %s\n**urlplay** - %v\n**gallery** - %v\n**celebrations** - %v\n**eventquiet** - %v\n**weights** - %v\n**selection** - %s\n**voicetrigger** - %v\n**fairchannels** - %v\n**quiethours** - %s\n**spam** - %s\n**automod** - %s\n**cooldowns** - %s\n**modchannel** - %s\n**auditlog** - %s\n**priority** - %s\n"+
+				"Change a setting with **!settings set {setting} {value}** or reset everything with **!settings reset**",
+			channels, denied, disabled, gs.MaxBombSize, gs.MaxChainLength, gs.Volume, bitrate, gs.Prefix, gs.Language, gs.AllowURLPlay, gs.GalleryOptIn, gs.Celebrations, gs.EventQuiet, gs.DynamicWeights, selectionMode(gs), gs.VoiceTrigger, gs.FairChannels, describeQuietHours(gs), spam, autoMod, cooldowns, modChannel, auditLog, priority),
+	})
+}
+
+// Handles the !settings admin command group
+func handleSettingsCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, parts []string, dryRun bool) {
+	if len(parts) < 2 || parts[1] == "show" {
+		displayGuildSettings(m.ChannelID, getGuildSettings(guild.ID))
+		return
+	}
+
+	var (
+		update func(gs *GuildSettings)
+		setErr error
+	)
+	switch parts[1] {
+	case "set":
+		if len(parts) < 3 {
+			discord.ChannelMessageSend(m.ChannelID, "Usage: `!settings set <setting> <value>`")
+			return
+		}
+
+		update = func(gs *GuildSettings) {
+			setErr = setGuildSetting(guild, gs, parts[2], parts[3:])
+		}
+	case "reset":
+		update = func(gs *GuildSettings) {
+			*gs = *defaultGuildSettings()
+		}
+	default:
+		discord.ChannelMessageSend(m.ChannelID, "Usage: `!settings [show|set|reset]`")
+		return
+	}
+
+	var err error
+	if dryRun {
+		var changes []string
+		changes, err = settingsChanges(guild.ID, update)
+		if setErr == nil && err == nil {
+			reportDryRun(m.ChannelID, changes)
+			return
+		}
+	} else {
+		_, err = updateGuildSettings(guild.ID, update)
+	}
+
+	if setErr != nil {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Can't change that: %s", setErr))
+		return
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"error": err,
+		}).Error("Failed to save guild settings")
+		return
+	}
+
+	discord.ChannelMessageSend(m.ChannelID, ":ok_hand:")
+}
+
+// Handles `!airhornchannel allow|deny|remove #channel...`, `!airhornchannel clear`
+// and `!airhornchannel list`
+func handleAirhornChannelCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, parts []string, dryRun bool) {
+	if len(parts) < 2 || parts[1] == "list" {
+		gs := getGuildSettings(guild.ID)
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("**Allowed** - %s\n**Denied** - %s",
+			channelMentions(gs.AllowedChannels, "all"), channelMentions(gs.DeniedChannels, "none")))
+		return
+	}
+
+	var channels []string
+	switch parts[1] {
+	case "allow", "deny", "remove":
+		var err error
+		channels, err = parseChannelMentions(parts[2:])
+		if err != nil || len(channels) == 0 {
+			discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Usage: `!airhornchannel %s #channel`", parts[1]))
+			return
+		}
+	case "clear":
+	default:
+		discord.ChannelMessageSend(m.ChannelID, "Usage: `!airhornchannel [list|allow|deny|remove|clear] #channel`")
+		return
+	}
+
+	update := func(gs *GuildSettings) {
+		if parts[1] == "clear" {
+			gs.AllowedChannels = nil
+			gs.DeniedChannels = nil
+			return
+		}
+
+		// A channel is only ever in one of the lists
+		for _, cid := range channels {
+			gs.AllowedChannels = sremove(cid, gs.AllowedChannels)
+			gs.DeniedChannels = sremove(cid, gs.DeniedChannels)
+
+			if parts[1] == "allow" {
+				gs.AllowedChannels = append(gs.AllowedChannels, cid)
+			} else if parts[1] == "deny" {
+				gs.DeniedChannels = append(gs.DeniedChannels, cid)
+			}
+		}
+	}
+
+	if dryRun {
+		if changes, err := settingsChanges(guild.ID, update); err == nil {
+			reportDryRun(m.ChannelID, changes)
+		}
+		return
+	}
+
+	_, err := updateGuildSettings(guild.ID, update)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"error": err,
+		}).Error("Failed to save guild settings")
+		return
+	}
+
+	discord.ChannelMessageSend(m.ChannelID, ":ok_hand:")
+}
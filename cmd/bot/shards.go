@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dustin/go-humanize"
+	"github.com/noisemaster/airhornbot/pkg/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How often each shard publishes its stats to redis
+	SHARD_STATS_INTERVAL = time.Second * 30
+
+	// Shards that haven't published stats within this long are considered down
+	SHARD_STATS_EXPIRY = SHARD_STATS_INTERVAL * 3
+
+	// How long the manager waits before restarting a shard process that exited
+	SHARD_RESTART_DELAY = time.Second * 5
+)
+
+// ShardStats is the snapshot each shard process publishes for the manager and
+// the owner status commands
+type ShardStats struct {
+	Shard      int       `json:"shard"`
+	ShardCount int       `json:"shard_count"`
+	Guilds     int       `json:"guilds"`
+	Users      int       `json:"users"`
+	Voice      int       `json:"voice"`
+	Memory     uint64    `json:"memory"`
+	Updated    time.Time `json:"updated"`
+
+	// Host and pid of the process running the shard
+	Instance string `json:"instance"`
+
+	// Gateway heartbeat round trip
+	Latency time.Duration `json:"latency"`
+
+	// When the shard process started
+	Started time.Time `json:"started"`
+}
+
+var (
+	// When this process started, published with the shard stats
+	startTime = time.Now()
+
+	// Identifies this process in the shard stats
+	instanceName = processInstanceName()
+)
+
+func processInstanceName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// Publishes this shard's stats to redis every SHARD_STATS_INTERVAL
+func publishShardStats() {
+	if rcli == nil {
+		return
+	}
+
+	for {
+		mem := runtime.MemStats{}
+		runtime.ReadMemStats(&mem)
+
+		ss := ShardStats{
+			Shard:      discord.ShardID,
+			ShardCount: discord.ShardCount,
+			Memory:     mem.Alloc,
+			Updated:    time.Now(),
+			Instance:   instanceName,
+			Latency:    discord.HeartbeatLatency(),
+			Started:    startTime,
+		}
+
+		for _, guild := range discord.State.Ready.Guilds {
+			ss.Guilds++
+			ss.Users += len(guild.Members)
+		}
+
+		discord.RLock()
+		ss.Voice = len(discord.VoiceConnections)
+		discord.RUnlock()
+
+		data, err := json.Marshal(ss)
+		if err == nil {
+			err = rcli.HSet("airhorn:shards", strconv.Itoa(ss.Shard), string(data)).Err()
+		}
+
+		if err != nil {
+			log.WithFields(log.Fields{
+				"shard": ss.Shard,
+				"error": err,
+			}).Warning("Failed to publish shard stats")
+		}
+
+		time.Sleep(SHARD_STATS_INTERVAL)
+	}
+}
+
+// Returns the stats every shard has recently published, sorted by shard id
+func getShardStats() ([]*ShardStats, error) {
+	data, err := rcli.HGetAll("airhorn:shards").Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	shards := make([]*ShardStats, 0, len(data))
+	for _, raw := range data {
+		ss := &ShardStats{}
+		if err := json.Unmarshal([]byte(raw), ss); err != nil || time.Since(ss.Updated) > SHARD_STATS_EXPIRY {
+			continue
+		}
+		shards = append(shards, ss)
+	}
+
+	sort.Slice(shards, func(i, j int) bool {
+		return shards[i].Shard < shards[j].Shard
+	})
+	return shards, nil
+}
+
+// Adds up the counters of every shard
+func sumShardStats(shards []*ShardStats) ShardStats {
+	var total ShardStats
+	for _, ss := range shards {
+		total.Guilds += ss.Guilds
+		total.Users += ss.Users
+		total.Voice += ss.Voice
+		total.Memory += ss.Memory
+	}
+	return total
+}
+
+// Handles the owner `shards` control command, showing the stats of every shard
+func displayShardStats(cid string) {
+	if rcli == nil {
+		discord.ChannelMessageSend(cid, "Shard stats require a redis connection")
+		return
+	}
+
+	shards, err := getShardStats()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to fetch shard stats")
+		return
+	}
+
+	total := sumShardStats(shards)
+
+	w := &tabwriter.Writer{}
+	buf := &bytes.Buffer{}
+
+	w.Init(buf, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(w, "```\n")
+	fmt.Fprintf(w, "Shard\tServers\tUsers\tVoice\tMemory\tLatency\tUptime\tInstance\n")
+	for _, ss := range shards {
+		fmt.Fprintf(w, "%d/%d\t%d\t%d\t%d\t%s\t%s\t%s\t%s\n", ss.Shard, ss.ShardCount, ss.Guilds, ss.Users, ss.Voice, humanize.Bytes(ss.Memory),
+			ss.Latency.Round(time.Millisecond), time.Since(ss.Started).Round(time.Second), ss.Instance)
+	}
+	fmt.Fprintf(w, "Total\t%d\t%d\t%d\t%s\n", total.Guilds, total.Users, total.Voice, humanize.Bytes(total.Memory))
+	fmt.Fprintf(w, "```\n")
+	w.Flush()
+	sendReplyText(cid, buf.String(), REPLY_NORMAL)
+}
+
+// ShardManager runs a bot process for every shard, restarting processes that
+// exit and respawning all of them when the shard count changes
+type ShardManager struct {
+	Token string
+
+	// Shard count to run, 0 uses the count recommended by discord
+	FixedCount int
+
+	// Arguments passed to every shard process, besides the shard flags
+	Args []string
+
+	sync.Mutex
+	count     int
+	processes []*exec.Cmd
+	stopping  bool
+	running   sync.WaitGroup
+}
+
+// Returns the flags this process was started with, minus the ones the
+// manager sets itself, so shard processes can be started with the same options
+func shardArgs() []string {
+	args := make([]string, 0)
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "manage" || f.Name == "s" || f.Name == "c" || f.Name == "serveassets" || f.Name == "health" {
+			return
+		}
+		args = append(args, fmt.Sprintf("-%s=%s", f.Name, f.Value.String()))
+	})
+	return args
+}
+
+// Returns the number of shards discord recommends for the bot
+func recommendedShardCount(token string) (int, error) {
+	s, err := discordgo.New(token)
+	if err != nil {
+		return 0, err
+	}
+
+	gateway, err := s.GatewayBot()
+	if err != nil {
+		return 0, err
+	}
+	return gateway.Shards, nil
+}
+
+func (sm *ShardManager) shardCount() (int, error) {
+	if sm.FixedCount > 0 {
+		return sm.FixedCount, nil
+	}
+	return recommendedShardCount(sm.Token)
+}
+
+// Starts a process for every shard
+func (sm *ShardManager) start(count int) {
+	sm.Lock()
+	defer sm.Unlock()
+
+	sm.count = count
+	sm.stopping = false
+	sm.processes = make([]*exec.Cmd, count)
+	for i := 0; i < count; i++ {
+		sm.running.Add(1)
+		go sm.supervise(i, count)
+	}
+
+	log.WithFields(log.Fields{
+		"shards": count,
+	}).Info("Started shard processes")
+}
+
+// Runs a single shard process, restarting it whenever it exits until the
+// manager is stopped
+func (sm *ShardManager) supervise(shard, count int) {
+	defer sm.running.Done()
+
+	for {
+		args := append([]string{}, sm.Args...)
+		args = append(args, "-s", strconv.Itoa(shard), "-c", strconv.Itoa(count))
+
+		cmd := exec.Command(os.Args[0], args...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		sm.Lock()
+		if sm.stopping {
+			sm.Unlock()
+			return
+		}
+		err := cmd.Start()
+		if err == nil {
+			sm.processes[shard] = cmd
+		}
+		sm.Unlock()
+
+		if err == nil {
+			err = cmd.Wait()
+		}
+
+		sm.Lock()
+		stopping := sm.stopping
+		sm.Unlock()
+		if stopping {
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"shard": shard,
+			"error": err,
+		}).Warning("Shard process exited, restarting")
+		time.Sleep(SHARD_RESTART_DELAY)
+	}
+}
+
+// Interrupts every shard process and waits for them to exit
+func (sm *ShardManager) stop() {
+	sm.Lock()
+	sm.stopping = true
+	for _, cmd := range sm.processes {
+		if cmd != nil && cmd.Process != nil {
+			cmd.Process.Signal(os.Interrupt)
+		}
+	}
+	sm.Unlock()
+
+	sm.running.Wait()
+}
+
+// Logs the combined stats of every shard that is reporting
+func (sm *ShardManager) logStats() {
+	shards, err := getShardStats()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to fetch shard stats")
+		return
+	}
+
+	total := sumShardStats(shards)
+	log.WithFields(log.Fields{
+		"reporting": len(shards),
+		"shards":    sm.count,
+		"guilds":    total.Guilds,
+		"users":     total.Users,
+		"voice":     total.Voice,
+		"memory":    total.Memory,
+	}).Info("Shard stats")
+}
+
+// Runs the shards until the manager receives an interrupt, checking for a new
+// recommended shard count every interval
+func (sm *ShardManager) Run(interval time.Duration) error {
+	count, err := sm.shardCount()
+	if err != nil {
+		return err
+	}
+	sm.start(count)
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, os.Kill)
+
+	// A zero interval never fires, keeping the starting count
+	var check <-chan time.Time
+	if interval > 0 && sm.FixedCount == 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		check = ticker.C
+	}
+
+	// Shard stats are only published with a redis connection
+	var report <-chan time.Time
+	if rcli != nil {
+		ticker := time.NewTicker(SHARD_STATS_INTERVAL * 10)
+		defer ticker.Stop()
+		report = ticker.C
+	}
+
+	for {
+		select {
+		case <-c:
+			sm.stop()
+			return nil
+		case <-report:
+			sm.logStats()
+		case <-check:
+			count, err := sm.shardCount()
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Warning("Failed to fetch the recommended shard count")
+				continue
+			}
+
+			if count == sm.count {
+				continue
+			}
+
+			log.WithFields(log.Fields{
+				"old": sm.count,
+				"new": count,
+			}).Info("Shard count changed, restarting shards")
+			sm.stop()
+			sm.start(count)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	"github.com/noisemaster/airhornbot/pkg/sound"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Discord allows at most 5 buttons per row and 5 rows per message
+	SOUNDBOARD_ROW_SIZE = 5
+	SOUNDBOARD_ROWS     = 5
+)
+
+// Posts a soundboard of buttons for every sound in a collection, split across
+// as many messages as needed
+func displaySoundboard(cid string, coll *sound.Collection) {
+	perMessage := SOUNDBOARD_ROW_SIZE * SOUNDBOARD_ROWS
+
+	for start := 0; start < len(coll.Sounds); start += perMessage {
+		end := start + perMessage
+		if end > len(coll.Sounds) {
+			end = len(coll.Sounds)
+		}
+
+		rows := make([]discordgo.MessageComponent, 0)
+		for i := start; i < end; i += SOUNDBOARD_ROW_SIZE {
+			row := discordgo.ActionsRow{}
+			for j := i; j < end && j < i+SOUNDBOARD_ROW_SIZE; j++ {
+				row.Components = append(row.Components, discordgo.Button{
+					Label:    coll.Sounds[j].Name,
+					Style:    discordgo.SecondaryButton,
+					CustomID: componentID("soundboard", coll.Prefix, coll.Sounds[j].Name),
+				})
+			}
+			rows = append(rows, row)
+		}
+
+		msg := &discordgo.MessageSend{Components: rows}
+		if start == 0 {
+			msg.Content = fmt.Sprintf("**%s** soundboard, click a sound to play it in your voice channel", coll.Prefix)
+		}
+
+		_, err := discord.ChannelMessageSendComplex(cid, msg)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"collection": coll.Prefix,
+				"error":      err,
+			}).Warning("Failed to send soundboard")
+			return
+		}
+	}
+}
+
+// Handles the !soundboard command
+func handleSoundboardCommand(cid string, guild *discordgo.Guild, parts []string) {
+	if len(parts) < 2 {
+		discord.ChannelMessageSend(cid, "Usage: `!soundboard <collection>`, see `!help` for the list of collections")
+		return
+	}
+
+	coll := findCollection(parts[1])
+	if coll == nil || !getGuildSettings(guild.ID).CollectionEnabled(coll) {
+		discord.ChannelMessageSend(cid, fmt.Sprintf("I don't know a collection called %s", parts[1]))
+		return
+	}
+
+	displaySoundboard(cid, coll)
+}
+
+// Handles a click on a soundboard button, args are the collection prefix and sound name
+func handleSoundboardClick(s *discordgo.Session, i *discordgo.InteractionCreate, args []string) {
+	if len(args) < 2 || i.GuildID == "" {
+		return
+	}
+
+	coll := findCollection(args[0])
+	if coll == nil || !getGuildSettings(i.GuildID).CollectionEnabled(coll) {
+		respondEphemeral(s, i, "That collection isn't available here")
+		return
+	}
+
+	sound := coll.Find(args[1])
+	if sound == nil {
+		respondEphemeral(s, i, "That sound no longer exists")
+		return
+	}
+
+	guild, _ := discord.State.Guild(i.GuildID)
+	if guild == nil {
+		return
+	}
+
+	user := interactionUser(i)
+	if !canUse(guild, user.ID, coll.Prefix) {
+		respondEphemeral(s, i, "You don't have a role that can play these sounds")
+		return
+	}
+
+	if getCurrentVoiceChannel(user, guild) == nil {
+		respondEphemeral(s, i, "Join a voice channel first")
+		return
+	}
+
+	respondAcknowledge(s, i)
+	go enqueuePlay(user, guild, i.ChannelID, coll, sound, queue.SOURCE_SOUNDBOARD)
+}
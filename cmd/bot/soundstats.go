@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/sound"
+)
+
+const (
+	// Days of plays the trend in `!stats sound` covers
+	SOUND_STATS_DAYS = 7
+)
+
+// Bars the trend is drawn with, from no plays to the busiest day
+var sparkBars = []rune("▁▂▃▄▅▆▇█")
+
+// Handles `!stats sound [collection] <sound>`. Without a collection the first
+// collection with a sound of that name is used.
+func handleStatsCommand(c *CommandContext) {
+	if tracker == nil {
+		sendReplyText(c.Message.ChannelID, c.translate("soundstats.disabled", nil), REPLY_NORMAL)
+		return
+	}
+
+	if len(c.Parts) < 3 || len(c.Parts) > 4 || c.Parts[1] != "sound" {
+		sendReplyText(c.Message.ChannelID, c.translate("soundstats.usage", nil), REPLY_NORMAL)
+		return
+	}
+
+	coll, s := findStatsSound(c.Parts[2:])
+	if s == nil {
+		sendReplyText(c.Message.ChannelID, c.translate("soundstats.unknown", map[string]string{
+			"Sound": strings.Join(c.Parts[2:], " "),
+		}), REPLY_NORMAL)
+		return
+	}
+
+	names := make([]string, len(coll.Sounds))
+	for i, cs := range coll.Sounds {
+		names[i] = cs.Name
+	}
+
+	totals := tracker.SoundTotals(coll.Prefix, names)
+	collTotal := 0
+	for _, count := range totals {
+		collTotal += count
+	}
+
+	share := 0.0
+	if collTotal > 0 {
+		share = float64(totals[s.Name]) / float64(collTotal) * 100
+	}
+
+	daily := tracker.SoundDaily(coll.Prefix, s.Name, SOUND_STATS_DAYS)
+	counts := make([]string, len(daily))
+	for i, count := range daily {
+		counts[i] = fmt.Sprint(count)
+	}
+
+	sendReplyEmbed(c.Message.ChannelID, &discordgo.MessageEmbed{
+		Title: c.translate("soundstats.title", map[string]string{
+			"Collection": coll.Prefix,
+			"Sound":      s.Name,
+		}),
+		Color: 0xE5343A,
+		Description: c.translate("soundstats.body", map[string]interface{}{
+			"Total":      totals[s.Name],
+			"Guild":      tracker.GuildSoundTotal(c.Guild.ID, coll.Prefix, s.Name),
+			"Share":      fmt.Sprintf("%.1f%%", share),
+			"Collection": coll.Prefix,
+			"Days":       SOUND_STATS_DAYS,
+			"Trend":      sparkline(daily),
+			"Counts":     strings.Join(counts, " "),
+		}),
+	}, REPLY_NORMAL)
+}
+
+// Finds the sound `!stats sound` was asked about, args are either the sound
+// name or the collection and sound name
+func findStatsSound(args []string) (*sound.Collection, *sound.Sound) {
+	if len(args) == 2 {
+		for _, coll := range getCollections() {
+			if coll.Prefix == args[0] || scontains("!"+args[0], coll.Commands...) {
+				return coll, coll.Find(args[1])
+			}
+		}
+		return nil, nil
+	}
+
+	for _, coll := range getCollections() {
+		if s := coll.Find(args[0]); s != nil {
+			return coll, s
+		}
+	}
+	return nil, nil
+}
+
+// Draws the counts as a row of bars scaled to the largest count
+func sparkline(counts []int) string {
+	max := 0
+	for _, count := range counts {
+		if count > max {
+			max = count
+		}
+	}
+
+	bars := make([]rune, len(counts))
+	for i, count := range counts {
+		bars[i] = sparkBars[0]
+		if max > 0 {
+			bars[i] = sparkBars[count*(len(sparkBars)-1)/max]
+		}
+	}
+	return string(bars)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Longest a spam mute can escalate to
+	SPAM_MUTE_MAX = time.Hour
+
+	// How long a user has to behave before their next mute starts from the
+	// guild's base duration again
+	SPAM_OFFENSE_RESET = time.Hour * 6
+)
+
+// What a user recently sent in a guild, for spotting repeated commands
+type spamTracker struct {
+	command string
+	first   time.Time
+	repeats int
+
+	offenses    int
+	lastOffense time.Time
+	mutedUntil  time.Time
+}
+
+var (
+	// Recent commands, keyed by `<guild id>:<user id>`
+	spamTrackers     map[string]*spamTracker = make(map[string]*spamTracker)
+	spamTrackersLock sync.Mutex
+)
+
+// Returns true if the message should be ignored as spam. The first of a burst
+// of identical commands goes through and the rest are coalesced into it. Once
+// a user sends SpamRepeats of them within SpamWindow they are muted, for
+// twice as long every time they do it again, and told so once.
+func checkSpam(m *discordgo.MessageCreate, guild *discordgo.Guild, settings *GuildSettings, parts []string) bool {
+	if m.Author.ID == OWNER || settings.SpamRepeats <= 0 {
+		return false
+	}
+
+	key := guild.ID + ":" + m.Author.ID
+	command := strings.Join(parts, " ")
+	window := time.Second * time.Duration(settings.SpamWindow)
+	now := time.Now()
+
+	spamTrackersLock.Lock()
+	st := spamTrackers[key]
+	if st == nil {
+		st = &spamTracker{}
+		spamTrackers[key] = st
+	}
+
+	if now.Before(st.mutedUntil) {
+		spamTrackersLock.Unlock()
+		return true
+	}
+
+	if st.command != command || now.Sub(st.first) > window {
+		st.command = command
+		st.first = now
+		st.repeats = 1
+		spamTrackersLock.Unlock()
+		return false
+	}
+
+	st.repeats++
+	if st.repeats < settings.SpamRepeats {
+		spamTrackersLock.Unlock()
+		return true
+	}
+
+	if now.Sub(st.lastOffense) > SPAM_OFFENSE_RESET {
+		st.offenses = 0
+	}
+	st.offenses++
+	st.lastOffense = now
+
+	mute := time.Second * time.Duration(settings.SpamMute)
+	for i := 1; i < st.offenses && mute < SPAM_MUTE_MAX; i++ {
+		mute *= 2
+	}
+	if mute > SPAM_MUTE_MAX {
+		mute = SPAM_MUTE_MAX
+	}
+	st.mutedUntil = now.Add(mute)
+	st.command = ""
+	offenses := st.offenses
+	spamTrackersLock.Unlock()
+
+	log.WithFields(log.Fields{
+		"guild":    guild.ID,
+		"user":     m.Author.ID,
+		"command":  command,
+		"offenses": offenses,
+		"mute":     mute,
+	}).Info("Muting user for spamming commands")
+
+	go discord.ChannelMessageSend(m.ChannelID, localize(guild.ID, "spam.muted", map[string]interface{}{
+		"User":     "<@" + m.Author.ID + ">",
+		"Duration": mute,
+	}))
+	return true
+}
+
+// Removes trackers of users who are neither muted nor likely to be muted again
+func expireSpamTrackers() {
+	for {
+		time.Sleep(time.Minute * 10)
+
+		spamTrackersLock.Lock()
+		for key, st := range spamTrackers {
+			if time.Now().After(st.mutedUntil) && time.Since(st.lastOffense) > SPAM_OFFENSE_RESET && time.Since(st.first) > time.Minute {
+				delete(spamTrackers, key)
+			}
+		}
+		spamTrackersLock.Unlock()
+	}
+}
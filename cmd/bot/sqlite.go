@@ -0,0 +1,7 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+// Built with -tags sqlite, allowing -stats sqlite3:<path>
+import _ "github.com/mattn/go-sqlite3"
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	"github.com/noisemaster/airhornbot/pkg/redis"
+	"github.com/noisemaster/airhornbot/pkg/stats"
+	log "github.com/sirupsen/logrus"
+)
+
+// Opens the stats sink picked with -stats, which is `redis`, `none` or
+// `<driver>:<dsn>` for a SQL database (eg. `sqlite3:airhorn.db`). SQL drivers
+// are only built in with their build tag, see sqlite.go and postgres.go.
+func openStatsSink(spec string) (stats.Sink, error) {
+	switch spec {
+	case "none":
+		return stats.NopSink{}, nil
+	case "redis":
+		if rcli == nil {
+			log.Warning("Stats are disabled without a redis connection, pass -r or pick another backend with -stats")
+			return stats.NopSink{}, nil
+		}
+
+		tracker = stats.NewTracker(rcli)
+		return &stats.RedisSink{
+			Tracker: tracker,
+			Extra: func(pipe *redis.Pipeline, play *queue.Play) {
+				trackExperimentStats(pipe, play)
+			},
+		}, nil
+	}
+
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("unknown stats backend %s", spec)
+	}
+
+	if !scontains(parts[0], sql.Drivers()...) {
+		return nil, fmt.Errorf("the %s driver isn't built in, available drivers are %s", parts[0], strings.Join(sql.Drivers(), ", "))
+	}
+	return stats.NewSQLSink(parts[0], parts[1])
+}
+
+// Counts an error with the stats sink
+func trackError(kind string) {
+	if err := statsSink.TrackError(kind); err != nil {
+		log.WithFields(log.Fields{
+			"kind":  kind,
+			"error": err,
+		}).Warning("Failed to track error")
+	}
+}
+
+// Formats the error counts of the sink for the status command
+func formatErrorCounts(counts *stats.Counts) string {
+	kinds := make([]string, 0, len(counts.Errors))
+	for kind := range counts.Errors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	parts := make([]string, len(kinds))
+	for i, kind := range kinds {
+		parts[i] = fmt.Sprintf("%d %s", counts.Errors[kind], kind)
+	}
+	return orNone(strings.Join(parts, ", "))
+}
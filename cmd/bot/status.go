@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/noisemaster/airhornbot/pkg/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Redis key holding the incident note shown on the status page
+	INCIDENT_KEY = "airhorn:status:incident"
+)
+
+// A note the owner leaves on the status page while something is wrong
+type Incident struct {
+	Note string    `json:"note"`
+	Set  time.Time `json:"set"`
+}
+
+// The health of a single shard as shown on the status page
+type shardStatus struct {
+	Shard   int
+	Up      bool
+	Servers int
+	Latency time.Duration
+	Uptime  string
+}
+
+var (
+	// The incident note when there is no redis to share it through
+	localIncident     *Incident
+	localIncidentLock sync.Mutex
+
+	statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="60">
+<title>Airhorn Bot Status</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 2em auto; color: #222; }
+h1 { color: #E5343A; }
+.incident { border-left: 4px solid #E5343A; padding: 0.5em 1em; background: #fbeaea; }
+.up { color: #2a8a2a; }
+.down { color: #E5343A; }
+td, th { padding: 0.2em 1em 0.2em 0; text-align: left; }
+</style>
+</head>
+<body>
+<h1>Airhorn Bot Status</h1>
+{{if .Incident}}<div class="incident"><p>{{.Incident.Note}}</p><small>Posted {{.IncidentAge}}</small></div>{{end}}
+<p>{{if .Healthy}}<span class="up">All systems horning</span>{{else}}<span class="down">Some shards are down</span>{{end}}</p>
+<p>Up for {{.Uptime}}, currently {{printf "%.1f" .APS}} airhorns per second</p>
+<table>
+<tr><th>Shard</th><th>Status</th><th>Servers</th><th>Latency</th><th>Uptime</th></tr>
+{{range .Shards}}<tr><td>{{.Shard}}</td>{{if .Up}}<td class="up">up</td><td>{{.Servers}}</td><td>{{.Latency}}</td><td>{{.Uptime}}</td>{{else}}<td class="down">down</td><td></td><td></td><td></td>{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+)
+
+// Returns the current incident note, or nil if there is none
+func getIncident() *Incident {
+	if rcli == nil {
+		localIncidentLock.Lock()
+		defer localIncidentLock.Unlock()
+		return localIncident
+	}
+
+	raw, err := rcli.Get(INCIDENT_KEY).Result()
+	if err != nil {
+		if err != redis.Nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warning("Failed to fetch incident note")
+		}
+		return nil
+	}
+
+	incident := &Incident{}
+	if err := json.Unmarshal([]byte(raw), incident); err != nil {
+		return nil
+	}
+	return incident
+}
+
+// Sets the incident note shown on the status page, an empty note clears it
+func setIncident(note string) error {
+	var incident *Incident
+	if note != "" {
+		incident = &Incident{Note: note, Set: time.Now()}
+	}
+
+	if rcli == nil {
+		localIncidentLock.Lock()
+		localIncident = incident
+		localIncidentLock.Unlock()
+		return nil
+	}
+
+	if incident == nil {
+		return rcli.Del(INCIDENT_KEY).Err()
+	}
+
+	data, err := json.Marshal(incident)
+	if err != nil {
+		return err
+	}
+	return rcli.Set(INCIDENT_KEY, string(data), 0).Err()
+}
+
+// Handles the owner `incident <note>` and `incident clear` control commands.
+// The note is taken from the original message so it keeps its case.
+func handleIncidentCommand(cid, content string) {
+	idx := strings.Index(strings.ToLower(content), "incident")
+	note := strings.TrimSpace(content[idx+len("incident"):])
+	if note == "" {
+		incident := getIncident()
+		if incident == nil {
+			discord.ChannelMessageSend(cid, "There is no incident note, set one with `incident <note>`")
+			return
+		}
+		discord.ChannelMessageSend(cid, "Current incident note: "+incident.Note)
+		return
+	}
+
+	if note == "clear" {
+		note = ""
+	}
+
+	if err := setIncident(note); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to save incident note")
+		discord.ChannelMessageSend(cid, "Failed to save the incident note")
+		return
+	}
+	discord.ChannelMessageSend(cid, ":ok_hand:")
+}
+
+// Returns the health of every shard. Without redis only this shard is known.
+func statusShards() []*shardStatus {
+	if rcli == nil {
+		status, _ := healthStatus()
+		return []*shardStatus{{
+			Shard:   discord.ShardID,
+			Up:      status.Gateway == "connected",
+			Servers: len(discord.State.Ready.Guilds),
+			Latency: discord.HeartbeatLatency().Round(time.Millisecond),
+			Uptime:  humanize.RelTime(startTime, time.Now(), "", ""),
+		}}
+	}
+
+	published, err := getShardStats()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to fetch shard stats")
+	}
+
+	// Shards that haven't published recently are missing and shown as down
+	count := discord.ShardCount
+	for _, ss := range published {
+		if ss.ShardCount > count {
+			count = ss.ShardCount
+		}
+	}
+
+	shards := make([]*shardStatus, count)
+	for i := range shards {
+		shards[i] = &shardStatus{Shard: i}
+	}
+	for _, ss := range published {
+		if ss.Shard >= count {
+			continue
+		}
+		shards[ss.Shard] = &shardStatus{
+			Shard:   ss.Shard,
+			Up:      true,
+			Servers: ss.Guilds,
+			Latency: ss.Latency.Round(time.Millisecond),
+			Uptime:  humanize.RelTime(ss.Started, time.Now(), "", ""),
+		}
+	}
+	return shards
+}
+
+// Serves the public status page, which only shows what server admins need to
+// tell whether an outage is on their end
+func serveStatusPage(w http.ResponseWriter, r *http.Request) {
+	shards := statusShards()
+	healthy := true
+	for _, ss := range shards {
+		healthy = healthy && ss.Up
+	}
+
+	aps := 0.0
+	if tracker != nil {
+		if rates, err := tracker.Rates(); err == nil {
+			aps = rates.APS
+		}
+	}
+
+	data := map[string]interface{}{
+		"Healthy": healthy,
+		"Uptime":  humanize.RelTime(startTime, time.Now(), "", ""),
+		"APS":     aps,
+		"Shards":  shards,
+	}
+	if incident := getIncident(); incident != nil {
+		data["Incident"] = incident
+		data["IncidentAge"] = humanize.Time(incident.Set)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, data); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to render status page")
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Redis set of the guilds synchronized plays are played in
+	SYNC_GUILDS_KEY = "airhorn:syncplay:guilds"
+
+	// Redis channel synchronized plays are announced to every shard on
+	SYNC_CHANNEL = "airhorn:syncplay"
+
+	// How far ahead synchronized plays are scheduled, giving every shard time to
+	// hear about it and join voice before the sound starts
+	SYNC_LEAD = time.Second * 10
+)
+
+// A sound every shard plays in its synchronized guilds at the same instant.
+// Shards rely on their clocks being in sync (eg. with NTP) to line up.
+type SyncPlay struct {
+	ID         string    `json:"id"`
+	Collection string    `json:"collection"`
+	Sound      string    `json:"sound"`
+	At         time.Time `json:"at"`
+}
+
+// Handles the owner `syncplay list`, `syncplay add|remove <guild id...>` and
+// `syncplay <collection> [sound]` control commands
+func handleSyncPlayCommand(cid string, parts []string) {
+	if rcli == nil {
+		discord.ChannelMessageSend(cid, "Synchronized plays require a redis connection")
+		return
+	}
+
+	if len(parts) == 0 {
+		discord.ChannelMessageSend(cid, "Usage: `syncplay list`, `syncplay add|remove <guild id...>` or `syncplay <collection> [sound]`")
+		return
+	}
+
+	switch parts[0] {
+	case "list":
+		guilds, err := rcli.SMembers(SYNC_GUILDS_KEY).Result()
+		if err != nil {
+			discord.ChannelMessageSend(cid, fmt.Sprintf("Failed to list guilds: %s", err))
+			return
+		}
+
+		if len(guilds) == 0 {
+			discord.ChannelMessageSend(cid, "No guilds are set up for synchronized plays")
+			return
+		}
+		discord.ChannelMessageSend(cid, fmt.Sprintf("Synchronized plays go to %d guilds: %s", len(guilds), strings.Join(guilds, ", ")))
+		return
+	case "add", "remove":
+		if len(parts) < 2 {
+			discord.ChannelMessageSend(cid, fmt.Sprintf("Usage: `syncplay %s <guild id...>`", parts[0]))
+			return
+		}
+
+		var err error
+		if parts[0] == "add" {
+			err = rcli.SAdd(SYNC_GUILDS_KEY, parts[1:]...).Err()
+		} else {
+			err = rcli.SRem(SYNC_GUILDS_KEY, parts[1:]...).Err()
+		}
+
+		if err != nil {
+			discord.ChannelMessageSend(cid, fmt.Sprintf("Failed to update guilds: %s", err))
+			return
+		}
+		discord.ChannelMessageSend(cid, ":ok_hand:")
+		return
+	}
+
+	coll := findCollection(parts[0])
+	if coll == nil {
+		discord.ChannelMessageSend(cid, fmt.Sprintf("There is no collection %s", parts[0]))
+		return
+	}
+
+	sp := &SyncPlay{
+		ID:         queue.NewID(),
+		Collection: coll.Prefix,
+		At:         time.Now().Add(SYNC_LEAD),
+	}
+
+	if len(parts) > 1 {
+		if coll.Find(parts[1]) == nil {
+			discord.ChannelMessageSend(cid, fmt.Sprintf("There is no sound %s in %s", parts[1], coll.Prefix))
+			return
+		}
+		sp.Sound = parts[1]
+	} else {
+		// Every guild hears the same sound, so the random pick happens up front
+		sp.Sound = coll.Random().Name
+	}
+
+	data, err := json.Marshal(sp)
+	if err != nil {
+		return
+	}
+
+	shards, err := rcli.Publish(SYNC_CHANNEL, string(data)).Result()
+	if err != nil {
+		discord.ChannelMessageSend(cid, fmt.Sprintf("Failed to start the synchronized play: %s", err))
+		return
+	}
+	discord.ChannelMessageSend(cid, fmt.Sprintf(":ok_hand: %d shards will play it at %s", shards, sp.At.UTC().Format("15:04:05 MST")))
+}
+
+// Listens for synchronized plays announced by any shard, resubscribing if the
+// connection to redis drops
+func listenSyncPlays() {
+	for {
+		pubsub, err := rcli.Subscribe(SYNC_CHANNEL)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warning("Failed to subscribe to synchronized plays")
+			time.Sleep(time.Second * 5)
+			continue
+		}
+
+		for {
+			msg, err := pubsub.ReceiveMessage()
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Warning("Lost the synchronized play subscription")
+				break
+			}
+
+			sp := &SyncPlay{}
+			if err := json.Unmarshal([]byte(msg.Payload), sp); err != nil {
+				continue
+			}
+			go startSyncPlay(sp)
+		}
+
+		pubsub.Close()
+		time.Sleep(time.Second)
+	}
+}
+
+// Queues a synchronized play in every configured guild on this shard. The
+// sound is started half a gateway round trip early, as an estimate of how long
+// frames take to reach discord.
+func startSyncPlay(sp *SyncPlay) {
+	coll := findCollection(sp.Collection)
+	if coll == nil {
+		return
+	}
+
+	s := coll.Find(sp.Sound)
+	if s == nil {
+		return
+	}
+
+	guilds, err := rcli.SMembers(SYNC_GUILDS_KEY).Result()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sync":  sp.ID,
+			"error": err,
+		}).Warning("Failed to load synchronized play guilds")
+		return
+	}
+
+	startAt := sp.At.Add(-discord.HeartbeatLatency() / 2)
+	played := 0
+	for _, gid := range guilds {
+		// Other shards play in their own guilds
+		guild, _ := discord.State.Guild(gid)
+		if guild == nil || !getGuildSettings(gid).CollectionEnabled(coll) {
+			continue
+		}
+
+		channelID := busiestVoiceChannel(guild)
+		if channelID == "" {
+			continue
+		}
+
+		play := newPlay(guild, channelID, OWNER, coll, s, queue.SOURCE_SYNC)
+		play.StartAt = startAt
+		go queuePlay(play)
+		played++
+	}
+
+	log.WithFields(log.Fields{
+		"sync":   sp.ID,
+		"sound":  sp.Collection + ":" + sp.Sound,
+		"at":     sp.At,
+		"guilds": played,
+	}).Info("Queued synchronized play")
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/noisemaster/airhornbot/pkg/redis"
+	"github.com/noisemaster/airhornbot/pkg/sound"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Percentage of the most played sounds that are pinned in memory, the long
+	// tail is streamed from disk on every play. 100 keeps everything in memory.
+	PIN_PERCENT = 100
+
+	// Only sounds played within this long are loaded on startup, the rest are
+	// loaded the first time they're played. 0 loads everything.
+	WARMUP_WINDOW time.Duration
+
+	// Keeps the most recently played sounds in memory within -maxsoundmem,
+	// nil when every sound is loaded up front
+	soundCache *sound.Cache
+)
+
+// Returns true if only a subset of the sounds should be kept in memory. A
+// memory budget takes precedence over tiering.
+func tieringEnabled() bool {
+	return PIN_PERCENT < 100 && rcli != nil && soundCache == nil
+}
+
+// Returns the sounds that should be loaded on startup, or nil if everything
+// should be. Without any play history everything is loaded.
+func warmupSounds() map[string]bool {
+	if WARMUP_WINDOW <= 0 || tracker == nil {
+		return nil
+	}
+
+	played, err := tracker.LastPlayed()
+	if err != nil || len(played) == 0 {
+		return nil
+	}
+
+	recent := make(map[string]bool)
+	for name, at := range played {
+		if time.Since(at) <= WARMUP_WINDOW {
+			recent[name] = true
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"window": WARMUP_WINDOW,
+		"sounds": len(recent),
+	}).Info("Warming up recently played sounds")
+	return recent
+}
+
+// Loads every collection, pinning only the most popular sounds when tiering is enabled
+func loadSounds() {
+	// Sounds that are missing on startup are skipped, unlike on a reload
+	colls := sound.CopyAll(COLLECTIONS)
+	loadCollections(colls)
+
+	activeCollections.Store(colls)
+	updateTierMetrics()
+}
+
+// Periodically recalculates which sounds are pinned based on the latest play counts
+func retierLoop(interval time.Duration) {
+	if !tieringEnabled() || interval <= 0 {
+		return
+	}
+
+	for {
+		time.Sleep(interval)
+		retierSounds()
+	}
+}
+
+// Pins the top PIN_PERCENT most played sounds in memory and releases the rest
+func retierSounds() {
+	retierCollections(getCollections())
+	updateTierMetrics()
+}
+
+func retierCollections(colls []*sound.Collection) {
+	type ranked struct {
+		sound *sound.Sound
+		plays *redis.StringCmd
+		other *redis.StringCmd
+	}
+
+	sounds := make([]*ranked, 0)
+	_, err := rcli.Pipelined(func(pipe *redis.Pipeline) error {
+		for _, coll := range colls {
+			for _, s := range coll.Sounds {
+				sounds = append(sounds, &ranked{
+					sound: s,
+					plays: pipe.Get(fmt.Sprintf("airhorn:a:sound:%s", s.Name)),
+					other: pipe.Get(fmt.Sprintf("airhorn:f:sound:%s", s.Name)),
+				})
+			}
+		}
+		return nil
+	})
+
+	// Missing keys are reported as errors, which is fine as they just count as zero
+	if err != nil && err != redis.Nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warning("Failed to fetch sound popularity, pinning everything")
+	}
+
+	count := func(r *ranked) int {
+		a, _ := strconv.Atoi(r.plays.Val())
+		f, _ := strconv.Atoi(r.other.Val())
+		return a + f
+	}
+
+	sort.SliceStable(sounds, func(i, j int) bool {
+		return count(sounds[i]) > count(sounds[j])
+	})
+
+	pinned := (len(sounds)*PIN_PERCENT + 99) / 100
+	for i, r := range sounds {
+		if i < pinned {
+			r.sound.Pin()
+		} else {
+			r.sound.Unpin()
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"pinned":   pinned,
+		"streamed": len(sounds) - pinned,
+	}).Info("Recalculated sound memory tiers")
+}
+
+func updateTierMetrics() {
+	var (
+		pinned, streamed int64
+		bytes            int64
+	)
+
+	for _, coll := range getCollections() {
+		for _, s := range coll.Sounds {
+			if s.Pinned() {
+				pinned++
+				bytes += s.Size()
+			} else {
+				streamed++
+			}
+		}
+	}
+
+	setMetric(sound.Metrics, "pinned", pinned)
+	setMetric(sound.Metrics, "streamed", streamed)
+	setMetric(sound.Metrics, "pinned_bytes", bytes)
+}
+
+// Returns the percentage of plays that found their sound in the cache
+func cacheHitRate() float64 {
+	hits, misses := getMetric(sound.Metrics, "cache_hits"), getMetric(sound.Metrics, "cache_misses")
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) * 100 / float64(hits+misses)
+}
+
+func setMetric(m *expvar.Map, key string, value int64) {
+	v := new(expvar.Int)
+	v.Set(value)
+	m.Set(key, v)
+}
+
+// Returns the current value of an integer metric
+func getMetric(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// Describes how many frames were sent late and by how much on average
+func formatFrameJitter() string {
+	late := getMetric(sound.Metrics, "frames_late")
+	if late == 0 {
+		return "none late"
+	}
+
+	average := time.Duration(getMetric(sound.Metrics, "frames_late_us")/late) * time.Microsecond
+	return fmt.Sprintf("%d late by %s on average, %d schedule resets", late, average, getMetric(sound.Metrics, "pace_resets"))
+}
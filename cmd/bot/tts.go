@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/dca"
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	"github.com/noisemaster/airhornbot/pkg/sound"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Longest piece of text we will synthesize for a single !say
+	TTS_MAX_LENGTH = 200
+
+	// Directory synthesized sounds are cached in
+	TTS_CACHE_DIR = "cache/tts"
+)
+
+var (
+	// Backend used for !say, nil when text-to-speech is disabled
+	tts TTSBackend
+
+	// Pseudo collection used for plays created from !say
+	SAY *sound.Collection = &sound.Collection{
+		Prefix: "say",
+		Commands: []string{
+			"!say",
+		},
+	}
+)
+
+// TTSBackend synthesizes speech into an audio file that can be fed to the encoder
+type TTSBackend interface {
+	Synthesize(text string) ([]byte, error)
+
+	// Identifies the backend and voice, so speech cached for one isn't
+	// played for another
+	CacheKey() string
+}
+
+// Synthesizes speech locally using the espeak binary
+type espeakBackend struct {
+	Voice string
+}
+
+func (e *espeakBackend) Synthesize(text string) ([]byte, error) {
+	args := []string{"--stdout", "--stdin"}
+	if e.Voice != "" {
+		args = append(args, "-v", e.Voice)
+	}
+
+	// The text is user input, so it goes in on stdin where espeak can't take
+	// it for options
+	cmd := exec.Command("espeak", args...)
+	cmd.Stdin = strings.NewReader(text)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (e *espeakBackend) CacheKey() string {
+	return "espeak:" + e.Voice
+}
+
+// Synthesizes speech by POSTing the text to a HTTP API, which should respond
+// with an audio file
+type httpTTSBackend struct {
+	URL string
+
+	client *http.Client
+}
+
+func (h *httpTTSBackend) Synthesize(text string) ([]byte, error) {
+	resp, err := h.client.PostForm(h.URL, url.Values{"text": {text}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tts backend returned %s", resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (h *httpTTSBackend) CacheKey() string {
+	return h.URL
+}
+
+// Creates the TTS backend for the given flag value. Either "espeak",
+// "espeak:<voice>" or a http(s) URL
+func newTTSBackend(backend string) TTSBackend {
+	if strings.HasPrefix(backend, "http://") || strings.HasPrefix(backend, "https://") {
+		return &httpTTSBackend{
+			URL:    backend,
+			client: &http.Client{Timeout: (20 * time.Second)},
+		}
+	}
+
+	if backend == "espeak" || strings.HasPrefix(backend, "espeak:") {
+		return &espeakBackend{Voice: strings.TrimPrefix(strings.TrimPrefix(backend, "espeak"), ":")}
+	}
+
+	return nil
+}
+
+// Returns a sound speaking the given text, synthesizing and caching it if needed
+func getSpeechSound(text string, volume, bitrate int) (*sound.Sound, error) {
+	hash := sha1.Sum([]byte(fmt.Sprintf("%s:%d:%d:%s", tts.CacheKey(), volume, bitrate, text)))
+	path := fmt.Sprintf("%s/%s.dca", TTS_CACHE_DIR, hex.EncodeToString(hash[:]))
+
+	// Try the cache first
+	if _, err := os.Stat(path); err == nil {
+		s := sound.New("say", 1, 250)
+		if err := s.LoadFile(path); err == nil {
+			return s, nil
+		}
+	}
+
+	audio, err := tts.Synthesize(text)
+	if err != nil {
+		return nil, err
+	}
+
+	frames, err := encodeDCABytes(audio, volume, bitrate)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dca.WriteFile(path, frames); err != nil {
+		log.WithFields(log.Fields{
+			"path":  path,
+			"error": err,
+		}).Warning("Failed to cache synthesized speech")
+	}
+
+	return sound.NewFromFrames("say", frames), nil
+}
+
+// Handles the !say command
+func handleSay(m *discordgo.MessageCreate, guild *discordgo.Guild, text string) {
+	if tts == nil {
+		return
+	}
+
+	text = strings.TrimSpace(text)
+	if text == "" {
+		discord.ChannelMessageSend(m.ChannelID, "Usage: `!say <text>`")
+		return
+	}
+
+	if len(text) > TTS_MAX_LENGTH {
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("That's a bit long, keep it under %d characters", TTS_MAX_LENGTH))
+		return
+	}
+
+	bitrate := encodeBitrate(guild, getCurrentVoiceChannel(m.Author, guild))
+	sound, err := getSpeechSound(text, getGuildSettings(guild.ID).Volume, bitrate)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"error": err,
+		}).Warning("Failed to synthesize speech")
+		return
+	}
+
+	enqueuePlay(m.Author, guild, m.ChannelID, SAY, sound, queue.SOURCE_COMMAND)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/dca"
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	"github.com/noisemaster/airhornbot/pkg/sound"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Directory downloaded sounds are cached in
+	URL_CACHE_DIR = "cache/url"
+
+	// Limits for sounds played from a URL
+	URL_MAX_BYTES  = 1024 * 1024 * 5
+	URL_MAX_FRAMES = 50 * 15
+)
+
+var (
+	// Maximum number of downloaded sounds kept in the on-disk cache
+	URL_CACHE_SIZE = 100
+
+	// Pseudo collection used for plays created from !play
+	URL *sound.Collection = &sound.Collection{
+		Prefix: "url",
+		Commands: []string{
+			"!play",
+		},
+	}
+
+	// Serializes cache eviction
+	urlCacheLock sync.Mutex
+
+	// The only error users see when a link can't be downloaded
+	errURLDownload = errors.New("couldn't download that link")
+)
+
+// Returns true if the content type of a download looks like something we can transcode
+func isAudioContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "audio/") || mediaType == "application/ogg" || mediaType == "video/ogg" || mediaType == "video/webm"
+}
+
+// Returns a playable sound for the audio at the given URL, downloading and
+// transcoding it if it isn't already cached
+func getURLSound(rawurl string, volume, bitrate int) (*sound.Sound, error) {
+	hash := sha1.Sum([]byte(fmt.Sprintf("%d:%d:%s", volume, bitrate, rawurl)))
+	path := filepath.Join(URL_CACHE_DIR, hex.EncodeToString(hash[:])+".dca")
+
+	s := sound.NewStreamed("url", path)
+
+	// Cache hits bump the modification time, which the eviction uses as the LRU order
+	if _, err := os.Stat(path); err == nil {
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return s, nil
+	}
+
+	// What went wrong downloading isn't passed on, it would tell users which
+	// addresses the bot can reach
+	data, resp, err := downloadLimited(rawurl, URL_MAX_BYTES)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"url":   rawurl,
+			"error": err,
+		}).Info("Failed to download sound from url")
+		return nil, errURLDownload
+	}
+
+	if !isAudioContentType(resp.Header.Get("Content-Type")) {
+		return nil, fmt.Errorf("that doesn't look like an audio file")
+	}
+
+	frames, err := encodeDCABytes(data, volume, bitrate)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read that audio file")
+	}
+
+	if len(frames) > URL_MAX_FRAMES {
+		return nil, fmt.Errorf("sounds can be at most %d seconds long", URL_MAX_FRAMES/50)
+	}
+
+	if err := dca.WriteFile(path, frames); err != nil {
+		log.WithFields(log.Fields{
+			"path":  path,
+			"error": err,
+		}).Error("Failed to cache sound from url")
+		return nil, fmt.Errorf("something went wrong, try again later")
+	}
+
+	go evictURLCache()
+	return s, nil
+}
+
+// Removes the least recently used downloads from the cache once it grows past URL_CACHE_SIZE
+func evictURLCache() {
+	urlCacheLock.Lock()
+	defer urlCacheLock.Unlock()
+
+	files, err := ioutil.ReadDir(URL_CACHE_DIR)
+	if err != nil || len(files) <= URL_CACHE_SIZE {
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	for _, file := range files[:len(files)-URL_CACHE_SIZE] {
+		os.Remove(filepath.Join(URL_CACHE_DIR, file.Name()))
+	}
+}
+
+// Handles the !play command
+func handlePlayCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, parts []string) {
+	if len(parts) < 2 {
+		discord.ChannelMessageSend(m.ChannelID, "Usage: `!play <url>`")
+		return
+	}
+
+	// Admins toggle the feature per guild
+	if parts[1] == "allow" || parts[1] == "deny" {
+		if !isGuildAdmin(guild, m.Author.ID, m.ChannelID) {
+			return
+		}
+
+		_, err := updateGuildSettings(guild.ID, func(gs *GuildSettings) {
+			gs.AllowURLPlay = parts[1] == "allow"
+		})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"guild": guild.ID,
+				"error": err,
+			}).Error("Failed to save guild settings")
+			return
+		}
+
+		discord.ChannelMessageSend(m.ChannelID, ":ok_hand:")
+		return
+	}
+
+	settings := getGuildSettings(guild.ID)
+	if !settings.AllowURLPlay {
+		discord.ChannelMessageSend(m.ChannelID, "Playing sounds from links is disabled here, an admin can enable it with `!play allow`")
+		return
+	}
+
+	// Use the original message so the case of the URL is preserved
+	fields := strings.Fields(m.Content)
+	if len(fields) < 2 {
+		return
+	}
+
+	u, err := url.Parse(fields[1])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		discord.ChannelMessageSend(m.ChannelID, "That isn't a valid http(s) link")
+		return
+	}
+
+	bitrate := encodeBitrate(guild, getCurrentVoiceChannel(m.Author, guild))
+	sound, err := getURLSound(u.String(), settings.Volume, bitrate)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"url":   u.String(),
+			"error": err,
+		}).Info("Failed to play sound from url")
+		discord.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Can't play that: %s", err))
+		return
+	}
+
+	enqueuePlay(m.Author, guild, m.ChannelID, URL, sound, queue.SOURCE_COMMAND)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// A voice connection kept open after its guild's queue drained
+type idleConnection struct {
+	vc    *discordgo.VoiceConnection
+	timer *time.Timer
+}
+
+var (
+	// How long voice connections are kept open once there's nothing left to
+	// play, 0 leaves straight away
+	VOICE_IDLE time.Duration
+
+	// Connections waiting for their guild's next play, keyed by guild id
+	idleVoice     map[string]*idleConnection = make(map[string]*idleConnection)
+	idleVoiceLock sync.Mutex
+)
+
+// Keeps the connection open for VOICE_IDLE so the guild's next play can skip
+// joining voice, disconnecting if nothing is played before then
+func keepVoice(vc *discordgo.VoiceConnection) {
+	if VOICE_IDLE <= 0 {
+		vc.Disconnect()
+		return
+	}
+
+	// A play queued right as the last one finished starts a new queue, which
+	// already joined on this connection
+	gid := vc.GuildID
+	if queues.Playing(gid) != nil {
+		return
+	}
+	idle := &idleConnection{vc: vc}
+
+	idleVoiceLock.Lock()
+	if previous := idleVoice[gid]; previous != nil {
+		previous.timer.Stop()
+	}
+	idle.timer = time.AfterFunc(VOICE_IDLE, func() {
+		expireIdleVoice(gid, idle)
+	})
+	idleVoice[gid] = idle
+	idleVoiceLock.Unlock()
+}
+
+// Hands the guild's idle connection to a play that is starting, nil if there
+// is none or it died while idle
+func takeIdleVoice(gid string) *discordgo.VoiceConnection {
+	idleVoiceLock.Lock()
+	idle := idleVoice[gid]
+	delete(idleVoice, gid)
+	idleVoiceLock.Unlock()
+
+	if idle == nil {
+		return nil
+	}
+	idle.timer.Stop()
+
+	idle.vc.RLock()
+	usable := idle.vc.Ready && idle.vc.ChannelID != ""
+	idle.vc.RUnlock()
+	if !usable {
+		idle.vc.Disconnect()
+		return nil
+	}
+	return idle.vc
+}
+
+// Leaves voice once a connection has been idle for VOICE_IDLE, unless a play
+// took it in the meantime
+func expireIdleVoice(gid string, idle *idleConnection) {
+	idleVoiceLock.Lock()
+	if idleVoice[gid] != idle {
+		idleVoiceLock.Unlock()
+		return
+	}
+	delete(idleVoice, gid)
+	idleVoiceLock.Unlock()
+
+	if queues.Playing(gid) != nil {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"guild":   gid,
+		"channel": idle.vc.ChannelID,
+	}).Debug("Leaving idle voice connection")
+	idle.vc.Disconnect()
+}
+
+// Disconnects the guild's idle connection straight away, returning false if
+// it didn't have one
+func dropIdleVoice(gid string) bool {
+	idleVoiceLock.Lock()
+	idle := idleVoice[gid]
+	delete(idleVoice, gid)
+	idleVoiceLock.Unlock()
+
+	if idle == nil {
+		return false
+	}
+	idle.timer.Stop()
+	idle.vc.Disconnect()
+	return true
+}
+
+// Returns the number of connections waiting for their guild's next play
+func idleVoiceCount() int {
+	idleVoiceLock.Lock()
+	defer idleVoiceLock.Unlock()
+	return len(idleVoice)
+}
+
+// Disconnects every idle connection, so the bot doesn't linger in voice
+// channels after shutting down
+func dropAllIdleVoice() {
+	idleVoiceLock.Lock()
+	gids := make([]string, 0, len(idleVoice))
+	for gid := range idleVoice {
+		gids = append(gids, gid)
+	}
+	idleVoiceLock.Unlock()
+
+	for _, gid := range gids {
+		dropIdleVoice(gid)
+	}
+}
+
+// Forgets the idle connection of a guild when the bot is kicked from its
+// voice channel
+func onBotVoiceStateUpdate(s *discordgo.Session, vs *discordgo.VoiceStateUpdate) {
+	if s.State.User == nil || vs.UserID != s.State.User.ID || vs.ChannelID != "" {
+		return
+	}
+	dropIdleVoice(vs.GuildID)
+}
+
+// Forgets the idle connection in a voice channel that was deleted
+func onVoiceChannelDelete(s *discordgo.Session, event *discordgo.ChannelDelete) {
+	idleVoiceLock.Lock()
+	idle := idleVoice[event.GuildID]
+	idleVoiceLock.Unlock()
+
+	if idle != nil && idle.vc.ChannelID == event.ID {
+		dropIdleVoice(event.GuildID)
+	}
+}
+
+// Forgets the idle connection of a guild the bot was removed from
+func onIdleGuildDelete(s *discordgo.Session, event *discordgo.GuildDelete) {
+	dropIdleVoice(event.ID)
+}
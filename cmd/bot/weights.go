@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	"github.com/noisemaster/airhornbot/pkg/redis"
+	"github.com/noisemaster/airhornbot/pkg/sound"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Plays are counted in hourly buckets, and this many of the latest count
+	// as recent for dynamic weights
+	RECENT_PLAY_BUCKETS = 6
+
+	// How much each recent play cuts a sound's weight by, a sound played
+	// n times recently is picked with weight / (1 + n*RECENT_PLAY_DECAY)
+	RECENT_PLAY_DECAY = 0.5
+)
+
+// How random plays pick a sound from a collection, set per guild with
+// `!settings set selection`
+const (
+	// Weighted random picks, the same sound can come up several times in a row
+	SELECTION_RANDOM = "random"
+
+	// Every sound comes up (as often as its weight says) before any repeats
+	SELECTION_SHUFFLE = "shuffle"
+)
+
+var (
+	// Shuffle bags of the guilds using SELECTION_SHUFFLE, keyed by
+	// `<guild id>:<collection prefix>`. They only live in memory, a restart
+	// starts every guild on a fresh pass.
+	shuffleBags     map[string]*sound.Bag = make(map[string]*sound.Bag)
+	shuffleBagsLock sync.Mutex
+)
+
+func selectionMode(gs *GuildSettings) string {
+	if gs.SelectionMode == "" {
+		return SELECTION_RANDOM
+	}
+	return gs.SelectionMode
+}
+
+// Draws the next sound from the guild's shuffle bag for the collection
+func shuffleSound(gid string, coll *sound.Collection) *sound.Sound {
+	key := gid + ":" + coll.Prefix
+
+	shuffleBagsLock.Lock()
+	defer shuffleBagsLock.Unlock()
+
+	// Reloads swap in new collections, which start a new bag
+	bag := shuffleBags[key]
+	if bag == nil || bag.Collection != coll {
+		bag = sound.NewBag(coll)
+		shuffleBags[key] = bag
+	}
+	return bag.Next()
+}
+
+func recentPlaysKey(gid, coll string, bucket int64) string {
+	return fmt.Sprintf("airhorn:guild:%s:recent:%s:%d", gid, coll, bucket)
+}
+
+func recentPlaysBucket(t time.Time) int64 {
+	return t.Unix() / int64(time.Hour/time.Second)
+}
+
+// Returns how often each sound in the collection was played in the guild over
+// the last RECENT_PLAY_BUCKETS hours, keyed by sound name
+func recentPlays(gid, coll string) map[string]int {
+	counts := make(map[string]int)
+	if rcli == nil {
+		return counts
+	}
+
+	now := recentPlaysBucket(time.Now())
+	results := make([]*redis.MapStringStringCmd, RECENT_PLAY_BUCKETS)
+	rcli.Pipelined(func(pipe *redis.Pipeline) error {
+		for i := range results {
+			results[i] = pipe.HGetAll(recentPlaysKey(gid, coll, now-int64(i)))
+		}
+		return nil
+	})
+
+	for _, result := range results {
+		for name, raw := range result.Val() {
+			count, _ := strconv.Atoi(raw)
+			counts[name] += count
+		}
+	}
+	return counts
+}
+
+// Picks a random sound from the collection. Guilds with dynamic weights on get
+// recently played sounds less often.
+func randomSound(gid string, coll *sound.Collection) *sound.Sound {
+	gs := getGuildSettings(gid)
+	if gs.SelectionMode == SELECTION_SHUFFLE {
+		return shuffleSound(gid, coll)
+	}
+
+	if rcli == nil || !gs.DynamicWeights {
+		return coll.Random()
+	}
+
+	counts := recentPlays(gid, coll.Prefix)
+	return coll.RandomWeighted(func(s *sound.Sound) float64 {
+		return 1 / (1 + float64(counts[s.Name])*RECENT_PLAY_DECAY)
+	})
+}
+
+// Counts the play towards the dynamic weights of its guild
+func trackRecentPlay(play *queue.Play) {
+	if rcli == nil || play.Collection == "" || !getGuildSettings(play.GuildID).DynamicWeights {
+		return
+	}
+
+	key := recentPlaysKey(play.GuildID, play.Collection, recentPlaysBucket(time.Now()))
+	rcli.Pipelined(func(pipe *redis.Pipeline) error {
+		pipe.HIncrBy(key, play.Sound.Name, 1)
+		pipe.Expire(key, time.Hour*(RECENT_PLAY_BUCKETS+1))
+		return nil
+	})
+}
+
+// Handles `!weights [collection]`, `!weights on|off` and `!weights reset`,
+// the last three for admins
+func handleWeightsCommand(m *discordgo.MessageCreate, guild *discordgo.Guild, parts []string, dryRun bool) {
+	if rcli == nil {
+		discord.ChannelMessageSend(m.ChannelID, "Dynamic weights require a redis connection")
+		return
+	}
+
+	if len(parts) < 2 || (parts[1] != "on" && parts[1] != "off" && parts[1] != "reset") {
+		displayWeights(m.ChannelID, guild.ID, parts)
+		return
+	}
+
+	if !isGuildAdmin(guild, m.Author.ID, m.ChannelID) {
+		discord.ChannelMessageSend(m.ChannelID, "Only server admins can change how sounds are picked")
+		return
+	}
+
+	if parts[1] == "reset" {
+		resetRecentPlays(m.ChannelID, guild.ID)
+		return
+	}
+
+	on := parts[1] == "on"
+	update := func(gs *GuildSettings) {
+		gs.DynamicWeights = on
+	}
+
+	if dryRun {
+		if changes, err := settingsChanges(guild.ID, update); err == nil {
+			reportDryRun(m.ChannelID, changes)
+		}
+		return
+	}
+
+	if _, err := updateGuildSettings(guild.ID, update); err != nil {
+		log.WithFields(log.Fields{
+			"guild": guild.ID,
+			"error": err,
+		}).Error("Failed to save guild settings")
+		return
+	}
+	discord.ChannelMessageSend(m.ChannelID, ":ok_hand:")
+}
+
+// Forgets every recent play in the guild, so all sounds are back to their
+// normal weight
+func resetRecentPlays(cid, gid string) {
+	keys, err := rcli.Keys(fmt.Sprintf("airhorn:guild:%s:recent:*", gid)).Result()
+	if err == nil && len(keys) > 0 {
+		err = rcli.Del(keys...).Err()
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"guild": gid,
+			"error": err,
+		}).Error("Failed to reset recent plays")
+		return
+	}
+	discord.ChannelMessageSend(cid, ":ok_hand: every sound is back to its normal weight")
+}
+
+// Shows whether dynamic weights are on, and with a collection the chance each
+// of its sounds currently has of being picked
+func displayWeights(cid, gid string, parts []string) {
+	gs := getGuildSettings(gid)
+	status := "off, sounds are picked by their normal weight"
+	if gs.DynamicWeights {
+		status = "on, recently played sounds are picked less often"
+	}
+
+	if len(parts) < 2 {
+		discord.ChannelMessageSend(cid, fmt.Sprintf("Dynamic weights are %s. See a collection's odds with `!weights <collection>`", status))
+		return
+	}
+
+	coll := findCollection(strings.TrimPrefix(parts[1], "!"))
+	if coll == nil {
+		discord.ChannelMessageSend(cid, fmt.Sprintf("There is no collection %s", parts[1]))
+		return
+	}
+
+	counts := map[string]int{}
+	if gs.DynamicWeights {
+		counts = recentPlays(gid, coll.Prefix)
+	}
+
+	weights := make(map[string]float64, len(coll.Sounds))
+	total := 0.0
+	for _, s := range coll.Sounds {
+		weights[s.Name] = float64(s.Weight) / (1 + float64(counts[s.Name])*RECENT_PLAY_DECAY)
+		total += weights[s.Name]
+	}
+
+	names := make([]string, 0, len(weights))
+	for name := range weights {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return weights[names[i]] > weights[names[j]]
+	})
+
+	lines := make([]string, len(names))
+	for i, name := range names {
+		chance := 0.0
+		if total > 0 {
+			chance = weights[name] / total * 100
+		}
+		lines[i] = fmt.Sprintf("**%s** - %.1f%% (%d recent plays)", name, chance, counts[name])
+	}
+
+	discord.ChannelMessageSendEmbed(cid, &discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("%s odds", coll.Prefix),
+		Color:       0xE5343A,
+		Description: fmt.Sprintf("Dynamic weights are %s\n\n%s", status, strings.Join(lines, "\n")),
+	})
+}
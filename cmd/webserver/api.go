@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/noisemaster/airhornbot/pkg/stats"
+)
+
+// Describes a JSON endpoint, used both to register it and to document it in
+// the OpenAPI spec served at /api/openapi.json
+type apiRoute struct {
+	Path    string
+	Summary string
+	Handler http.HandlerFunc
+
+	// A value of the type the endpoint responds with, only used for the spec
+	Response interface{}
+
+	// If true the route is only served with a redis connection
+	NeedsRedis bool
+}
+
+var apiRoutes = []*apiRoute{
+	{
+		Path:     "/me",
+		Summary:  "The user making the request, empty if they aren't logged in",
+		Handler:  handleMe,
+		Response: AuthUser{},
+	},
+	{
+		Path:       "/api/stats",
+		Summary:    "Play counters, the same values pushed over /events",
+		Handler:    handleStatsJSON,
+		Response:   CountUpdate{},
+		NeedsRedis: true,
+	},
+	{
+		Path:       "/api/rates",
+		Summary:    "Plays per second and over the last minute, hour and day",
+		Handler:    handleRatesJSON,
+		Response:   stats.Rates{},
+		NeedsRedis: true,
+	},
+	{
+		Path:       "/gallery.json",
+		Summary:    "Every custom sound published to the gallery, newest first",
+		Handler:    handleGalleryJSON,
+		Response:   []*GalleryEntry{},
+		NeedsRedis: true,
+	},
+}
+
+// Adds the api routes (and the spec describing them) to the server
+func registerAPIRoutes(server *http.ServeMux) {
+	routes := make([]*apiRoute, 0, len(apiRoutes))
+	for _, route := range apiRoutes {
+		if route.NeedsRedis && rcli == nil {
+			continue
+		}
+
+		server.HandleFunc(route.Path, route.Handler)
+		routes = append(routes, route)
+	}
+
+	spec, _ := json.Marshal(openAPISpec(routes))
+	server.HandleFunc("/api/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(spec)
+	})
+}
+
+func handleStatsJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(NewCountUpdate().ToJSON())
+}
+
+func handleRatesJSON(w http.ResponseWriter, r *http.Request) {
+	rates, err := stats.NewTracker(rcli).Rates()
+	if err != nil {
+		http.Error(w, "Failed to fetch play rates", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rates)
+}
+
+// Builds an OpenAPI 3 document for the routes
+func openAPISpec(routes []*apiRoute) map[string]interface{} {
+	paths := make(map[string]interface{}, len(routes))
+	for _, route := range routes {
+		paths[route.Path] = map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": route.Summary,
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{
+						"description": "OK",
+						"content": map[string]interface{}{
+							"application/json": map[string]interface{}{
+								"schema": schemaFor(reflect.TypeOf(route.Response)),
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   "Airhorn",
+			"version": "1",
+		},
+		"paths": paths,
+	}
+}
+
+// Returns the JSON schema of a type as encoding/json would marshal it
+func schemaFor(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaFor(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "-" || field.PkgPath != "" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = schemaFor(field.Type)
+		}
+		return map[string]interface{}{"type": "object", "properties": properties}
+	}
+	return map[string]interface{}{}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AuthUser is the user a request was made by
+type AuthUser struct {
+	Username string `json:"username"`
+	Tag      string `json:"tag"`
+}
+
+// AuthProvider identifies the user behind a request
+type AuthProvider interface {
+	// Adds any routes the provider needs, e.g. an oauth callback
+	Routes(server *http.ServeMux)
+
+	// Returns the user making the request, or nil if the provider can't identify them
+	Authenticate(r *http.Request) *AuthUser
+}
+
+var (
+	// Providers tried in order for every request, set with -auth
+	authProviders []AuthProvider
+)
+
+// Returns the user making the request according to the first provider that knows them
+func currentUser(r *http.Request) *AuthUser {
+	for _, provider := range authProviders {
+		if user := provider.Authenticate(r); user != nil {
+			return user
+		}
+	}
+	return nil
+}
+
+// Wraps a handler so it's only served to authenticated users
+func requireAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if currentUser(r) == nil {
+			http.Error(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Logs users in through discord oauth2, keeping them in the session cookie
+type discordAuth struct{}
+
+func (discordAuth) Routes(server *http.ServeMux) {
+	server.HandleFunc("/login", handleLogin)
+	server.HandleFunc("/callback", handleCallback)
+}
+
+func (discordAuth) Authenticate(r *http.Request) *AuthUser {
+	session, _ := store.Get(r, "session")
+	if session == nil {
+		return nil
+	}
+
+	username, _ := session.Values["username"].(string)
+	if username == "" {
+		return nil
+	}
+
+	tag, _ := session.Values["tag"].(string)
+	return &AuthUser{Username: username, Tag: tag}
+}
+
+// Accepts static api tokens sent as `Authorization: Bearer <token>`
+type tokenAuth struct {
+	// Maps each token to the name of the user it belongs to
+	tokens map[string]string
+}
+
+// Reads a file with a `<token> <name>` pair on every line, skipping blank
+// lines and lines starting with #
+func newTokenAuth(path string) (*tokenAuth, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ta := &tokenAuth{tokens: make(map[string]string)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid token line %q, expected `<token> <name>`", line)
+		}
+		ta.tokens[fields[0]] = fields[1]
+	}
+	return ta, scanner.Err()
+}
+
+func (*tokenAuth) Routes(server *http.ServeMux) {}
+
+func (ta *tokenAuth) Authenticate(r *http.Request) *AuthUser {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+
+	for known, name := range ta.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+			return &AuthUser{Username: name}
+		}
+	}
+	return nil
+}
+
+// Trusts a header set by a reverse proxy that has already authenticated the
+// user. Only enable this behind a proxy that strips the header from clients.
+type headerAuth struct {
+	header string
+}
+
+func (*headerAuth) Routes(server *http.ServeMux) {}
+
+func (ha *headerAuth) Authenticate(r *http.Request) *AuthUser {
+	username := r.Header.Get(ha.header)
+	if username == "" {
+		return nil
+	}
+	return &AuthUser{Username: username}
+}
+
+// Builds the providers named in a comma separated list
+func setupAuthProviders(names, tokenFile, header string) error {
+	authProviders = nil
+	for _, name := range strings.Split(names, ",") {
+		var provider AuthProvider
+		switch strings.TrimSpace(name) {
+		case "discord":
+			provider = discordAuth{}
+		case "token":
+			if tokenFile == "" {
+				return fmt.Errorf("token auth requires -tokens")
+			}
+
+			ta, err := newTokenAuth(tokenFile)
+			if err != nil {
+				return err
+			}
+			provider = ta
+		case "header":
+			if header == "" {
+				return fmt.Errorf("header auth requires -authheader")
+			}
+			provider = &headerAuth{header: header}
+		default:
+			return fmt.Errorf("unknown auth provider %q", name)
+		}
+		authProviders = append(authProviders, provider)
+	}
+
+	log.WithFields(log.Fields{
+		"providers": names,
+	}).Info("Configured web authentication")
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Template for the public sound gallery page
+var galleryTemplate *template.Template
+
+// Represents a custom sound a guild published to the gallery, written to redis by the bot
+type GalleryEntry struct {
+	ID        string    `json:"id"`
+	GuildID   string    `json:"guild_id"`
+	GuildName string    `json:"guild_name"`
+	Name      string    `json:"name"`
+	Publisher string    `json:"publisher"`
+	Published time.Time `json:"published"`
+	Imports   int       `json:"imports"`
+}
+
+// Returns every gallery entry, newest first
+func getGalleryEntries() ([]*GalleryEntry, error) {
+	data, err := rcli.HGetAll("airhorn:gallery").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*GalleryEntry, 0, len(data))
+	for _, raw := range data {
+		entry := &GalleryEntry{}
+		if json.Unmarshal([]byte(raw), entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Published.After(entries[j].Published)
+	})
+	return entries, nil
+}
+
+func handleGallery(w http.ResponseWriter, r *http.Request) {
+	entries, err := getGalleryEntries()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to load gallery entries")
+		http.Error(w, "Failed to load the gallery", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = galleryTemplate.Execute(w, entries)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to render gallery")
+	}
+}
+
+func handleGalleryJSON(w http.ResponseWriter, r *http.Request) {
+	entries, err := getGalleryEntries()
+	if err != nil {
+		http.Error(w, "Failed to load the gallery", http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(entries)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
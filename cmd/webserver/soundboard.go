@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Template for the web soundboard page
+	soundboardTemplate *template.Template
+
+	// Key soundboard plays are signed with, shared with the bot
+	remotePlaySecret string
+)
+
+// A play requested from the soundboard, published to the bot over redis
+type RemotePlay struct {
+	GuildID    string    `json:"guild_id"`
+	UserID     string    `json:"user_id"`
+	Collection string    `json:"collection"`
+	Sound      string    `json:"sound"`
+	Sent       time.Time `json:"sent"`
+	Signature  string    `json:"signature"`
+}
+
+// A collection and its sounds, written to redis by the bot
+type CatalogCollection struct {
+	Prefix string   `json:"prefix"`
+	Sounds []string `json:"sounds"`
+}
+
+// What the soundboard page is rendered with
+type soundboardPage struct {
+	Guilds      []*discordgo.UserGuild
+	Guild       string
+	Collections []*CatalogCollection
+	CSRF        string
+	Played      bool
+}
+
+// Signs the remote play the same way the bot checks it
+func signRemotePlay(rp *RemotePlay) {
+	mac := hmac.New(sha256.New, []byte(remotePlaySecret))
+	fmt.Fprintf(mac, "%s:%s:%s:%s:%d", rp.GuildID, rp.UserID, rp.Collection, rp.Sound, rp.Sent.Unix())
+	rp.Signature = hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the guilds the user is in according to discord
+func fetchUserGuilds(token string) ([]*discordgo.UserGuild, error) {
+	req, err := http.NewRequest("GET", apiBaseUrl+"/users/@me/guilds", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := &http.Client{Timeout: (20 * time.Second)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discord responded with %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	guilds := make([]*discordgo.UserGuild, 0)
+	return guilds, json.Unmarshal(body, &guilds)
+}
+
+// Keeps only the guilds the bot is in
+func sharedGuilds(guilds []*discordgo.UserGuild) ([]*discordgo.UserGuild, error) {
+	results := make([]*redis.BoolCmd, len(guilds))
+	_, err := rcli.Pipelined(func(pipe *redis.Pipeline) error {
+		for i, guild := range guilds {
+			results[i] = pipe.SIsMember("airhorn:bot:guilds", guild.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	shared := make([]*discordgo.UserGuild, 0)
+	for i, guild := range guilds {
+		if results[i].Val() {
+			shared = append(shared, guild)
+		}
+	}
+	return shared, nil
+}
+
+func getCatalog() ([]*CatalogCollection, error) {
+	data, err := rcli.Get("airhorn:catalog").Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	catalog := make([]*CatalogCollection, 0)
+	if data == "" {
+		return catalog, nil
+	}
+	return catalog, json.Unmarshal([]byte(data), &catalog)
+}
+
+// Shows the sounds of every collection, for the guilds the logged in user
+// shares with the bot. Clicking one plays it in the user's voice channel.
+func handleSoundboard(w http.ResponseWriter, r *http.Request) {
+	session := getSessionOrAbort(w, r)
+	if session == nil {
+		return
+	}
+
+	token, _ := session.Values["token"].(string)
+	if token == "" || session.Values["user_id"] == nil {
+		http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+		return
+	}
+
+	guilds, err := fetchUserGuilds(token)
+	if err == nil {
+		guilds, err = sharedGuilds(guilds)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to load the user's guilds")
+		http.Error(w, "Failed to load your servers", http.StatusInternalServerError)
+		return
+	}
+
+	catalog, err := getCatalog()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to load the sound catalog")
+		http.Error(w, "Failed to load the sounds", http.StatusInternalServerError)
+		return
+	}
+
+	// Plays are only accepted with the token from the page, so other sites
+	// can't post them on the user's behalf
+	csrf, _ := session.Values["csrf"].(string)
+	if csrf == "" {
+		csrf = randSeq(32)
+		session.Values["csrf"] = csrf
+		session.Save(r, w)
+	}
+
+	page := &soundboardPage{
+		Guilds:      guilds,
+		Guild:       r.FormValue("guild"),
+		Collections: catalog,
+		CSRF:        csrf,
+		Played:      r.FormValue("played") == "1",
+	}
+	if page.Guild == "" && len(guilds) > 0 {
+		page.Guild = guilds[0].ID
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := soundboardTemplate.Execute(w, page); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to render soundboard")
+	}
+}
+
+// Sends a soundboard click to the bot, which plays it if the user is in a
+// voice channel in that guild
+func handleSoundboardPlay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session := getSessionOrAbort(w, r)
+	if session == nil {
+		return
+	}
+
+	uid, _ := session.Values["user_id"].(string)
+	csrf, _ := session.Values["csrf"].(string)
+	if uid == "" || csrf == "" || !hmac.Equal([]byte(csrf), []byte(r.FormValue("csrf"))) {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+
+	rp := &RemotePlay{
+		GuildID:    r.FormValue("guild"),
+		UserID:     uid,
+		Collection: r.FormValue("collection"),
+		Sound:      r.FormValue("sound"),
+		Sent:       time.Now(),
+	}
+	if rp.GuildID == "" || rp.Collection == "" || rp.Sound == "" {
+		http.Error(w, "Missing guild, collection or sound", http.StatusBadRequest)
+		return
+	}
+	signRemotePlay(rp)
+
+	data, _ := json.Marshal(rp)
+	if err := rcli.Publish("airhorn:remoteplay", string(data)).Err(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to send soundboard play")
+		http.Error(w, "Failed to play the sound", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/soundboard?played=1&guild="+url.QueryEscape(rp.GuildID), http.StatusSeeOther)
+}
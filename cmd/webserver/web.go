@@ -5,13 +5,14 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	log "github.com/Sirupsen/logrus"
 	"github.com/antage/eventsource"
 	"github.com/bwmarrin/discordgo"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/sessions"
+	"github.com/noisemaster/airhornbot/pkg/redis"
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
-	redis "gopkg.in/redis.v3"
+	"html/template"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
@@ -230,6 +231,7 @@ func handleCallback(w http.ResponseWriter, r *http.Request) {
 
 	// Finally write some information to the session store
 	session.Values["token"] = token.AccessToken
+	session.Values["user_id"] = user.ID
 	session.Values["username"] = user.Username
 	session.Values["tag"] = user.Discriminator
 	delete(session.Values, "state")
@@ -240,13 +242,12 @@ func handleCallback(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleMe(w http.ResponseWriter, r *http.Request) {
-	session, _ := store.Get(r, "session")
-
-	body, err := json.Marshal(map[string]interface{}{
-		"username": session.Values["username"],
-		"tag":      session.Values["tag"],
-	})
+	user := currentUser(r)
+	if user == nil {
+		user = &AuthUser{}
+	}
 
+	body, err := json.Marshal(user)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -259,15 +260,27 @@ func handleMe(w http.ResponseWriter, r *http.Request) {
 func server() {
 	server := http.NewServeMux()
 	server.Handle("/", http.FileServer(http.Dir("static/dist")))
-	server.HandleFunc("/me", handleMe)
-	server.HandleFunc("/login", handleLogin)
-	server.HandleFunc("/callback", handleCallback)
+	for _, provider := range authProviders {
+		provider.Routes(server)
+	}
+	registerAPIRoutes(server)
 
 	// Only add this route if we have stats to push (e.g. redis connection)
 	if es != nil {
 		server.Handle("/events", es)
 	}
 
+	// The sound gallery is also stored in redis
+	if rcli != nil {
+		server.HandleFunc("/gallery", handleGallery)
+	}
+
+	// The soundboard sends plays to the bot over redis, signed with the shared key
+	if rcli != nil && remotePlaySecret != "" {
+		server.HandleFunc("/soundboard", handleSoundboard)
+		server.HandleFunc("/soundboard/play", handleSoundboardPlay)
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "14000"
@@ -335,6 +348,10 @@ func main() {
 		ClientID     = flag.String("i", "", "OAuth2 Client ID")
 		ClientSecret = flag.String("s", "", "OAtuh2 Client Secret")
 		Redis        = flag.String("r", "", "Redis Connection String")
+		Auth         = flag.String("auth", "discord", "Comma separated auth providers to try (discord, token, header)")
+		Tokens       = flag.String("tokens", "", "File of `<token> <name>` lines accepted by token auth")
+		AuthHeader   = flag.String("authheader", "", "Header a reverse proxy sets to the authenticated user, for header auth")
+		RemoteSecret = flag.String("remotesecret", "", "Key shared with the bot to sign soundboard plays, the soundboard is off without one")
 		err          error
 	)
 	flag.Parse()
@@ -361,6 +378,32 @@ func main() {
 	}
 	htmlIndexPage = string(data)
 
+	// Load the sound gallery page
+	galleryTemplate, err = template.ParseFiles("templates/gallery.html")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to open gallery.html")
+		return
+	}
+
+	// Load the soundboard page
+	soundboardTemplate, err = template.ParseFiles("templates/soundboard.html")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to open soundboard.html")
+		return
+	}
+	remotePlaySecret = *RemoteSecret
+
+	if err := setupAuthProviders(*Auth, *Tokens, *AuthHeader); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to configure web authentication")
+		return
+	}
+
 	// Create a cookie store
 	store = sessions.NewCookieStore([]byte(*ClientSecret))
 
@@ -373,7 +416,7 @@ func main() {
 	oauthConf = &oauth2.Config{
 		ClientID:     *ClientID,
 		ClientSecret: *ClientSecret,
-		Scopes:       []string{"bot", "identify"},
+		Scopes:       []string{"bot", "identify", "guilds"},
 		Endpoint:     endpoint,
 		RedirectURL:  "https://airhornbot.com/callback",
 	}
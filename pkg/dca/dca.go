@@ -0,0 +1,257 @@
+// Package dca reads and writes DCA files, the length prefixed opus frames
+// (optionally behind a DCA1 metadata header) the sounds are stored as. Lengths
+// come from the file, so they are checked before anything is allocated.
+package dca
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// Largest metadata block ReadMetadata accepts
+	maxMetadata = 1024 * 1024
+
+	// Largest opus packet a DCA frame can hold, the packet size libopus
+	// recommends encoding into
+	maxOpusFrame = 4000
+)
+
+// ErrTruncatedLength is returned by ReadFrame when a stream ends part way
+// through a frame's length prefix
+var ErrTruncatedLength = errors.New("frame length is truncated")
+
+// Magic bytes DCA1 files start with, followed by the metadata size and block
+var dcaMagic = []byte("DCA1")
+
+// Metadata is the JSON block at the start of DCA1 files. Raw DCA files have none.
+type Metadata struct {
+	DCA struct {
+		Version int `json:"version"`
+		Tool    struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+			URL     string `json:"url"`
+			Author  string `json:"author"`
+		} `json:"tool"`
+	} `json:"dca"`
+
+	Opus struct {
+		Mode       string `json:"mode"`
+		SampleRate int    `json:"sample_rate"`
+		FrameSize  int    `json:"frame_size"`
+		Bitrate    int    `json:"abr"`
+		VBR        bool   `json:"vbr"`
+		Channels   int    `json:"channels"`
+	} `json:"opus"`
+
+	Info struct {
+		Title    string `json:"title"`
+		Artist   string `json:"artist"`
+		Album    string `json:"album"`
+		Genre    string `json:"genre"`
+		Comments string `json:"comments"`
+	} `json:"info"`
+
+	Origin struct {
+		Source   string `json:"source"`
+		Bitrate  int    `json:"abr"`
+		Channels int    `json:"channels"`
+		Encoding string `json:"encoding"`
+		URL      string `json:"url"`
+	} `json:"origin"`
+
+	Extra map[string]interface{} `json:"extra"`
+}
+
+// ReadMetadata reads the DCA1 header from the start of a stream, returning
+// nil metadata without consuming anything if the stream is raw DCA
+func ReadMetadata(r *bufio.Reader) (*Metadata, error) {
+	magic, err := r.Peek(len(dcaMagic))
+	if err != nil || !bytes.Equal(magic, dcaMagic) {
+		// Too short to have a header, let the frame reader deal with it
+		return nil, nil
+	}
+	r.Discard(len(dcaMagic))
+
+	var size int32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	if size < 0 || size > maxMetadata {
+		return nil, fmt.Errorf("invalid DCA1 metadata size %d", size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	meta := &Metadata{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, fmt.Errorf("invalid DCA1 metadata: %s", err)
+	}
+	return meta, nil
+}
+
+// Read reads DCA opus frames from a stream until EOF, skipping the
+// metadata of DCA1 files
+func Read(r io.Reader) ([][]byte, error) {
+	frames, _, err := ReadWithMetadata(r)
+	return frames, err
+}
+
+// ReadWithMetadata reads the metadata (nil for raw DCA) and every opus
+// frame from a stream
+func ReadWithMetadata(r io.Reader) ([][]byte, *Metadata, error) {
+	br := bufio.NewReader(r)
+	meta, err := ReadMetadata(br)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	frames, err := readFrames(br)
+	return frames, meta, err
+}
+
+func readFrames(r io.Reader) ([][]byte, error) {
+	frames := make([][]byte, 0)
+
+	for {
+		frame, err := ReadFrame(r)
+
+		// If this is the end of the file, just return
+		if err == io.EOF {
+			return frames, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		// append encoded pcm data to the buffer
+		frames = append(frames, frame)
+	}
+}
+
+// ReadFrame reads a single opus frame from a DCA stream, returning io.EOF
+// at the end of the stream. The length prefix comes from the file, so it's
+// checked before anything is allocated for the frame. A stream ending part
+// way through a length prefix is truncated, not finished.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var opuslen int16
+
+	// read opus frame length from dca file
+	err := binary.Read(r, binary.LittleEndian, &opuslen)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+
+	if err == io.ErrUnexpectedEOF {
+		return nil, ErrTruncatedLength
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkFrameLength(opuslen); err != nil {
+		return nil, err
+	}
+
+	// read encoded pcm from dca file
+	InBuf := make([]byte, opuslen)
+	if _, err := io.ReadFull(r, InBuf); err != nil {
+		// Should not be any end of file errors
+		return nil, fmt.Errorf("frame is truncated: %s", err)
+	}
+
+	return InBuf, nil
+}
+
+// Rejects frame lengths no opus packet can have, like the negative ones a
+// corrupted length prefix reads as
+func checkFrameLength(opuslen int16) error {
+	if opuslen <= 0 || opuslen > maxOpusFrame {
+		return fmt.Errorf("invalid frame length %d", opuslen)
+	}
+	return nil
+}
+
+// Verify checks that the DCA file at path has a valid header and at least
+// one complete opus frame, returning the number of frames
+func Verify(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	if _, err := ReadMetadata(r); err != nil {
+		return 0, err
+	}
+
+	frames := 0
+	for {
+		var opuslen int16
+		err := binary.Read(r, binary.LittleEndian, &opuslen)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return frames, fmt.Errorf("truncated frame length after frame %d", frames)
+		}
+
+		if err := checkFrameLength(opuslen); err != nil {
+			return frames, fmt.Errorf("frame %d: %s", frames+1, err)
+		}
+
+		if _, err := r.Discard(int(opuslen)); err != nil {
+			return frames, fmt.Errorf("frame %d is truncated", frames+1)
+		}
+		frames++
+	}
+
+	if frames == 0 {
+		return 0, fmt.Errorf("no opus frames")
+	}
+	return frames, nil
+}
+
+// Write writes opus frames out in the raw DCA format
+func Write(w io.Writer, frames [][]byte) error {
+	for _, frame := range frames {
+		err := binary.Write(w, binary.LittleEndian, int16(len(frame)))
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(frame)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteFile writes opus frames to a DCA file, creating any missing directories
+func WriteFile(path string, frames [][]byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return Write(file, frames)
+}
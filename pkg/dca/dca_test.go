@@ -0,0 +1,253 @@
+package dca
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// Builds a DCA frame with the given length prefix and size bytes of payload
+func dcaFrame(prefix int16, size int) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, prefix)
+	buf.Write(bytes.Repeat([]byte{0xAB}, size))
+	return buf.Bytes()
+}
+
+func TestReadFrame(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  int
+		err   string
+	}{
+		{"empty stream", nil, 0, "EOF"},
+		{"single byte prefix", []byte{0x05}, 0, "frame length is truncated"},
+		{"zero length", dcaFrame(0, 0), 0, "invalid frame length 0"},
+		{"negative length", dcaFrame(-1, 8), 0, "invalid frame length -1"},
+		{"oversized length", dcaFrame(maxOpusFrame+1, 8), 0, "invalid frame length 4001"},
+		{"largest length", dcaFrame(maxOpusFrame, maxOpusFrame), maxOpusFrame, ""},
+		{"truncated frame", dcaFrame(10, 4), 0, "frame is truncated"},
+		{"missing frame", dcaFrame(10, 0), 0, "frame is truncated"},
+		{"complete frame", dcaFrame(3, 3), 3, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame, err := ReadFrame(bytes.NewReader(test.input))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				if frame != nil {
+					t.Fatalf("got a %d byte frame along with the error", len(frame))
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(frame) != test.want {
+				t.Fatalf("got a %d byte frame, want %d", len(frame), test.want)
+			}
+		})
+	}
+}
+
+func TestReadFrameEOF(t *testing.T) {
+	r := bytes.NewReader(append(dcaFrame(2, 2), dcaFrame(1, 1)...))
+	for i := 0; i < 2; i++ {
+		if _, err := ReadFrame(r); err != nil {
+			t.Fatalf("frame %d: %s", i, err)
+		}
+	}
+
+	if _, err := ReadFrame(r); err != io.EOF {
+		t.Fatalf("got %v at the end of the stream, want io.EOF", err)
+	}
+}
+
+func TestReadMetadata(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		err   string
+	}{
+		{"raw dca", dcaFrame(3, 3), ""},
+		{"short stream", []byte("DC"), ""},
+		{"truncated size", []byte("DCA1\x01"), "EOF"},
+		{"negative size", []byte("DCA1\xff\xff\xff\xff"), "invalid DCA1 metadata size -1"},
+		{"oversized size", []byte("DCA1\x01\x00\x10\x00"), "invalid DCA1 metadata size"},
+		{"truncated block", []byte("DCA1\x10\x00\x00\x00{}"), "EOF"},
+		{"invalid json", []byte("DCA1\x02\x00\x00\x00{{"), "invalid DCA1 metadata"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ReadMetadata(bufio.NewReader(bytes.NewReader(test.input)))
+			if test.err == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	frames := [][]byte{{1}, bytes.Repeat([]byte{2}, 300), bytes.Repeat([]byte{3}, maxOpusFrame)}
+
+	buf := &bytes.Buffer{}
+	if err := Write(buf, frames); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(frames) {
+		t.Fatalf("read %d frames, wrote %d", len(read), len(frames))
+	}
+	for i := range frames {
+		if !bytes.Equal(read[i], frames[i]) {
+			t.Fatalf("frame %d doesn't match", i)
+		}
+	}
+}
+
+// Describes what the readers make of a fixture, compared against its golden file
+func describeDCA(path string) string {
+	out := &strings.Builder{}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err.Error()
+	}
+	defer file.Close()
+
+	frames, meta, err := ReadWithMetadata(file)
+	if meta != nil {
+		fmt.Fprintf(out, "metadata: %s %dHz %d channels, %q\n", meta.Opus.Mode, meta.Opus.SampleRate, meta.Opus.Channels, meta.Info.Title)
+	}
+	if err != nil {
+		fmt.Fprintf(out, "read: %s\n", err)
+	} else {
+		fmt.Fprintf(out, "read: %d frames\n", len(frames))
+	}
+	for i, frame := range frames {
+		fmt.Fprintf(out, "  frame %d: %d bytes %x\n", i, len(frame), sha256.Sum256(frame))
+	}
+
+	count, err := Verify(path)
+	if err != nil {
+		fmt.Fprintf(out, "verify: %s\n", err)
+	} else {
+		fmt.Fprintf(out, "verify: %d frames\n", count)
+	}
+	return out.String()
+}
+
+func TestDCAGolden(t *testing.T) {
+	fixtures, err := filepath.Glob("testdata/*.dca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("no fixtures in testdata")
+	}
+
+	for _, fixture := range fixtures {
+		name := strings.TrimSuffix(filepath.Base(fixture), ".dca")
+		t.Run(name, func(t *testing.T) {
+			got := describeDCA(fixture)
+			golden := strings.TrimSuffix(fixture, ".dca") + ".golden"
+
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%s, run with -update to create it", err)
+			}
+			if got != string(want) {
+				t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+// Readers and Verify have to agree on which streams are valid
+func TestVerifyMatchesRead(t *testing.T) {
+	fixtures, _ := filepath.Glob("testdata/*.dca")
+	for _, fixture := range fixtures {
+		file, err := os.Open(fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames, readErr := Read(file)
+		file.Close()
+
+		count, verifyErr := Verify(fixture)
+		valid := readErr == nil && len(frames) > 0
+		if valid != (verifyErr == nil) {
+			t.Errorf("%s: Read returned %d frames and %v, Verify returned %v", fixture, len(frames), readErr, verifyErr)
+		}
+		if verifyErr == nil && count != len(frames) {
+			t.Errorf("%s: Verify counted %d frames, Read read %d", fixture, count, len(frames))
+		}
+	}
+}
+
+func FuzzReadFrame(f *testing.F) {
+	fixtures, _ := filepath.Glob("testdata/*.dca")
+	for _, fixture := range fixtures {
+		if data, err := os.ReadFile(fixture); err == nil {
+			f.Add(data)
+		}
+	}
+	f.Add([]byte{0x05})
+	f.Add(dcaFrame(-32768, 0))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		consumed := 0
+
+		for {
+			frame, err := ReadFrame(r)
+			if err == io.EOF {
+				if consumed != len(data) {
+					t.Fatalf("io.EOF after %d of %d bytes", consumed, len(data))
+				}
+				return
+			}
+			if err != nil {
+				if frame != nil {
+					t.Fatal("frame returned along with an error")
+				}
+				return
+			}
+
+			if len(frame) == 0 || len(frame) > maxOpusFrame {
+				t.Fatalf("read a %d byte frame", len(frame))
+			}
+			consumed += 2 + len(frame)
+		}
+	})
+}
@@ -0,0 +1,58 @@
+package queue
+
+import (
+	"time"
+)
+
+// Drain plays play, the plays chained to it and then the rest of its guild's
+// queue one after another, calling playOne for every play that isn't
+// skipped. Once the queue is empty it waits out the last sound's PartDelay,
+// playing anything queued in the meantime, before the queue is removed.
+//
+// A chain gives way to plays with a higher priority queued while it plays,
+// the rest of it is queued again behind them.
+//
+// A play playOne fails is dropped along with its chain. Drain carries on with
+// the queue if the guild still has one, otherwise (the queue was removed,
+// eg. when everyone left) it returns the error straight away.
+func (m *Manager) Drain(play *Play, playOne func(play *Play) error) error {
+	gid := play.GuildID
+
+	for play != nil {
+		if play.Skip != nil && play.Skip() {
+			play.Drop()
+			play = m.Next(gid)
+			continue
+		}
+
+		m.SetPlaying(play)
+		if err := playOne(play); err != nil {
+			play.Drop()
+
+			// A queue that was removed might already have been replaced by
+			// a new one, which is someone else's to play
+			if m.Playing(gid) != play {
+				return err
+			}
+			play = m.Next(gid)
+			continue
+		}
+		play.Finish()
+
+		// Chained sounds play before anything else in the queue of the same
+		// or a lower priority. Enqueue only starts a new queue, which is
+		// then ours to play, if the queue was removed in the meantime.
+		if next := play.Next; next != nil {
+			if !m.Outranked(next) || m.Enqueue(next) {
+				play = next
+				continue
+			}
+		}
+
+		if m.Len(gid) == 0 && play.Sound != nil {
+			time.Sleep(time.Millisecond * time.Duration(play.Sound.PartDelay))
+		}
+		play = m.Next(gid)
+	}
+	return nil
+}
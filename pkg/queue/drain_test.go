@@ -0,0 +1,290 @@
+package queue
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/noisemaster/airhornbot/pkg/sound"
+)
+
+// Plays queued plays into a ChannelSender, the way the bot plays them into a
+// voice connection, recording the order they were played in
+type testPlayer struct {
+	out  *sound.ChannelSender
+	stop chan struct{}
+
+	sync.Mutex
+	played []string
+
+	// Called instead of playing the play, if set
+	play func(p *Play) error
+}
+
+func newTestPlayer(t *testing.T) *testPlayer {
+	p := &testPlayer{
+		out:  &sound.ChannelSender{C: make(chan []byte)},
+		stop: make(chan struct{}),
+	}
+
+	go func() {
+		for range p.out.C {
+		}
+	}()
+	t.Cleanup(func() { close(p.out.C) })
+	return p
+}
+
+func (p *testPlayer) playOne(play *Play) error {
+	p.Lock()
+	p.played = append(p.played, play.ID)
+	p.Unlock()
+
+	if p.play != nil {
+		return p.play(play)
+	}
+	return play.Sound.PlayTo(p.out, p.stop)
+}
+
+func (p *testPlayer) order() []string {
+	p.Lock()
+	defer p.Unlock()
+	return append([]string(nil), p.played...)
+}
+
+// A play of a single frame sound, counting in done when it's over
+func newDrainPlay(id string, partDelay int, done *int) *Play {
+	s := sound.NewFromFrames(id, [][]byte{{0x01}})
+	s.PartDelay = partDelay
+
+	play := &Play{ID: id, GuildID: "guild", ChannelID: "a", Sound: s}
+	if done != nil {
+		play.Done = func() { *done++ }
+	}
+	return play
+}
+
+func TestDrainPlaysChain(t *testing.T) {
+	m := NewManager(10)
+	player := newTestPlayer(t)
+
+	var done int
+	head := newDrainPlay("head", 0, &done)
+	head.Next = newDrainPlay("anotha", 0, &done)
+	head.Next.Next = newDrainPlay("one", 0, &done)
+
+	m.Enqueue(head)
+	if err := m.Drain(head, player.playOne); err != nil {
+		t.Fatal(err)
+	}
+
+	expectOrder(t, player.order(), "head", "anotha", "one")
+	if done != 3 {
+		t.Fatalf("%d plays finished, want 3", done)
+	}
+	if m.Playing("guild") != nil {
+		t.Fatal("queue wasn't removed once it was drained")
+	}
+}
+
+func TestDrainPlaysQueueAfterChain(t *testing.T) {
+	m := NewManager(10)
+	player := newTestPlayer(t)
+
+	head := newDrainPlay("head", 0, nil)
+	head.Next = newDrainPlay("chained", 0, nil)
+	m.Enqueue(head)
+	m.Enqueue(newDrainPlay("queued1", 0, nil))
+	m.Enqueue(newDrainPlay("queued2", 0, nil))
+
+	if err := m.Drain(head, player.playOne); err != nil {
+		t.Fatal(err)
+	}
+	expectOrder(t, player.order(), "head", "chained", "queued1", "queued2")
+}
+
+func TestDrainChainGivesWayToHigherPriority(t *testing.T) {
+	m := NewManager(10)
+	player := newTestPlayer(t)
+
+	var done int
+	head := newDrainPlay("bomb1", 0, &done)
+	head.Next = newDrainPlay("bomb2", 0, &done)
+	head.Next.Next = newDrainPlay("bomb3", 0, &done)
+	m.Enqueue(head)
+	m.Enqueue(newDrainPlay("low", 0, &done))
+
+	// An owner play queued while the bomb goes off plays after the current
+	// horn, the rest of the bomb keeps its place among the low priority plays
+	player.play = func(p *Play) error {
+		if p.ID == "bomb1" {
+			owner := newDrainPlay("owner", 0, &done)
+			owner.Priority = PRIORITY_OWNER
+			m.Enqueue(owner)
+		}
+		return p.Sound.PlayTo(player.out, player.stop)
+	}
+
+	if err := m.Drain(head, player.playOne); err != nil {
+		t.Fatal(err)
+	}
+	expectOrder(t, player.order(), "bomb1", "owner", "low", "bomb2", "bomb3")
+	if done != 5 {
+		t.Fatalf("%d plays finished, want 5", done)
+	}
+}
+
+func TestDrainSkipsChain(t *testing.T) {
+	m := NewManager(10)
+	player := newTestPlayer(t)
+
+	var done int
+	skipped := newDrainPlay("skipped", 0, &done)
+	skipped.Next = newDrainPlay("skipped2", 0, &done)
+	skipped.Skip = func() bool { return true }
+	skipped.Next.Skip = skipped.Skip
+
+	m.Enqueue(skipped)
+	m.Enqueue(newDrainPlay("queued", 0, &done))
+
+	if err := m.Drain(skipped, player.playOne); err != nil {
+		t.Fatal(err)
+	}
+	expectOrder(t, player.order(), "queued")
+	if done != 3 {
+		t.Fatalf("%d plays finished, want 3", done)
+	}
+}
+
+func TestDrainCancellation(t *testing.T) {
+	m := NewManager(10)
+	player := newTestPlayer(t)
+
+	var done int
+	head := newDrainPlay("head", 0, &done)
+	head.Next = newDrainPlay("chained", 0, &done)
+	m.Enqueue(head)
+	m.Enqueue(newDrainPlay("queued", 0, &done))
+
+	// Everyone leaves while the first sound plays, which drops the queue and
+	// stops playback
+	player.play = func(p *Play) error {
+		m.Remove("guild")
+		close(player.stop)
+		return p.Sound.PlayTo(player.out, player.stop)
+	}
+
+	if err := m.Drain(head, player.playOne); err != sound.ErrStopped {
+		t.Fatalf("got %v, want ErrStopped", err)
+	}
+	expectOrder(t, player.order(), "head")
+	if done != 3 {
+		t.Fatalf("%d plays finished, want 3", done)
+	}
+}
+
+func TestDrainCarriesOnAfterFailure(t *testing.T) {
+	m := NewManager(10)
+	player := newTestPlayer(t)
+
+	var done int
+	head := newDrainPlay("head", 0, &done)
+	head.Next = newDrainPlay("chained", 0, &done)
+	m.Enqueue(head)
+	m.Enqueue(newDrainPlay("queued", 0, &done))
+
+	player.play = func(p *Play) error {
+		if p.ID == "head" {
+			return errors.New("voice connection stalled")
+		}
+		return p.Sound.PlayTo(player.out, player.stop)
+	}
+
+	if err := m.Drain(head, player.playOne); err != nil {
+		t.Fatal(err)
+	}
+	expectOrder(t, player.order(), "head", "queued")
+	if done != 3 {
+		t.Fatalf("%d plays finished, want 3", done)
+	}
+}
+
+func TestDrainStopsWhenQueueIsReplaced(t *testing.T) {
+	m := NewManager(10)
+	player := newTestPlayer(t)
+
+	head := newDrainPlay("head", 0, nil)
+	m.Enqueue(head)
+
+	// Joining voice failed and removed the queue, and a new play started a
+	// queue of its own before Drain noticed
+	replacement := newDrainPlay("replacement", 0, nil)
+	player.play = func(p *Play) error {
+		m.Remove("guild")
+		m.Enqueue(replacement)
+		m.Enqueue(newDrainPlay("theirs", 0, nil))
+		return errors.New("failed to join voice")
+	}
+
+	if err := m.Drain(head, player.playOne); err == nil {
+		t.Fatal("no error from a failed play")
+	}
+	expectOrder(t, player.order(), "head")
+	if m.Playing("guild") != replacement || m.Len("guild") != 1 {
+		t.Fatal("Drain took plays from the queue that replaced its own")
+	}
+}
+
+func TestDrainPartDelay(t *testing.T) {
+	m := NewManager(10)
+	player := newTestPlayer(t)
+
+	head := newDrainPlay("head", 200, nil)
+	m.Enqueue(head)
+
+	// A play queued while the last sound's part delay runs is still played
+	queued := make(chan bool, 1)
+	player.play = func(p *Play) error {
+		err := p.Sound.PlayTo(player.out, player.stop)
+		if p.ID == "head" {
+			time.AfterFunc(time.Millisecond*50, func() {
+				queued <- m.Enqueue(newDrainPlay("late", 0, nil))
+			})
+		}
+		return err
+	}
+
+	start := time.Now()
+	if err := m.Drain(head, player.playOne); err != nil {
+		t.Fatal(err)
+	}
+	if <-queued {
+		t.Fatal("play during the part delay started a new queue")
+	}
+	expectOrder(t, player.order(), "head", "late")
+	if elapsed := time.Since(start); elapsed < time.Millisecond*200 {
+		t.Fatalf("drained in %s, before the part delay was over", elapsed)
+	}
+}
+
+func TestDrainPartDelayExpires(t *testing.T) {
+	m := NewManager(10)
+	player := newTestPlayer(t)
+
+	head := newDrainPlay("head", 50, nil)
+	m.Enqueue(head)
+
+	start := time.Now()
+	if err := m.Drain(head, player.playOne); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*50 {
+		t.Fatalf("drained in %s, before the part delay was over", elapsed)
+	}
+
+	// Once drained the guild starts over with a new queue
+	if !m.Enqueue(newDrainPlay("next", 0, nil)) {
+		t.Fatal("play after the part delay didn't start a new queue")
+	}
+}
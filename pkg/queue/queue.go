@@ -0,0 +1,373 @@
+// Package queue holds the per guild queues plays wait in while the bot is
+// busy playing another sound in that guild.
+package queue
+
+import (
+	"container/heap"
+	"crypto/rand"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/noisemaster/airhornbot/pkg/sound"
+)
+
+// Play represents an individual use of the !airhorn command
+type Play struct {
+	// Unique id used to follow a play through logs and stats
+	ID string
+
+	GuildID   string
+	ChannelID string
+	UserID    string
+	Sound     *sound.Sound
+
+	// Prefix of the collection the sound is from
+	Collection string
+
+	// Text channel the play was requested from, empty if it wasn't requested in one
+	TextChannelID string
+
+	// The next play to occur after this, only used for chaining sounds like anotha
+	Next *Play
+
+	// If true, this was a forced play using a specific airhorn sound name
+	Forced bool
+
+	// The experiment and variant this play was bucketed into, if any
+	Experiment string
+	Variant    string
+
+	// What triggered the play, one of the SOURCE_ constants
+	Source string
+
+	// Plays with a higher priority jump ahead in the guild queue
+	Priority int
+
+	// If set it's called just before the play starts, returning true skips the
+	// play and anything chained to it
+	Skip func() bool
+
+	// If set the sound doesn't start before this time, used to line up
+	// synchronized plays across guilds
+	StartAt time.Time
+
+	// If set it's called once the play is over, whether it was played, skipped
+	// or dropped without ever playing. Chained plays call their own.
+	Done func()
+
+	// Set once Done has been called
+	finished int32
+}
+
+// Finish calls the play's Done, only the first time it's called
+func (p *Play) Finish() {
+	if atomic.CompareAndSwapInt32(&p.finished, 0, 1) && p.Done != nil {
+		p.Done()
+	}
+}
+
+// Drop finishes the play and everything chained to it, for plays that end
+// up never being played
+func (p *Play) Drop() {
+	for ; p != nil; p = p.Next {
+		p.Finish()
+	}
+}
+
+// Sources a play can be triggered from
+const (
+	SOURCE_COMMAND    = "command"
+	SOURCE_SLASH      = "slash"
+	SOURCE_SOUNDBOARD = "soundboard"
+	SOURCE_BOMB       = "bomb"
+	SOURCE_WEB        = "web"
+	SOURCE_TWITCH     = "twitch"
+	SOURCE_SCHEDULER  = "scheduler"
+	SOURCE_ENTRANCE   = "entrance"
+	SOURCE_FOLLOW     = "follow"
+	SOURCE_SYNC       = "sync"
+	SOURCE_DM         = "dm"
+	SOURCE_VOICE      = "voice"
+	SOURCE_API        = "api"
+)
+
+// Priorities plays are queued with
+const (
+	PRIORITY_LOW = iota
+	PRIORITY_NORMAL
+	PRIORITY_HIGH
+	PRIORITY_OWNER
+)
+
+// NewID returns a random (version 4) UUID for a play
+func NewID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Manager tracks a bounded priority queue of plays for every guild currently
+// playing sounds. Plays with a higher Priority are played first, plays with
+// the same priority in the order they were queued.
+type Manager struct {
+	size int
+
+	// If set and true for a guild, plays of the same priority take turns
+	// between voice channels instead of going strictly in order, so one busy
+	// channel can't hold up everyone else. A bot can only be in one voice
+	// channel per guild, so channels still play one at a time.
+	Fair func(guildID string) bool
+
+	sync.Mutex
+	queues map[string]*guildQueue
+}
+
+type guildQueue struct {
+	plays []*queuedPlay
+	seq   int
+
+	// The play the guild is currently playing
+	playing *Play
+
+	// With fair queuing, the turn of the play that was played last and the
+	// last turn handed to each voice channel
+	round  int
+	rounds map[string]int
+}
+
+type queuedPlay struct {
+	play  *Play
+	seq   int
+	round int
+}
+
+func (q *guildQueue) Len() int { return len(q.plays) }
+func (q *guildQueue) Less(i, j int) bool {
+	if q.plays[i].play.Priority != q.plays[j].play.Priority {
+		return q.plays[i].play.Priority > q.plays[j].play.Priority
+	}
+	if q.plays[i].round != q.plays[j].round {
+		return q.plays[i].round < q.plays[j].round
+	}
+	return q.plays[i].seq < q.plays[j].seq
+}
+func (q *guildQueue) Swap(i, j int)      { q.plays[i], q.plays[j] = q.plays[j], q.plays[i] }
+func (q *guildQueue) Push(x interface{}) { q.plays = append(q.plays, x.(*queuedPlay)) }
+func (q *guildQueue) Pop() interface{} {
+	last := q.plays[len(q.plays)-1]
+	q.plays = q.plays[:len(q.plays)-1]
+	return last
+}
+
+// Returns the index of the play that would be played last
+func (q *guildQueue) last() int {
+	last := 0
+	for i := range q.plays {
+		if q.Less(last, i) {
+			last = i
+		}
+	}
+	return last
+}
+
+// NewManager creates a Manager whose guild queues hold at most size plays
+func NewManager(size int) *Manager {
+	return &Manager{
+		size:   size,
+		queues: make(map[string]*guildQueue),
+	}
+}
+
+// Enqueue adds a play to its guild's queue. If the guild wasn't playing
+// anything a new queue is created and true is returned, the caller is then
+// responsible for playing it and draining the queue with Next. When a queue
+// is full the play is dropped, unless it has a higher priority than the last
+// play in the queue, which is dropped instead.
+func (m *Manager) Enqueue(play *Play) bool {
+	fair := m.Fair != nil && m.Fair(play.GuildID)
+
+	// Dropped plays are finished once the lock is released, so their Done
+	// can use the manager
+	var dropped *Play
+	defer func() {
+		if dropped != nil {
+			dropped.Drop()
+		}
+	}()
+
+	m.Lock()
+	defer m.Unlock()
+
+	q, exists := m.queues[play.GuildID]
+	if !exists {
+		m.queues[play.GuildID] = &guildQueue{
+			playing: play,
+			rounds:  map[string]int{play.ChannelID: 0},
+		}
+		return true
+	}
+
+	// Each channel gets one turn per round, a channel that queues a lot is
+	// pushed back to later rounds while the others catch up
+	round := 0
+	if fair {
+		round = q.round
+		if last, ok := q.rounds[play.ChannelID]; ok && last > round {
+			round = last
+		}
+		round++
+	}
+
+	q.seq++
+	if q.Len() >= m.size {
+		last := q.last()
+		if q.plays[last].play.Priority >= play.Priority {
+			dropped = play
+			return false
+		}
+		dropped = heap.Remove(q, last).(*queuedPlay).play
+	}
+	heap.Push(q, &queuedPlay{play: play, seq: q.seq, round: round})
+	if fair {
+		q.rounds[play.ChannelID] = round
+	}
+	return false
+}
+
+// Next returns the next queued play for a guild. When the queue is empty it
+// is removed and nil is returned, so the next Enqueue starts a new one.
+func (m *Manager) Next(guildID string) *Play {
+	m.Lock()
+	defer m.Unlock()
+
+	q, exists := m.queues[guildID]
+	if !exists || q.Len() == 0 {
+		delete(m.queues, guildID)
+		return nil
+	}
+
+	next := heap.Pop(q).(*queuedPlay)
+	if next.round > q.round {
+		q.round = next.round
+	}
+	q.playing = next.play
+	return q.playing
+}
+
+// SetPlaying records the play as the one its guild is currently playing, for
+// plays that didn't come out of the queue like the rest of a chain
+func (m *Manager) SetPlaying(play *Play) {
+	m.Lock()
+	defer m.Unlock()
+
+	if q, exists := m.queues[play.GuildID]; exists {
+		q.playing = play
+	}
+}
+
+// Playing returns the play a guild is currently playing, nil if it's idle
+func (m *Manager) Playing(guildID string) *Play {
+	m.Lock()
+	defer m.Unlock()
+
+	if q, exists := m.queues[guildID]; exists {
+		return q.playing
+	}
+	return nil
+}
+
+// Outranked returns true if a play with a higher priority than play is
+// waiting in its guild's queue
+func (m *Manager) Outranked(play *Play) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	q, exists := m.queues[play.GuildID]
+	return exists && q.Len() > 0 && q.plays[0].play.Priority > play.Priority
+}
+
+// Pending returns the plays waiting in a guild's queue, in the order they
+// will be played
+func (m *Manager) Pending(guildID string) []*Play {
+	m.Lock()
+	defer m.Unlock()
+
+	q, exists := m.queues[guildID]
+	if !exists {
+		return nil
+	}
+
+	sorted := &guildQueue{plays: make([]*queuedPlay, len(q.plays))}
+	copy(sorted.plays, q.plays)
+	sort.Sort(sorted)
+
+	plays := make([]*Play, len(sorted.plays))
+	for i, qp := range sorted.plays {
+		plays[i] = qp.play
+	}
+	return plays
+}
+
+// Clear drops the plays waiting in a guild's queue, returning how many there
+// were. Unlike Remove the guild keeps playing what it currently is.
+func (m *Manager) Clear(guildID string) int {
+	m.Lock()
+	q, exists := m.queues[guildID]
+	if !exists {
+		m.Unlock()
+		return 0
+	}
+
+	dropped := q.plays
+	q.plays = nil
+	m.Unlock()
+
+	dropPlays(dropped)
+	return len(dropped)
+}
+
+// Remove drops a guild's queue and any plays waiting in it
+func (m *Manager) Remove(guildID string) {
+	m.Lock()
+	q := m.queues[guildID]
+	delete(m.queues, guildID)
+	m.Unlock()
+
+	if q != nil {
+		dropPlays(q.plays)
+	}
+}
+
+func dropPlays(plays []*queuedPlay) {
+	for _, qp := range plays {
+		qp.play.Drop()
+	}
+}
+
+// Totals returns the number of guilds with a queue (those playing something)
+// and the plays waiting across all of them
+func (m *Manager) Totals() (guilds int, waiting int) {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, q := range m.queues {
+		waiting += q.Len()
+	}
+	return len(m.queues), waiting
+}
+
+// Len returns the number of plays waiting in a guild's queue
+func (m *Manager) Len(guildID string) int {
+	m.Lock()
+	defer m.Unlock()
+
+	if q, exists := m.queues[guildID]; exists {
+		return q.Len()
+	}
+	return 0
+}
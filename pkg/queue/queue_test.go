@@ -0,0 +1,214 @@
+package queue
+
+import (
+	"testing"
+)
+
+func newTestPlay(id, channel string, priority int) *Play {
+	return &Play{ID: id, GuildID: "guild", ChannelID: channel, Priority: priority}
+}
+
+// Drains the guild's queue, returning the ids in the order they'd be played
+func drain(m *Manager, gid string) []string {
+	ids := make([]string, 0)
+	for play := m.Next(gid); play != nil; play = m.Next(gid) {
+		ids = append(ids, play.ID)
+	}
+	return ids
+}
+
+func expectOrder(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestEnqueueStartsQueue(t *testing.T) {
+	m := NewManager(10)
+
+	first := newTestPlay("first", "a", PRIORITY_NORMAL)
+	if !m.Enqueue(first) {
+		t.Fatal("first play didn't start a queue")
+	}
+	if m.Playing("guild") != first {
+		t.Fatal("first play isn't playing")
+	}
+	if m.Enqueue(newTestPlay("second", "a", PRIORITY_NORMAL)) {
+		t.Fatal("second play started another queue")
+	}
+	if m.Len("guild") != 1 {
+		t.Fatalf("%d plays waiting, want 1", m.Len("guild"))
+	}
+}
+
+func TestPriorityOrdering(t *testing.T) {
+	m := NewManager(10)
+	m.Enqueue(newTestPlay("playing", "a", PRIORITY_NORMAL))
+
+	m.Enqueue(newTestPlay("low", "a", PRIORITY_LOW))
+	m.Enqueue(newTestPlay("normal1", "a", PRIORITY_NORMAL))
+	m.Enqueue(newTestPlay("owner", "a", PRIORITY_OWNER))
+	m.Enqueue(newTestPlay("normal2", "a", PRIORITY_NORMAL))
+	m.Enqueue(newTestPlay("high", "a", PRIORITY_HIGH))
+
+	pending := m.Pending("guild")
+	ids := make([]string, len(pending))
+	for i, play := range pending {
+		ids[i] = play.ID
+	}
+	expectOrder(t, ids, "owner", "high", "normal1", "normal2", "low")
+	expectOrder(t, drain(m, "guild"), "owner", "high", "normal1", "normal2", "low")
+}
+
+func TestFairRounds(t *testing.T) {
+	m := NewManager(10)
+	m.Fair = func(string) bool { return true }
+	m.Enqueue(newTestPlay("playing", "a", PRIORITY_NORMAL))
+
+	// One busy channel queues three plays before the others get a turn, its
+	// later plays wait for the rounds the others are in to finish
+	m.Enqueue(newTestPlay("a1", "a", PRIORITY_NORMAL))
+	m.Enqueue(newTestPlay("a2", "a", PRIORITY_NORMAL))
+	m.Enqueue(newTestPlay("a3", "a", PRIORITY_NORMAL))
+	m.Enqueue(newTestPlay("b1", "b", PRIORITY_NORMAL))
+	m.Enqueue(newTestPlay("c1", "c", PRIORITY_NORMAL))
+	m.Enqueue(newTestPlay("b2", "b", PRIORITY_NORMAL))
+
+	expectOrder(t, drain(m, "guild"), "a1", "b1", "c1", "a2", "b2", "a3")
+}
+
+func TestFairRoundsKeepPriority(t *testing.T) {
+	m := NewManager(10)
+	m.Fair = func(string) bool { return true }
+	m.Enqueue(newTestPlay("playing", "a", PRIORITY_NORMAL))
+
+	m.Enqueue(newTestPlay("a1", "a", PRIORITY_NORMAL))
+	m.Enqueue(newTestPlay("a2", "a", PRIORITY_NORMAL))
+	m.Enqueue(newTestPlay("b1", "b", PRIORITY_NORMAL))
+	m.Enqueue(newTestPlay("owner", "a", PRIORITY_OWNER))
+
+	expectOrder(t, drain(m, "guild"), "owner", "a1", "b1", "a2")
+}
+
+func TestUnfairIsFIFO(t *testing.T) {
+	m := NewManager(10)
+	m.Enqueue(newTestPlay("playing", "a", PRIORITY_NORMAL))
+
+	m.Enqueue(newTestPlay("a1", "a", PRIORITY_NORMAL))
+	m.Enqueue(newTestPlay("a2", "a", PRIORITY_NORMAL))
+	m.Enqueue(newTestPlay("b1", "b", PRIORITY_NORMAL))
+
+	expectOrder(t, drain(m, "guild"), "a1", "a2", "b1")
+}
+
+func TestNextRemovesEmptiedQueue(t *testing.T) {
+	m := NewManager(10)
+	m.Enqueue(newTestPlay("playing", "a", PRIORITY_NORMAL))
+	m.Enqueue(newTestPlay("queued", "a", PRIORITY_NORMAL))
+
+	if next := m.Next("guild"); next == nil || next.ID != "queued" {
+		t.Fatalf("got %v, want the queued play", next)
+	}
+	if guilds, _ := m.Totals(); guilds != 1 {
+		t.Fatal("queue was removed while its last play is playing")
+	}
+
+	if next := m.Next("guild"); next != nil {
+		t.Fatalf("got %s from an empty queue", next.ID)
+	}
+	if guilds, _ := m.Totals(); guilds != 0 {
+		t.Fatal("emptied queue wasn't removed")
+	}
+	if m.Playing("guild") != nil {
+		t.Fatal("guild is still playing")
+	}
+	if !m.Enqueue(newTestPlay("again", "a", PRIORITY_NORMAL)) {
+		t.Fatal("play after the queue emptied didn't start a new queue")
+	}
+}
+
+func TestFullQueue(t *testing.T) {
+	m := NewManager(2)
+	m.Enqueue(newTestPlay("playing", "a", PRIORITY_NORMAL))
+
+	dropped := make([]string, 0)
+	queue := func(id string, priority int) {
+		play := newTestPlay(id, "a", priority)
+		play.Done = func() { dropped = append(dropped, id) }
+		m.Enqueue(play)
+	}
+
+	queue("low", PRIORITY_LOW)
+	queue("normal", PRIORITY_NORMAL)
+
+	// Same priority as the last play, so it's the one dropped
+	queue("low2", PRIORITY_LOW)
+	expectOrder(t, dropped, "low2")
+
+	// A higher priority displaces the last play
+	queue("high", PRIORITY_HIGH)
+	expectOrder(t, dropped, "low2", "low")
+
+	expectOrder(t, drain(m, "guild"), "high", "normal")
+}
+
+func TestRemoveAndClearDropPlays(t *testing.T) {
+	m := NewManager(10)
+	m.Enqueue(newTestPlay("playing", "a", PRIORITY_NORMAL))
+
+	done := 0
+	for i := 0; i < 3; i++ {
+		play := newTestPlay("queued", "a", PRIORITY_NORMAL)
+		play.Done = func() { done++ }
+		m.Enqueue(play)
+	}
+
+	if cleared := m.Clear("guild"); cleared != 3 || done != 3 {
+		t.Fatalf("cleared %d plays and finished %d, want 3", cleared, done)
+	}
+	if m.Playing("guild") == nil {
+		t.Fatal("Clear stopped the playing play")
+	}
+
+	play := newTestPlay("queued", "a", PRIORITY_NORMAL)
+	play.Done = func() { done++ }
+	m.Enqueue(play)
+	m.Remove("guild")
+	if done != 4 {
+		t.Fatal("Remove didn't finish the queued play")
+	}
+	if m.Playing("guild") != nil {
+		t.Fatal("guild is still playing after Remove")
+	}
+}
+
+func TestDropFinishesChainOnce(t *testing.T) {
+	done := 0
+	head := &Play{Done: func() { done++ }}
+	head.Next = &Play{Done: func() { done++ }}
+	head.Next.Next = &Play{}
+
+	head.Finish()
+	head.Drop()
+	head.Drop()
+
+	if done != 2 {
+		t.Fatalf("Done was called %d times, want once for each of 2 plays", done)
+	}
+}
+
+func TestNewID(t *testing.T) {
+	id := NewID()
+	if len(id) != 36 || id[14] != '4' {
+		t.Fatalf("%s isn't a version 4 UUID", id)
+	}
+	if NewID() == id {
+		t.Fatal("got the same id twice")
+	}
+}
@@ -0,0 +1,234 @@
+// Package redis is the thin wrapper the bot, webserver and stats use to talk
+// to redis. It keeps the calls the code makes in one place, so moving to
+// another client version only touches this package. Commands use a
+// background context, the client's timeouts bound them.
+package redis
+
+import (
+	"context"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// Nil is the error replies for missing keys come with
+const Nil = goredis.Nil
+
+// Types of the client and its replies, usable without importing the client
+type (
+	Options            = goredis.Options
+	Cmder              = goredis.Cmder
+	Cmd                = goredis.Cmd
+	StatusCmd          = goredis.StatusCmd
+	StringCmd          = goredis.StringCmd
+	IntCmd             = goredis.IntCmd
+	BoolCmd            = goredis.BoolCmd
+	FloatCmd           = goredis.FloatCmd
+	DurationCmd        = goredis.DurationCmd
+	StringSliceCmd     = goredis.StringSliceCmd
+	MapStringStringCmd = goredis.MapStringStringCmd
+	ZSliceCmd          = goredis.ZSliceCmd
+	Z                  = goredis.Z
+	Message            = goredis.Message
+)
+
+// Keys SCAN is asked for at a time
+const SCAN_COUNT = 1000
+
+var background = context.Background()
+
+// The commands clients and pipelines have in common
+type commands struct {
+	c goredis.Cmdable
+}
+
+// Client is a connection pool to a redis server
+type Client struct {
+	commands
+	client *goredis.Client
+}
+
+// Pipeline queues commands to be sent to redis at once
+type Pipeline struct {
+	commands
+}
+
+// PubSub is a subscription to one or more channels
+type PubSub struct {
+	pubsub *goredis.PubSub
+}
+
+// NewClient creates a client for the server in opt, it connects on first use
+func NewClient(opt *Options) *Client {
+	client := goredis.NewClient(opt)
+	return &Client{commands: commands{client}, client: client}
+}
+
+func (c *Client) Close() error {
+	return c.client.Close()
+}
+
+// Pipelined sends the commands fn queues in a single round trip, returning
+// the first error any of them failed with
+func (c *Client) Pipelined(fn func(pipe *Pipeline) error) ([]Cmder, error) {
+	return c.client.Pipelined(background, func(pipe goredis.Pipeliner) error {
+		return fn(&Pipeline{commands{pipe}})
+	})
+}
+
+// Subscribe subscribes to the channels, returning once redis confirmed it
+func (c *Client) Subscribe(channels ...string) (*PubSub, error) {
+	pubsub := c.client.Subscribe(background, channels...)
+	if _, err := pubsub.Receive(background); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	return &PubSub{pubsub}, nil
+}
+
+// ScanKeys returns the keys matching pattern. It walks the keyspace with SCAN
+// a few keys at a time, so unlike KEYS it doesn't block redis while it runs.
+func (c *Client) ScanKeys(pattern string) ([]string, error) {
+	keys := make([]string, 0)
+	iter := c.client.Scan(background, 0, pattern, SCAN_COUNT).Iterator()
+	for iter.Next(background) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// ReceiveMessage waits for the next message published to the subscription
+func (ps *PubSub) ReceiveMessage() (*Message, error) {
+	return ps.pubsub.ReceiveMessage(background)
+}
+
+func (ps *PubSub) Close() error {
+	return ps.pubsub.Close()
+}
+
+// Converts string arguments for the variadic commands that take any value
+func values(strs []string) []interface{} {
+	vals := make([]interface{}, len(strs))
+	for i, s := range strs {
+		vals[i] = s
+	}
+	return vals
+}
+
+func (c commands) Ping() *StatusCmd {
+	return c.c.Ping(background)
+}
+
+func (c commands) Publish(channel, message string) *IntCmd {
+	return c.c.Publish(background, channel, message)
+}
+
+func (c commands) Eval(script string, keys []string, args []string) *Cmd {
+	return c.c.Eval(background, script, keys, values(args)...)
+}
+
+func (c commands) Keys(pattern string) *StringSliceCmd {
+	return c.c.Keys(background, pattern)
+}
+
+func (c commands) Del(keys ...string) *IntCmd {
+	return c.c.Del(background, keys...)
+}
+
+// Exists returns the number of the keys that exist
+func (c commands) Exists(keys ...string) *IntCmd {
+	return c.c.Exists(background, keys...)
+}
+
+func (c commands) Expire(key string, expiration time.Duration) *BoolCmd {
+	return c.c.Expire(background, key, expiration)
+}
+
+func (c commands) PTTL(key string) *DurationCmd {
+	return c.c.PTTL(background, key)
+}
+
+func (c commands) Get(key string) *StringCmd {
+	return c.c.Get(background, key)
+}
+
+func (c commands) Set(key string, value interface{}, expiration time.Duration) *StatusCmd {
+	return c.c.Set(background, key, value, expiration)
+}
+
+func (c commands) SetNX(key string, value interface{}, expiration time.Duration) *BoolCmd {
+	return c.c.SetNX(background, key, value, expiration)
+}
+
+func (c commands) Incr(key string) *IntCmd {
+	return c.c.Incr(background, key)
+}
+
+func (c commands) HGet(key, field string) *StringCmd {
+	return c.c.HGet(background, key, field)
+}
+
+func (c commands) HGetAll(key string) *MapStringStringCmd {
+	return c.c.HGetAll(background, key)
+}
+
+// HSet sets a single field, returning 1 if the field is new
+func (c commands) HSet(key, field string, value interface{}) *IntCmd {
+	return c.c.HSet(background, key, field, value)
+}
+
+func (c commands) HDel(key string, fields ...string) *IntCmd {
+	return c.c.HDel(background, key, fields...)
+}
+
+func (c commands) HIncrBy(key, field string, incr int64) *IntCmd {
+	return c.c.HIncrBy(background, key, field, incr)
+}
+
+func (c commands) LPush(key string, elements ...string) *IntCmd {
+	return c.c.LPush(background, key, values(elements)...)
+}
+
+func (c commands) LTrim(key string, start, stop int64) *StatusCmd {
+	return c.c.LTrim(background, key, start, stop)
+}
+
+func (c commands) LRem(key string, count int64, value interface{}) *IntCmd {
+	return c.c.LRem(background, key, count, value)
+}
+
+func (c commands) LRange(key string, start, stop int64) *StringSliceCmd {
+	return c.c.LRange(background, key, start, stop)
+}
+
+func (c commands) SAdd(key string, members ...string) *IntCmd {
+	return c.c.SAdd(background, key, values(members)...)
+}
+
+func (c commands) SRem(key string, members ...string) *IntCmd {
+	return c.c.SRem(background, key, values(members)...)
+}
+
+func (c commands) SMembers(key string) *StringSliceCmd {
+	return c.c.SMembers(background, key)
+}
+
+func (c commands) SIsMember(key string, member string) *BoolCmd {
+	return c.c.SIsMember(background, key, member)
+}
+
+func (c commands) SCard(key string) *IntCmd {
+	return c.c.SCard(background, key)
+}
+
+func (c commands) ZIncrBy(key string, increment float64, member string) *FloatCmd {
+	return c.c.ZIncrBy(background, key, increment, member)
+}
+
+func (c commands) ZRevRangeWithScores(key string, start, stop int64) *ZSliceCmd {
+	return c.c.ZRevRangeWithScores(background, key, start, stop)
+}
+
+func (c commands) ZRem(key string, members ...string) *IntCmd {
+	return c.c.ZRem(background, key, values(members)...)
+}
@@ -0,0 +1,98 @@
+package sound
+
+import (
+	"math/rand"
+)
+
+const (
+	// Most draws a bag holds before it's refilled. Collections with weights
+	// that don't reduce below this are scaled down to it.
+	maxBagSize = 1000
+)
+
+// Bag deals out the sounds of a collection in a shuffled order. Every sound is
+// in the bag as many times as its weight, reduced by the weights' common
+// divisor, so a full pass plays each sound in proportion to its weight
+// without the streaks Random can produce.
+type Bag struct {
+	Collection *Collection
+
+	draws []*Sound
+	last  *Sound
+}
+
+// NewBag creates an empty bag for the collection, filled on the first Next
+func NewBag(coll *Collection) *Bag {
+	return &Bag{Collection: coll}
+}
+
+// Next takes the next sound out of the bag, refilling and shuffling it once
+// it's empty. The first sound of a new pass is never the last one of the
+// previous pass, unless the collection only has one sound.
+func (b *Bag) Next() *Sound {
+	if len(b.draws) == 0 {
+		b.fill()
+		if len(b.draws) == 0 {
+			return nil
+		}
+	}
+
+	next := b.draws[len(b.draws)-1]
+	b.draws = b.draws[:len(b.draws)-1]
+	b.last = next
+	return next
+}
+
+func (b *Bag) fill() {
+	divisor := 0
+	total := 0
+	for _, s := range b.Collection.Sounds {
+		if s.Weight > 0 {
+			divisor = gcd(divisor, s.Weight)
+			total += s.Weight
+		}
+	}
+	if total == 0 {
+		return
+	}
+	total /= divisor
+
+	for _, s := range b.Collection.Sounds {
+		if s.Weight <= 0 {
+			continue
+		}
+
+		copies := s.Weight / divisor
+		if total > maxBagSize {
+			copies = copies * maxBagSize / total
+			if copies < 1 {
+				copies = 1
+			}
+		}
+		for i := 0; i < copies; i++ {
+			b.draws = append(b.draws, s)
+		}
+	}
+
+	rand.Shuffle(len(b.draws), func(i, j int) {
+		b.draws[i], b.draws[j] = b.draws[j], b.draws[i]
+	})
+
+	// Draws come off the end, so that's where a repeat of the last sound would be
+	end := len(b.draws) - 1
+	if b.draws[end] == b.last {
+		for i := end - 1; i >= 0; i-- {
+			if b.draws[i] != b.last {
+				b.draws[i], b.draws[end] = b.draws[end], b.draws[i]
+				break
+			}
+		}
+	}
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
@@ -0,0 +1,76 @@
+package sound
+
+import (
+	"testing"
+)
+
+func TestBagPassFollowsWeights(t *testing.T) {
+	coll := newTestCollection(2, 4, 0, 6)
+	bag := NewBag(coll)
+
+	// The weights reduce to 1, 2 and 3, so a pass is 6 draws
+	for pass := 0; pass < 10; pass++ {
+		counts := make(map[*Sound]int)
+		for i := 0; i < 6; i++ {
+			counts[bag.Next()]++
+		}
+
+		for _, s := range coll.Sounds {
+			if counts[s] != s.Weight/2 {
+				t.Fatalf("pass %d played %s %d times, want %d", pass, s.Name, counts[s], s.Weight/2)
+			}
+		}
+	}
+}
+
+func TestBagDoesNotRepeatAcrossPasses(t *testing.T) {
+	coll := newTestCollection(1, 1, 1)
+	bag := NewBag(coll)
+
+	last := bag.Next()
+	for i := 1; i < 3000; i++ {
+		next := bag.Next()
+		if next == last {
+			t.Fatalf("%s played twice in a row at draw %d", next.Name, i)
+		}
+		last = next
+	}
+}
+
+func TestBagSingleSound(t *testing.T) {
+	coll := newTestCollection(3)
+	bag := NewBag(coll)
+	for i := 0; i < 10; i++ {
+		if bag.Next() != coll.Sounds[0] {
+			t.Fatal("bag played something other than the only sound")
+		}
+	}
+}
+
+func TestBagScalesLargeWeights(t *testing.T) {
+	// Primes don't reduce, so the bag is scaled down to maxBagSize
+	coll := newTestCollection(997, 991, 1)
+	bag := NewBag(coll)
+	bag.Next()
+
+	if size := len(bag.draws) + 1; size > maxBagSize {
+		t.Fatalf("bag holds %d draws, at most %d allowed", size, maxBagSize)
+	}
+
+	counts := make(map[*Sound]int)
+	for _, s := range bag.draws {
+		counts[s]++
+	}
+	if counts[coll.Sounds[2]] > 1 {
+		t.Fatal("lightest sound is in the bag more than once")
+	}
+}
+
+func TestBagEmptyCollection(t *testing.T) {
+	if s := NewBag(newTestCollection()).Next(); s != nil {
+		t.Fatalf("got %s from an empty collection", s.Name)
+	}
+	if s := NewBag(newTestCollection(0, 0)).Next(); s != nil {
+		t.Fatalf("got %s from a collection without weights", s.Name)
+	}
+}
@@ -0,0 +1,80 @@
+package sound
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Cache keeps the most recently played sounds in memory within a budget,
+// loading sounds the first time they're played and releasing the least
+// recently played ones to make room
+type Cache struct {
+	budget int64
+
+	lock    sync.Mutex
+	order   *list.List
+	entries map[*Sound]*list.Element
+	size    int64
+}
+
+// NewCache creates a cache that keeps at most budget bytes of opus frames in memory
+func NewCache(budget int64) *Cache {
+	return &Cache{
+		budget:  budget,
+		order:   list.New(),
+		entries: make(map[*Sound]*list.Element),
+	}
+}
+
+// Returns the frames of a sound that is about to be played, loading it into
+// the cache if it isn't already. Loading happens under the cache lock, so a
+// miss briefly holds up other misses. nil is returned if the sound can't be read.
+func (c *Cache) use(s *Sound) [][]byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if el, exists := c.entries[s]; exists {
+		c.order.MoveToFront(el)
+		Metrics.Add("cache_hits", 1)
+		return s.loadedFrames()
+	}
+	Metrics.Add("cache_misses", 1)
+
+	if err := s.LoadFile(s.path); err != nil {
+		return nil
+	}
+	frames := s.loadedFrames()
+
+	// Sounds bigger than the whole budget are played once and dropped
+	size := s.Size()
+	if size > c.budget {
+		s.Unpin()
+		return frames
+	}
+
+	c.entries[s] = c.order.PushFront(s)
+	c.size += size
+	for c.size > c.budget {
+		oldest := c.order.Back()
+		evicted := oldest.Value.(*Sound)
+
+		c.size -= evicted.Size()
+		evicted.Unpin()
+		c.order.Remove(oldest)
+		delete(c.entries, evicted)
+		Metrics.Add("cache_evictions", 1)
+	}
+	return frames
+}
+
+// Size returns the bytes of opus frames currently kept in memory by this cache
+func (c *Cache) Size() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.size
+}
+
+// Budget returns the most bytes of opus frames this cache keeps in memory
+func (c *Cache) Budget() int64 {
+	return c.budget
+}
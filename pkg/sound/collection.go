@@ -0,0 +1,224 @@
+package sound
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// Collection is a group of sounds played by the same commands
+type Collection struct {
+	Prefix    string
+	Commands  []string
+	Sounds    []*Sound
+	ChainWith *Collection
+
+	// Weight adjusts how likely RandomCollection is to pick this collection, 0
+	// uses the combined weight of its sounds
+	Weight int
+
+	soundRange int
+}
+
+// SoundPath returns the DCA file a sound in this collection is stored in
+func (sc *Collection) SoundPath(s *Sound) string {
+	return fmt.Sprintf("audio/%v_%v.dca", sc.Prefix, s.Name)
+}
+
+// Load reads every sound in the collection into memory, returning the first
+// sound that failed to load. Sounds that fail are skipped.
+func (sc *Collection) Load() error {
+	var firstErr error
+
+	for _, sound := range sc.Sounds {
+		sc.soundRange += sound.Weight
+		if err := sound.Load(sc); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to load %s_%s: %s", sc.Prefix, sound.Name, err)
+		}
+	}
+	return firstErr
+}
+
+// LoadLazy reads the sounds preload returns true for into memory, the others
+// are streamed from disk and loaded the first time they're played. Like Load,
+// the first sound that failed to load is returned.
+func (sc *Collection) LoadLazy(preload func(s *Sound) bool) error {
+	var firstErr error
+
+	sc.Index()
+	for _, sound := range sc.Sounds {
+		if !preload(sound) {
+			sound.lazy = true
+			continue
+		}
+
+		if err := sound.Pin(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to load %s_%s: %s", sc.Prefix, sound.Name, err)
+		}
+	}
+	return firstErr
+}
+
+// LoadCached indexes the collection and leaves loading its sounds to the
+// cache, which reads them into memory the first time they're played
+func (sc *Collection) LoadCached(cache *Cache) {
+	sc.Index()
+	for _, sound := range sc.Sounds {
+		sound.cache = cache
+	}
+}
+
+// Index prepares the collection for playback without reading any sounds into memory
+func (sc *Collection) Index() {
+	for _, sound := range sc.Sounds {
+		sc.soundRange += sound.Weight
+		sound.path = sc.SoundPath(sound)
+		sound.Unpin()
+	}
+}
+
+// Random picks a sound from the collection based on the sound weights
+func (sc *Collection) Random() *Sound {
+	var (
+		i      int
+		number int = randomRange(0, sc.soundRange)
+	)
+
+	for _, sound := range sc.Sounds {
+		i += sound.Weight
+
+		if number < i {
+			return sound
+		}
+	}
+	return nil
+}
+
+// RandomWeighted picks a sound like Random, with the weight of every sound
+// multiplied by scale (eg. to make recently played sounds less likely). If
+// every scaled weight is 0 it falls back to Random.
+func (sc *Collection) RandomWeighted(scale func(s *Sound) float64) *Sound {
+	weights := make([]float64, len(sc.Sounds))
+	total := 0.0
+	for i, sound := range sc.Sounds {
+		weights[i] = float64(sound.Weight) * scale(sound)
+		total += weights[i]
+	}
+
+	if total <= 0 {
+		return sc.Random()
+	}
+
+	number := rand.Float64() * total
+	for i, sound := range sc.Sounds {
+		number -= weights[i]
+		if number < 0 {
+			return sound
+		}
+	}
+	return sc.Sounds[len(sc.Sounds)-1]
+}
+
+// TotalWeight returns the weight RandomCollection picks this collection with
+func (sc *Collection) TotalWeight() int {
+	if sc.Weight > 0 {
+		return sc.Weight
+	}
+	return sc.soundRange
+}
+
+// RandomCollection picks one of the collections based on their weights, in the
+// same way Random picks a sound. nil is returned if none have any weight.
+func RandomCollection(colls []*Collection) *Collection {
+	total := 0
+	for _, coll := range colls {
+		total += coll.TotalWeight()
+	}
+
+	if total == 0 {
+		return nil
+	}
+
+	var (
+		i      int
+		number int = randomRange(0, total)
+	)
+
+	for _, coll := range colls {
+		i += coll.TotalWeight()
+
+		if number < i {
+			return coll
+		}
+	}
+	return nil
+}
+
+// RandomCollectionWeighted picks a collection like RandomCollection, with the
+// weight of every collection multiplied by scale (eg. to favor collections
+// that are in season). If every scaled weight is 0 it returns nil.
+func RandomCollectionWeighted(colls []*Collection, scale func(coll *Collection) float64) *Collection {
+	weights := make([]float64, len(colls))
+	total := 0.0
+	for i, coll := range colls {
+		weights[i] = float64(coll.TotalWeight()) * scale(coll)
+		total += weights[i]
+	}
+
+	if total <= 0 {
+		return nil
+	}
+
+	number := rand.Float64() * total
+	for i, coll := range colls {
+		number -= weights[i]
+		if number < 0 {
+			return coll
+		}
+	}
+	return colls[len(colls)-1]
+}
+
+// Find returns the sound with the given name in this collection
+func (sc *Collection) Find(name string) *Sound {
+	for _, sound := range sc.Sounds {
+		if sound.Name == name {
+			return sound
+		}
+	}
+	return nil
+}
+
+// CopyAll returns a copy of the collection definitions with fresh, unloaded
+// sounds. Chains point into the new set, not at the definitions.
+func CopyAll(defs []*Collection) []*Collection {
+	copies := make(map[*Collection]*Collection, len(defs))
+	colls := make([]*Collection, len(defs))
+
+	for i, def := range defs {
+		coll := &Collection{
+			Prefix:   def.Prefix,
+			Commands: append([]string(nil), def.Commands...),
+			Sounds:   make([]*Sound, len(def.Sounds)),
+			Weight:   def.Weight,
+		}
+
+		for j, sound := range def.Sounds {
+			coll.Sounds[j] = New(sound.Name, sound.Weight, sound.PartDelay).WithCelebration(sound.Celebration).WithMinInterval(sound.MinInterval)
+		}
+
+		copies[def] = coll
+		colls[i] = coll
+	}
+
+	for i, def := range defs {
+		if def.ChainWith != nil {
+			colls[i].ChainWith = copies[def.ChainWith]
+		}
+	}
+	return colls
+}
+
+// Returns a random integer between min and max
+func randomRange(min, max int) int {
+	return rand.Intn(max-min) + min
+}
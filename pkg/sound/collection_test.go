@@ -0,0 +1,143 @@
+package sound
+
+import (
+	"math"
+	"testing"
+)
+
+func newTestCollection(weights ...int) *Collection {
+	coll := &Collection{Prefix: "test"}
+	for i, weight := range weights {
+		coll.Sounds = append(coll.Sounds, New(string(rune('a'+i)), weight, 0))
+	}
+	coll.Index()
+	return coll
+}
+
+// Checks that every sound was picked about as often as its weight says
+func expectWeighted(t *testing.T, coll *Collection, counts map[*Sound]int, draws int) {
+	t.Helper()
+
+	total := 0
+	for _, s := range coll.Sounds {
+		total += s.Weight
+	}
+
+	for _, s := range coll.Sounds {
+		want := float64(draws) * float64(s.Weight) / float64(total)
+		got := float64(counts[s])
+		if s.Weight == 0 && got != 0 {
+			t.Fatalf("%s has no weight but was picked %d times", s.Name, counts[s])
+		}
+
+		// Generous enough not to flake, tight enough to catch an off by one
+		if math.Abs(got-want) > 0.05*float64(draws) {
+			t.Fatalf("%s was picked %d times, want about %.0f", s.Name, counts[s], want)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	coll := newTestCollection(1, 1, 1)
+
+	if s := coll.Find("b"); s != coll.Sounds[1] {
+		t.Fatalf("got %v, want sound b", s)
+	}
+	if s := coll.Find("missing"); s != nil {
+		t.Fatalf("got %s for a sound that doesn't exist", s.Name)
+	}
+	if s := coll.Find("B"); s != nil {
+		t.Fatal("Find isn't case sensitive")
+	}
+}
+
+func TestRandom(t *testing.T) {
+	coll := newTestCollection(1, 0, 3, 6)
+
+	draws := 20000
+	counts := make(map[*Sound]int)
+	for i := 0; i < draws; i++ {
+		s := coll.Random()
+		if s == nil {
+			t.Fatal("Random returned nothing")
+		}
+		counts[s]++
+	}
+	expectWeighted(t, coll, counts, draws)
+}
+
+func TestRandomSingleSound(t *testing.T) {
+	coll := newTestCollection(5)
+	for i := 0; i < 100; i++ {
+		if coll.Random() != coll.Sounds[0] {
+			t.Fatal("Random picked something other than the only sound")
+		}
+	}
+}
+
+func TestRandomWeighted(t *testing.T) {
+	coll := newTestCollection(2, 2, 2)
+	muted := coll.Sounds[0]
+
+	for i := 0; i < 1000; i++ {
+		s := coll.RandomWeighted(func(s *Sound) float64 {
+			if s == muted {
+				return 0
+			}
+			return 1
+		})
+		if s == muted {
+			t.Fatal("picked a sound scaled to 0")
+		}
+	}
+
+	// Scaling everything away falls back to the plain weights
+	if coll.RandomWeighted(func(*Sound) float64 { return 0 }) == nil {
+		t.Fatal("nothing picked with every weight scaled to 0")
+	}
+}
+
+func TestRandomCollection(t *testing.T) {
+	light := newTestCollection(1)
+	heavy := newTestCollection(1, 1, 1)
+	fixed := newTestCollection(1)
+	fixed.Weight = 4
+
+	if light.TotalWeight() != 1 || heavy.TotalWeight() != 3 || fixed.TotalWeight() != 4 {
+		t.Fatalf("total weights are %d, %d and %d", light.TotalWeight(), heavy.TotalWeight(), fixed.TotalWeight())
+	}
+
+	colls := []*Collection{light, heavy, fixed}
+	draws := 16000
+	counts := make(map[*Collection]int)
+	for i := 0; i < draws; i++ {
+		counts[RandomCollection(colls)]++
+	}
+
+	for _, coll := range colls {
+		want := float64(draws) * float64(coll.TotalWeight()) / 8
+		if math.Abs(float64(counts[coll])-want) > 0.05*float64(draws) {
+			t.Fatalf("collection with weight %d was picked %d times, want about %.0f", coll.TotalWeight(), counts[coll], want)
+		}
+	}
+
+	if RandomCollection([]*Collection{newTestCollection(0)}) != nil {
+		t.Fatal("picked a collection without any weight")
+	}
+}
+
+func TestCopyAll(t *testing.T) {
+	second := &Collection{Prefix: "second", Sounds: []*Sound{New("b", 1, 0)}}
+	first := &Collection{Prefix: "first", Sounds: []*Sound{New("a", 2, 100)}, ChainWith: second}
+
+	copies := CopyAll([]*Collection{first, second})
+	if copies[0] == first || copies[0].Sounds[0] == first.Sounds[0] {
+		t.Fatal("CopyAll shares the definitions")
+	}
+	if copies[0].ChainWith != copies[1] {
+		t.Fatal("chain points at the definition, not the copy")
+	}
+	if s := copies[0].Sounds[0]; s.Name != "a" || s.Weight != 2 || s.PartDelay != 100 {
+		t.Fatalf("copied sound is %+v", s)
+	}
+}
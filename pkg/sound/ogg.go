@@ -0,0 +1,111 @@
+package sound
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	// Samples in every 20ms opus frame, opus always counts at 48khz
+	oggFrameSamples = 960
+
+	// Samples the decoder drops from the start of the stream, libopus' encoder delay
+	oggPreSkip = 312
+
+	// Bitstream serial, there is only one stream in every file
+	oggSerial = 0x41495248
+)
+
+var oggCRCTable = makeOggCRCTable()
+
+func makeOggCRCTable() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = (r << 1) ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return table
+}
+
+// WriteOgg writes stereo opus frames out as an Ogg Opus file, which unlike
+// DCA can be played by browsers and the discord client
+func WriteOgg(w io.Writer, frames [][]byte) error {
+	head := &bytes.Buffer{}
+	head.WriteString("OpusHead")
+	head.WriteByte(1) // version
+	head.WriteByte(2) // channels
+	binary.Write(head, binary.LittleEndian, uint16(oggPreSkip))
+	binary.Write(head, binary.LittleEndian, uint32(48000))
+	binary.Write(head, binary.LittleEndian, int16(0)) // output gain
+	head.WriteByte(0)                                 // channel mapping family
+
+	vendor := "airhornbot"
+	tags := &bytes.Buffer{}
+	tags.WriteString("OpusTags")
+	binary.Write(tags, binary.LittleEndian, uint32(len(vendor)))
+	tags.WriteString(vendor)
+	binary.Write(tags, binary.LittleEndian, uint32(0)) // user comments
+
+	if err := writeOggPage(w, head.Bytes(), 0x02, 0, 0); err != nil {
+		return err
+	}
+	if err := writeOggPage(w, tags.Bytes(), 0, 0, 1); err != nil {
+		return err
+	}
+
+	for i, frame := range frames {
+		var flags byte
+		if i == len(frames)-1 {
+			flags = 0x04
+		}
+
+		granule := uint64(i+1) * oggFrameSamples
+		if err := writeOggPage(w, frame, flags, granule, uint32(i+2)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes a page holding a single packet
+func writeOggPage(w io.Writer, packet []byte, flags byte, granule uint64, sequence uint32) error {
+	// Packets are laced into 255 byte segments, ending with a shorter one
+	segments := make([]byte, 0, len(packet)/255+1)
+	for n := len(packet); ; n -= 255 {
+		if n < 255 {
+			segments = append(segments, byte(n))
+			break
+		}
+		segments = append(segments, 255)
+	}
+
+	page := &bytes.Buffer{}
+	page.WriteString("OggS")
+	page.WriteByte(0) // version
+	page.WriteByte(flags)
+	binary.Write(page, binary.LittleEndian, granule)
+	binary.Write(page, binary.LittleEndian, uint32(oggSerial))
+	binary.Write(page, binary.LittleEndian, sequence)
+	binary.Write(page, binary.LittleEndian, uint32(0)) // crc, filled in below
+	page.WriteByte(byte(len(segments)))
+	page.Write(segments)
+	page.Write(packet)
+
+	data := page.Bytes()
+	var crc uint32
+	for _, b := range data {
+		crc = (crc << 8) ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	binary.LittleEndian.PutUint32(data[22:], crc)
+
+	_, err := w.Write(data)
+	return err
+}
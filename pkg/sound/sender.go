@@ -0,0 +1,50 @@
+package sound
+
+import (
+	"github.com/bwmarrin/discordgo"
+)
+
+// OpusSender is somewhere sounds are played to, frame by frame. Frames are
+// sent to the channel Frames returns every FrameDuration, and a send blocking
+// for longer than SendTimeout fails the play.
+type OpusSender interface {
+	Speaking(speaking bool) error
+	Frames() chan<- []byte
+}
+
+// Voice returns an OpusSender playing into a discord voice connection
+func Voice(vc *discordgo.VoiceConnection) OpusSender {
+	return voiceSender{vc}
+}
+
+type voiceSender struct {
+	vc *discordgo.VoiceConnection
+}
+
+func (v voiceSender) Speaking(speaking bool) error {
+	return v.vc.Speaking(speaking)
+}
+
+func (v voiceSender) Frames() chan<- []byte {
+	return v.vc.OpusSend
+}
+
+// ChannelSender is an OpusSender writing into a plain channel, for playing
+// sounds somewhere other than discord or recording what would be played
+type ChannelSender struct {
+	C chan []byte
+
+	// If set it's called whenever the sound starts and stops
+	OnSpeaking func(speaking bool)
+}
+
+func (c *ChannelSender) Speaking(speaking bool) error {
+	if c.OnSpeaking != nil {
+		c.OnSpeaking(speaking)
+	}
+	return nil
+}
+
+func (c *ChannelSender) Frames() chan<- []byte {
+	return c.C
+}
@@ -0,0 +1,207 @@
+package sound
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/noisemaster/airhornbot/pkg/dca"
+)
+
+// Collects everything played into a ChannelSender until the play is over
+type recorder struct {
+	sender   *ChannelSender
+	frames   [][]byte
+	speaking []bool
+	done     chan struct{}
+}
+
+func newRecorder() *recorder {
+	r := &recorder{done: make(chan struct{})}
+	r.sender = &ChannelSender{
+		C: make(chan []byte),
+		OnSpeaking: func(speaking bool) {
+			r.speaking = append(r.speaking, speaking)
+		},
+	}
+
+	go func() {
+		defer close(r.done)
+		for frame := range r.sender.C {
+			r.frames = append(r.frames, frame)
+		}
+	}()
+	return r
+}
+
+// Stops recording, returning the frames that were played
+func (r *recorder) stop() [][]byte {
+	close(r.sender.C)
+	<-r.done
+	return r.frames
+}
+
+func testFrames(n int) [][]byte {
+	frames := make([][]byte, n)
+	for i := range frames {
+		frames[i] = []byte{byte(i + 1)}
+	}
+	return frames
+}
+
+func expectPlayed(t *testing.T, got [][]byte, want [][]byte) {
+	t.Helper()
+
+	want = append([][]byte(nil), want...)
+	for i := 0; i < SilenceFrames; i++ {
+		want = append(want, silenceFrame)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("played %d frames, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("frame %d is %x, want %x", i, got[i], want[i])
+		}
+	}
+}
+
+func TestPlayToSendsFramesThenSilence(t *testing.T) {
+	frames := testFrames(3)
+	rec := newRecorder()
+
+	if err := NewFromFrames("test", frames).PlayTo(rec.sender, nil); err != nil {
+		t.Fatal(err)
+	}
+	expectPlayed(t, rec.stop(), frames)
+
+	if len(rec.speaking) != 2 || !rec.speaking[0] || rec.speaking[1] {
+		t.Fatalf("speaking went %v, want [true false]", rec.speaking)
+	}
+}
+
+func TestPlayToIsPaced(t *testing.T) {
+	frames := testFrames(10)
+	rec := newRecorder()
+
+	start := time.Now()
+	if err := NewFromFrames("test", frames).PlayTo(rec.sender, nil); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	rec.stop()
+
+	// Frames go out on a FrameDuration schedule, the first PaceLead ahead of it
+	min := time.Duration(len(frames)+SilenceFrames-PaceLead-1) * FrameDuration
+	if elapsed < min {
+		t.Fatalf("played %d frames in %s, at least %s expected", len(frames)+SilenceFrames, elapsed, min)
+	}
+}
+
+func TestPlayToStreamsFromDisk(t *testing.T) {
+	rec := newRecorder()
+
+	s := NewStreamed("raw", "../dca/testdata/raw.dca")
+	if err := s.PlayTo(rec.sender, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open("../dca/testdata/raw.dca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	frames, err := dca.Read(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPlayed(t, rec.stop(), frames)
+}
+
+func TestPlayToStop(t *testing.T) {
+	sender := &ChannelSender{C: make(chan []byte)}
+	stop := make(chan struct{})
+
+	result := make(chan error)
+	go func() {
+		result <- NewFromFrames("test", testFrames(100)).PlayTo(sender, stop)
+	}()
+
+	<-sender.C
+	<-sender.C
+	close(stop)
+
+	select {
+	case err := <-result:
+		if err != ErrStopped {
+			t.Fatalf("got %v, want ErrStopped", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("play didn't stop")
+	}
+}
+
+func TestPlayToSendTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { SendTimeout = timeout }(SendTimeout)
+	SendTimeout = time.Millisecond * 50
+
+	// Nothing reads the frames, like a voice connection that died
+	sender := &ChannelSender{C: make(chan []byte)}
+	if err := NewFromFrames("test", testFrames(3)).PlayTo(sender, nil); err != ErrSendTimeout {
+		t.Fatalf("got %v, want ErrSendTimeout", err)
+	}
+}
+
+func TestPlayToPlayTimeout(t *testing.T) {
+	defer func(slack time.Duration) { PlaySlack = slack }(PlaySlack)
+	PlaySlack = -time.Hour
+
+	rec := newRecorder()
+	err := NewFromFrames("test", testFrames(3)).PlayTo(rec.sender, nil)
+	rec.stop()
+	if err != ErrPlayTimeout {
+		t.Fatalf("got %v, want ErrPlayTimeout", err)
+	}
+}
+
+func TestPlayToMissingFile(t *testing.T) {
+	rec := newRecorder()
+	err := NewStreamed("missing", "../dca/testdata/missing.dca").PlayTo(rec.sender, nil)
+	played := rec.stop()
+
+	if _, ok := err.(*FileError); !ok {
+		t.Fatalf("got %v, want a FileError", err)
+	}
+	if len(played) != 0 {
+		t.Fatalf("played %d frames of a missing sound", len(played))
+	}
+}
+
+func TestPlayToCorruptFile(t *testing.T) {
+	tests := []struct {
+		fixture string
+		played  int
+	}{
+		{"bad_metadata", 0},
+		{"truncated_frame", 2 + SilenceFrames},
+		{"truncated_length", 3 + SilenceFrames},
+		{"oversized_length", 1 + SilenceFrames},
+	}
+
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			rec := newRecorder()
+			err := NewStreamed(test.fixture, "../dca/testdata/"+test.fixture+".dca").PlayTo(rec.sender, nil)
+			played := rec.stop()
+
+			if _, ok := err.(*FileError); !ok {
+				t.Fatalf("got %v, want a FileError", err)
+			}
+			if len(played) != test.played {
+				t.Fatalf("played %d frames, want %d", len(played), test.played)
+			}
+		})
+	}
+}
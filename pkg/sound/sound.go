@@ -0,0 +1,466 @@
+// Package sound loads DCA encoded sound clips and plays them over discord
+// voice connections.
+package sound
+
+import (
+	"bufio"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/noisemaster/airhornbot/pkg/dca"
+)
+
+var (
+	// Counters describing where sounds were played from and how many are kept in memory
+	Metrics = expvar.NewMap("sounds")
+
+	// How long sending a single frame can block before the voice connection is
+	// considered dead. Frames are normally sent every 20ms.
+	SendTimeout = time.Second
+
+	// ErrSendTimeout is returned by Play when the voice connection stops accepting frames
+	ErrSendTimeout = errors.New("timed out sending to the voice connection")
+
+	// How much longer than its length a sound can take to play
+	PlaySlack = time.Second * 5
+
+	// Longest a sound streamed from disk can take to play, as its length isn't known up front
+	MaxStreamDuration = time.Minute * 5
+
+	// ErrPlayTimeout is returned by Play when a sound takes too long to play as a whole
+	ErrPlayTimeout = errors.New("timed out playing the sound")
+
+	// ErrStopped is returned by PlayUntil when the sound was stopped part way through
+	ErrStopped = errors.New("playback was stopped")
+
+	// Opus silence frames sent after every sound, so clients don't clip its
+	// tail or interpolate past the end of it
+	SilenceFrames = 5
+
+	// Frames are sent on a FrameDuration schedule, at most this many ahead of
+	// it so the receiving end always has the next frame buffered
+	PaceLead = 2
+
+	// How far behind its schedule a sound can fall before the schedule is
+	// reset, rather than rushing the late frames out to catch up
+	MaxPaceDrift = FrameDuration * 5
+
+	silenceFrame = []byte{0xF8, 0xFF, 0xFE}
+)
+
+const (
+	// Length of audio in every opus frame
+	FrameDuration = time.Millisecond * 20
+)
+
+// Sound represents a sound clip
+type Sound struct {
+	Name string
+
+	// Weight adjust how likely it is this song will play, higher = more likely
+	Weight int
+
+	// Delay (in milliseconds) for the bot to wait before sending the disconnect request
+	PartDelay int
+
+	// Message (a gif link or emoji burst) guilds with celebrations enabled post
+	// when the sound starts playing
+	Celebration string
+
+	// Shortest time between two plays of this sound in the same guild, 0 for no limit
+	MinInterval time.Duration
+
+	// Buffer to store encoded PCM packets, nil while the sound is only kept on disk
+	buffer     [][]byte
+	bufferLock sync.RWMutex
+
+	// Path to the DCA file backing this sound
+	path string
+
+	// If true the sound is loaded into memory after it's first streamed
+	lazy bool
+
+	// Cache deciding whether this sound is kept in memory, if any
+	cache *Cache
+
+	// The DCA1 metadata and number of frames, known once the sound has been loaded
+	metadata *dca.Metadata
+	frames   int
+}
+
+// New creates a Sound that is loaded into memory once its collection is loaded
+func New(Name string, Weight int, PartDelay int) *Sound {
+	return &Sound{
+		Name:      Name,
+		Weight:    Weight,
+		PartDelay: PartDelay,
+		buffer:    make([][]byte, 0),
+	}
+}
+
+// NewStreamed creates a Sound that is always streamed from the DCA file at path
+func NewStreamed(Name string, path string) *Sound {
+	return &Sound{
+		Name:      Name,
+		Weight:    1,
+		PartDelay: 250,
+		path:      path,
+	}
+}
+
+// NewFromFrames creates a Sound from frames that are already in memory
+func NewFromFrames(Name string, frames [][]byte) *Sound {
+	return &Sound{
+		Name:      Name,
+		Weight:    1,
+		PartDelay: 250,
+		buffer:    frames,
+	}
+}
+
+// WithCelebration sets the message posted when this sound starts playing
+func (s *Sound) WithCelebration(message string) *Sound {
+	s.Celebration = message
+	return s
+}
+
+// WithMinInterval sets how long a guild has to wait between plays of this sound
+func (s *Sound) WithMinInterval(d time.Duration) *Sound {
+	s.MinInterval = d
+	return s
+}
+
+// Path returns the DCA file backing this sound, if any
+func (s *Sound) Path() string {
+	return s.path
+}
+
+// Load attempts to load an encoded sound file from disk
+// DCA files are pre-computed sound files that are easy to send to Discord.
+// If you would like to create your own DCA files, please use:
+// https://github.com/nstafie/dca-rs
+// eg: dca-rs --raw -i <input wav file> > <output file>
+func (s *Sound) Load(c *Collection) error {
+	s.path = c.SoundPath(s)
+	return s.LoadFile(s.path)
+}
+
+// LoadFile reads the DCA frames for this sound from the given path
+func (s *Sound) LoadFile(path string) error {
+	file, err := os.Open(path)
+
+	if err != nil {
+		fmt.Println("error opening dca file :", err)
+		return err
+	}
+	defer file.Close()
+
+	frames, meta, err := dca.ReadWithMetadata(file)
+	if err != nil {
+		fmt.Println("error reading from dca file :", err)
+		return err
+	}
+
+	s.bufferLock.Lock()
+	s.buffer = frames
+	s.metadata = meta
+	s.frames = len(frames)
+	s.bufferLock.Unlock()
+	return nil
+}
+
+// Metadata returns the DCA1 metadata of this sound, nil for raw DCA files
+// and sounds that haven't been loaded yet
+func (s *Sound) Metadata() *dca.Metadata {
+	s.bufferLock.RLock()
+	defer s.bufferLock.RUnlock()
+	return s.metadata
+}
+
+// Duration returns the length of this sound, 0 if it hasn't been loaded yet
+func (s *Sound) Duration() time.Duration {
+	s.bufferLock.RLock()
+	defer s.bufferLock.RUnlock()
+
+	frames := s.frames
+	if s.buffer != nil {
+		frames = len(s.buffer)
+	}
+	return time.Duration(frames) * FrameDuration
+}
+
+// Pin loads this sound into memory if it isn't already
+func (s *Sound) Pin() error {
+	if s.Pinned() || s.path == "" {
+		return nil
+	}
+	return s.LoadFile(s.path)
+}
+
+// Unpin releases the in-memory frames for this sound so it is streamed from disk
+func (s *Sound) Unpin() {
+	if s.path == "" {
+		return
+	}
+
+	s.bufferLock.Lock()
+	s.buffer = nil
+	s.bufferLock.Unlock()
+}
+
+// Pinned returns true if this sound is kept in memory
+func (s *Sound) Pinned() bool {
+	s.bufferLock.RLock()
+	defer s.bufferLock.RUnlock()
+	return s.buffer != nil
+}
+
+// Returns the frames currently kept in memory, nil if there are none
+func (s *Sound) loadedFrames() [][]byte {
+	s.bufferLock.RLock()
+	defer s.bufferLock.RUnlock()
+	return s.buffer
+}
+
+// Frames returns the opus frames of this sound, reading them from disk if
+// the sound isn't kept in memory
+func (s *Sound) Frames() ([][]byte, error) {
+	s.bufferLock.RLock()
+	buffer := s.buffer
+	s.bufferLock.RUnlock()
+
+	if buffer != nil {
+		return buffer, nil
+	}
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return dca.Read(file)
+}
+
+// Size returns the number of bytes of opus frames kept in memory for this sound
+func (s *Sound) Size() int64 {
+	s.bufferLock.RLock()
+	defer s.bufferLock.RUnlock()
+
+	var size int64
+	for _, frame := range s.buffer {
+		size += int64(len(frame))
+	}
+	return size
+}
+
+// Play plays this sound over the specified VoiceConnection, returning
+// ErrSendTimeout if the connection stopped accepting frames part way through
+// or ErrPlayTimeout if the sound took too long to play
+func (s *Sound) Play(vc *discordgo.VoiceConnection) error {
+	return s.PlayUntil(vc, nil)
+}
+
+// PlayUntil is Play, but it stops as soon as stop is closed and returns ErrStopped
+func (s *Sound) PlayUntil(vc *discordgo.VoiceConnection, stop <-chan struct{}) error {
+	return s.PlayTo(Voice(vc), stop)
+}
+
+// PlayTo plays this sound into any OpusSender, stopping when stop is closed
+func (s *Sound) PlayTo(out OpusSender, stop <-chan struct{}) error {
+	out.Speaking(true)
+	defer out.Speaking(false)
+
+	s.bufferLock.Lock()
+	buffer := s.buffer
+	load := buffer == nil && s.lazy
+	if load {
+		s.lazy = false
+	}
+	s.bufferLock.Unlock()
+
+	if s.cache != nil {
+		buffer = s.cache.use(s)
+	}
+
+	// Sounds in the long tail are streamed straight from disk
+	if buffer == nil {
+		if load {
+			go s.Pin()
+		}
+		return s.stream(out, stop)
+	}
+	Metrics.Add("plays_from_memory", 1)
+
+	sender := newSender(out, time.Duration(len(buffer)+SilenceFrames)*FrameDuration+PlaySlack, stop)
+	defer sender.stop()
+
+	for _, buff := range buffer {
+		if err := sender.send(buff); err != nil {
+			return err
+		}
+	}
+	return sender.silence()
+}
+
+// Sends frames to an OpusSender, giving up after SendTimeout on a single
+// frame, once the whole sound has taken too long or when stopped
+type sender struct {
+	frames   chan<- []byte
+	timeout  *time.Timer
+	deadline time.Time
+	stopped  <-chan struct{}
+
+	// When the next frame is due and the timer waiting for it
+	next time.Time
+	pace *time.Timer
+}
+
+func newSender(out OpusSender, limit time.Duration, stop <-chan struct{}) *sender {
+	return &sender{
+		frames:   out.Frames(),
+		timeout:  time.NewTimer(SendTimeout),
+		deadline: time.Now().Add(limit),
+		stopped:  stop,
+		next:     time.Now(),
+		pace:     time.NewTimer(0),
+	}
+}
+
+// Waits until the next frame is at most PaceLead frames ahead of its
+// schedule, tracking how late frames are in the sounds metrics
+func (sd *sender) wait() error {
+	due := sd.next
+	sd.next = sd.next.Add(FrameDuration)
+
+	if early := time.Until(due) - time.Duration(PaceLead)*FrameDuration; early > 0 {
+		if !sd.pace.Stop() {
+			select {
+			case <-sd.pace.C:
+			default:
+			}
+		}
+		sd.pace.Reset(early)
+
+		select {
+		case <-sd.pace.C:
+		case <-sd.stopped:
+			return ErrStopped
+		}
+		return nil
+	}
+
+	// Timers aren't precise to the microsecond, so that isn't counted as late
+	late := time.Since(due)
+	if late < time.Millisecond {
+		return nil
+	}
+	Metrics.Add("frames_late", 1)
+	Metrics.Add("frames_late_us", int64(late/time.Microsecond))
+
+	if late > MaxPaceDrift {
+		Metrics.Add("pace_resets", 1)
+		sd.next = time.Now().Add(FrameDuration)
+	}
+	return nil
+}
+
+func (sd *sender) send(frame []byte) error {
+	if time.Now().After(sd.deadline) {
+		Metrics.Add("play_timeouts", 1)
+		return ErrPlayTimeout
+	}
+
+	if err := sd.wait(); err != nil {
+		return err
+	}
+
+	if !sd.timeout.Stop() {
+		select {
+		case <-sd.timeout.C:
+		default:
+		}
+	}
+	sd.timeout.Reset(SendTimeout)
+
+	select {
+	case sd.frames <- frame:
+		Metrics.Add("frames_sent", 1)
+		return nil
+	case <-sd.timeout.C:
+		Metrics.Add("send_timeouts", 1)
+		return ErrSendTimeout
+	case <-sd.stopped:
+		return ErrStopped
+	}
+}
+
+// Sends SilenceFrames frames of silence to end a sound
+func (sd *sender) silence() error {
+	for i := 0; i < SilenceFrames; i++ {
+		if err := sd.send(silenceFrame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sd *sender) stop() {
+	sd.timeout.Stop()
+	sd.pace.Stop()
+}
+
+// FileError is returned by Play when a sound streamed from disk is missing
+// or can't be read, either up front or part way through
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("reading %s: %s", e.Path, e.Err)
+}
+
+// Streams this sound's frames from disk into out
+func (s *Sound) stream(out OpusSender, stop <-chan struct{}) error {
+	Metrics.Add("plays_from_disk", 1)
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		Metrics.Add("stream_errors", 1)
+		return &FileError{Path: s.path, Err: err}
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	if _, err := dca.ReadMetadata(r); err != nil {
+		Metrics.Add("stream_errors", 1)
+		return &FileError{Path: s.path, Err: err}
+	}
+
+	sender := newSender(out, MaxStreamDuration, stop)
+	defer sender.stop()
+
+	for {
+		frame, err := dca.ReadFrame(r)
+		if err == io.EOF {
+			return sender.silence()
+		}
+
+		// What was already played still ends cleanly, but the sound was cut short
+		if err != nil {
+			Metrics.Add("stream_errors", 1)
+			sender.silence()
+			return &FileError{Path: s.path, Err: err}
+		}
+
+		if err := sender.send(frame); err != nil {
+			return err
+		}
+	}
+}
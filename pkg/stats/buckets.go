@@ -0,0 +1,112 @@
+package stats
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/noisemaster/airhornbot/pkg/redis"
+)
+
+// A width plays are counted in, along with how long its counters are kept
+type resolution struct {
+	name  string
+	width time.Duration
+	keep  time.Duration
+}
+
+var (
+	byMinute = resolution{"minute", time.Minute, time.Hour * 2}
+	byHour   = resolution{"hour", time.Hour, time.Hour * 48}
+	byDay    = resolution{"day", time.Hour * 24, DAILY_STATS_EXPIRY}
+
+	resolutions = []resolution{byMinute, byHour, byDay}
+)
+
+// Rates are the play counts over rolling windows, read straight from the
+// bucketed counters so they don't need sampling
+type Rates struct {
+	// Airhorns per second over the last minute or so
+	APS float64 `json:"aps"`
+
+	LastMinute int `json:"last_minute"`
+	LastHour   int `json:"last_hour"`
+	LastDay    int `json:"last_day"`
+
+	// Plays since midnight UTC
+	Today int `json:"today"`
+}
+
+// Returns the index of the bucket t falls into, buckets are aligned to the
+// unix epoch so days start at midnight UTC
+func (r resolution) index(t time.Time) int64 {
+	return t.Unix() / int64(r.width/time.Second)
+}
+
+func (r resolution) key(index int64) string {
+	return fmt.Sprintf("airhorn:bucket:%s:%d", r.name, index)
+}
+
+// Queues the increments of the buckets now falls into
+func trackBuckets(pipe *redis.Pipeline, now time.Time) {
+	for _, r := range resolutions {
+		key := r.key(r.index(now))
+		pipe.Incr(key)
+		pipe.Expire(key, r.keep)
+	}
+}
+
+// Returns the keys of the last n buckets, oldest first and ending with the
+// one now falls into
+func bucketKeys(r resolution, n int, now time.Time) []string {
+	current := r.index(now)
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = r.key(current - int64(n-1-i))
+	}
+	return keys
+}
+
+// Queues reads of the last n buckets, in the order of bucketKeys
+func getBuckets(pipe *redis.Pipeline, r resolution, n int, now time.Time) []*redis.StringCmd {
+	keys := bucketKeys(r, n, now)
+	cmds := make([]*redis.StringCmd, n)
+	for i, key := range keys {
+		cmds[i] = pipe.Get(key)
+	}
+	return cmds
+}
+
+func sumBuckets(cmds []*redis.StringCmd) int {
+	total := 0
+	for _, cmd := range cmds {
+		count, _ := cmd.Int64()
+		total += int(count)
+	}
+	return total
+}
+
+// Rates returns the current play rates. The current minute is still filling
+// up, so APS also counts the minute before it and divides by the time since.
+func (t *Tracker) Rates() (*Rates, error) {
+	var minutes, hours, today []*redis.StringCmd
+	now := time.Now()
+
+	_, err := t.client.Pipelined(func(pipe *redis.Pipeline) error {
+		minutes = getBuckets(pipe, byMinute, 60, now)
+		hours = getBuckets(pipe, byHour, 24, now)
+		today = getBuckets(pipe, byDay, 1, now)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	elapsed := now.Sub(time.Unix(byMinute.index(now)*60, 0)) + byMinute.width
+	return &Rates{
+		APS:        float64(sumBuckets(minutes[58:])) / elapsed.Seconds(),
+		LastMinute: sumBuckets(minutes[59:]),
+		LastHour:   sumBuckets(minutes),
+		LastDay:    sumBuckets(hours),
+		Today:      sumBuckets(today),
+	}, nil
+}
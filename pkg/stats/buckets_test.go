@@ -0,0 +1,76 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketRotation(t *testing.T) {
+	for _, r := range resolutions {
+		t.Run(r.name, func(t *testing.T) {
+			start := time.Date(2020, 3, 14, 0, 0, 0, 0, time.UTC)
+			current := r.index(start)
+
+			if got := r.index(start.Add(r.width - time.Second)); got != current {
+				t.Fatalf("moved to bucket %d within the bucket %d", got, current)
+			}
+			if got := r.index(start.Add(r.width)); got != current+1 {
+				t.Fatalf("got bucket %d after the boundary, want %d", got, current+1)
+			}
+			if got := r.index(start.Add(-time.Second)); got != current-1 {
+				t.Fatalf("got bucket %d before the boundary, want %d", got, current-1)
+			}
+		})
+	}
+}
+
+func TestDayBucketsStartAtMidnightUTC(t *testing.T) {
+	berlin := time.FixedZone("CET", 60*60)
+	midnight := time.Date(2020, 3, 15, 0, 0, 0, 0, time.UTC)
+
+	if byDay.index(midnight) != byDay.index(midnight.In(berlin)) {
+		t.Fatal("the time zone changed the day bucket")
+	}
+	if byDay.index(midnight.Add(-time.Nanosecond)) != byDay.index(midnight)-1 {
+		t.Fatal("the day bucket didn't change at midnight UTC")
+	}
+}
+
+func TestBucketKeys(t *testing.T) {
+	now := time.Unix(600, 0)
+	keys := bucketKeys(byMinute, 3, now)
+
+	want := []string{
+		"airhorn:bucket:minute:8",
+		"airhorn:bucket:minute:9",
+		"airhorn:bucket:minute:10",
+	}
+	if len(keys) != len(want) {
+		t.Fatalf("got %d keys, want %d", len(keys), len(want))
+	}
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Fatalf("key %d is %s, want %s", i, keys[i], want[i])
+		}
+	}
+
+	// A minute later the oldest bucket drops off the window
+	later := bucketKeys(byMinute, 3, now.Add(time.Minute))
+	if later[0] != keys[1] || later[1] != keys[2] || later[2] != "airhorn:bucket:minute:11" {
+		t.Fatalf("window didn't move along by one bucket: %v", later)
+	}
+}
+
+// Rates reads the last 60 minutes and 24 hours, those buckets have to still
+// be around
+func TestBucketsKeptForTheirWindow(t *testing.T) {
+	if byMinute.keep < byMinute.width*60 {
+		t.Fatalf("minute buckets are kept for %s, Rates reads the last hour", byMinute.keep)
+	}
+	if byHour.keep < byHour.width*24 {
+		t.Fatalf("hour buckets are kept for %s, Rates reads the last day", byHour.keep)
+	}
+	if byDay.keep < byDay.width {
+		t.Fatalf("day buckets are kept for %s, less than a day", byDay.keep)
+	}
+}
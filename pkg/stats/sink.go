@@ -0,0 +1,108 @@
+package stats
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	"github.com/noisemaster/airhornbot/pkg/redis"
+)
+
+// Sink is somewhere plays (and errors playing them) are recorded
+type Sink interface {
+	TrackPlay(play *queue.Play) error
+
+	// TrackError counts an error of the given kind, eg. "voice" or "playback"
+	TrackError(kind string) error
+
+	Counts() (*Counts, error)
+
+	// ForgetUser deletes everything recorded about a user
+	ForgetUser(uid string) error
+}
+
+// Counts are the totals every sink can report
+type Counts struct {
+	Total int `json:"total"`
+
+	// Plays of each sound, keyed by sound name
+	Sounds map[string]int `json:"sounds"`
+
+	// Errors of each kind
+	Errors map[string]int `json:"errors"`
+}
+
+// RedisSink records plays with a Tracker, which is also what every richer stat
+// (user stats, trends, rates) is read from
+type RedisSink struct {
+	Tracker *Tracker
+
+	// If set it can queue additional commands in the pipeline of each play
+	Extra func(pipe *redis.Pipeline, play *queue.Play)
+}
+
+func (s *RedisSink) TrackPlay(play *queue.Play) error {
+	return s.Tracker.TrackPlay(play, func(pipe *redis.Pipeline) {
+		if s.Extra != nil {
+			s.Extra(pipe, play)
+		}
+	})
+}
+
+func (s *RedisSink) TrackError(kind string) error {
+	return s.Tracker.client.Incr(fmt.Sprintf("airhorn:errors:%s", kind)).Err()
+}
+
+func (s *RedisSink) ForgetUser(uid string) error {
+	return s.Tracker.ForgetUser(uid)
+}
+
+func (s *RedisSink) Counts() (*Counts, error) {
+	counts := &Counts{
+		Total:  s.Tracker.Total(),
+		Sounds: make(map[string]int),
+		Errors: make(map[string]int),
+	}
+
+	if err := s.sumByName("airhorn:[af]:sound:*", counts.Sounds); err != nil {
+		return nil, err
+	}
+	if err := s.sumByName("airhorn:errors:*", counts.Errors); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// Adds the counters matching pattern into into, keyed by the last part of the key
+func (s *RedisSink) sumByName(pattern string, into map[string]int) error {
+	keys, err := s.Tracker.client.Keys(pattern).Result()
+	if err != nil {
+		return err
+	}
+
+	results := make([]*redis.StringCmd, 0, len(keys))
+	s.Tracker.client.Pipelined(func(pipe *redis.Pipeline) error {
+		for _, key := range keys {
+			results = append(results, pipe.Get(key))
+		}
+		return nil
+	})
+
+	for i, key := range keys {
+		count, _ := strconv.Atoi(results[i].Val())
+		into[key[strings.LastIndex(key, ":")+1:]] += count
+	}
+	return nil
+}
+
+// NopSink drops everything, for running without stats
+type NopSink struct{}
+
+func (NopSink) TrackPlay(play *queue.Play) error { return nil }
+func (NopSink) TrackError(kind string) error     { return nil }
+func (NopSink) ForgetUser(uid string) error      { return nil }
+
+func (NopSink) Counts() (*Counts, error) {
+	return &Counts{Sounds: map[string]int{}, Errors: map[string]int{}}, nil
+}
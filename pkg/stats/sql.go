@@ -0,0 +1,134 @@
+package stats
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/noisemaster/airhornbot/pkg/queue"
+)
+
+// Tables the SQL sink keeps, the syntax is shared by sqlite and postgres
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS plays (
+		id TEXT PRIMARY KEY,
+		played_at TIMESTAMP NOT NULL,
+		guild TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		collection TEXT NOT NULL,
+		sound TEXT NOT NULL,
+		source TEXT NOT NULL,
+		forced BOOLEAN NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS plays_sound ON plays (sound)`,
+	`CREATE INDEX IF NOT EXISTS plays_guild ON plays (guild)`,
+	`CREATE TABLE IF NOT EXISTS errors (
+		occurred_at TIMESTAMP NOT NULL,
+		kind TEXT NOT NULL
+	)`,
+}
+
+// SQLSink records every play as a row, which allows queries the redis
+// counters can't answer (eg. leaderboards over any time range). The driver has
+// to be registered with database/sql by the binary.
+type SQLSink struct {
+	db       *sql.DB
+	postgres bool
+}
+
+// NewSQLSink opens the database and creates the tables if they don't exist
+func NewSQLSink(driver, dsn string) (*SQLSink, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	for _, stmt := range sqlSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("creating tables: %s", err)
+		}
+	}
+
+	return &SQLSink{db: db, postgres: driver == "postgres" || driver == "pgx"}, nil
+}
+
+// Rewrites ? placeholders into $n for postgres
+func (s *SQLSink) query(q string) string {
+	if !s.postgres {
+		return q
+	}
+
+	parts := strings.Split(q, "?")
+	for i := 1; i < len(parts); i++ {
+		parts[i] = fmt.Sprintf("$%d", i) + parts[i]
+	}
+	return strings.Join(parts, "")
+}
+
+func (s *SQLSink) TrackPlay(play *queue.Play) error {
+	_, err := s.db.Exec(s.query(`INSERT INTO plays (id, played_at, guild, channel, user_id, collection, sound, source, forced)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		play.ID, time.Now().UTC(), play.GuildID, play.ChannelID, play.UserID, play.Collection, play.Sound.Name, play.Source, play.Forced)
+	return err
+}
+
+func (s *SQLSink) TrackError(kind string) error {
+	_, err := s.db.Exec(s.query(`INSERT INTO errors (occurred_at, kind) VALUES (?, ?)`), time.Now().UTC(), kind)
+	return err
+}
+
+func (s *SQLSink) ForgetUser(uid string) error {
+	_, err := s.db.Exec(s.query(`UPDATE plays SET user_id = '' WHERE user_id = ?`), uid)
+	return err
+}
+
+func (s *SQLSink) Counts() (*Counts, error) {
+	counts := &Counts{}
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM plays`).Scan(&counts.Total); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if counts.Sounds, err = s.countBy(`SELECT sound, COUNT(*) FROM plays GROUP BY sound`); err != nil {
+		return nil, err
+	}
+	if counts.Errors, err = s.countBy(`SELECT kind, COUNT(*) FROM errors GROUP BY kind`); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// Runs a query returning name, count rows
+func (s *SQLSink) countBy(q string) (map[string]int, error) {
+	rows, err := s.db.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var (
+			name  string
+			count int
+		)
+		if err := rows.Scan(&name, &count); err != nil {
+			return nil, err
+		}
+		counts[name] = count
+	}
+	return counts, rows.Err()
+}
+
+// Close closes the database
+func (s *SQLSink) Close() error {
+	return s.db.Close()
+}
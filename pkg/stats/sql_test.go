@@ -0,0 +1,30 @@
+package stats
+
+import (
+	"testing"
+)
+
+func TestSQLSinkQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		postgres bool
+		query    string
+		want     string
+	}{
+		{"sqlite", false, "SELECT * FROM plays WHERE guild = ? AND sound = ?", "SELECT * FROM plays WHERE guild = ? AND sound = ?"},
+		{"postgres", true, "SELECT * FROM plays WHERE guild = ? AND sound = ?", "SELECT * FROM plays WHERE guild = $1 AND sound = $2"},
+		{"no placeholders", true, "SELECT COUNT(*) FROM plays", "SELECT COUNT(*) FROM plays"},
+		{"trailing placeholder", true, "DELETE FROM plays WHERE id = ?", "DELETE FROM plays WHERE id = $1"},
+		{"values list", true, "VALUES (?, ?, ?)", "VALUES ($1, $2, $3)"},
+		{"ten or more", true, "?,?,?,?,?,?,?,?,?,?,?", "$1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &SQLSink{postgres: test.postgres}
+			if got := s.query(test.query); got != test.want {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
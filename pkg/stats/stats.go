@@ -0,0 +1,305 @@
+// Package stats tracks plays in redis and reads the counters back.
+package stats
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/noisemaster/airhornbot/pkg/queue"
+	"github.com/noisemaster/airhornbot/pkg/redis"
+)
+
+const (
+	// Number of play ids kept in the airhorn:plays list
+	RECENT_PLAYS = 1000
+
+	// How long the metadata of each play is kept
+	PLAY_METADATA_EXPIRY = time.Hour * 24 * 7
+
+	// How long the daily play counters of each sound are kept
+	DAILY_STATS_EXPIRY = time.Hour * 24 * 30
+)
+
+// Tracker records plays in redis
+type Tracker struct {
+	client *redis.Client
+}
+
+// NewTracker creates a Tracker storing counters with the given redis client
+func NewTracker(client *redis.Client) *Tracker {
+	return &Tracker{client: client}
+}
+
+// TrackPlay increments the counters for a play. extra, if not nil, can queue
+// additional commands in the same pipeline.
+func (t *Tracker) TrackPlay(play *queue.Play, extra func(pipe *redis.Pipeline)) error {
+	_, err := t.client.Pipelined(func(pipe *redis.Pipeline) error {
+		var baseChar string
+
+		if play.Forced {
+			baseChar = "f"
+		} else {
+			baseChar = "a"
+		}
+
+		base := fmt.Sprintf("airhorn:%s", baseChar)
+		pipe.Incr("airhorn:total")
+		pipe.Incr(fmt.Sprintf("%s:total", base))
+		pipe.Incr(fmt.Sprintf("%s:sound:%s", base, play.Sound.Name))
+		pipe.Incr(fmt.Sprintf("%s:guild:%s:sound:%s", base, play.GuildID, play.Sound.Name))
+		pipe.Incr(fmt.Sprintf("%s:guild:%s:chan:%s:sound:%s", base, play.GuildID, play.ChannelID, play.Sound.Name))
+		// Plays of users who opted out of stats come without a user id
+		if play.UserID != "" {
+			pipe.Incr(fmt.Sprintf("%s:user:%s:sound:%s", base, play.UserID, play.Sound.Name))
+			pipe.SAdd(fmt.Sprintf("%s:users", base), play.UserID)
+		}
+		pipe.SAdd(fmt.Sprintf("%s:guilds", base), play.GuildID)
+		pipe.SAdd(fmt.Sprintf("%s:channels", base), play.ChannelID)
+		pipe.HSet("airhorn:lastplayed", play.Sound.Name, strconv.FormatInt(time.Now().Unix(), 10))
+		pipe.LPush("airhorn:plays", play.ID)
+		pipe.LTrim("airhorn:plays", 0, RECENT_PLAYS-1)
+		pipe.Incr(fmt.Sprintf("%s:source:%s", base, play.Source))
+
+		// Sounds of the same name in different collections are counted
+		// apart for `!stats sound`, with daily counters for trends bucketed
+		// by UTC day
+		if play.Collection != "" {
+			pipe.Incr(soundKey(base, play.Collection, play.Sound.Name))
+			pipe.Incr(guildSoundKey(base, play.GuildID, play.Collection, play.Sound.Name))
+
+			daily := dailySoundKey(time.Now(), play.Collection, play.Sound.Name)
+			pipe.Incr(daily)
+			pipe.Expire(daily, DAILY_STATS_EXPIRY)
+		}
+		trackBuckets(pipe, time.Now())
+
+		// Keep who played what from where for a while, for attributing usage
+		key := fmt.Sprintf("airhorn:play:%s", play.ID)
+		pipe.HSet(key, "guild", play.GuildID)
+		pipe.HSet(key, "channel", play.ChannelID)
+		if play.UserID != "" {
+			pipe.HSet(key, "user", play.UserID)
+		}
+		pipe.HSet(key, "sound", play.Sound.Name)
+		pipe.HSet(key, "source", play.Source)
+		pipe.HSet(key, "time", strconv.FormatInt(time.Now().Unix(), 10))
+		pipe.Expire(key, PLAY_METADATA_EXPIRY)
+
+		if extra != nil {
+			extra(pipe)
+		}
+		return nil
+	})
+	return err
+}
+
+func soundKey(base, coll, name string) string {
+	return fmt.Sprintf("%s:coll:%s:sound:%s", base, coll, name)
+}
+
+func guildSoundKey(base, gid, coll, name string) string {
+	return fmt.Sprintf("%s:guild:%s:coll:%s:sound:%s", base, gid, coll, name)
+}
+
+func dailySoundKey(day time.Time, coll, name string) string {
+	return fmt.Sprintf("airhorn:day:%s:sound:%s:%s", day.UTC().Format("2006-01-02"), coll, name)
+}
+
+// SumKeys returns the sum of the integer values stored at keys
+func (t *Tracker) SumKeys(keys []string) int {
+	results := make([]*redis.StringCmd, 0)
+
+	t.client.Pipelined(func(pipe *redis.Pipeline) error {
+		for _, key := range keys {
+			results = append(results, pipe.Get(key))
+		}
+		return nil
+	})
+
+	var total int
+	for _, i := range results {
+		t, _ := strconv.Atoi(i.Val())
+		total += t
+	}
+
+	return total
+}
+
+// UserTotal returns the number of sounds a user has played
+func (t *Tracker) UserTotal(uid string) (int, error) {
+	keys, err := t.client.Keys(fmt.Sprintf("airhorn:*:user:%s:sound:*", uid)).Result()
+	if err != nil {
+		return 0, err
+	}
+	return t.SumKeys(keys), nil
+}
+
+// UserSounds returns the number of times a user has played each sound, keyed by sound name
+func (t *Tracker) UserSounds(uid string) (map[string]int, error) {
+	keys, err := t.client.Keys(fmt.Sprintf("airhorn:*:user:%s:sound:*", uid)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*redis.StringCmd, 0, len(keys))
+	t.client.Pipelined(func(pipe *redis.Pipeline) error {
+		for _, key := range keys {
+			results = append(results, pipe.Get(key))
+		}
+		return nil
+	})
+
+	counts := make(map[string]int)
+	for i, key := range keys {
+		count, _ := strconv.Atoi(results[i].Val())
+		counts[key[strings.LastIndex(key, ":")+1:]] += count
+	}
+	return counts, nil
+}
+
+// GuildTotal returns the number of sounds played in a guild
+func (t *Tracker) GuildTotal(gid string) (int, error) {
+	keys, err := t.client.Keys(fmt.Sprintf("airhorn:*:guild:%s:sound:*", gid)).Result()
+	if err != nil {
+		return 0, err
+	}
+	return t.SumKeys(keys), nil
+}
+
+// SoundTotals returns the number of times each of a collection's sounds has
+// been played, keyed by sound name
+func (t *Tracker) SoundTotals(coll string, names []string) map[string]int {
+	totals := make(map[string]int, len(names))
+	for _, name := range names {
+		totals[name] = t.SumKeys([]string{
+			soundKey("airhorn:a", coll, name),
+			soundKey("airhorn:f", coll, name),
+		})
+	}
+	return totals
+}
+
+// GuildSoundTotal returns the number of times a collection's sound has been
+// played in a guild
+func (t *Tracker) GuildSoundTotal(gid, coll, name string) int {
+	return t.SumKeys([]string{
+		guildSoundKey("airhorn:a", gid, coll, name),
+		guildSoundKey("airhorn:f", gid, coll, name),
+	})
+}
+
+// SoundDaily returns the number of times a collection's sound was played on
+// each of the last days UTC days, oldest first and ending with today
+func (t *Tracker) SoundDaily(coll, name string, days int) []int {
+	results := make([]*redis.StringCmd, 0, days)
+	now := time.Now()
+
+	t.client.Pipelined(func(pipe *redis.Pipeline) error {
+		for i := days - 1; i >= 0; i-- {
+			results = append(results, pipe.Get(dailySoundKey(now.AddDate(0, 0, -i), coll, name)))
+		}
+		return nil
+	})
+
+	counts := make([]int, len(results))
+	for i, result := range results {
+		counts[i], _ = strconv.Atoi(result.Val())
+	}
+	return counts
+}
+
+// ForgetUser deletes every counter keyed by the user and their id from the
+// play metadata and user sets, leaving the anonymous totals alone
+func (t *Tracker) ForgetUser(uid string) error {
+	// Anyone can run !forgetme, so the keyspace is scanned instead of
+	// blocking redis with KEYS
+	keys, err := t.client.ScanKeys(fmt.Sprintf("airhorn:*:user:%s:*", uid))
+	if err != nil {
+		return err
+	}
+
+	plays, err := t.client.ScanKeys("airhorn:play:*")
+	if err != nil {
+		return err
+	}
+
+	users := make([]*redis.StringCmd, len(plays))
+	_, err = t.client.Pipelined(func(pipe *redis.Pipeline) error {
+		for i, key := range plays {
+			users[i] = pipe.HGet(key, "user")
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	_, err = t.client.Pipelined(func(pipe *redis.Pipeline) error {
+		if len(keys) > 0 {
+			pipe.Del(keys...)
+		}
+		pipe.SRem("airhorn:a:users", uid)
+		pipe.SRem("airhorn:f:users", uid)
+
+		for i, key := range plays {
+			if users[i].Val() == uid {
+				pipe.HDel(key, "user")
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// Total returns the number of sounds played across every guild
+func (t *Tracker) Total() int {
+	total, _ := strconv.Atoi(t.client.Get("airhorn:total").Val())
+	return total
+}
+
+// RandomTotal returns the number of random (not forced) plays
+func (t *Tracker) RandomTotal() int {
+	total, _ := strconv.Atoi(t.client.Get("airhorn:a:total").Val())
+	return total
+}
+
+// LastPlayed returns when each sound was last played, keyed by sound name
+func (t *Tracker) LastPlayed() (map[string]time.Time, error) {
+	data, err := t.client.HGetAll("airhorn:lastplayed").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	played := make(map[string]time.Time, len(data))
+	for name, raw := range data {
+		unix, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			continue
+		}
+		played[name] = time.Unix(unix, 0)
+	}
+	return played, nil
+}
+
+// RecentPlays returns the ids of the most recent plays, newest first
+func (t *Tracker) RecentPlays(count int) ([]string, error) {
+	return t.client.LRange("airhorn:plays", 0, int64(count-1)).Result()
+}
+
+// PlayMetadata returns the stored metadata (guild, channel, user, sound, source
+// and time) of a recent play
+func (t *Tracker) PlayMetadata(id string) (map[string]string, error) {
+	return t.client.HGetAll(fmt.Sprintf("airhorn:play:%s", id)).Result()
+}
+
+// SourceTotal returns the number of plays triggered from a source
+func (t *Tracker) SourceTotal(source string) int {
+	var total int
+	for _, base := range []string{"a", "f"} {
+		count, _ := strconv.Atoi(t.client.Get(fmt.Sprintf("airhorn:%s:source:%s", base, source)).Val())
+		total += count
+	}
+	return total
+}